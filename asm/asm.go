@@ -0,0 +1,154 @@
+// Package asm assembles RISC-V assembly text into zhuji bytecode, ready to
+// hand to vm.VM.Run or codegen.Generate.
+//
+//	program, err := asm.Assemble("addi x1, x0, 42")
+//
+// The exported API of asm, vm and codegen is stable: from one release to the
+// next nothing is removed or changed in meaning without first being marked
+// Deprecated for at least one release. The layout of the bytecode itself is
+// not part of that promise; treat a program as an opaque []int that only
+// this version of zhuji understands.
+package asm
+
+import (
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/disassembler"
+	"github.com/phasecurve/zhuji/internal/translator"
+)
+
+// Error is a line of assembly that could not be assembled. Line holds the
+// line as written, less any comment.
+type Error = assembler.Error
+
+// ErrStackDepth is wrapped by the error TranslateStack returns when the
+// depth of the stack cannot be worked out before every instruction: an
+// instruction pops more than the stack holds, two paths reach it with
+// different depths, or the stack grows deeper than the 15 registers that
+// hold it.
+var ErrStackDepth = translator.ErrStackDepth
+
+// SizeReport is what MeasureSize reports: how many instructions of a program
+// are compressed and how many bytes that saves.
+type SizeReport = assembler.SizeReport
+
+type config struct {
+	trace    bool
+	stack    bool
+	compress bool
+	rv64     bool
+	rv32e    bool
+}
+
+// Option configures Assemble.
+type Option func(*config)
+
+// WithTrace prints what the assembler does to standard output.
+func WithTrace() Option {
+	return func(c *config) {
+		c.trace = true
+	}
+}
+
+// WithStackMode assembles the stack-machine instruction set, run with
+// vm.WithStackMode, instead of RISC-V:
+//
+//	psh 6
+//	psh 7
+//	mul
+//
+// Its instructions are psh, dup, swp, drp, add, sub, mul, div, lte, gt, and
+// jmp, jz and jnz to a label. When Disassemble is given it, it prints that
+// set too.
+func WithStackMode() Option {
+	return func(c *config) {
+		c.stack = true
+	}
+}
+
+// WithCompression emits each instruction that has a C extension form its
+// operands fit as that 16-bit form, as if it had been written with the c.
+// mnemonic: addi x8, x8, 1 becomes c.addi x8, 1. Labels and branch offsets
+// follow the smaller code. MeasureSize reports what it saved.
+func WithCompression() Option {
+	return func(c *config) {
+		c.compress = true
+	}
+}
+
+// WithRV64 assembles for RV64I with the M extension, run with vm.WithRV64
+// and codegen.WithRV64: it adds ld, sd, lwu, the W instructions addiw,
+// slliw, srliw, sraiw, addw, subw, sllw, srlw, sraw, mulw, divw, divuw, remw
+// and remuw, and the sext.w and negw pseudo-instructions, and lets shifts by
+// a constant go up to 63. li still loads a 32-bit constant, sign-extended.
+// When Disassemble is given it, it prints the RV64 instructions too.
+func WithRV64() Option {
+	return func(c *config) {
+		c.rv64 = true
+	}
+}
+
+// WithRV32E assembles for RV32E, which has only the registers x0 to x15: an
+// instruction naming any of x16 to x31 is an error. Those are exactly the
+// registers codegen keeps in x86 ones, so an RV32E program never spills.
+func WithRV32E() Option {
+	return func(c *config) {
+		c.rv32e = true
+	}
+}
+
+// Assemble turns source into bytecode. A problem with the source is reported
+// as an *Error naming the first line that could not be assembled.
+func Assemble(source string, opts ...Option) ([]int, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	a := assembler.NewAssembler()
+	if c.trace {
+		a.EnableTrace()
+	}
+	if c.stack {
+		a.EnableStackMode()
+	}
+	if c.compress {
+		a.EnableCompression()
+	}
+	if c.rv64 {
+		a.EnableRV64()
+	}
+	if c.rv32e {
+		a.EnableRV32E()
+	}
+	return a.TryAssemble(source)
+}
+
+// MeasureSize counts the compressed instructions in a program and the bytes
+// they save over full-size ones. Its String method prints the report.
+func MeasureSize(program []int) SizeReport {
+	return assembler.MeasureSize(program)
+}
+
+// Disassemble turns a program back into assembly text, one instruction per
+// line, that Assemble with the same options turns into the same program.
+// Branch and jump targets are written as byte offsets rather than labels.
+func Disassemble(program []int, opts ...Option) (string, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.stack {
+		return disassembler.DisassembleStack(program)
+	}
+	if c.rv64 {
+		return disassembler.DisassembleRV64(program)
+	}
+	return disassembler.Disassemble(program)
+}
+
+// TranslateStack turns a program assembled WithStackMode into RISC-V
+// bytecode for vm.New and codegen.Generate without options. Each value on
+// the stack gets a register, x1 for the bottom one, and the value the stack
+// program leaves on top ends up in x1, or 0 there if the stack ends empty.
+func TranslateStack(program []int) ([]int, error) {
+	return translator.Translate(program)
+}
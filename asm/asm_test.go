@@ -0,0 +1,99 @@
+package asm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleReturnsBytecode(t *testing.T) {
+	program, err := Assemble("addi x1, x0, 42\nadd x2, x1, x1")
+
+	assert.NoError(t, err)
+	assert.Len(t, program, 8, "each instruction should take four slots")
+}
+
+func TestAssembleReportsBadLines(t *testing.T) {
+	program, err := Assemble("addi x1, x0, 1\nbogus x1")
+
+	var asmErr *Error
+	assert.ErrorAs(t, err, &asmErr)
+	assert.Equal(t, "bogus x1", asmErr.Line, "the error should name the line that failed")
+	assert.Nil(t, program)
+}
+
+func TestDisassembleRoundTrips(t *testing.T) {
+	program, _ := Assemble("li x1, 0x12345678\nloop:\naddi x1, x1, -1\nbne x1, x0, loop")
+
+	text, err := Disassemble(program)
+	assert.NoError(t, err)
+	again, err := Assemble(text)
+
+	assert.NoError(t, err)
+	assert.Equal(t, program, again, "disassembled text should assemble to the same program")
+}
+
+func TestWithCompressionShrinksTheProgram(t *testing.T) {
+	source := "addi x8, x0, 3\nloop:\naddi x8, x8, -1\nbne x8, x0, loop\naddi x1, x8, 42"
+	program, err := Assemble(source, WithCompression())
+	assert.NoError(t, err)
+
+	report := MeasureSize(program)
+	text, _ := Disassemble(program)
+	again, err := Assemble(text)
+
+	assert.Equal(t, 3, report.Compressed, "all but the last addi should have a compressed form")
+	assert.Equal(t, 10, report.Bytes)
+	assert.Equal(t, 6, report.Saved())
+	assert.NoError(t, err)
+	assert.Equal(t, program, again, "the disassembled c. instructions should assemble back without the option")
+}
+
+func TestWithStackModeAssemblesTheStackSet(t *testing.T) {
+	program, err := Assemble("psh 2\ndup\nmul", WithStackMode())
+	assert.NoError(t, err)
+
+	text, err := Disassemble(program, WithStackMode())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "psh 2\ndup\nmul\n", text)
+}
+
+func TestWithRV64AssemblesTheRV64Instructions(t *testing.T) {
+	_, err := Assemble("ld x1, 8(x2)")
+	assert.Error(t, err)
+
+	program, err := Assemble("ld x1, 8(x2)\naddiw x1, x1, 1", WithRV64())
+	assert.NoError(t, err)
+
+	text, err := Disassemble(program, WithRV64())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ld x1, 8(x2)\naddiw x1, x1, 1\n", text)
+}
+
+func TestWithRV32ERejectsTheUpperRegisters(t *testing.T) {
+	_, err := Assemble("addi x16, x0, 1", WithRV32E())
+
+	var asmErr *Error
+	assert.ErrorAs(t, err, &asmErr)
+	assert.Equal(t, "addi x16, x0, 1", asmErr.Line)
+}
+
+func TestTranslateStackGivesARegisterProgram(t *testing.T) {
+	program, _ := Assemble("psh 40\npsh 2\nadd", WithStackMode())
+
+	translated, err := TranslateStack(program)
+
+	assert.NoError(t, err)
+	text, _ := Disassemble(translated)
+	assert.Equal(t, "addi x1, x0, 42\n", text)
+}
+
+func TestTranslateStackReportsDepthErrors(t *testing.T) {
+	program, _ := Assemble("psh 1\nadd", WithStackMode())
+
+	_, err := TranslateStack(program)
+
+	assert.ErrorIs(t, err, ErrStackDepth)
+}
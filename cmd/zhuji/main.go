@@ -6,16 +6,31 @@ import (
 	"os"
 	"strings"
 
-	"github.com/phasecurve/zhuji/internal/compiler"
+	"github.com/phasecurve/zhuji/asm"
+	"github.com/phasecurve/zhuji/codegen"
+	"github.com/phasecurve/zhuji/vm"
 )
 
 func main() {
 	outputFile := flag.String("o", "", "output file (default: input.x86.s)")
+	run := flag.Bool("run", false, "run the program in the VM instead of compiling it")
+	trace := flag.Bool("trace", false, "trace assembly and execution or code generation")
+	memory := flag.Int("mem", vm.DefaultMemory, "bytes of RAM for -run")
+	harts := flag.Int("harts", 1, "number of harts for -run")
+	stack := flag.Bool("stack", false, "assemble, run or compile the stack-machine instruction set")
+	translate := flag.Bool("translate", false, "translate a stack-machine program to RISC-V before running or compiling it")
+	compress := flag.Bool("compress", false, "use 16-bit C extension instructions where they fit and report the bytes saved")
+	rv64 := flag.Bool("rv64", false, "assemble, run or compile for RV64 with 64-bit registers")
+	rv32e := flag.Bool("rv32e", false, "assemble or run for RV32E, which has only x0 to x15")
+	regalloc := flag.Bool("regalloc", false, "allocate x86 registers by linear scan instead of the fixed map")
 	flag.Parse()
 
 	args := flag.Args()
 	if len(args) != 1 {
-		fmt.Fprintln(os.Stderr, "usage: zhuji [-o output] <input.s>")
+		fmt.Fprintln(os.Stderr, "usage: zhuji [-stack] [-compress] [-rv64 | -rv32e] [-regalloc] [-o output] <input.s>")
+		fmt.Fprintln(os.Stderr, "       zhuji -run [-compress] [-rv64 | -rv32e] [-mem bytes] [-harts n] <input.s>")
+		fmt.Fprintln(os.Stderr, "       zhuji -run -stack <input.s>")
+		fmt.Fprintln(os.Stderr, "       zhuji -translate [-run] <input.s>")
 		os.Exit(1)
 	}
 
@@ -26,7 +41,65 @@ func main() {
 		os.Exit(1)
 	}
 
-	result := compiler.Compile(string(input))
+	var asmOpts []asm.Option
+	if *trace {
+		asmOpts = append(asmOpts, asm.WithTrace())
+	}
+	if *stack || *translate {
+		asmOpts = append(asmOpts, asm.WithStackMode())
+	}
+	if *compress && !*stack && !*translate {
+		asmOpts = append(asmOpts, asm.WithCompression())
+	}
+	if *rv64 {
+		asmOpts = append(asmOpts, asm.WithRV64())
+	}
+	if *rv32e {
+		asmOpts = append(asmOpts, asm.WithRV32E())
+	}
+	program, err := asm.Assemble(string(input), asmOpts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error assembling %s: %v\n", inputFile, err)
+		os.Exit(1)
+	}
+	if *compress && !*stack && !*translate {
+		fmt.Fprint(os.Stderr, asm.MeasureSize(program))
+	}
+
+	if *translate {
+		program, err = asm.TranslateStack(program)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error translating %s: %v\n", inputFile, err)
+			os.Exit(1)
+		}
+	}
+	stackMachine := *stack && !*translate
+
+	if *run && stackMachine {
+		os.Exit(executeStack(program, *trace))
+	}
+	if *run {
+		os.Exit(execute(program, *memory, *harts, *rv64, *rv32e, *trace))
+	}
+
+	var genOpts []codegen.Option
+	if *trace {
+		genOpts = append(genOpts, codegen.WithTrace())
+	}
+	if stackMachine {
+		genOpts = append(genOpts, codegen.WithStackMode())
+	}
+	if *rv64 {
+		genOpts = append(genOpts, codegen.WithRV64())
+	}
+	if *regalloc {
+		genOpts = append(genOpts, codegen.WithRegisterAllocation())
+	}
+	result, err := codegen.Generate(program, genOpts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error compiling %s: %v\n", inputFile, err)
+		os.Exit(1)
+	}
 
 	outPath := *outputFile
 	if outPath == "" {
@@ -41,3 +114,52 @@ func main() {
 
 	fmt.Printf("wrote %s\n", outPath)
 }
+
+// execute runs the program with a UART on stdin and stdout and returns the
+// exit status the compiled program would have: the low byte of x1.
+func execute(program []int, memory, harts int, rv64, rv32e, trace bool) int {
+	opts := []vm.Option{vm.WithMemory(memory), vm.WithHarts(harts), vm.WithUART(os.Stdout, os.Stdin)}
+	if rv64 {
+		opts = append(opts, vm.WithRV64())
+	}
+	if rv32e {
+		opts = append(opts, vm.WithRV32E())
+	}
+	if trace {
+		opts = append(opts, vm.WithTrace())
+	}
+	machine, err := vm.New(opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error starting the VM: %v\n", err)
+		return 1
+	}
+	if err := machine.Run(program); err != nil {
+		fmt.Fprintf(os.Stderr, "error running the program: %v\n", err)
+		return 1
+	}
+	return int(machine.Register(1) & 0xFF)
+}
+
+// executeStack runs a stack-machine program and returns the exit status the
+// compiled program would have: the low byte of the value on top of the
+// stack, or 0 if the stack is empty.
+func executeStack(program []int, trace bool) int {
+	opts := []vm.Option{vm.WithStackMode()}
+	if trace {
+		opts = append(opts, vm.WithTrace())
+	}
+	machine, err := vm.New(opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error starting the VM: %v\n", err)
+		return 1
+	}
+	if err := machine.Run(program); err != nil {
+		fmt.Fprintf(os.Stderr, "error running the program: %v\n", err)
+		return 1
+	}
+	stack := machine.Stack()
+	if len(stack) == 0 {
+		return 0
+	}
+	return int(stack[len(stack)-1] & 0xFF)
+}
@@ -0,0 +1,87 @@
+// Package codegen translates zhuji bytecode into x86-64 assembly for the GNU
+// assembler. The output defines _start and exits with the value of x1 as its
+// status, so it can be linked on its own:
+//
+//	out, err := codegen.Generate(program)
+//	// as -o prog.o prog.s && ld -o prog prog.o
+//
+// See package asm for the stability of this API.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/codegen"
+)
+
+type config struct {
+	trace bool
+	stack bool
+	rv64  bool
+	alloc bool
+}
+
+// Option configures Generate.
+type Option func(*config)
+
+// WithTrace prints the generated assembly, and where it came from, to
+// standard error.
+func WithTrace() Option {
+	return func(c *config) {
+		c.trace = true
+	}
+}
+
+// WithStackMode generates code for a program assembled with
+// asm.WithStackMode. The operand stack is the native stack and the program
+// exits with the value on top of it.
+func WithStackMode() Option {
+	return func(c *config) {
+		c.stack = true
+	}
+}
+
+// WithRV64 generates code for a program assembled with asm.WithRV64, whose
+// registers are the whole x86-64 ones. The F, D and B extensions are not
+// supported in this mode.
+func WithRV64() Option {
+	return func(c *config) {
+		c.rv64 = true
+	}
+}
+
+// WithRegisterAllocation assigns the x86 registers by linear scan over the
+// live ranges of the program instead of the fixed map, so registers past x15
+// that are not all live at once need not be spilled.
+func WithRegisterAllocation() Option {
+	return func(c *config) {
+		c.alloc = true
+	}
+}
+
+// Generate returns the x86-64 assembly for program. It fails on bytecode the
+// code generator has no lowering for.
+func Generate(program []int, opts ...Option) (string, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	gen := codegen.NewCodeGen()
+	if c.trace {
+		gen.EnableTrace()
+	}
+	if c.stack {
+		gen.EnableStackMode()
+	}
+	if c.rv64 {
+		gen.EnableRV64()
+	}
+	if c.alloc {
+		gen.EnableRegisterAllocation()
+	}
+	out, err := gen.Generate(program)
+	if err != nil {
+		return "", fmt.Errorf("codegen: %w", err)
+	}
+	return out, nil
+}
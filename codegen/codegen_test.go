@@ -0,0 +1,64 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/asm"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateEmitsAnEntryPoint(t *testing.T) {
+	program, _ := asm.Assemble("addi x1, x0, 7")
+
+	out, err := Generate(program)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out, "_start:")
+	assert.Contains(t, out, "movq $7, %rax")
+}
+
+func TestGenerateReportsUnsupportedBytecode(t *testing.T) {
+	program := []int{int(opcodes.JALR), 1, 2, 0}
+
+	out, err := Generate(program)
+
+	assert.Error(t, err, "jalr with a link register has no lowering")
+	assert.Empty(t, out)
+}
+
+func TestGenerateNamesUnsupportedInstructions(t *testing.T) {
+	program, _ := asm.Assemble("mret")
+
+	_, err := Generate(program)
+
+	assert.ErrorContains(t, err, "mret is not supported", "the error should name the instruction")
+}
+
+func TestWithStackModeGeneratesStackCode(t *testing.T) {
+	program, _ := asm.Assemble("psh 7", asm.WithStackMode())
+
+	out, err := Generate(program, WithStackMode())
+
+	assert.NoError(t, err)
+	assert.Contains(t, out, "pushq $7")
+}
+
+func TestWithRV64GeneratesQuadwordCode(t *testing.T) {
+	program, _ := asm.Assemble("slli x1, x2, 40", asm.WithRV64())
+
+	out, err := Generate(program, WithRV64())
+
+	assert.NoError(t, err)
+	assert.Contains(t, out, "shlq $40, %rax")
+}
+
+func TestWithRegisterAllocationKeepsHighRegistersInRegisters(t *testing.T) {
+	program, _ := asm.Assemble("addi x20, x0, 7\nadd x1, x20, x0")
+
+	out, err := Generate(program, WithRegisterAllocation())
+
+	assert.NoError(t, err)
+	assert.Contains(t, out, "movq $7, %rbx")
+	assert.NotContains(t, out, "spill")
+}
@@ -3,15 +3,36 @@ package assembler
 import (
 	"fmt"
 	"log"
+	"maps"
+	"math"
+	"math/bits"
+	"slices"
 	"strconv"
 	"strings"
 
 	ours "github.com/phasecurve/zhuji/internal"
+	"github.com/phasecurve/zhuji/internal/fpu"
 	"github.com/phasecurve/zhuji/internal/opcodes"
 )
 
 type Assembler struct {
 	traceEnabled bool
+	set          *opcodes.Set
+	labels       map[string]int
+	// pcrelHi holds, for each auipc whose immediate is a %pcrel_hi, the
+	// offset it split, so that %pcrel_lo naming the auipc can supply the rest.
+	pcrelHi map[int]int32
+	// compress turns on compressing instructions as they are emitted.
+	// emitted counts them through one pass, shrunk marks those a pass has
+	// compressed and pinned those that then stopped fitting, which are kept
+	// full size from then on so that the passes settle.
+	compress       bool
+	emitted        int
+	shrunk, pinned map[int]bool
+	rv64           bool
+	// registers is the number of integer registers there are: 32, or 16
+	// in RV32E.
+	registers int
 }
 
 var reg = map[string]int{
@@ -21,8 +42,66 @@ var reg = map[string]int{
 	"x24": 24, "x25": 25, "x26": 26, "x27": 27, "x28": 28, "x29": 29, "x30": 30, "x31": 31,
 }
 
+var freg = map[string]int{
+	"f0": 0, "f1": 1, "f2": 2, "f3": 3, "f4": 4, "f5": 5, "f6": 6, "f7": 7,
+	"f8": 8, "f9": 9, "f10": 10, "f11": 11, "f12": 12, "f13": 13, "f14": 14, "f15": 15,
+	"f16": 16, "f17": 17, "f18": 18, "f19": 19, "f20": 20, "f21": 21, "f22": 22, "f23": 23,
+	"f24": 24, "f25": 25, "f26": 26, "f27": 27, "f28": 28, "f29": 29, "f30": 30, "f31": 31,
+}
+
 func NewAssembler() *Assembler {
-	return &Assembler{}
+	return &Assembler{set: opcodes.RegisterSet, registers: 32}
+}
+
+func (a *Assembler) EnableTrace() {
+	a.traceEnabled = true
+}
+
+// EnableCompression emits every instruction that has a C extension form its
+// operands fit as that 16-bit form, as if it had been written with the c.
+// mnemonic.
+func (a *Assembler) EnableCompression() {
+	a.compress = true
+}
+
+// EnableStackMode assembles the stack-machine instruction set instead of
+// RISC-V.
+func (a *Assembler) EnableStackMode() {
+	a.set = opcodes.StackSet
+}
+
+// EnableRV64 assembles for RV64 mode, which adds LD, SD, LWU and the W
+// instructions to RV32 and lets the other shifts by a constant shift by up
+// to 63.
+func (a *Assembler) EnableRV64() {
+	a.set = opcodes.RV64Set
+	a.rv64 = true
+}
+
+// EnableRV32E assembles for RV32E, which has only the registers x0 to x15
+// and rejects any instruction naming one of the others.
+func (a *Assembler) EnableRV32E() {
+	a.registers = 16
+}
+
+// Error is a problem with the assembly text, such as an unknown mnemonic or
+// an immediate that does not parse.
+type Error struct {
+	Line    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Line == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Line, e.Message)
+}
+
+// fail abandons assembly. The helpers below call it from deep inside the
+// instruction loop, and TryAssemble recovers it into an *Error.
+func fail(format string, args ...any) {
+	panic(&Error{Message: fmt.Sprintf(format, args...)})
 }
 
 func (a *Assembler) findLabels(lines []string) map[string]int {
@@ -34,114 +113,595 @@ func (a *Assembler) findLabels(lines []string) map[string]int {
 			line = ours.TrimSuffix(line, ':')
 			labels[line] = ip
 		} else {
-			ip += 4
+			ip += a.size(tokens(line))
 		}
 	}
 
 	return labels
 }
 
+func tokens(line string) []string {
+	return strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t'
+	})
+}
+
+// size is how many bytes a line assembles to before anything is compressed:
+// two for a c. instruction and four for each other one.
+func (a *Assembler) size(tks []string) int {
+	if info, ok := a.set.ByMnemonic(tks[0]); ok && info.Is(opcodes.Compressed) {
+		return info.Size()
+	}
+	return 4 * a.instructionCount(tks)
+}
+
+// instructionCount is how many instructions a line assembles to. Only the
+// pseudo-instructions that load constants and addresses take more than one.
+func (a *Assembler) instructionCount(tks []string) int {
+	switch tks[0] {
+	case "la":
+		return 2
+	case "li":
+		if len(tks) < 3 {
+			break
+		}
+		if a.rv64 {
+			if value, err := parseConstant64(tks[2]); err == nil {
+				return len(loadImmediate64(nil, 0, value)) / 4
+			}
+			break
+		}
+		if value, err := parseConstant(tks[2]); err == nil {
+			if hi, lo := splitImmediate(value); hi != 0 && lo != 0 {
+				return 2
+			}
+		}
+	}
+	return 1
+}
+
+// Assemble is TryAssemble for callers that treat bad input as fatal: it logs
+// the error and exits.
 func (a *Assembler) Assemble(assembly string) []int {
+	byteCode, err := a.TryAssemble(assembly)
+	if err != nil {
+		log.Fatalf("error while assembling: %v", err)
+	}
+	return byteCode
+}
+
+// TryAssemble turns the assembly text into bytecode, or reports the first
+// line it could not make sense of.
+func (a *Assembler) TryAssemble(assembly string) (byteCode []int, err error) {
+	line := ""
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			e.Line = line
+			byteCode, err = nil, e
+		}
+	}()
 	noComments := a.removeComments(assembly)
 	lines := ours.SplitRemoveEmpty(noComments, "\n")
-	byteCode := []int{}
+	a.shrunk, a.pinned = map[int]bool{}, map[int]bool{}
 	labels := a.findLabels(lines)
-	ip := 0
-	for _, line := range lines {
-		tks := strings.FieldsFunc(line, func(r rune) bool {
-			return r == ' ' || r == ',' || r == '\t'
-		})
+	for {
+		var found map[string]int
+		byteCode, found = a.pass(lines, labels, &line)
+		if maps.Equal(found, labels) {
+			return byteCode, nil
+		}
+		labels = found
+	}
+}
+
+// pass assembles every line with the labels where an earlier pass put them,
+// and reports where they ended up. That only differs when compression has
+// shrunk instructions, moving the labels after them closer, so TryAssemble
+// repeats passes until the labels stay put. line tracks the line being
+// assembled for the error report.
+func (a *Assembler) pass(lines []string, labels map[string]int, line *string) ([]int, map[string]int) {
+	a.labels, a.pcrelHi, a.emitted = labels, map[int]int32{}, 0
+	byteCode, found := []int{}, map[string]int{}
+	for _, *line = range lines {
+		tks := tokens(*line)
 		if strings.Contains(tks[0], ":") {
+			found[ours.TrimSuffix(*line, ':')] = len(byteCode)
 			continue
 		}
-		switch tks[0] {
-		case "li":
-			byteCode = handleImmediateOp3(opcodes.ADDI, byteCode, []string{"li", tks[1], "x0", tks[2]})
-		case "mv":
-			byteCode = handleImmediateOp3(opcodes.ADDI, byteCode, []string{"mv", tks[1], tks[2], "0"})
-		case "addi":
-			byteCode = handleImmediateOp3(opcodes.ADDI, byteCode, tks)
-		case "add":
-			byteCode = handleRegistersOp3(opcodes.ADD, byteCode, tks)
-		case "sub":
-			byteCode = handleRegistersOp3(opcodes.SUB, byteCode, tks)
-		case "mul":
-			byteCode = handleRegistersOp3(opcodes.MUL, byteCode, tks)
-		case "div":
-			byteCode = handleRegistersOp3(opcodes.DIV, byteCode, tks)
-		case "mod":
-			byteCode = handleRegistersOp3(opcodes.MOD, byteCode, tks)
-		case "lw":
-			byteCode = handleLoadOrStore(opcodes.LW, byteCode, tks)
-		case "sw":
-			byteCode = handleLoadOrStore(opcodes.SW, byteCode, tks)
-		case "blt":
-			byteCode = handleBranchOp(opcodes.BLT, byteCode, tks, labels, ip)
-		case "beq":
-			byteCode = handleBranchOp(opcodes.BEQ, byteCode, tks, labels, ip)
-		case "bne":
-			byteCode = handleBranchOp(opcodes.BNE, byteCode, tks, labels, ip)
-		case "bge":
-			byteCode = handleBranchOp(opcodes.BGE, byteCode, tks, labels, ip)
-		case "jal":
-			byteCode = handleBranchOp2(opcodes.JAL, byteCode, tks, labels, ip)
-		}
-		ip += 4
+		byteCode = a.assemble(byteCode, tks, len(byteCode))
 	}
-	return byteCode
+	return byteCode, found
 }
 
-func handleRegistersOp3(op opcodes.OpCode, byteCode []int, tks []string) []int {
-	byteCode = append(byteCode, int(op))
-	byteCode = append(byteCode, reg[tks[1]])
-	byteCode = append(byteCode, reg[tks[2]])
-	byteCode = append(byteCode, reg[tks[3]])
-	return byteCode
+// assemble appends the instruction on one line, looking its mnemonic up in
+// the opcode table. Pseudo-instructions are expanded and assembled in turn.
+func (a *Assembler) assemble(byteCode []int, tks []string, ip int) []int {
+	info, ok := a.set.ByMnemonic(stripOrdering(tks[0]))
+	if !ok {
+		fail("unknown instruction: %v", tks[0])
+	}
+	switch {
+	case info.Mnemonic == "li" && a.rv64:
+		operands(tks, 2)
+		value, err := parseConstant64(tks[2])
+		if err != nil {
+			fail("li needs a 64-bit constant: %v", tks[2])
+		}
+		for inst := range slices.Chunk(loadImmediate64(nil, register(tks[1]), value), 4) {
+			byteCode = a.emit(byteCode, [4]int(inst), len(byteCode))
+		}
+		return byteCode
+	case info.Mnemonic == "li":
+		operands(tks, 2)
+		value, err := parseConstant(tks[2])
+		if err != nil {
+			fail("li needs a 32-bit constant: %v", tks[2])
+		}
+		for inst := range slices.Chunk(LoadImmediate(nil, register(tks[1]), value), 4) {
+			byteCode = a.emit(byteCode, [4]int(inst), len(byteCode))
+		}
+		return byteCode
+	case info.Mnemonic == "la":
+		operands(tks, 2)
+		offset, ok := a.labels[tks[2]]
+		if !ok {
+			fail("unknown label: %v", tks[2])
+		}
+		hi, lo := splitImmediate(int32(offset - ip))
+		byteCode = a.assemble(byteCode, []string{"auipc", tks[1], strconv.Itoa(int(hi))}, ip)
+		return a.assemble(byteCode, []string{"addi", tks[1], tks[1], strconv.Itoa(int(lo))}, ip+4)
+	case info.Is(opcodes.Pseudo):
+		return a.assemble(byteCode, expand(info.Expansion, tks), ip)
+	case info.Is(opcodes.Compressed):
+		inst := a.expandCompressed(info, tks, ip)
+		if err := info.Constraint.Check(inst); err != nil {
+			fail("%v", err)
+		}
+		a.checkRegisters(inst)
+		return append(byteCode, int(info.Op), info.Pack(inst))
+	}
+	return a.emit(byteCode, a.encode(info, tks, ip), ip)
+}
+
+// expandCompressed encodes the base instruction a c. instruction stands for.
+func (a *Assembler) expandCompressed(info opcodes.Info, tks []string, ip int) [4]int {
+	expanded := expand(info.Expansion, tks)
+	base, _ := a.set.ByOpCode(info.Base)
+	return a.encode(base, expanded, ip)
+}
+
+// emit appends an instruction, compressed when compression is on and one of
+// the C extension forms of it fits its operands.
+func (a *Assembler) emit(byteCode []int, inst [4]int, ip int) []int {
+	a.checkRegisters(inst)
+	n := a.emitted
+	a.emitted++
+	if !a.compress || a.pinned[n] {
+		return append(byteCode, inst[:]...)
+	}
+	if info, ok := a.compressed(inst, ip); ok {
+		a.shrunk[n] = true
+		return append(byteCode, int(info.Op), info.Pack(inst))
+	}
+	a.pinned[n] = a.shrunk[n]
+	return append(byteCode, inst[:]...)
+}
+
+// checkRegisters rejects an instruction naming a register there is not, which
+// only RV32E lacks any of.
+func (a *Assembler) checkRegisters(inst [4]int) {
+	info, _ := a.set.ByOpCode(opcodes.OpCode(inst[0]))
+	for _, r := range info.Registers(inst) {
+		if r >= a.registers {
+			fail("RV32E has no register x%d, only x0 to x15", r)
+		}
+	}
 }
 
-func handleImmediateOp3(op opcodes.OpCode, byteCode []int, tks []string) []int {
-	byteCode = append(byteCode, int(op))
-	byteCode = append(byteCode, reg[tks[1]])
-	byteCode = append(byteCode, reg[tks[2]])
-	if n, err := strconv.Atoi(tks[3]); err != nil {
-		log.Fatalf("error while trying to parse an instruction: %v", err)
+// compressed finds the C extension form of an instruction, if it has one
+// its operands fit. Each candidate is written out with the operands the
+// instruction has in the slots its fields name, and taken only if what that
+// expands to is the instruction itself.
+func (a *Assembler) compressed(inst [4]int, ip int) (opcodes.Info, bool) {
+	for _, info := range a.set.Compressions(opcodes.OpCode(inst[0])) {
+		if info.Constraint.Check(inst) != nil {
+			continue
+		}
+		tks := []string{info.Mnemonic}
+		for _, field := range info.Format.Fields() {
+			tks = append(tks, operandText(field, inst))
+		}
+		if a.expandCompressed(info, tks, ip) == inst {
+			return info, true
+		}
+	}
+	return opcodes.Info{}, false
+}
+
+// operandText writes the operand a field places in inst back out as
+// assembly.
+func operandText(field opcodes.Field, inst [4]int) string {
+	switch field.Kind {
+	case opcodes.RegOperand:
+		return fmt.Sprintf("x%d", inst[field.Slot])
+	case opcodes.MemOperand:
+		return fmt.Sprintf("%d(x%d)", inst[field.Slot], inst[field.Base])
+	}
+	return strconv.Itoa(inst[field.Slot])
+}
+
+// expand substitutes the operands of a pseudo-instruction or compressed
+// instruction into the expansion it stands for. An operand may be part of a
+// token, as in the 0(%1) of c.jr.
+func expand(expansion string, tks []string) []string {
+	expanded := tokens(expansion)
+	arity := 0
+	for i, tk := range expanded {
+		at := strings.Index(tk, "%")
+		if at < 0 {
+			continue
+		}
+		n := int(tk[at+1] - '0')
+		arity = max(arity, n)
+		if n < len(tks) {
+			expanded[i] = tk[:at] + tks[n] + tk[at+2:]
+		}
+	}
+	operands(tks, arity)
+	return expanded
+}
+
+// operands checks that an instruction was written with n operands.
+func operands(tks []string, n int) {
+	if len(tks)-1 != n {
+		fail("%v takes %d operands, not %d", tks[0], n, len(tks)-1)
+	}
+}
+
+// optionalOperands checks that an instruction was written with between min
+// and max operands.
+func optionalOperands(tks []string, min, max int) {
+	if n := len(tks) - 1; n < min || n > max {
+		fail("%v takes %d or %d operands, not %d", tks[0], min, max, n)
+	}
+}
+
+// encode builds one instruction, parsing each operand as its format says
+// and placing it in its slot. An optional operand that was left off gets its
+// default.
+func (a *Assembler) encode(info opcodes.Info, tks []string, ip int) [4]int {
+	fields := info.Format.Fields()
+	required := len(fields)
+	for required > 0 && fields[required-1].Optional {
+		required--
+	}
+	if required == len(fields) {
+		operands(tks, len(fields))
 	} else {
-		byteCode = append(byteCode, n)
+		optionalOperands(tks, required, len(fields))
 	}
-	return byteCode
+	inst := [4]int{int(info.Op)}
+	for i, field := range fields {
+		n := i + 1
+		if n >= len(tks) {
+			inst[field.Slot] = int(fpu.DYN)
+			continue
+		}
+		switch field.Kind {
+		case opcodes.FRegOperand:
+			inst[field.Slot] = floatRegister(tks[n])
+		case opcodes.RMOperand:
+			inst[field.Slot] = roundingMode(tks[n])
+		case opcodes.RegOperand:
+			inst[field.Slot] = register(tks[n])
+		case opcodes.ImmOperand:
+			inst[field.Slot] = immediate(a.relocate(tks, n, ip)[n])
+		case opcodes.ShamtOperand:
+			inst[field.Slot] = smallImmediate(tks[n], "shift amount", a.maxShift(info))
+		case opcodes.UImmOperand:
+			inst[field.Slot] = smallImmediate(tks[n], "CSR immediate", 31)
+		case opcodes.UpperOperand:
+			inst[field.Slot] = upperImmediate(a.relocate(tks, n, ip)[n])
+		case opcodes.TargetOperand:
+			inst[field.Slot] = a.target(tks[n], ip)
+		case opcodes.MemOperand:
+			inst[field.Slot], inst[field.Base] = memory(a.relocate(tks, n, ip)[n])
+		case opcodes.AddrOperand:
+			inst[field.Slot] = address(tks[n])
+		case opcodes.CSROperand:
+			inst[field.Slot] = parseCSR(tks[n])
+		case opcodes.WordOperand:
+			value, err := parseConstant(tks[n])
+			if err != nil {
+				fail("%v needs a 32-bit constant: %v", tks[0], tks[n])
+			}
+			inst[field.Slot] = int(value)
+		}
+	}
+	return inst
+}
+
+func register(name string) int {
+	r, ok := reg[name]
+	if !ok {
+		fail("unknown register: %v", name)
+	}
+	return r
+}
+
+func floatRegister(name string) int {
+	r, ok := freg[name]
+	if !ok {
+		fail("unknown float register: %v", name)
+	}
+	return r
+}
+
+// roundingMode parses the rm operand of a float instruction.
+func roundingMode(name string) int {
+	rm, ok := fpu.RoundingModeNames[name]
+	if !ok {
+		fail("unknown rounding mode: %v", name)
+	}
+	return int(rm)
+}
+
+// immediate parses an immediate, which like every RV32 I-type immediate
+// must fit in 12 signed bits.
+func immediate(operand string) int {
+	n, err := strconv.ParseInt(operand, 0, 64)
+	if err != nil {
+		fail("error while trying to parse an instruction: %v", err)
+	}
+	if !fitsImm12(n) {
+		fail("immediate must be between -2048 and 2047: %v", operand)
+	}
+	return int(n)
 }
 
-func handleBranchOp2(op opcodes.OpCode, byteCode []int, tks []string, labels map[string]int, ip int) []int {
-	jumpTo := tks[2]
-	tks[2] = "x0" // unused position for JAL
-	if pos, ok := labels[jumpTo]; ok {
-		tks = append(tks, strconv.Itoa(pos-ip))
+// smallImmediate parses a shift amount or the immediate of a CSR ...I form,
+// which are unsigned and at most max.
+func smallImmediate(operand, what string, max int64) int {
+	n, err := strconv.ParseInt(operand, 0, 64)
+	if err != nil || n < 0 || n > max {
+		fail("%s must be between 0 and %d: %v", what, max, operand)
 	}
-	return handleImmediateOp3(op, byteCode, tks)
+	return int(n)
 }
 
-func handleBranchOp(op opcodes.OpCode, byteCode []int, tks []string, labels map[string]int, ip int) []int {
-	if pos, ok := labels[tks[3]]; ok {
-		tks[3] = strconv.Itoa(pos - ip)
+// maxShift is the largest amount the instruction can shift by: 63 in RV64
+// mode, except for the W shifts, which like every shift in RV32 take five
+// bits.
+func (a *Assembler) maxShift(info opcodes.Info) int64 {
+	if a.rv64 && !info.Is(opcodes.RV64) {
+		return 63
 	}
-	return handleImmediateOp3(op, byteCode, tks)
+	return 31
 }
 
-func handleLoadOrStore(op opcodes.OpCode, byteCode []int, tks []string) []int {
-	byteCode = append(byteCode, int(op))
-	byteCode = append(byteCode, reg[tks[1]])
-	offsetAndBase := strings.FieldsFunc(tks[2], func(r rune) bool {
+// upperImmediate parses the 20-bit value LUI and AUIPC place in the upper
+// bits of rd.
+func upperImmediate(operand string) int {
+	n, err := strconv.ParseInt(operand, 0, 64)
+	if err != nil || n < 0 || n > 0xFFFFF {
+		fail("upper immediate must be between 0 and 0xfffff: %v", operand)
+	}
+	return int(n)
+}
+
+// target resolves a branch or jump target, a label or a byte offset, to the
+// offset from the instruction at ip.
+func (a *Assembler) target(operand string, ip int) int {
+	if pos, ok := a.labels[operand]; ok {
+		return pos - ip
+	}
+	n, err := strconv.ParseInt(operand, 0, 64)
+	if err != nil {
+		fail("error while trying to parse an instruction: %v", err)
+	}
+	return int(n)
+}
+
+// memory parses offset(base). The offset may be left out when it is zero.
+func memory(operand string) (offset, base int) {
+	offsetAndBase := strings.FieldsFunc(operand, func(r rune) bool {
 		return r == '(' || r == ')'
 	})
-	offset, err := strconv.Atoi(offsetAndBase[0])
+	if !strings.HasSuffix(operand, ")") || len(offsetAndBase) == 0 || len(offsetAndBase) > 2 {
+		fail("expected offset(base): %v", operand)
+	}
+	if len(offsetAndBase) == 1 {
+		return 0, register(offsetAndBase[0])
+	}
+	n, err := strconv.ParseInt(offsetAndBase[0], 0, 64)
 	if err != nil {
-		log.Fatalf("error attempting to parse offset: %v err: %v", offsetAndBase[0], err)
+		fail("error attempting to parse offset: %v err: %v", offsetAndBase[0], err)
+	}
+	if !fitsImm12(n) {
+		fail("offset must be between -2048 and 2047: %v", offsetAndBase[0])
+	}
+	return int(n), register(offsetAndBase[1])
+}
+
+// address parses the (rs1) of an atomic. It may carry an offset, but only a
+// zero one, as the A extension has no room for anything else.
+func address(operand string) int {
+	offsetAndBase := strings.FieldsFunc(operand, func(r rune) bool {
+		return r == '(' || r == ')'
+	})
+	if len(offsetAndBase) == 0 {
+		fail("expected (base): %v", operand)
+	}
+	if len(offsetAndBase) == 2 && offsetAndBase[0] != "0" {
+		fail("atomic memory operations take no offset: %v", operand)
+	}
+	return register(offsetAndBase[len(offsetAndBase)-1])
+}
+
+// LoadImmediate appends li r, value: the shortest sequence that builds
+// value, one addi when it fits in 12 bits, otherwise a lui for the upper 20
+// bits and, unless they are zero, an addi for the lower 12.
+func LoadImmediate(byteCode []int, r int, value int32) []int {
+	hi, lo := splitImmediate(value)
+	if hi == 0 {
+		return append(byteCode, int(opcodes.ADDI), r, 0, int(lo))
+	}
+	byteCode = append(byteCode, int(opcodes.LUI), r, 0, int(hi))
+	if lo != 0 {
+		byteCode = append(byteCode, int(opcodes.ADDI), r, r, int(lo))
 	}
-	byteCode = append(byteCode, offset)
-	byteCode = append(byteCode, reg[offsetAndBase[1]])
 	return byteCode
 }
 
+// loadImmediate64 appends li r, value on RV64. A value that is a
+// sign-extended word is built as on RV32, but with addiw, as an addi after
+// lui could carry into the upper word. Any other value is built from its
+// upper bits, shifted left past any low zeros, and then its low 12 bits are
+// added in.
+func loadImmediate64(byteCode []int, r int, value int64) []int {
+	if value == int64(int32(value)) {
+		hi, lo := splitImmediate(int32(value))
+		if hi == 0 {
+			return append(byteCode, int(opcodes.ADDI), r, 0, int(lo))
+		}
+		byteCode = append(byteCode, int(opcodes.LUI), r, 0, int(hi))
+		if lo != 0 {
+			byteCode = append(byteCode, int(opcodes.ADDIW), r, r, int(lo))
+		}
+		return byteCode
+	}
+	lo := value << 52 >> 52
+	upper := (value - lo) >> 12
+	shift := 12 + bits.TrailingZeros64(uint64(upper))
+	byteCode = loadImmediate64(byteCode, r, upper>>(shift-12))
+	byteCode = append(byteCode, int(opcodes.SLLI), r, r, shift)
+	if lo != 0 {
+		byteCode = append(byteCode, int(opcodes.ADDI), r, r, int(lo))
+	}
+	return byteCode
+}
+
+// splitImmediate splits value into the 20 bits %hi gives to lui or auipc and
+// the 12 signed bits %lo gives to the addi or load after it. lo is
+// sign-extended when added back, so hi is rounded up when lo is negative.
+func splitImmediate(value int32) (hi, lo int32) {
+	lo = value << 20 >> 20
+	hi = int32(uint32(value-lo) >> 12)
+	return hi, lo
+}
+
+func fitsImm12(n int64) bool {
+	return n >= -2048 && n <= 2047
+}
+
+// parseConstant parses a 32-bit constant, which may be written signed or, in
+// any base strconv understands, as an unsigned bit pattern.
+func parseConstant(s string) (int32, error) {
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < math.MinInt32 || n > math.MaxUint32 {
+		return 0, fmt.Errorf("%v does not fit in 32 bits", s)
+	}
+	return int32(n), nil
+}
+
+// parseConstant64 is parseConstant for RV64's li, whose constant may take
+// all 64 bits.
+func parseConstant64(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err == nil {
+		return n, nil
+	}
+	u, uerr := strconv.ParseUint(s, 0, 64)
+	if uerr != nil {
+		return 0, err
+	}
+	return int64(u), nil
+}
+
+// relocate replaces a %hi, %lo, %pcrel_hi or %pcrel_lo operator in operand i
+// with its value, leaving anything after it, such as the base register of a
+// load, in place.
+func (a *Assembler) relocate(tks []string, i, ip int) []string {
+	operand := tks[i]
+	if !strings.HasPrefix(operand, "%") {
+		return tks
+	}
+	open := strings.Index(operand, "(")
+	closing := strings.Index(operand, ")")
+	if open < 0 || closing < open {
+		fail("malformed relocation: %v", operand)
+	}
+	name, symbol, rest := operand[1:open], operand[open+1:closing], operand[closing+1:]
+	var value int32
+	switch name {
+	case "hi", "lo":
+		hi, lo := splitImmediate(a.symbol(symbol))
+		value = hi
+		if name == "lo" {
+			value = lo
+		}
+	case "pcrel_hi":
+		offset := a.symbol(symbol) - int32(ip)
+		a.pcrelHi[ip] = offset
+		value, _ = splitImmediate(offset)
+	case "pcrel_lo":
+		auipc, ok := a.labels[symbol]
+		offset, found := a.pcrelHi[auipc]
+		if !ok || !found {
+			fail("%%pcrel_lo must name the label of an auipc using %%pcrel_hi: %v", symbol)
+		}
+		_, value = splitImmediate(offset)
+	default:
+		fail("unknown relocation: %%%v", name)
+	}
+	relocated := append([]string{}, tks...)
+	relocated[i] = strconv.Itoa(int(value)) + rest
+	return relocated
+}
+
+// symbol is the value of a label or a constant.
+func (a *Assembler) symbol(name string) int32 {
+	if ip, ok := a.labels[name]; ok {
+		return int32(ip)
+	}
+	value, err := parseConstant(name)
+	if err != nil {
+		fail("unknown symbol: %v", name)
+	}
+	return value
+}
+
+// parseCSR looks up a control and status register by name or by number.
+func parseCSR(name string) int {
+	if csr, ok := opcodes.CSRNames[name]; ok {
+		return int(csr)
+	}
+	n, err := strconv.ParseInt(name, 0, 32)
+	if err != nil {
+		fail("unknown control and status register: %v", name)
+	}
+	return int(n)
+}
+
+// stripOrdering drops the .aq, .rl and .aqrl memory ordering suffixes from
+// atomic mnemonics. Harts take turns one instruction at a time, so every
+// atomic is already sequentially consistent.
+func stripOrdering(mnemonic string) string {
+	for _, suffix := range []string{".aqrl", ".aq", ".rl"} {
+		if strings.HasSuffix(mnemonic, suffix) {
+			return strings.TrimSuffix(mnemonic, suffix)
+		}
+	}
+	return mnemonic
+}
+
 func stripComment(line string) string {
 	commentStart := strings.Index(line, "#")
 	if commentStart == -1 {
@@ -1,6 +1,7 @@
 package assembler
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/phasecurve/zhuji/internal/opcodes"
@@ -19,6 +20,33 @@ func TestAssembleArithmeticInstructions(t *testing.T) {
 		{"mul", "mul x3, x1, x2", []int{int(opcodes.MUL), 3, 1, 2}, "mul should encode destination and two source registers"},
 		{"div", "div x3, x1, x2", []int{int(opcodes.DIV), 3, 1, 2}, "div should encode destination and two source registers"},
 		{"mod", "mod x3, x1, x2", []int{int(opcodes.MOD), 3, 1, 2}, "mod should encode destination and two source registers"},
+		{"rem", "rem x3, x1, x2", []int{int(opcodes.REM), 3, 1, 2}, "rem should encode the same instruction as mod"},
+		{"mulh", "mulh x3, x1, x2", []int{int(opcodes.MULH), 3, 1, 2}, "mulh should encode destination and two source registers"},
+		{"mulhu", "mulhu x3, x1, x2", []int{int(opcodes.MULHU), 3, 1, 2}, "mulhu should encode destination and two source registers"},
+		{"mulhsu", "mulhsu x3, x1, x2", []int{int(opcodes.MULHSU), 3, 1, 2}, "mulhsu should encode destination and two source registers"},
+		{"divu", "divu x3, x1, x2", []int{int(opcodes.DIVU), 3, 1, 2}, "divu should encode destination and two source registers"},
+		{"remu", "remu x3, x1, x2", []int{int(opcodes.REMU), 3, 1, 2}, "remu should encode destination and two source registers"},
+		{"and", "and x3, x1, x2", []int{int(opcodes.AND), 3, 1, 2}, "and should encode destination and two source registers"},
+		{"or", "or x3, x1, x2", []int{int(opcodes.OR), 3, 1, 2}, "or should encode destination and two source registers"},
+		{"xor", "xor x3, x1, x2", []int{int(opcodes.XOR), 3, 1, 2}, "xor should encode destination and two source registers"},
+		{"sll", "sll x3, x1, x2", []int{int(opcodes.SLL), 3, 1, 2}, "sll should encode destination and two source registers"},
+		{"srl", "srl x3, x1, x2", []int{int(opcodes.SRL), 3, 1, 2}, "srl should encode destination and two source registers"},
+		{"sra", "sra x3, x1, x2", []int{int(opcodes.SRA), 3, 1, 2}, "sra should encode destination and two source registers"},
+		{"andi", "andi x3, x1, -16", []int{int(opcodes.ANDI), 3, 1, -16}, "andi should encode destination, source register, and immediate value"},
+		{"ori", "ori x3, x1, 7", []int{int(opcodes.ORI), 3, 1, 7}, "ori should encode destination, source register, and immediate value"},
+		{"xori", "xori x3, x1, 7", []int{int(opcodes.XORI), 3, 1, 7}, "xori should encode destination, source register, and immediate value"},
+		{"not", "not x3, x1", []int{int(opcodes.XORI), 3, 1, -1}, "not should expand to xori with -1"},
+		{"slli", "slli x3, x1, 31", []int{int(opcodes.SLLI), 3, 1, 31}, "slli should encode the shift amount"},
+		{"srli", "srli x3, x1, 0", []int{int(opcodes.SRLI), 3, 1, 0}, "srli should encode the shift amount"},
+		{"srai", "srai x3, x1, 5", []int{int(opcodes.SRAI), 3, 1, 5}, "srai should encode the shift amount"},
+		{"slt", "slt x3, x1, x2", []int{int(opcodes.SLT), 3, 1, 2}, "slt should encode destination and two source registers"},
+		{"sltu", "sltu x3, x1, x2", []int{int(opcodes.SLTU), 3, 1, 2}, "sltu should encode destination and two source registers"},
+		{"slti", "slti x3, x1, -4", []int{int(opcodes.SLTI), 3, 1, -4}, "slti should encode destination, source register, and immediate value"},
+		{"sltiu", "sltiu x3, x1, 9", []int{int(opcodes.SLTIU), 3, 1, 9}, "sltiu should encode destination, source register, and immediate value"},
+		{"seqz", "seqz x3, x1", []int{int(opcodes.SLTIU), 3, 1, 1}, "seqz should expand to sltiu with 1"},
+		{"snez", "snez x3, x1", []int{int(opcodes.SLTU), 3, 0, 1}, "snez should expand to sltu from x0"},
+		{"sltz", "sltz x3, x1", []int{int(opcodes.SLT), 3, 1, 0}, "sltz should expand to slt against x0"},
+		{"sgtz", "sgtz x3, x1", []int{int(opcodes.SLT), 3, 0, 1}, "sgtz should expand to slt from x0"},
 		{"addi", "addi x1, x0, 42", []int{int(opcodes.ADDI), 1, 0, 42}, "addi should encode destination, source register, and immediate value"},
 	}
 
@@ -42,6 +70,12 @@ func TestAssembleBranchInstructions(t *testing.T) {
 		{"beq", "beq x1, x2, 12", []int{int(opcodes.BEQ), 1, 2, 12}, "beq should encode two registers and offset for branch if equal"},
 		{"bne", "bne x1, x2, 12", []int{int(opcodes.BNE), 1, 2, 12}, "bne should encode two registers and offset for branch if not equal"},
 		{"bge", "bge x1, x2, 12", []int{int(opcodes.BGE), 1, 2, 12}, "bge should encode two registers and offset for branch if greater or equal"},
+		{"jalr", "jalr x1, 4(x5)", []int{int(opcodes.JALR), 1, 5, 4}, "jalr should encode rd, the base register, then the offset"},
+		{"jal offset", "jal x1, -8", []int{int(opcodes.JAL), 1, 0, -8}, "jal should take a byte offset as well as a label"},
+		{"bltu", "bltu x1, x2, 12", []int{int(opcodes.BLTU), 1, 2, 12}, "bltu should encode two registers and offset for unsigned branch if less than"},
+		{"bgeu", "bgeu x1, x2, 12", []int{int(opcodes.BGEU), 1, 2, 12}, "bgeu should encode two registers and offset for unsigned branch if greater or equal"},
+		{"bgtu", "bgtu x1, x2, 12", []int{int(opcodes.BLTU), 2, 1, 12}, "bgtu should be bltu with its registers swapped"},
+		{"bleu", "bleu x1, x2, 12", []int{int(opcodes.BGEU), 2, 1, 12}, "bleu should be bgeu with its registers swapped"},
 	}
 
 	for _, tc := range cases {
@@ -62,6 +96,13 @@ func TestAssembleMemoryInstructions(t *testing.T) {
 	}{
 		{"lw", "lw x1, 0(x0)", []int{int(opcodes.LW), 1, 0, 0}, "lw should encode destination, offset, and base register for load word"},
 		{"sw", "sw x1, 4(x2)", []int{int(opcodes.SW), 1, 4, 2}, "sw should encode source, offset, and base register for store word"},
+		{"lb", "lb x1, -1(x2)", []int{int(opcodes.LB), 1, -1, 2}, "lb should encode like lw"},
+		{"lbu", "lbu x1, 3(x2)", []int{int(opcodes.LBU), 1, 3, 2}, "lbu should encode like lw"},
+		{"lh", "lh x1, 2(x2)", []int{int(opcodes.LH), 1, 2, 2}, "lh should encode like lw"},
+		{"lhu", "lhu x1, 6(x2)", []int{int(opcodes.LHU), 1, 6, 2}, "lhu should encode like lw"},
+		{"sb", "sb x1, 1(x2)", []int{int(opcodes.SB), 1, 1, 2}, "sb should encode like sw"},
+		{"sh", "sh x1, 2(x2)", []int{int(opcodes.SH), 1, 2, 2}, "sh should encode like sw"},
+		{"no offset", "lw x1, (x2)", []int{int(opcodes.LW), 1, 0, 2}, "a missing offset should be zero"},
 	}
 
 	for _, tc := range cases {
@@ -142,3 +183,541 @@ func TestAssembleJALWithLabel(t *testing.T) {
 	}
 	assert.Equal(t, expected, bytecode, "branch should resolve label to PC-relative offset")
 }
+
+func TestAssembleAtomicInstructions(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"lr.w", "lr.w x1, (x2)", []int{int(opcodes.LRW), 1, 2, 0}, "lr.w should encode destination and address register"},
+		{"sc.w", "sc.w x3, x4, (x2)", []int{int(opcodes.SCW), 3, 2, 4}, "sc.w should encode destination, address and source registers"},
+		{"amoadd.w", "amoadd.w x1, x2, (x3)", []int{int(opcodes.AMOADDW), 1, 3, 2}, "amoadd.w should encode destination, address and source registers"},
+		{"amoswap.w", "amoswap.w x1, x2, 0(x3)", []int{int(opcodes.AMOSWAPW), 1, 3, 2}, "a zero offset should be accepted on the address"},
+		{"amomaxu.w", "amomaxu.w x1, x2, (x3)", []int{int(opcodes.AMOMAXUW), 1, 3, 2}, "amomaxu.w should encode destination, address and source registers"},
+		{"ordering", "amoor.w.aqrl x1, x2, (x3)", []int{int(opcodes.AMOORW), 1, 3, 2}, "memory ordering suffixes should be accepted and dropped"},
+		{"lr.w.aq", "lr.w.aq x5, (x6)", []int{int(opcodes.LRW), 5, 6, 0}, "lr.w should accept an acquire suffix"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestAssembleCSRRead(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"csrr by name", "csrr x10, mhartid", []int{int(opcodes.CSRRS), 10, int(opcodes.MHARTID), 0}, "csrr should expand to csrrs rd, csr, x0"},
+		{"csrrs by number", "csrrs x10, 0xf14, x0", []int{int(opcodes.CSRRS), 10, 0xf14, 0}, "a CSR can be given by number"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestAssembleCSRInstructions(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"csrrw", "csrrw x1, mtvec, x2", []int{int(opcodes.CSRRW), 1, int(opcodes.MTVEC), 2}, "csrrw should encode destination, CSR and source register"},
+		{"csrrc", "csrrc x1, mstatus, x2", []int{int(opcodes.CSRRC), 1, int(opcodes.MSTATUS), 2}, "csrrc should encode destination, CSR and source register"},
+		{"csrw", "csrw mepc, x5", []int{int(opcodes.CSRRW), 0, int(opcodes.MEPC), 5}, "csrw should expand to csrrw x0, csr, rs1"},
+		{"csrs", "csrs mie, x5", []int{int(opcodes.CSRRS), 0, int(opcodes.MIE), 5}, "csrs should expand to csrrs x0, csr, rs1"},
+		{"csrc", "csrc mie, x5", []int{int(opcodes.CSRRC), 0, int(opcodes.MIE), 5}, "csrc should expand to csrrc x0, csr, rs1"},
+		{"csrrsi", "csrrsi x1, mstatus, 8", []int{int(opcodes.CSRRSI), 1, int(opcodes.MSTATUS), 8}, "csrrsi should encode the immediate in place of rs1"},
+		{"csrsi", "csrsi mstatus, 8", []int{int(opcodes.CSRRSI), 0, int(opcodes.MSTATUS), 8}, "csrsi should expand to csrrsi x0, csr, uimm"},
+		{"csrci", "csrci mstatus, 8", []int{int(opcodes.CSRRCI), 0, int(opcodes.MSTATUS), 8}, "csrci should expand to csrrci x0, csr, uimm"},
+		{"csrwi", "csrwi mstatus, 0", []int{int(opcodes.CSRRWI), 0, int(opcodes.MSTATUS), 0}, "csrwi should expand to csrrwi x0, csr, uimm"},
+		{"rdtime", "rdtime x3", []int{int(opcodes.CSRRS), 3, int(opcodes.TIME), 0}, "rdtime should read the time CSR"},
+		{"rdinstreth", "rdinstreth x3", []int{int(opcodes.CSRRS), 3, int(opcodes.INSTRETH), 0}, "rdinstreth should read the instreth CSR"},
+		{"mret", "mret", []int{int(opcodes.MRET), 0, 0, 0}, "mret should take no operands"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestAssembleFloatInstructions(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"fadd.s", "fadd.s f1, f2, f3", []int{int(opcodes.FADDS), 1, 2, 3}, "fadd.s should encode three float registers"},
+		{"flw", "flw f1, 8(x2)", []int{int(opcodes.FLW), 1, 8, 2}, "flw should load a float register from offset(base)"},
+		{"fsd", "fsd f31, -8(x2)", []int{int(opcodes.FSD), 31, -8, 2}, "fsd should store a float register to offset(base)"},
+		{"fsqrt.d", "fsqrt.d f1, f2", []int{int(opcodes.FSQRTD), 1, 2, 7}, "a left-off rounding mode should be dyn"},
+		{"fcvt.w.s", "fcvt.w.s x1, f2, rtz", []int{int(opcodes.FCVTWS), 1, 2, 1}, "a rounding mode should be encoded by name"},
+		{"fcvt.d.wu", "fcvt.d.wu f1, x2, rmm", []int{int(opcodes.FCVTDWU), 1, 2, 4}, "a conversion from an integer should take an integer source"},
+		{"flt.d", "flt.d x1, f2, f3", []int{int(opcodes.FLTD), 1, 2, 3}, "a comparison should write an integer register"},
+		{"fmv.w.x", "fmv.w.x f1, x2", []int{int(opcodes.FMVWX), 1, 2, 0}, "fmv.w.x should move an integer register into a float one"},
+		{"fneg.s", "fneg.s f1, f2", []int{int(opcodes.FSGNJNS), 1, 2, 2}, "fneg.s should expand to fsgnjn.s"},
+		{"fmv.d", "fmv.d f1, f2", []int{int(opcodes.FSGNJD), 1, 2, 2}, "fmv.d should expand to fsgnj.d"},
+		{"fsrm", "fsrm x5", []int{int(opcodes.CSRRW), 0, int(opcodes.FRM), 5}, "fsrm should write frm"},
+		{"frflags", "frflags x5", []int{int(opcodes.CSRRS), 5, int(opcodes.FFLAGS), 0}, "frflags should read fflags"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestAssembleBitManipulationInstructions(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"clz", "clz x1, x2", []int{int(opcodes.CLZ), 1, 2, 0}, "clz should take one source register"},
+		{"sext.h", "sext.h x1, x2", []int{int(opcodes.SEXTH), 1, 2, 0}, "sext.h should take one source register"},
+		{"andn", "andn x1, x2, x3", []int{int(opcodes.ANDN), 1, 2, 3}, "andn should encode three registers"},
+		{"sh3add", "sh3add x1, x2, x3", []int{int(opcodes.SH3ADD), 1, 2, 3}, "sh3add should encode three registers"},
+		{"rori", "rori x1, x2, 31", []int{int(opcodes.RORI), 1, 2, 31}, "rori should take a shift amount"},
+		{"bexti", "bexti x1, x2, 7", []int{int(opcodes.BEXTI), 1, 2, 7}, "bexti should take a bit number"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestAssembleRV64Instructions(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"ld", "ld x1, 8(x2)", []int{int(opcodes.LD), 1, 8, 2}, "ld should load from offset(base)"},
+		{"sd", "sd x1, -8(x2)", []int{int(opcodes.SD), 1, -8, 2}, "sd should store to offset(base)"},
+		{"lwu", "lwu x1, 4(x2)", []int{int(opcodes.LWU), 1, 4, 2}, "lwu should load from offset(base)"},
+		{"addiw", "addiw x1, x2, -1", []int{int(opcodes.ADDIW), 1, 2, -1}, "addiw should take an immediate"},
+		{"subw", "subw x1, x2, x3", []int{int(opcodes.SUBW), 1, 2, 3}, "subw should encode three registers"},
+		{"slli by 63", "slli x1, x2, 63", []int{int(opcodes.SLLI), 1, 2, 63}, "RV64 should shift by up to 63"},
+		{"sext.w", "sext.w x1, x2", []int{int(opcodes.ADDIW), 1, 2, 0}, "sext.w should expand to addiw"},
+		{"li of a word", "li x1, 0x7FFFFFFF", []int{int(opcodes.LUI), 1, 0, 0x80000, int(opcodes.ADDIW), 1, 1, -1}, "li should add with addiw so that the sum stays a word"},
+		{"li of 2^32", "li x1, 0x100000000", []int{int(opcodes.ADDI), 1, 0, 1, int(opcodes.SLLI), 1, 1, 32}, "li should shift the upper bits into place"},
+		{"li of a doubleword", "li x1, 0x123456789ABCDEF0", []int{
+			int(opcodes.LUI), 1, 0, 0x247, int(opcodes.ADDIW), 1, 1, -1875,
+			int(opcodes.SLLI), 1, 1, 14, int(opcodes.ADDI), 1, 1, -947,
+			int(opcodes.SLLI), 1, 1, 12, int(opcodes.ADDI), 1, 1, 1511,
+			int(opcodes.SLLI), 1, 1, 13, int(opcodes.ADDI), 1, 1, -272,
+		}, "li should build all 64 bits"},
+		{"li of an unsigned pattern", "li x1, 0xFFFFFFFFFFFFFFFF", []int{int(opcodes.ADDI), 1, 0, -1}, "a 64-bit pattern should be taken as its signed value"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			asm.EnableRV64()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestRV64InstructionsNeedRV64Mode(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		rv64     bool
+		expected string
+	}{
+		{"ld in RV32", "ld x1, 0(x2)", false, "ld x1, 0(x2): unknown instruction: ld"},
+		{"slli by 32 in RV32", "slli x1, x2, 32", false, "slli x1, x2, 32: shift amount must be between 0 and 31: 32"},
+		{"slliw by 32", "slliw x1, x2, 32", true, "slliw x1, x2, 32: shift amount must be between 0 and 31: 32"},
+		{"slli by 64", "slli x1, x2, 64", true, "slli x1, x2, 64: shift amount must be between 0 and 63: 64"},
+		{"li of 2^32 in RV32", "li x1, 0x100000000", false, "li x1, 0x100000000: li needs a 32-bit constant: 0x100000000"},
+		{"li of 2^64", "li x1, 0x10000000000000000", true, "li x1, 0x10000000000000000: li needs a 64-bit constant: 0x10000000000000000"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			if tc.rv64 {
+				asm.EnableRV64()
+			}
+			_, err := asm.TryAssemble(tc.input)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestRV32ERejectsTheUpperRegisters(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"destination", "addi x16, x0, 1", "addi x16, x0, 1: RV32E has no register x16, only x0 to x15"},
+		{"source", "add x1, x2, x31", "add x1, x2, x31: RV32E has no register x31, only x0 to x15"},
+		{"base", "lw x1, 4(x17)", "lw x1, 4(x17): RV32E has no register x17, only x0 to x15"},
+		{"li", "li x20, 0x12345", "li x20, 0x12345: RV32E has no register x20, only x0 to x15"},
+		{"pseudo", "mv x1, x16", "mv x1, x16: RV32E has no register x16, only x0 to x15"},
+		{"compressed", "c.mv x1, x18", "c.mv x1, x18: RV32E has no register x18, only x0 to x15"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			asm.EnableRV32E()
+			_, err := asm.TryAssemble(tc.input)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestRV32EAssemblesTheLowerRegisters(t *testing.T) {
+	asm := NewAssembler()
+	asm.EnableRV32E()
+
+	byteCode, err := asm.TryAssemble("add x15, x14, x1\nlw x2, 0(x15)")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{int(opcodes.ADD), 15, 14, 1, int(opcodes.LW), 2, 0, 15}, byteCode)
+}
+
+func TestTryAssembleReportsTheOffendingLine(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+		message  string
+	}{
+		{"unknown mnemonic", "addi x1, x0, 1\nfrob x1, x2", "frob x1, x2: unknown instruction: frob", "an unknown mnemonic should be rejected"},
+		{"bad immediate", "addi x1, x0, ten", "addi x1, x0, ten: error while trying to parse an instruction: strconv.ParseInt: parsing \"ten\": invalid syntax", "an immediate should be a number"},
+		{"shift amount", "slli x1, x1, 32", "slli x1, x1, 32: shift amount must be between 0 and 31: 32", "a shift amount should fit in five bits"},
+		{"bad CSR", "csrr x1, mfoo", "csrr x1, mfoo: unknown control and status register: mfoo", "a CSR should be a name or a number"},
+		{"unknown register", "add x1, x2, y3", "add x1, x2, y3: unknown register: y3", "a register should be x0 to x31"},
+		{"missing operand", "add x1, x2", "add x1, x2: add takes 3 operands, not 2", "every operand should be given"},
+		{"pseudo operands", "mv x1", "mv x1: mv takes 2 operands, not 1", "a pseudo-instruction should check its operands too"},
+		{"memory operand", "lw x1, x2", "lw x1, x2: expected offset(base): x2", "a load should take offset(base)"},
+		{"float register", "fadd.s f1, f2, x3", "fadd.s f1, f2, x3: unknown float register: x3", "float operands should be f0 to f31"},
+		{"rounding mode", "fsqrt.s f1, f2, up", "fsqrt.s f1, f2, up: unknown rounding mode: up", "a rounding mode should be one of its names"},
+		{"bit number", "bseti x1, x2, 32", "bseti x1, x2, 32: shift amount must be between 0 and 31: 32", "a bit number should fit in five bits"},
+		{"optional operand", "fsqrt.s f1", "fsqrt.s f1: fsqrt.s takes 2 or 3 operands, not 1", "only the rounding mode may be left off"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode, err := asm.TryAssemble(tc.input)
+			assert.Nil(t, bytecode)
+			assert.EqualError(t, err, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestAssembleLoadImmediate(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"small", "li x1, -2048", []int{int(opcodes.ADDI), 1, 0, -2048}, "li should use a single addi when the value fits in 12 bits"},
+		{"upper only", "li x1, 0x12345000", []int{int(opcodes.LUI), 1, 0, 0x12345}, "li should use a single lui when the low 12 bits are zero"},
+		{"both", "li x1, 0x12345678", []int{int(opcodes.LUI), 1, 0, 0x12345, int(opcodes.ADDI), 1, 1, 0x678}, "li should use lui then addi"},
+		{"rounds up", "li x1, 0x12345FFF", []int{int(opcodes.LUI), 1, 0, 0x12346, int(opcodes.ADDI), 1, 1, -1}, "lui should round up when the addi subtracts"},
+		{"unsigned pattern", "li x1, 0xFFFFFFFF", []int{int(opcodes.ADDI), 1, 0, -1}, "an unsigned bit pattern should be taken as its signed value"},
+		{"min int", "li x1, -2147483648", []int{int(opcodes.LUI), 1, 0, 0x80000}, "li should reach the most negative value"},
+		{"lui", "lui x1, 0xFFFFF", []int{int(opcodes.LUI), 1, 0, 0xFFFFF}, "lui should encode its 20-bit immediate"},
+		{"auipc", "auipc x1, 1", []int{int(opcodes.AUIPC), 1, 0, 1}, "auipc should encode its 20-bit immediate"},
+		{"hi and lo", "lui x1, %hi(0x12345FFF)\naddi x1, x1, %lo(0x12345FFF)", []int{int(opcodes.LUI), 1, 0, 0x12346, int(opcodes.ADDI), 1, 1, -1}, "%hi and %lo should split a constant"},
+		{"lo offset", "lw x2, %lo(0x1004)(x1)", []int{int(opcodes.LW), 2, 4, 1}, "%lo should work as a load offset"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestLabelsAccountForExpandedPseudoInstructions(t *testing.T) {
+	asm := NewAssembler()
+
+	bytecode := asm.Assemble("li x1, 0x12345678\nloop:\naddi x1, x1, -1\nbne x1, x0, loop\njal x0, loop")
+
+	assert.Equal(t, -4, bytecode[15], "the branch should find the label after the two instructions li became")
+	assert.Equal(t, -8, bytecode[19], "the jump should find the label after the two instructions li became")
+}
+
+func TestAssembleLoadAddress(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{
+			"la",
+			"addi x0, x0, 0\nla x5, target\naddi x0, x0, 0\ntarget:\nmret",
+			[]int{int(opcodes.ADDI), 0, 0, 0, int(opcodes.AUIPC), 5, 0, 0, int(opcodes.ADDI), 5, 5, 12, int(opcodes.ADDI), 0, 0, 0, int(opcodes.MRET), 0, 0, 0},
+			"la should add the distance to the label to the address of its auipc",
+		},
+		{
+			"pcrel",
+			"here:\nauipc x5, %pcrel_hi(target)\naddi x5, x5, %pcrel_lo(here)\ntarget:\nmret",
+			[]int{int(opcodes.AUIPC), 5, 0, 0, int(opcodes.ADDI), 5, 5, 8, int(opcodes.MRET), 0, 0, 0},
+			"%pcrel_lo should take the low bits of the offset split by the auipc it names",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode := asm.Assemble(tc.input)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestImmediatesOutOfRangeAreRejected(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"addi", "addi x1, x0, 2048", "addi x1, x0, 2048: immediate must be between -2048 and 2047: 2048"},
+		{"andi", "andi x1, x1, -2049", "andi x1, x1, -2049: immediate must be between -2048 and 2047: -2049"},
+		{"load offset", "lw x1, 4096(x2)", "lw x1, 4096(x2): offset must be between -2048 and 2047: 4096"},
+		{"lui", "lui x1, 0x100000", "lui x1, 0x100000: upper immediate must be between 0 and 0xfffff: 0x100000"},
+		{"li", "li x1, 0x100000000", "li x1, 0x100000000: li needs a 32-bit constant: 0x100000000"},
+		{"pcrel_lo", "addi x1, x1, %pcrel_lo(nowhere)", "addi x1, x1, %pcrel_lo(nowhere): %pcrel_lo must name the label of an auipc using %pcrel_hi: nowhere"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			_, err := asm.TryAssemble(tc.input)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestAssembleUnsignedBranchAliasWithLabel(t *testing.T) {
+	asm := NewAssembler()
+
+	bytecode := asm.Assemble("loop:\naddi x1, x1, 1\nbleu x1, x2, loop")
+
+	expected := []int{
+		int(opcodes.ADDI), 1, 1, 1,
+		int(opcodes.BGEU), 2, 1, -4,
+	}
+	assert.Equal(t, expected, bytecode, "bleu should resolve its label after swapping the registers")
+}
+
+// compressed is the bytecode of a compressed instruction standing for inst.
+func compressed(op opcodes.OpCode, inst ...int) []int {
+	info, _ := opcodes.ByOpCode(op)
+	return []int{int(op), info.Pack([4]int(append([]int{int(info.Base)}, inst...)))}
+}
+
+func TestAssembleCompressedInstructions(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"c.addi", "c.addi x5, -3", compressed(opcodes.CADDI, 5, 5, -3), "c.addi should add to its own register"},
+		{"c.li", "c.li x6, 31", compressed(opcodes.CLI, 6, 0, 31), "c.li should add to x0"},
+		{"c.lui", "c.lui x7, 0xFFFFF", compressed(opcodes.CLUI, 7, 0, 0xFFFFF), "c.lui should take a negative upper immediate"},
+		{"c.mv", "c.mv x3, x4", compressed(opcodes.CMV, 3, 0, 4), "c.mv should add to x0"},
+		{"c.lw", "c.lw x9, 124(x10)", compressed(opcodes.CLW, 9, 124, 10), "c.lw should keep its offset above the registers"},
+		{"c.swsp", "c.swsp x1, 8(x2)", compressed(opcodes.CSWSP, 1, 8, 2), "c.swsp should store relative to x2"},
+		{"c.addi16sp", "c.addi16sp -512", compressed(opcodes.CADDI16SP, 2, 2, -512), "c.addi16sp should adjust x2"},
+		{"c.jr", "c.jr x1", compressed(opcodes.CJR, 0, 1, 0), "c.jr should jump through its register without linking"},
+		{"c.jalr", "c.jalr x5", compressed(opcodes.CJALR, 1, 5, 0), "c.jalr should link in x1"},
+		{"c.nop", "c.nop", compressed(opcodes.CNOP, 0, 0, 0), "c.nop should be an addi to x0"},
+		{"mixed", "c.li x8, 1\naddi x1, x0, 1\nc.nop",
+			append(append(compressed(opcodes.CLI, 8, 0, 1), int(opcodes.ADDI), 1, 0, 1), compressed(opcodes.CNOP, 0, 0, 0)...),
+			"compressed and full instructions should mix"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			bytecode, err := asm.TryAssemble(tc.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestLabelsAccountForCompressedInstructions(t *testing.T) {
+	asm := NewAssembler()
+
+	bytecode := asm.Assemble("c.li x8, 3\nloop:\nc.addi x8, -1\nc.bnez x8, loop\njal x1, loop\nc.j end\nend:")
+
+	assert.Equal(t, compressed(opcodes.CBNEZ, 8, 0, -2), bytecode[4:6], "the branch should find the label two bytes back")
+	assert.Equal(t, []int{int(opcodes.JAL), 1, 0, -4}, bytecode[6:10], "the jump should find the label four bytes back")
+	assert.Equal(t, compressed(opcodes.CJ, 0, 0, 2), bytecode[10:12], "a label at the end should follow the last two-byte instruction")
+}
+
+func TestCompressedOperandsMustFit(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"compact register", "c.lw x1, 0(x8)", "c.lw x1, 0(x8): x1 is not one of x8 to x15"},
+		{"x0", "c.addi x0, 1", "c.addi x0, 1: x0 is not allowed here"},
+		{"stack pointer", "c.lwsp x1, 4(x3)", "c.lwsp x1, 4(x3): base must be x2, not x3"},
+		{"lui into x2", "c.lui x2, 1", "c.lui x2, 1: x2 is not allowed here"},
+		{"range", "c.li x1, 32", "c.li x1, 32: 32 is out of range -32 to 31"},
+		{"upper range", "c.lui x1, 32", "c.lui x1, 32: 32 is out of range -32 to 31"},
+		{"scale", "c.lw x8, 6(x9)", "c.lw x8, 6(x9): 6 is not a multiple of 4"},
+		{"zero", "c.addi16sp 0", "c.addi16sp 0: the immediate must not be zero"},
+		{"branch range", "c.beqz x8, 256", "c.beqz x8, 256: 256 is out of range -256 to 254"},
+		{"operands", "c.add x1", "c.add x1: c.add takes 2 operands, not 1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAssembler().TryAssemble(tc.input)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestEnableCompressionPicksTheFormThatFits(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []int
+		message  string
+	}{
+		{"addi to itself", "addi x9, x9, 5", compressed(opcodes.CADDI, 9, 9, 5), "addi rd, rd should become c.addi"},
+		{"addi from x0", "addi x9, x0, 5", compressed(opcodes.CLI, 9, 0, 5), "addi from x0 should become c.li"},
+		{"nop", "addi x0, x0, 0", compressed(opcodes.CNOP, 0, 0, 0), "the canonical nop should become c.nop"},
+		{"add", "add x20, x20, x21", compressed(opcodes.CADD, 20, 20, 21), "add rd, rd should become c.add"},
+		{"sub", "sub x8, x8, x9", compressed(opcodes.CSUB, 8, 8, 9), "sub of compact registers should become c.sub"},
+		{"load", "lw x8, 4(x9)", compressed(opcodes.CLW, 8, 4, 9), "a load between compact registers should become c.lw"},
+		{"stack load", "lw x20, 4(x2)", compressed(opcodes.CLWSP, 20, 4, 2), "a load from x2 should become c.lwsp"},
+		{"return", "jalr x0, 0(x1)", compressed(opcodes.CJR, 0, 1, 0), "a return should become c.jr"},
+		{"li", "li x8, 0x12345001", append(append([]int{}, int(opcodes.LUI), 8, 0, 0x12345), compressed(opcodes.CADDI, 8, 8, 1)...), "li should compress what it expands to"},
+		{"addi to another", "addi x9, x8, 5", []int{int(opcodes.ADDI), 9, 8, 5}, "addi between two registers has no compressed form"},
+		{"sub of others", "sub x1, x1, x2", []int{int(opcodes.SUB), 1, 1, 2}, "c.sub only takes x8 to x15"},
+		{"big immediate", "addi x9, x9, 32", []int{int(opcodes.ADDI), 9, 9, 32}, "c.addi only takes six bits"},
+		{"misaligned load", "lw x8, 2(x9)", []int{int(opcodes.LW), 8, 2, 9}, "c.lw only takes multiples of four"},
+		{"float", "fadd.s f1, f2, f3", []int{int(opcodes.FADDS), 1, 2, 3}, "float instructions are never compressed"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			asm.EnableCompression()
+			bytecode, err := asm.TryAssemble(tc.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, bytecode, tc.message)
+		})
+	}
+}
+
+func TestEnableCompressionRelaxesBranches(t *testing.T) {
+	source := "beq x8, x0, end\n" + strings.Repeat("addi x9, x9, 1\n", 70) + "end:\nbne x8, x0, 0"
+	asm := NewAssembler()
+	asm.EnableCompression()
+
+	bytecode, err := asm.TryAssemble(source)
+
+	assert.NoError(t, err)
+	assert.Equal(t, compressed(opcodes.CBEQZ, 8, 0, 142), bytecode[:2], "the branch should fit once the instructions it skips have shrunk")
+	assert.Len(t, bytecode, 2+70*2+2)
+}
+
+func TestMeasureSizeReportsWhatCompressionSaved(t *testing.T) {
+	asm := NewAssembler()
+	asm.EnableCompression()
+	bytecode := asm.Assemble("addi x8, x0, 10\nloop:\naddi x8, x8, -1\nbne x8, x0, loop\naddi x1, x8, 100")
+
+	report := MeasureSize(bytecode)
+
+	assert.Equal(t, SizeReport{
+		Instructions: 4, Compressed: 3, Bytes: 10, Uncompressed: 16,
+		ByMnemonic: map[string]int{"c.li": 1, "c.addi": 1, "c.bnez": 1},
+	}, report)
+	assert.Equal(t, 6, report.Saved())
+	assert.Equal(t, "3 of 4 instructions compressed: 10 bytes instead of 16, 6 saved (37.5%)\n"+
+		"  c.addi      1\n  c.bnez      1\n  c.li        1\n", report.String())
+}
+
+func TestAssembleStackMode(t *testing.T) {
+	asm := NewAssembler()
+	asm.EnableStackMode()
+
+	bytecode, err := asm.TryAssemble("psh 0x12345678\nloop:\ndup\njz done\npsh -1\nadd\njmp loop\ndone:\ndrp")
+
+	expected := []int{
+		int(opcodes.PSH), 0, 0, 0x12345678,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.JZ), 0, 0, 16,
+		int(opcodes.PSH), 0, 0, -1,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.JMP), 0, 0, -16,
+		int(opcodes.DRP), 0, 0, 0,
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, expected, bytecode, "psh should take a whole 32-bit constant and jumps should resolve labels")
+}
+
+func TestStackModeRejectsTheOtherSet(t *testing.T) {
+	cases := []struct {
+		name     string
+		stack    bool
+		input    string
+		expected string
+	}{
+		{"register in stack mode", true, "addi x1, x0, 1", "addi x1, x0, 1: unknown instruction: addi"},
+		{"stack in register mode", false, "psh 1", "psh 1: unknown instruction: psh"},
+		{"operands on add", true, "add x1, x2, x3", "add x1, x2, x3: add takes 0 operands, not 3"},
+		{"psh range", true, "psh 0x100000000", "psh 0x100000000: psh needs a 32-bit constant: 0x100000000"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			asm := NewAssembler()
+			if tc.stack {
+				asm.EnableStackMode()
+			}
+			_, err := asm.TryAssemble(tc.input)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
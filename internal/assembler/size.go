@@ -0,0 +1,67 @@
+package assembler
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// SizeReport is how much of a program is made of compressed instructions and
+// how many bytes that saves over writing every one of them at full size.
+type SizeReport struct {
+	Instructions int            // instructions in the program
+	Compressed   int            // how many of them are 16-bit
+	Bytes        int            // the size of the program
+	Uncompressed int            // its size with every instruction 32-bit
+	ByMnemonic   map[string]int // how often each c. instruction appears
+}
+
+// MeasureSize reports on a RISC-V program, typically one assembled with
+// EnableCompression.
+func MeasureSize(byteCode []int) SizeReport {
+	r := SizeReport{ByMnemonic: map[string]int{}}
+	for ip := 0; ip < len(byteCode); {
+		info, _ := opcodes.ByOpCode(opcodes.OpCode(byteCode[ip]))
+		size := min(info.Size(), len(byteCode)-ip)
+		r.Instructions++
+		r.Bytes += size
+		r.Uncompressed += 4
+		if info.Is(opcodes.Compressed) {
+			r.Compressed++
+			r.ByMnemonic[info.Mnemonic]++
+		}
+		ip += size
+	}
+	return r
+}
+
+// Saved is how many bytes compression saved.
+func (r SizeReport) Saved() int {
+	return r.Uncompressed - r.Bytes
+}
+
+// String prints the totals, then each compressed instruction by how often it
+// appears.
+func (r SizeReport) String() string {
+	var out strings.Builder
+	percent := 0.0
+	if r.Uncompressed > 0 {
+		percent = 100 * float64(r.Saved()) / float64(r.Uncompressed)
+	}
+	fmt.Fprintf(&out, "%d of %d instructions compressed: %d bytes instead of %d, %d saved (%.1f%%)\n",
+		r.Compressed, r.Instructions, r.Bytes, r.Uncompressed, r.Saved(), percent)
+	mnemonics := slices.Collect(maps.Keys(r.ByMnemonic))
+	slices.SortFunc(mnemonics, func(a, b string) int {
+		if n := r.ByMnemonic[b] - r.ByMnemonic[a]; n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	for _, m := range mnemonics {
+		fmt.Fprintf(&out, "  %-11s %d\n", m, r.ByMnemonic[m])
+	}
+	return out.String()
+}
@@ -0,0 +1,156 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// bitCounts maps the counting instructions to their LZCNT, BMI1 and POPCNT
+// equivalents, which agree with RISC-V on a zero source: lzcnt and tzcnt
+// give 32, unlike bsr and bsf.
+var bitCounts = map[opcodes.OpCode]string{
+	opcodes.CLZ: "lzcntl", opcodes.CTZ: "tzcntl", opcodes.CPOP: "popcntl",
+}
+
+// bitExtends maps the byte and halfword extensions to the move that does
+// them.
+var bitExtends = map[opcodes.OpCode]string{
+	opcodes.SEXTB: "movsbq", opcodes.SEXTH: "movswq", opcodes.ZEXTH: "movzwq",
+}
+
+// rotates maps the rotations to the x86 ones, which take their count in %cl
+// or as an immediate and mask it to five bits.
+var rotates = map[opcodes.OpCode]string{
+	opcodes.ROL: "roll", opcodes.ROR: "rorl", opcodes.RORI: "rorl",
+}
+
+// bitTests maps the single-bit instructions to the bt that sets, clears,
+// inverts or only reads the bit, copying it to the carry flag.
+var bitTests = map[opcodes.OpCode]string{
+	opcodes.BSET: "btsl", opcodes.BSETI: "btsl",
+	opcodes.BCLR: "btrl", opcodes.BCLRI: "btrl",
+	opcodes.BINV: "btcl", opcodes.BINVI: "btcl",
+	opcodes.BEXT: "btl", opcodes.BEXTI: "btl",
+}
+
+// minMax maps MIN, MAX and their unsigned forms to the cmov that replaces
+// rs2 with rs1 when rs1 is the one to keep.
+var minMax = map[opcodes.OpCode]string{
+	opcodes.MIN: "cmovl", opcodes.MAX: "cmovg",
+	opcodes.MINU: "cmovb", opcodes.MAXU: "cmova",
+}
+
+// shiftAdds maps each SHnADD to the scale lea multiplies rs1 by.
+var shiftAdds = map[opcodes.OpCode]int{
+	opcodes.SH1ADD: 2, opcodes.SH2ADD: 4, opcodes.SH3ADD: 8,
+}
+
+// bitmanipOp lowers the Zba, Zbb and Zbs instructions.
+func (c *CodeGen) bitmanipOp(info opcodes.Info, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	if rd == "$0" {
+		return
+	}
+	if info.Format == opcodes.R2Type {
+		c.bitUnaryOp(info.Op, rd, rs1)
+		return
+	}
+	if scale, ok := shiftAdds[info.Op]; ok {
+		c.shiftAddOp(scale, rd, rs1, riscTox86Regs[inst[3]])
+		return
+	}
+	c.bitBinaryOp(info, rd, rs1, inst[3])
+}
+
+// bitUnaryOp lowers the instructions that work on rs1 alone. x0 has no
+// register to count or extend, so its result is worked out here instead.
+func (c *CodeGen) bitUnaryOp(op opcodes.OpCode, rd, rs string) {
+	if rs == "$0" {
+		value := 0
+		if op == opcodes.CLZ || op == opcodes.CTZ {
+			value = 32
+		}
+		c.emit(fmt.Sprintf("movq $%d, %s", value, rd))
+		return
+	}
+	if count, ok := bitCounts[op]; ok {
+		// The count is never negative, so writing the low word, which
+		// zero-extends, leaves rd sign-extended as well.
+		c.emit(fmt.Sprintf("%s %s, %s", count, x86Regs32[rs], x86Regs32[rd]))
+		return
+	}
+	source := x86Regs8[rs]
+	if op != opcodes.SEXTB {
+		source = x86Regs16[rs]
+	}
+	c.emit(fmt.Sprintf("%s %s, %s", bitExtends[op], source, rd))
+}
+
+// shiftAddOp lowers SHnADD to one lea, which reads both sources before it
+// writes rd. x0 drops out of the address.
+func (c *CodeGen) shiftAddOp(scale int, rd, rs1, rs2 string) {
+	switch {
+	case rs1 == "$0" && rs2 == "$0":
+		c.emit(fmt.Sprintf("movq $0, %s", rd))
+		return
+	case rs1 == "$0":
+		c.emit(fmt.Sprintf("movq %s, %s", rs2, rd))
+		return
+	case rs2 == "$0":
+		c.emit(fmt.Sprintf("leal 0(,%s,%d), %s", rs1, scale, x86Regs32[rd]))
+	default:
+		c.emit(fmt.Sprintf("leal (%s,%s,%d), %s", rs2, rs1, scale, x86Regs32[rd]))
+	}
+	c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+}
+
+// bitBinaryOp lowers the instructions that combine rs1 with rs2 or an
+// immediate. As in shiftOp, rs2 goes to %rcx, saved around the operation,
+// and the work is done on a copy of rs1 on the stack, so that any of the
+// registers may be x3 or x0 and rd may be either source. The bit
+// instructions take their bit number modulo 32 only on a register, so a
+// register bit number is masked first.
+func (c *CodeGen) bitBinaryOp(info opcodes.Info, rd, rs1 string, operand int) {
+	rs2, count, bit := riscTox86Regs[operand], "%cl", "%ecx"
+	if info.Format == opcodes.ShiftType {
+		rs2 = fmt.Sprintf("$%d", operand&31)
+		count, bit = rs2, rs2
+	}
+	c.emit("pushq %rcx")
+	c.emit(fmt.Sprintf("pushq %s", rs1))
+	c.emit(fmt.Sprintf("movq %s, %%rcx", rs2))
+	switch op := info.Op; {
+	case rotates[op] != "":
+		c.emit(fmt.Sprintf("%s %s, (%%rsp)", rotates[op], count))
+	case bitTests[op] != "":
+		if bit == "%ecx" {
+			c.emit("andl $31, %ecx")
+		}
+		c.emit(fmt.Sprintf("%s %s, (%%rsp)", bitTests[op], bit))
+		if op == opcodes.BEXT || op == opcodes.BEXTI {
+			c.emit("setc %cl")
+			c.emit("movzbl %cl, %ecx")
+			c.emit("movl %ecx, (%rsp)")
+		}
+	case minMax[op] != "":
+		c.emit("cmpl %ecx, (%rsp)")
+		c.emit(fmt.Sprintf("%s (%%rsp), %%ecx", minMax[op]))
+		c.emit("movl %ecx, (%rsp)")
+	case op == opcodes.ANDN:
+		c.emit("andnl (%rsp), %ecx, %ecx")
+		c.emit("movl %ecx, (%rsp)")
+	case op == opcodes.ORN:
+		c.emit("notl %ecx")
+		c.emit("orl %ecx, (%rsp)")
+	case op == opcodes.XNOR:
+		c.emit("xorl %ecx, (%rsp)")
+		c.emit("notl (%rsp)")
+	}
+	c.emit("movslq (%rsp), %rcx")
+	c.emit("movq %rcx, (%rsp)")
+	c.emit("movq 8(%rsp), %rcx")
+	c.emit(fmt.Sprintf("movq (%%rsp), %s", rd))
+	c.emit("addq $16, %rsp")
+}
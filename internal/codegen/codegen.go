@@ -28,19 +28,131 @@ const (
 	rip = "%rip"
 )
 
-var opCodeToX86Ops = map[opcodes.OpCode]string{
-	opcodes.ADD: "addq", opcodes.SUB: "subq",
-	opcodes.MUL: "imulq", opcodes.DIV: "idivq",
-	opcodes.BEQ: "cmpq", opcodes.BLT: "cmpq", opcodes.BNE: "cmpq", opcodes.BGE: "cmpq",
-	opcodes.JAL: "call", opcodes.JALR: "ret",
-	opcodes.MVQ: "movq",
+// lowerKind names the method that lowers an instruction.
+type lowerKind int
+
+const (
+	notLowered          lowerKind = iota // rejected, as native code has no CSRs or atomics
+	lowerArith                           // parseArithOp
+	lowerAddImmediate                    // addImmediateOp
+	lowerImmediate                       // immediateOp
+	lowerShift                           // shiftOp
+	lowerShiftImmediate                  // shiftImmediateOp
+	lowerMExtension                      // mExtensionOp
+	lowerSetLessThan                     // setLessThanOp
+	lowerUpperImmediate                  // upperImmediateOp
+	lowerLoad                            // loadOp
+	lowerStore                           // storeOp
+	lowerBranch                          // branchOp
+	lowerCall                            // callOp
+	lowerReturn                          // returnOp
+	lowerFloat                           // floatOp
+	lowerBitmanip                        // bitmanipOp
+	lowerRV64                            // rv64Op, in RV64 mode only
+)
+
+// lowering is how the code generator lowers one opcode: the method that does
+// it and, for the methods that emit an x86 instruction chosen by opcode, that
+// instruction. word is the 32-bit instruction that ADD, SUB and MUL are
+// lowered to on RV32, and jump the jump that takes a branch after a compare
+// of rs1 with rs2.
+type lowering struct {
+	kind            lowerKind
+	x86, word, jump string
 }
 
-var branchToJump = map[opcodes.OpCode]string{
-	opcodes.BEQ: "je",
-	opcodes.BLT: "jl",
-	opcodes.BNE: "jne",
-	opcodes.BGE: "jge",
+// lowerings has an entry for every opcode of opcodes.Table but the
+// compressed ones, which are lowered as the instructions they expand to.
+var lowerings = map[opcodes.OpCode]lowering{
+	opcodes.ADD: {kind: lowerArith, x86: "addq", word: "addl"},
+	opcodes.SUB: {kind: lowerArith, x86: "subq", word: "subl"},
+	opcodes.MUL: {kind: lowerArith, x86: "imulq", word: "imull"},
+	opcodes.AND: {kind: lowerArith, x86: "andq"},
+	opcodes.OR:  {kind: lowerArith, x86: "orq"},
+	opcodes.XOR: {kind: lowerArith, x86: "xorq"},
+
+	opcodes.MULH: {kind: lowerMExtension}, opcodes.MULHU: {kind: lowerMExtension},
+	opcodes.MULHSU: {kind: lowerMExtension}, opcodes.DIV: {kind: lowerMExtension},
+	opcodes.DIVU: {kind: lowerMExtension}, opcodes.REM: {kind: lowerMExtension},
+	opcodes.REMU: {kind: lowerMExtension},
+
+	opcodes.SLL: {kind: lowerShift, x86: "shll"},
+	opcodes.SRL: {kind: lowerShift, x86: "shrl"},
+	opcodes.SRA: {kind: lowerShift, x86: "sarl"},
+
+	opcodes.ADDI: {kind: lowerAddImmediate},
+	opcodes.ANDI: {kind: lowerImmediate, x86: "andq"},
+	opcodes.ORI:  {kind: lowerImmediate, x86: "orq"},
+	opcodes.XORI: {kind: lowerImmediate, x86: "xorq"},
+	opcodes.SLLI: {kind: lowerShiftImmediate, x86: "shll"},
+	opcodes.SRLI: {kind: lowerShiftImmediate, x86: "shrl"},
+	opcodes.SRAI: {kind: lowerShiftImmediate, x86: "sarl"},
+
+	opcodes.SLT: {kind: lowerSetLessThan}, opcodes.SLTU: {kind: lowerSetLessThan},
+	opcodes.SLTI: {kind: lowerSetLessThan}, opcodes.SLTIU: {kind: lowerSetLessThan},
+	opcodes.LUI: {kind: lowerUpperImmediate}, opcodes.AUIPC: {kind: lowerUpperImmediate},
+
+	opcodes.CLZ: {kind: lowerBitmanip}, opcodes.CTZ: {kind: lowerBitmanip}, opcodes.CPOP: {kind: lowerBitmanip},
+	opcodes.MIN: {kind: lowerBitmanip}, opcodes.MAX: {kind: lowerBitmanip},
+	opcodes.MINU: {kind: lowerBitmanip}, opcodes.MAXU: {kind: lowerBitmanip},
+	opcodes.ROL: {kind: lowerBitmanip}, opcodes.ROR: {kind: lowerBitmanip}, opcodes.RORI: {kind: lowerBitmanip},
+	opcodes.ANDN: {kind: lowerBitmanip}, opcodes.ORN: {kind: lowerBitmanip}, opcodes.XNOR: {kind: lowerBitmanip},
+	opcodes.SEXTB: {kind: lowerBitmanip}, opcodes.SEXTH: {kind: lowerBitmanip}, opcodes.ZEXTH: {kind: lowerBitmanip},
+	opcodes.SH1ADD: {kind: lowerBitmanip}, opcodes.SH2ADD: {kind: lowerBitmanip}, opcodes.SH3ADD: {kind: lowerBitmanip},
+	opcodes.BSET: {kind: lowerBitmanip}, opcodes.BCLR: {kind: lowerBitmanip},
+	opcodes.BINV: {kind: lowerBitmanip}, opcodes.BEXT: {kind: lowerBitmanip},
+	opcodes.BSETI: {kind: lowerBitmanip}, opcodes.BCLRI: {kind: lowerBitmanip},
+	opcodes.BINVI: {kind: lowerBitmanip}, opcodes.BEXTI: {kind: lowerBitmanip},
+
+	opcodes.LW: {kind: lowerLoad}, opcodes.LB: {kind: lowerLoad}, opcodes.LBU: {kind: lowerLoad},
+	opcodes.LH: {kind: lowerLoad}, opcodes.LHU: {kind: lowerLoad},
+	opcodes.SW: {kind: lowerStore}, opcodes.SB: {kind: lowerStore}, opcodes.SH: {kind: lowerStore},
+
+	opcodes.BEQ: {kind: lowerBranch, jump: "je"},
+	opcodes.BNE: {kind: lowerBranch, jump: "jne"},
+	opcodes.BLT: {kind: lowerBranch, jump: "jl"},
+	opcodes.BGE: {kind: lowerBranch, jump: "jge"},
+	// Registers hold 32-bit values sign-extended to 64 bits, which keeps their
+	// unsigned order, so the unsigned jumps work on the whole register.
+	opcodes.BLTU: {kind: lowerBranch, jump: "jb"},
+	opcodes.BGEU: {kind: lowerBranch, jump: "jae"},
+	opcodes.JAL:  {kind: lowerCall, x86: "call"},
+	opcodes.JALR: {kind: lowerReturn, x86: "ret"},
+
+	opcodes.LRW: {}, opcodes.SCW: {}, opcodes.AMOSWAPW: {}, opcodes.AMOADDW: {}, opcodes.AMOXORW: {},
+	opcodes.AMOANDW: {}, opcodes.AMOORW: {}, opcodes.AMOMINW: {}, opcodes.AMOMAXW: {},
+	opcodes.AMOMINUW: {}, opcodes.AMOMAXUW: {},
+	opcodes.CSRRW: {}, opcodes.CSRRS: {}, opcodes.CSRRC: {},
+	opcodes.CSRRWI: {}, opcodes.CSRRSI: {}, opcodes.CSRRCI: {}, opcodes.MRET: {},
+
+	opcodes.FLW: {kind: lowerFloat}, opcodes.FSW: {kind: lowerFloat},
+	opcodes.FADDS: {kind: lowerFloat}, opcodes.FSUBS: {kind: lowerFloat},
+	opcodes.FMULS: {kind: lowerFloat}, opcodes.FDIVS: {kind: lowerFloat},
+	opcodes.FSQRTS: {kind: lowerFloat}, opcodes.FMINS: {kind: lowerFloat}, opcodes.FMAXS: {kind: lowerFloat},
+	opcodes.FSGNJS: {kind: lowerFloat}, opcodes.FSGNJNS: {kind: lowerFloat}, opcodes.FSGNJXS: {kind: lowerFloat},
+	opcodes.FCVTWS: {kind: lowerFloat}, opcodes.FCVTWUS: {kind: lowerFloat},
+	opcodes.FCVTSW: {kind: lowerFloat}, opcodes.FCVTSWU: {kind: lowerFloat},
+	opcodes.FEQS: {kind: lowerFloat}, opcodes.FLTS: {kind: lowerFloat}, opcodes.FLES: {kind: lowerFloat},
+	opcodes.FMVXW: {kind: lowerFloat}, opcodes.FMVWX: {kind: lowerFloat}, opcodes.FCLASSS: {kind: lowerFloat},
+
+	opcodes.FLD: {kind: lowerFloat}, opcodes.FSD: {kind: lowerFloat},
+	opcodes.FADDD: {kind: lowerFloat}, opcodes.FSUBD: {kind: lowerFloat},
+	opcodes.FMULD: {kind: lowerFloat}, opcodes.FDIVD: {kind: lowerFloat},
+	opcodes.FSQRTD: {kind: lowerFloat}, opcodes.FMIND: {kind: lowerFloat}, opcodes.FMAXD: {kind: lowerFloat},
+	opcodes.FSGNJD: {kind: lowerFloat}, opcodes.FSGNJND: {kind: lowerFloat}, opcodes.FSGNJXD: {kind: lowerFloat},
+	opcodes.FCVTWD: {kind: lowerFloat}, opcodes.FCVTWUD: {kind: lowerFloat},
+	opcodes.FCVTDW: {kind: lowerFloat}, opcodes.FCVTDWU: {kind: lowerFloat},
+	opcodes.FCVTSD: {kind: lowerFloat}, opcodes.FCVTDS: {kind: lowerFloat},
+	opcodes.FEQD: {kind: lowerFloat}, opcodes.FLTD: {kind: lowerFloat}, opcodes.FLED: {kind: lowerFloat},
+	opcodes.FCLASSD: {kind: lowerFloat},
+
+	opcodes.LD: {kind: lowerRV64}, opcodes.LWU: {kind: lowerRV64}, opcodes.SD: {kind: lowerRV64},
+	opcodes.ADDIW: {kind: lowerRV64}, opcodes.SLLIW: {kind: lowerRV64},
+	opcodes.SRLIW: {kind: lowerRV64}, opcodes.SRAIW: {kind: lowerRV64},
+	opcodes.ADDW: {kind: lowerRV64}, opcodes.SUBW: {kind: lowerRV64}, opcodes.SLLW: {kind: lowerRV64},
+	opcodes.SRLW: {kind: lowerRV64}, opcodes.SRAW: {kind: lowerRV64}, opcodes.MULW: {kind: lowerRV64},
+	opcodes.DIVW: {kind: lowerRV64}, opcodes.DIVUW: {kind: lowerRV64},
+	opcodes.REMW: {kind: lowerRV64}, opcodes.REMUW: {kind: lowerRV64},
 }
 
 var riscTox86Regs = map[int]string{
@@ -50,19 +162,98 @@ var riscTox86Regs = map[int]string{
 	11: r12, 12: r13, 13: r14, 14: r15, 15: rbp,
 }
 
+// x86Regs32, x86Regs16 and x86Regs8 name the low 32, 16 and 8 bits of each
+// register, for the instructions that must ignore the upper bits, such as
+// shifts and compares, or that only write the low ones, such as setcc and
+// sub-word stores. x0 stays the constant zero at every width.
+var x86Regs32 = map[string]string{
+	rax: "%eax", rbx: "%ebx", rcx: "%ecx", rdx: "%edx", rsi: "%esi",
+	rdi: "%edi", r8: "%r8d", r9: "%r9d", r10: "%r10d", r11: "%r11d",
+	r12: "%r12d", r13: "%r13d", r14: "%r14d", r15: "%r15d", rbp: "%ebp",
+	"$0": "$0",
+}
+
+// x86Regs64 names each register whole, for the lowerings that choose between
+// it and x86Regs32 by XLEN.
+var x86Regs64 = map[string]string{
+	rax: rax, rbx: rbx, rcx: rcx, rdx: rdx, rsi: rsi,
+	rdi: rdi, r8: r8, r9: r9, r10: r10, r11: r11,
+	r12: r12, r13: r13, r14: r14, r15: r15, rbp: rbp,
+	"$0": "$0",
+}
+
+var x86Regs16 = map[string]string{
+	rax: "%ax", rbx: "%bx", rcx: "%cx", rdx: "%dx", rsi: "%si",
+	rdi: "%di", r8: "%r8w", r9: "%r9w", r10: "%r10w", r11: "%r11w",
+	r12: "%r12w", r13: "%r13w", r14: "%r14w", r15: "%r15w", rbp: "%bp",
+	"$0": "$0",
+}
+
+var x86Regs8 = map[string]string{
+	rax: "%al", rbx: "%bl", rcx: "%cl", rdx: "%dl", rsi: "%sil",
+	rdi: "%dil", r8: "%r8b", r9: "%r9b", r10: "%r10b", r11: "%r11b",
+	r12: "%r12b", r13: "%r13b", r14: "%r14b", r15: "%r15b", rbp: "%bpl",
+	"$0": "$0",
+}
+
+// loads maps each load to the move that extends it to all of rd.
+var loads = map[opcodes.OpCode]string{
+	opcodes.LB: "movsbq", opcodes.LBU: "movzbq",
+	opcodes.LH: "movswq", opcodes.LHU: "movzwq",
+	opcodes.LW: "movslq",
+}
+
+// loadWidths gives the suffix for the width each load reads, for reading
+// memory without keeping the value when rd is x0.
+var loadWidths = map[opcodes.OpCode]string{
+	opcodes.LB: "b", opcodes.LBU: "b",
+	opcodes.LH: "w", opcodes.LHU: "w",
+	opcodes.LW: "l", opcodes.LWU: "l", opcodes.LD: "q",
+}
+
+// setLessThan maps each set-less-than instruction to the setcc that reads
+// its result from the flags, and to the one for the operands swapped.
+var setLessThan = map[opcodes.OpCode][2]string{
+	opcodes.SLT: {"setl", "setg"}, opcodes.SLTI: {"setl", "setg"},
+	opcodes.SLTU: {"setb", "seta"}, opcodes.SLTIU: {"setb", "seta"},
+}
+
 type CodeGen struct {
 	assembler    strings.Builder
 	traceEnabled bool
+	stackMode    bool
+	rv64         bool
+	set          *opcodes.Set
+	// spillEnd is one past the highest spilled register the program uses,
+	// and floatSpillEnd the same for float registers.
+	spillEnd      int
+	floatSpillEnd int
+	// allocateRegisters turns on linear-scan allocation, and allocation
+	// holds its result for the program being generated.
+	allocateRegisters bool
+	allocation        allocation
+	// err is the first instruction found that native code cannot run.
+	// Lowering stops there and Generate returns it.
+	err error
 }
 
 func NewCodeGen() *CodeGen {
 	cg := &CodeGen{
 		traceEnabled: false,
+		set:          opcodes.RegisterSet,
 	}
 	cg.prependStart()
 	return cg
 }
 
+// unsupported records that the program has an instruction, or a use of one,
+// that the code generator has no lowering for. Only the first is kept.
+func (c *CodeGen) unsupported(format string, args ...any) {
+	if c.err == nil {
+		c.err = fmt.Errorf(format, args...)
+	}
+}
+
 func (c *CodeGen) emit(s string) {
 	c.assembler.WriteString(s + "\n")
 }
@@ -79,42 +270,300 @@ func (c *CodeGen) trace(format string, args ...any) {
 	}
 }
 
-func (c *CodeGen) parseArithOp(op opcodes.OpCode, bytecode []int, ip int) int {
-	rd := riscTox86Regs[bytecode[ip+1]]
-	rs1 := riscTox86Regs[bytecode[ip+2]]
-	rs2 := riscTox86Regs[bytecode[ip+3]]
-	if op == opcodes.DIV || op == opcodes.MOD {
-		resultReg := rax
-		if op == opcodes.MOD {
-			resultReg = rdx
+// parseArithOp lowers the register-register arithmetic and logic. On RV32,
+// ADD, SUB and MUL work on the low words and sign-extend their result back
+// over rd, so they wrap at 32 bits as in the VM; AND, OR and XOR of
+// sign-extended values are sign-extended already.
+func (c *CodeGen) parseArithOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	rs2 := riscTox86Regs[inst[3]]
+	operation, add, negate, word := lowerings[op].x86, lowerings[opcodes.ADD].x86, "negq", x86Regs64
+	extend := lowerings[op].word != "" && !c.rv64
+	if extend {
+		operation, add, negate, word = lowerings[op].word, lowerings[opcodes.ADD].word, "negl", x86Regs32
+	}
+	switch rd {
+	case rs1:
+		c.emit(fmt.Sprintf("%s %s, %s", operation, word[rs2], word[rd]))
+	case rs2:
+		if op == opcodes.SUB {
+			// rd holds rs2, so rs1 - rs2 is -rs2 + rs1.
+			c.emit(fmt.Sprintf("%s %s", negate, word[rd]))
+			c.emit(fmt.Sprintf("%s %s, %s", add, word[rs1], word[rd]))
+		} else {
+			c.emit(fmt.Sprintf("%s %s, %s", operation, word[rs1], word[rd]))
+		}
+	default:
+		c.emit(fmt.Sprintf("movq %s, %s", rs1, rd))
+		c.emit(fmt.Sprintf("%s %s, %s", operation, word[rs2], word[rd]))
+	}
+	if extend {
+		c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+	}
+}
+
+// addImmediateOp lowers ADDI, and so li and mv. On RV32 the sum is taken of
+// the low word and sign-extended, and a constant is truncated to a word
+// first, as the VM does.
+func (c *CodeGen) addImmediateOp(inst [4]int) {
+	rd := riscTox86Regs[inst[1]]
+	rs := riscTox86Regs[inst[2]]
+	imm := inst[3]
+	if rs == "$0" {
+		if !c.rv64 {
+			imm = int(int32(imm))
 		}
-		if rs1 == rax {
-			c.emit("cqto")
-			c.emit(fmt.Sprintf("idivq %s", rs2))
-			c.emit(fmt.Sprintf("movq %s, %s", resultReg, rd))
-		} else if rs1 != rax && rs2 != rax {
-			c.emit(fmt.Sprintf("movq %s, %s", rs1, rax))
-			c.emit("cqto")
-			c.emit(fmt.Sprintf("idivq %s", rs2))
-			c.emit(fmt.Sprintf("movq %s, %s", resultReg, rd))
-		} else if rs1 != rax && rs2 == rax {
-			c.emit(fmt.Sprintf("xchgq %s, %s", rs1, rs2))
-			c.emit("cqto")
-			c.emit(fmt.Sprintf("idivq %s", rs1))
-			c.emit(fmt.Sprintf("movq %s, %s", resultReg, rd))
+		c.emit(fmt.Sprintf("movq $%d, %s", imm, rd))
+		return
+	}
+	if rd != rs {
+		c.emit(fmt.Sprintf("movq %s, %s", rs, rd))
+	}
+	switch {
+	case imm == 0:
+	case c.rv64:
+		c.emit(fmt.Sprintf("addq $%d, %s", imm, rd))
+	default:
+		c.emit(fmt.Sprintf("addl $%d, %s", imm, x86Regs32[rd]))
+		c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+	}
+}
+
+// immediateOp lowers the logic instructions that take an immediate.
+func (c *CodeGen) immediateOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	rs := riscTox86Regs[inst[2]]
+	imm := inst[3]
+	if rd == "$0" {
+		return
+	}
+	if rd != rs {
+		c.emit(fmt.Sprintf("movq %s, %s", rs, rd))
+	}
+	c.emit(fmt.Sprintf("%s $%d, %s", lowerings[op].x86, imm, rd))
+}
+
+// shiftImmediateOp lowers the shifts by a constant. The shift works on the
+// low word, as on RV32, and the result is sign-extended back to 64 bits.
+func (c *CodeGen) shiftImmediateOp(op opcodes.OpCode, inst [4]int, ip int) {
+	c.immediateShift(lowerings[op].x86, inst[3]&31, true, inst)
+}
+
+// immediateShift shifts rs by shamt into rd with the given shift, and
+// sign-extends the low word of the result when extend is set.
+func (c *CodeGen) immediateShift(shift string, shamt int, extend bool, inst [4]int) {
+	rd := riscTox86Regs[inst[1]]
+	rs := riscTox86Regs[inst[2]]
+	if rd == "$0" {
+		return
+	}
+	if rd != rs {
+		c.emit(fmt.Sprintf("movq %s, %s", rs, rd))
+	}
+	if !extend {
+		c.emit(fmt.Sprintf("%s $%d, %s", shift, shamt, rd))
+		return
+	}
+	c.emit(fmt.Sprintf("%s $%d, %s", shift, shamt, x86Regs32[rd]))
+	c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+}
+
+// shiftOp lowers the shifts by a register, which x86 only takes in %cl. rcx
+// holds x3, so it is saved around the shift, and rs1 is shifted on the stack
+// so that any of rd, rs1 and rs2 may be x3. x86 masks a 32-bit shift count to
+// five bits exactly as RV32 does.
+func (c *CodeGen) shiftOp(op opcodes.OpCode, inst [4]int, ip int) {
+	c.registerShift(lowerings[op].x86, true, inst)
+}
+
+// registerShift shifts rs1 by rs2 into rd with the given shift, as shiftOp
+// describes, and sign-extends the low word of the result when extend is set.
+// x86 masks the count of a quadword shift to six bits, as RV64 does.
+func (c *CodeGen) registerShift(shift string, extend bool, inst [4]int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	rs2 := riscTox86Regs[inst[3]]
+	if rd == "$0" {
+		return
+	}
+	c.emit("pushq %rcx")
+	c.emit(fmt.Sprintf("pushq %s", rs1))
+	c.emit(fmt.Sprintf("movq %s, %%rcx", rs2))
+	c.emit(fmt.Sprintf("%s %%cl, (%%rsp)", shift))
+	if extend {
+		c.emit("movslq (%rsp), %rcx")
+		c.emit("movq %rcx, (%rsp)")
+	}
+	c.emit("movq 8(%rsp), %rcx")
+	c.emit(fmt.Sprintf("movq (%%rsp), %s", rd))
+	c.emit("addq $16, %rsp")
+}
+
+// setLessThanOp lowers the set-less-than instructions to a compare of XLEN
+// bits and a setcc into the low byte of rd, zero-extended over the rest of it. The
+// compare comes first, so rd may be one of the operands. cmp cannot take an
+// immediate as its second operand, so x0 as rs1 is compared the other way
+// round, or folded away against an immediate.
+func (c *CodeGen) setLessThanOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	if rd == "$0" {
+		return
+	}
+	set := setLessThan[op]
+	cmp, word := "cmpl", x86Regs32
+	if c.rv64 {
+		cmp, word = "cmpq", x86Regs64
+	}
+	switch {
+	case op == opcodes.SLTI || op == opcodes.SLTIU:
+		imm := inst[3]
+		if rs1 == "$0" {
+			less := 0 < imm
+			if op == opcodes.SLTIU {
+				less = int32(imm) != 0
+			}
+			c.setConstant(rd, less)
+			return
 		}
-	} else {
-		switch rd {
-		case rs1:
-			c.emit(fmt.Sprintf("%s %s, %s", opCodeToX86Ops[op], rs2, rd))
-		case rs2:
-			c.emit(fmt.Sprintf("%s %s, %s", opCodeToX86Ops[op], rs1, rd))
-		default:
-			c.emit(fmt.Sprintf("%s %s, %s", opCodeToX86Ops[opcodes.MVQ], rs1, rd))
-			c.emit(fmt.Sprintf("%s %s, %s", opCodeToX86Ops[op], rs2, rd))
+		c.emit(fmt.Sprintf("%s $%d, %s", cmp, imm, word[rs1]))
+		c.emit(fmt.Sprintf("%s %s", set[0], x86Regs8[rd]))
+	case rs1 == "$0":
+		rs2 := riscTox86Regs[inst[3]]
+		if rs2 == "$0" {
+			c.setConstant(rd, false)
+			return
 		}
+		c.emit(fmt.Sprintf("%s $0, %s", cmp, word[rs2]))
+		c.emit(fmt.Sprintf("%s %s", set[1], x86Regs8[rd]))
+	default:
+		rs2 := riscTox86Regs[inst[3]]
+		c.emit(fmt.Sprintf("%s %s, %s", cmp, word[rs2], word[rs1]))
+		c.emit(fmt.Sprintf("%s %s", set[0], x86Regs8[rd]))
+	}
+	c.emit(fmt.Sprintf("movzbq %s, %s", x86Regs8[rd], rd))
+}
+
+func (c *CodeGen) setConstant(rd string, less bool) {
+	value := 0
+	if less {
+		value = 1
 	}
-	return ip + 4
+	c.emit(fmt.Sprintf("movq $%d, %s", value, rd))
+}
+
+// upperImmediateOp lowers LUI and AUIPC, whose results are both known at
+// compile time: an address is a bytecode offset, in native code as in the VM.
+// AUIPC wraps at 32 bits only on RV32.
+func (c *CodeGen) upperImmediateOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	value := int64(int32(uint32(inst[3]) << 12))
+	if op == opcodes.AUIPC {
+		value += int64(ip)
+		if !c.rv64 {
+			value = int64(int32(value))
+		}
+	}
+	if rd != "$0" {
+		c.emit(fmt.Sprintf("movq $%d, %s", value, rd))
+	}
+}
+
+// memoryOperand addresses offset bytes past base in the data area. The area
+// is linked at a fixed address below 2GiB, so its address can serve as the
+// displacement from a base register.
+func memoryOperand(base string, offset int) string {
+	if base == "$0" {
+		return fmt.Sprintf("mem+%d(%s)", offset, rip)
+	}
+	return fmt.Sprintf("mem+%d(%s)", offset, base)
+}
+
+// loadOp lowers the loads to a move from base + offset that sign- or
+// zero-extends into all of rd.
+func (c *CodeGen) loadOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	offset := inst[2]
+	base := riscTox86Regs[inst[3]]
+	if rd == "$0" {
+		c.discardLoad(op, memoryOperand(base, offset))
+		return
+	}
+	c.emit(fmt.Sprintf("%s %s, %s", loads[op], memoryOperand(base, offset), rd))
+}
+
+// discardLoad reads source for a load into x0 without writing any register:
+// the value is dropped but the access, and any fault it raises, is kept. A
+// compare changes only the flags, which no instruction carries over to the
+// next.
+func (c *CodeGen) discardLoad(op opcodes.OpCode, source string) {
+	c.emit(fmt.Sprintf("cmp%s $0, %s", loadWidths[op], source))
+}
+
+// storeOp lowers the stores to a move of the low byte, halfword or word of
+// rs2 to base + offset.
+func (c *CodeGen) storeOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rs2 := riscTox86Regs[inst[1]]
+	offset := inst[2]
+	base := riscTox86Regs[inst[3]]
+	move, value := "movl", x86Regs32[rs2]
+	switch op {
+	case opcodes.SB:
+		move, value = "movb", x86Regs8[rs2]
+	case opcodes.SH:
+		move, value = "movw", x86Regs16[rs2]
+	}
+	c.emit(fmt.Sprintf("%s %s, %s", move, value, memoryOperand(base, offset)))
+}
+
+// mExtensionOp lowers the high multiplies and the divisions, which all need
+// fixed registers: rax and rdx are saved around the operation and rs2 is
+// read from the stack, so any of rd, rs1 and rs2 may be rax or rdx. The
+// divisions are guarded by divide, so they never fault. Results are
+// sign-extended from 32 bits, the way every register is held.
+func (c *CodeGen) mExtensionOp(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	rs2 := riscTox86Regs[inst[3]]
+	c.emit("pushq %rax")
+	c.emit("pushq %rdx")
+	c.emit(fmt.Sprintf("pushq %s", rs2))
+	c.emit(fmt.Sprintf("movq %s, %%rax", rs1))
+	result := "%eax"
+	switch op {
+	case opcodes.MULH:
+		c.emit("imull (%rsp)")
+		result = "%edx"
+	case opcodes.MULHU:
+		c.emit("mull (%rsp)")
+		result = "%edx"
+	case opcodes.MULHSU:
+		// x86 has no mixed-sign multiply, but a signed 32-bit value times an
+		// unsigned one always fits in a signed 64-bit product.
+		c.emit("movslq %eax, %rax")
+		c.emit("movl (%rsp), %edx")
+		c.emit("imulq %rdx, %rax")
+		c.emit("sarq $32, %rax")
+	case opcodes.DIV, opcodes.MOD, opcodes.DIVU, opcodes.REMU:
+		if op == opcodes.MOD || op == opcodes.REMU {
+			result = "%edx"
+		}
+		c.divide(wordWidth, op == opcodes.DIV || op == opcodes.MOD, ip)
+	}
+	c.emit(fmt.Sprintf("movslq %s, %%rax", result))
+	c.emit("movq %rax, (%rsp)")
+	c.emit("movq 8(%rsp), %rdx")
+	c.emit("movq 16(%rsp), %rax")
+	if rd != "$0" {
+		c.emit(fmt.Sprintf("movq (%%rsp), %s", rd))
+	}
+	c.emit("addq $24, %rsp")
+}
+
+// localLabel names a label private to the lowering of the instruction at ip.
+func (c *CodeGen) localLabel(ip int, name string) string {
+	return fmt.Sprintf(".L%s%d", name, ip)
 }
 
 func (c *CodeGen) insertJumpLabel(branches map[int]string, functions map[int]string, ip int) {
@@ -125,77 +574,40 @@ func (c *CodeGen) insertJumpLabel(branches map[int]string, functions map[int]str
 	}
 }
 
-func (c *CodeGen) Generate(bytecode []int) string {
+// Generate returns the assembly for the program, or an error naming the
+// first instruction in it that native code cannot run.
+func (c *CodeGen) Generate(bytecode []int) (string, error) {
+	if c.stackMode {
+		return c.generateStack(bytecode)
+	}
 	branches := c.findBranches(bytecode)
 	functions := c.findFunctions(bytecode)
-	for ip := 0; ip < len(bytecode); {
+	if c.allocateRegisters {
+		c.allocation = c.allocate(bytecode)
+		c.trace("registers: %v\n", c.allocation)
+	}
+	for i, ip, next := 0, 0, 0; ip < len(bytecode); i, ip = i+1, next {
 		c.insertJumpLabel(branches, functions, ip)
 		if functions[ip] != "" {
 			c.emit("movq %rsp, %rbp")
 		}
-		token := bytecode[ip]
-		switch token {
-		case int(opcodes.ADDI):
-			rd := riscTox86Regs[bytecode[ip+1]]
-			rs := riscTox86Regs[bytecode[ip+2]]
-			imm := bytecode[ip+3]
-			if rs == "$0" {
-				c.emit(fmt.Sprintf("movq $%d, %s", imm, rd))
-			} else {
-				c.emit(fmt.Sprintf("movq %s, %s", rs, rd))
-				if imm != 0 {
-					c.emit(fmt.Sprintf("addq $%d, %s", imm, rd))
-				}
-			}
-			ip += 4
-		case int(opcodes.ADD):
-			ip = c.parseArithOp(opcodes.ADD, bytecode, ip)
-		case int(opcodes.SUB):
-			ip = c.parseArithOp(opcodes.SUB, bytecode, ip)
-		case int(opcodes.MUL):
-			ip = c.parseArithOp(opcodes.MUL, bytecode, ip)
-		case int(opcodes.DIV):
-			ip = c.parseArithOp(opcodes.DIV, bytecode, ip)
-		case int(opcodes.MOD):
-			ip = c.parseArithOp(opcodes.MOD, bytecode, ip)
-		case int(opcodes.BEQ):
-			ip = c.branchOp(opcodes.BEQ, branches, ip, bytecode)
-		case int(opcodes.BLT):
-			ip = c.branchOp(opcodes.BLT, branches, ip, bytecode)
-		case int(opcodes.BNE):
-			ip = c.branchOp(opcodes.BNE, branches, ip, bytecode)
-		case int(opcodes.BGE):
-			ip = c.branchOp(opcodes.BGE, branches, ip, bytecode)
-		case int(opcodes.SW):
-			rs1 := riscTox86Regs[bytecode[ip+1]]
-			offset := bytecode[ip+2]
-			c.emit(fmt.Sprintf("%s %s, mem+%d(%s)", opCodeToX86Ops[opcodes.MVQ], rs1, offset, rip))
-			ip += 4
-		case int(opcodes.LW):
-			rd := riscTox86Regs[bytecode[ip+1]]
-			offset := bytecode[ip+2]
-			c.emit(fmt.Sprintf("%s mem+%d(%s), %s", opCodeToX86Ops[opcodes.MVQ], offset, rip, rd))
-			ip += 4
-		case int(opcodes.JAL):
-			offset := bytecode[ip+3]
-			label := fmt.Sprintf("L%d", ip+offset)
-			branches[ip+offset] = label
-			c.emit(fmt.Sprintf("%s %s", opCodeToX86Ops[opcodes.JAL], label))
-			if !strings.Contains(c.assembler.String(), "{{{syscall}}}") {
-				c.emit("{{{syscall}}}")
-			}
-			ip += 4
-		case int(opcodes.JALR):
-			rd := bytecode[ip+1]
-			if rd != 0 {
-				panic("JALR with rd != 0 not supported in x86-64 codegen (only return pattern supported)")
-			}
-			if functions[ip] != "" {
-				c.emit("movq %rbp, %rsp")
-				c.emit("popq %rbp")
-			}
-			c.emit(opCodeToX86Ops[opcodes.JALR])
-			ip += 4
+		inst, size, whole := c.set.Fetch(bytecode, ip)
+		next = ip + size
+		token := inst[0]
+		info, known := c.set.ByOpCode(opcodes.OpCode(token))
+		if known && !whole {
+			return "", fmt.Errorf("%s at ip %d is cut short by the end of the bytecode", info.Mnemonic, ip)
+		}
+		if c.allocation != nil {
+			inst = c.allocation.rename(i, info, inst)
+		}
+		if c.spills(info, inst) {
+			c.spillOp(info, inst, ip, branches, functions)
+		} else {
+			c.lower(info, known, inst, ip, branches, functions)
+		}
+		if c.err != nil {
+			return "", c.err
 		}
 	}
 
@@ -203,48 +615,160 @@ func (c *CodeGen) Generate(bytecode []int) string {
 	if !strings.Contains(c.assembler.String(), "{{{syscall}}}") {
 		c.emit("{{{syscall}}}")
 	}
+	c.appendSpillArea()
 	asm := c.appendExit()
 	c.trace("asm:\n%s\n", asm)
-	return asm
+	return asm, nil
 }
 
-func (c *CodeGen) branchOp(op opcodes.OpCode, branches map[int]string, ip int, bytecode []int) int {
-	rs1 := bytecode[ip+1]
-	rs2 := bytecode[ip+2]
-	offset := bytecode[ip+3]
+// lower emits the code for one instruction, with the method its entry in
+// lowerings names.
+func (c *CodeGen) lower(info opcodes.Info, known bool, inst [4]int, ip int, branches, functions map[int]string) {
+	l := lowerings[info.Op]
+	if !known {
+		c.unsupported("unknown opcode %d at ip %d", inst[0], ip)
+		return
+	}
+	if l.kind == lowerBranch {
+		c.branchOp(info.Op, branches, inst, ip)
+		return
+	}
+	if c.rv64 && c.rv64Op(info, inst, ip) {
+		return
+	}
+	if inst[1] == 0 && discardsResult(info) {
+		return
+	}
+	switch op := info.Op; l.kind {
+	case lowerFloat:
+		c.floatOp(info, inst, ip)
+	case lowerBitmanip:
+		c.bitmanipOp(info, inst, ip)
+	case lowerAddImmediate:
+		c.addImmediateOp(inst)
+	case lowerArith:
+		c.parseArithOp(op, inst, ip)
+	case lowerMExtension:
+		c.mExtensionOp(op, inst, ip)
+	case lowerShift:
+		c.shiftOp(op, inst, ip)
+	case lowerImmediate:
+		c.immediateOp(op, inst, ip)
+	case lowerShiftImmediate:
+		c.shiftImmediateOp(op, inst, ip)
+	case lowerSetLessThan:
+		c.setLessThanOp(op, inst, ip)
+	case lowerUpperImmediate:
+		c.upperImmediateOp(op, inst, ip)
+	case lowerLoad:
+		c.loadOp(op, inst, ip)
+	case lowerStore:
+		c.storeOp(op, inst, ip)
+	case lowerCall:
+		c.callOp(op, inst, ip, branches)
+	case lowerReturn:
+		c.returnOp(op, inst, ip, functions)
+	default:
+		if name, ok := floatCSRs[opcodes.CSR(inst[2])]; ok && (info.Format == opcodes.CSRType || info.Format == opcodes.CSRIType) {
+			c.unsupported("%s of %s at ip %d is not supported in x86-64 codegen: native code keeps no float flags or rounding mode",
+				info.Mnemonic, name, ip)
+			return
+		}
+		c.unsupported("%s is not supported in x86-64 codegen", info.Mnemonic)
+	}
+}
+
+// floatCSRs are the CSRs native code has nothing behind, by name.
+var floatCSRs = map[opcodes.CSR]string{opcodes.FFLAGS: "fflags", opcodes.FRM: "frm", opcodes.FCSR: "fcsr"}
+
+// callOp lowers JAL to a call of the function at its target, followed by the
+// program's exit if no instruction has placed it yet.
+func (c *CodeGen) callOp(op opcodes.OpCode, inst [4]int, ip int, branches map[int]string) {
+	offset := inst[3]
+	label := fmt.Sprintf("L%d", ip+offset)
+	branches[ip+offset] = label
+	c.emit(fmt.Sprintf("%s %s", lowerings[op].x86, label))
+	if !strings.Contains(c.assembler.String(), "{{{syscall}}}") {
+		c.emit("{{{syscall}}}")
+	}
+}
+
+// returnOp lowers JALR to a return, tearing down the frame of a function
+// that returns from its first instruction.
+func (c *CodeGen) returnOp(op opcodes.OpCode, inst [4]int, ip int, functions map[int]string) {
+	rd := inst[1]
+	if rd != 0 {
+		c.unsupported("jalr with rd != 0 at ip %d is not supported in x86-64 codegen (only return pattern supported)", ip)
+		return
+	}
+	if functions[ip] != "" {
+		c.emit("movq %rbp, %rsp")
+		c.emit("popq %rbp")
+	}
+	c.emit(lowerings[op].x86)
+}
+
+// discardsResult reports whether an instruction with x0 as rd does nothing
+// at all, so that it lowers to nothing. Loads keep the access, which may
+// fault, jumps the jump, and the CSR instructions their side effects on the
+// CSR.
+func discardsResult(info opcodes.Info) bool {
+	return writesRegister(info) && !info.Is(opcodes.Loads) && !info.Is(opcodes.Jump) &&
+		info.Format != opcodes.CSRType && info.Format != opcodes.CSRIType
+}
+
+func (c *CodeGen) branchOp(op opcodes.OpCode, branches map[int]string, inst [4]int, ip int) {
+	c.branchCompare(inst)
+	c.branchJump(op, branches, inst, ip)
+}
+
+// branchCompare compares the two registers of a branch, and branchJump
+// jumps on the result. cmp cannot take an immediate as its destination, so
+// x0 as rs1 is compared as a zero on the stack, dropped with lea, which
+// leaves the flags alone.
+func (c *CodeGen) branchCompare(inst [4]int) {
+	rs1 := riscTox86Regs[inst[1]]
+	rs2 := riscTox86Regs[inst[2]]
+	if rs1 == "$0" {
+		c.emit("pushq $0")
+		c.emit(fmt.Sprintf("cmpq %s, (%%rsp)", rs2))
+		c.emit("leaq 8(%rsp), %rsp")
+		return
+	}
+	c.emit(fmt.Sprintf("cmpq %s, %s", rs2, rs1))
+}
+
+func (c *CodeGen) branchJump(op opcodes.OpCode, branches map[int]string, inst [4]int, ip int) {
+	offset := inst[3]
 	label := branches[ip+offset]
-	c.emit(fmt.Sprintf("%s %s, %s", opCodeToX86Ops[op], riscTox86Regs[rs2], riscTox86Regs[rs1]))
-	c.emit(fmt.Sprintf("%s %s", branchToJump[op], label))
-	return ip + 4
+	c.emit(fmt.Sprintf("%s %s", lowerings[op].jump, label))
 }
 
 func (c *CodeGen) findFunctions(bytecode []int) map[int]string {
 	functions := map[int]string{}
-	for ip := 0; ip < len(bytecode); {
-		opcode := bytecode[ip]
-		if opcode != int(opcodes.JAL) {
-			ip += 4
+	for ip, next := 0, 0; ip < len(bytecode); ip = next {
+		inst, size, _ := c.set.Fetch(bytecode, ip)
+		next = ip + size
+		if inst[0] != int(opcodes.JAL) {
 			continue
 		}
 
-		jmpPos := ip + bytecode[ip+3]
+		jmpPos := ip + inst[3]
 		functions[jmpPos] = fmt.Sprintf("L%d", jmpPos)
-		ip += 4
 	}
 	return functions
 }
 
 func (c *CodeGen) findBranches(bytecode []int) map[int]string {
 	branches := map[int]string{}
-	for ip := 0; ip < len(bytecode); {
-		opcode := bytecode[ip]
-		if opcode != int(opcodes.BEQ) && opcode != int(opcodes.BLT) && opcode != int(opcodes.BNE) && opcode != int(opcodes.BGE) {
-			ip += 4
+	for ip, next := 0, 0; ip < len(bytecode); ip = next {
+		inst, size, _ := c.set.Fetch(bytecode, ip)
+		next = ip + size
+		if info, _ := c.set.ByOpCode(opcodes.OpCode(inst[0])); !info.Is(opcodes.Branch) {
 			continue
 		}
-		jmpPos := ip + bytecode[ip+3]
+		jmpPos := ip + inst[3]
 		branches[jmpPos] = fmt.Sprintf("L%d", jmpPos)
-		ip += 4
 	}
 	return branches
 }
@@ -262,6 +786,29 @@ func (c *CodeGen) appendExit() string {
 	return strings.ReplaceAll(asm, "{{{syscall}}}", "movq %rax, %rdi\nmovq $60, %rax\nsyscall")
 }
 
+func (c *CodeGen) EnableTrace() {
+	c.traceEnabled = true
+}
+
+// EnableStackMode generates code for a stack-machine program.
+func (c *CodeGen) EnableStackMode() {
+	c.stackMode = true
+}
+
+// EnableRV64 generates code for a program assembled in RV64 mode, whose
+// registers are the whole 64 bits of the x86 ones.
+func (c *CodeGen) EnableRV64() {
+	c.rv64 = true
+	c.set = opcodes.RV64Set
+}
+
+// EnableRegisterAllocation assigns x86 registers to the values the program's
+// registers hold by linear scan instead of the fixed map, spilling only when
+// more are live at once than there are registers.
+func (c *CodeGen) EnableRegisterAllocation() {
+	c.allocateRegisters = true
+}
+
 func (c *CodeGen) toggleTraceOnOff() {
 	c.traceEnabled = !c.traceEnabled
 }
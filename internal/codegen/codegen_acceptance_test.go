@@ -116,3 +116,361 @@ func TestEndToEndFibonacci(t *testing.T) {
 	}
 	runEndToEnd(t, bytecode, 55, "fibonacci loop should compute 10th fibonacci number")
 }
+
+func TestEndToEndMExtension(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a        int
+		b        int
+		expected int
+		message  string
+	}{
+		{"mulh", opcodes.MULH, 0x40000000, 8, 2, "mulh should return the upper word of the product"},
+		{"mulhu", opcodes.MULHU, -1, -1, 254, "mulhu should treat both operands as unsigned"},
+		{"mulhsu", opcodes.MULHSU, -1, -1, 255, "mulhsu should treat only the first operand as signed"},
+		{"divu", opcodes.DIVU, -2, 1 << 25, 127, "divu should divide the unsigned values"},
+		{"divu by zero", opcodes.DIVU, 7, 0, 255, "divu by zero should set every bit"},
+		{"remu", opcodes.REMU, -1, 10, 5, "remu should take the unsigned remainder"},
+		{"remu by zero", opcodes.REMU, 7, 0, 7, "remu by zero should return the dividend"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bytecode := []int{
+				int(opcodes.ADDI), 2, 0, tc.a,
+				int(opcodes.ADDI), 3, 0, tc.b,
+				int(tc.op), 5, 2, 3,
+				int(opcodes.ADD), 1, 5, 0,
+			}
+			runEndToEnd(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestEndToEndMExtensionWithOperandsInRaxAndRdx(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.ADDI), 1, 0, 100,
+		int(opcodes.ADDI), 4, 0, 7,
+		int(opcodes.DIVU), 1, 1, 4,
+		int(opcodes.ADD), 1, 1, 4,
+	}
+	runEndToEnd(t, bytecode, 21, "divu should leave rdx holding x4 and write its quotient to rax")
+}
+
+func TestEndToEndLogicAndShifts(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a        int
+		b        int
+		expected int
+		message  string
+	}{
+		{"and", opcodes.AND, 0b1100, 0b1010, 0b1000, "and should keep the bits set in both"},
+		{"or", opcodes.OR, 0b1100, 0b1010, 0b1110, "or should keep the bits set in either"},
+		{"xor", opcodes.XOR, 0b1100, 0b1010, 0b0110, "xor should keep the bits set in one"},
+		{"sll masks amount", opcodes.SLL, 3, 33, 6, "sll should only use the low five bits of the amount"},
+		{"srl", opcodes.SRL, -16, 26, 63, "srl should shift in zeros from bit 31"},
+		{"sra", opcodes.SRA, -16, 2, 252, "sra should shift in copies of the sign bit"},
+		{"andi", opcodes.ANDI, 0xFF, -16, 0xF0, "andi should sign-extend its immediate"},
+		{"ori", opcodes.ORI, 0b0001, 0b0110, 0b0111, "ori should or in the immediate"},
+		{"xori", opcodes.XORI, 5, -1, 250, "xori with -1 should invert every bit"},
+		{"slli", opcodes.SLLI, 3, 4, 48, "slli should shift left"},
+		{"srli", opcodes.SRLI, -1, 25, 127, "srli should shift in zeros from bit 31"},
+		{"srai", opcodes.SRAI, -1024, 4, 192, "srai should keep the sign"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bytecode := []int{
+				int(opcodes.ADDI), 2, 0, tc.a,
+				int(opcodes.ADDI), 5, 0, tc.b,
+				int(tc.op), 6, 2, 5,
+				int(opcodes.ADD), 1, 6, 0,
+			}
+			if tc.op >= opcodes.ANDI {
+				bytecode[11] = tc.b
+			}
+			runEndToEnd(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestEndToEndShiftWithOperandsInRcx(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.ADDI), 3, 0, 5,
+		int(opcodes.ADDI), 2, 0, 2,
+		int(opcodes.SLL), 3, 3, 2,
+		int(opcodes.ADDI), 4, 0, 3,
+		int(opcodes.SRL), 1, 3, 4,
+		int(opcodes.ADD), 1, 1, 3,
+	}
+	runEndToEnd(t, bytecode, 22, "shifts should work when x3, which lives in rcx, is an operand or the result")
+}
+
+func TestEndToEndSetLessThan(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		rs1      int
+		a        int
+		b        int
+		expected int
+		message  string
+	}{
+		{"slt", opcodes.SLT, 2, -1, 1, 1, "slt should compare signed"},
+		{"slt equal", opcodes.SLT, 2, 1, 1, 0, "slt should be false for equal values"},
+		{"sltu", opcodes.SLTU, 2, -1, 1, 0, "sltu should treat -1 as the largest value"},
+		{"sltu true", opcodes.SLTU, 2, 1, -1, 1, "sltu should compare unsigned"},
+		{"sgtz", opcodes.SLT, 0, 0, 5, 1, "slt from x0 should test for a positive value"},
+		{"snez", opcodes.SLTU, 0, 0, -3, 1, "sltu from x0 should test for a non-zero value"},
+		{"slti", opcodes.SLTI, 2, -5, -4, 1, "slti should compare with the signed immediate"},
+		{"sltiu seqz", opcodes.SLTIU, 2, 0, 1, 1, "sltiu with 1 should test for zero"},
+		{"sltiu sign-extends", opcodes.SLTIU, 2, 5, -1, 1, "sltiu should sign-extend its immediate"},
+		{"sltiu from x0", opcodes.SLTIU, 0, 0, -1, 1, "zero is below every non-zero unsigned immediate"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bytecode := []int{
+				int(opcodes.ADDI), 1, 0, 99,
+				int(opcodes.ADDI), 2, 0, tc.a,
+				int(opcodes.ADDI), 3, 0, tc.b,
+				int(tc.op), 1, tc.rs1, 3,
+			}
+			if tc.op == opcodes.SLTI || tc.op == opcodes.SLTIU {
+				bytecode[15] = tc.b
+			}
+			runEndToEnd(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestEndToEndLoadUpperImmediate(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.LUI), 2, 0, 0x12345,
+		int(opcodes.ADDI), 2, 2, 0x678,
+		int(opcodes.SRLI), 1, 2, 4,
+	}
+	runEndToEnd(t, bytecode, 0x67, "lui and addi should build a full 32-bit constant")
+}
+
+func TestEndToEndAUIPC(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.ADDI), 2, 0, 0,
+		int(opcodes.ADDI), 2, 0, 0,
+		int(opcodes.AUIPC), 1, 0, 0,
+	}
+	runEndToEnd(t, bytecode, 8, "auipc should give the address of the instruction itself")
+}
+
+func TestEndToEndSubWordLoadsAndStores(t *testing.T) {
+	cases := []struct {
+		name     string
+		store    opcodes.OpCode
+		load     opcodes.OpCode
+		value    int
+		shift    int
+		expected int
+		message  string
+	}{
+		{"lb sign-extends", opcodes.SB, opcodes.LB, -2, 8, 255, "lb should fill the upper bits with the sign of the byte"},
+		{"lbu zero-extends", opcodes.SB, opcodes.LBU, -2, 8, 0, "lbu should clear the upper bits"},
+		{"lh sign-extends", opcodes.SH, opcodes.LH, -2, 16, 255, "lh should fill the upper bits with the sign of the halfword"},
+		{"lhu zero-extends", opcodes.SH, opcodes.LHU, -2, 16, 0, "lhu should clear the upper bits"},
+		{"sh keeps the low halfword", opcodes.SH, opcodes.LHU, 0x1234, 8, 0x12, "sh should store the low sixteen bits of rs2"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bytecode := []int{
+				int(opcodes.ADDI), 2, 0, tc.value,
+				int(opcodes.ADDI), 3, 0, 16,
+				int(tc.store), 2, 2, 3,
+				int(tc.load), 4, 2, 3,
+				int(opcodes.SRAI), 1, 4, tc.shift,
+			}
+			runEndToEnd(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestEndToEndByteLoop(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.ADDI), 2, 0, 0,
+		int(opcodes.ADDI), 3, 0, 5,
+		int(opcodes.SB), 3, 0, 2,
+		int(opcodes.ADDI), 2, 2, 1,
+		int(opcodes.ADDI), 3, 3, -1,
+		int(opcodes.BNE), 3, 0, -12,
+		int(opcodes.LBU), 1, 0, 0,
+		int(opcodes.LBU), 4, 4, 0,
+		int(opcodes.ADD), 1, 1, 4,
+	}
+	runEndToEnd(t, bytecode, 6, "sb through a moving base should fill consecutive bytes")
+}
+
+func TestEndToEndUnsignedBranches(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a, b     int
+		expected int
+		message  string
+	}{
+		{"bltu taken", opcodes.BLTU, 1, -1, 1, "bltu should treat -1 as the largest value"},
+		{"bltu not taken", opcodes.BLTU, -1, 1, 0, "bltu should not branch when rs1 is above rs2 unsigned"},
+		{"bgeu taken", opcodes.BGEU, -1, 1, 1, "bgeu should branch when rs1 is above rs2 unsigned"},
+		{"bgeu equal", opcodes.BGEU, -5, -5, 1, "bgeu should branch on equal values"},
+		{"bgeu not taken", opcodes.BGEU, 3, -3, 0, "bgeu should not branch when rs1 is below rs2 unsigned"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bytecode := []int{
+				int(opcodes.ADDI), 1, 0, 1,
+				int(opcodes.ADDI), 2, 0, tc.a,
+				int(opcodes.ADDI), 3, 0, tc.b,
+				int(tc.op), 2, 3, 8,
+				int(opcodes.ADDI), 1, 0, 0,
+			}
+			runEndToEnd(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestEndToEndHighRegisters(t *testing.T) {
+	cases := []struct {
+		name     string
+		bytecode []int
+		expected int
+		message  string
+	}{
+		{
+			"add",
+			[]int{
+				int(opcodes.ADDI), 16, 0, 40,
+				int(opcodes.ADDI), 31, 0, 2,
+				int(opcodes.ADD), 1, 16, 31,
+			},
+			42, "x16 and x31 should keep their values in the spill area",
+		},
+		{
+			"sub in place",
+			[]int{
+				int(opcodes.ADDI), 16, 0, 50,
+				int(opcodes.ADDI), 17, 0, 8,
+				int(opcodes.SUB), 16, 16, 17,
+				int(opcodes.ADD), 1, 16, 0,
+			},
+			42, "a spilled destination should be stored back",
+		},
+		{
+			"mixed with low registers",
+			[]int{
+				int(opcodes.ADDI), 14, 0, 6,
+				int(opcodes.ADDI), 15, 0, 7,
+				int(opcodes.ADDI), 20, 0, 100,
+				int(opcodes.MUL), 20, 14, 15,
+				int(opcodes.ADD), 1, 20, 14,
+				int(opcodes.ADD), 1, 1, 15,
+			},
+			55, "borrowing scratch registers should not disturb x14 and x15",
+		},
+		{
+			"division",
+			[]int{
+				int(opcodes.ADDI), 18, 0, 85,
+				int(opcodes.ADDI), 19, 0, 2,
+				int(opcodes.DIV), 20, 18, 19,
+				int(opcodes.MOD), 21, 18, 19,
+				int(opcodes.ADD), 1, 20, 21,
+			},
+			43, "div and rem should read and write spilled registers",
+		},
+		{
+			"m extension",
+			[]int{
+				int(opcodes.ADDI), 22, 0, 100,
+				int(opcodes.ADDI), 23, 0, 7,
+				int(opcodes.REMU), 24, 22, 23,
+				int(opcodes.MULH), 25, 22, 23,
+				int(opcodes.ADD), 1, 24, 25,
+			},
+			2, "remu and mulh should work on spilled registers",
+		},
+		{
+			"shift by a spilled amount",
+			[]int{
+				int(opcodes.ADDI), 3, 0, 5,
+				int(opcodes.ADDI), 26, 0, 3,
+				int(opcodes.SLL), 27, 3, 26,
+				int(opcodes.ADD), 1, 27, 3,
+			},
+			45, "the shift should leave x3 alone",
+		},
+		{
+			"immediates and compares",
+			[]int{
+				int(opcodes.ADDI), 28, 0, -1,
+				int(opcodes.SRLI), 28, 28, 28,
+				int(opcodes.SLTI), 29, 28, 16,
+				int(opcodes.XORI), 29, 29, 40,
+				int(opcodes.ADD), 1, 28, 29,
+			},
+			56, "15 < 16, and 1 ^ 40 is 41",
+		},
+		{
+			"memory",
+			[]int{
+				int(opcodes.ADDI), 16, 0, 8,
+				int(opcodes.ADDI), 17, 0, 42,
+				int(opcodes.SB), 17, 4, 16,
+				int(opcodes.LBU), 18, 4, 16,
+				int(opcodes.ADD), 1, 18, 0,
+			},
+			42, "a spilled register should serve as value and base",
+		},
+		{
+			"loop",
+			[]int{
+				int(opcodes.ADDI), 20, 0, 10,
+				int(opcodes.ADDI), 21, 0, 0,
+				int(opcodes.ADD), 21, 21, 20,
+				int(opcodes.ADDI), 20, 20, -1,
+				int(opcodes.BNE), 20, 0, -8,
+				int(opcodes.ADD), 1, 21, 0,
+			},
+			55, "a loop should count and sum in spilled registers",
+		},
+		{
+			"branch between spilled registers",
+			[]int{
+				int(opcodes.ADDI), 16, 0, 3,
+				int(opcodes.ADDI), 30, 0, 4,
+				int(opcodes.ADDI), 1, 0, 7,
+				int(opcodes.BLT), 16, 30, 8,
+				int(opcodes.ADDI), 1, 0, 99,
+			},
+			7, "3 < 4, and the stack should be balanced on the taken path",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runEndToEnd(t, tc.bytecode, tc.expected, tc.message)
+		})
+	}
+}
+
+func TestEndToEndAllThirtyTwoRegisters(t *testing.T) {
+	var bytecode []int
+	for r := 1; r < 32; r++ {
+		bytecode = append(bytecode, int(opcodes.ADDI), r, 0, r)
+	}
+	for r := 2; r < 32; r++ {
+		bytecode = append(bytecode, int(opcodes.ADD), 1, 1, r)
+	}
+	runEndToEnd(t, bytecode, (31*32/2)&0xFF, "every register should hold its own value")
+}
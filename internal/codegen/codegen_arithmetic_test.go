@@ -0,0 +1,76 @@
+package codegen
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestEndToEndArithmeticMatchesTheVM(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int32
+		message  string
+	}{
+		{"add", "li x4, 0x7fffffff\nli x5, 1\nadd x2, x4, x5", math.MinInt32, "0x7fffffff + 1 should wrap to the most negative word"},
+		{"add in place", "li x2, 0x7fffffff\nadd x2, x2, x2", -2, "doubling 0x7fffffff should wrap to -2"},
+		{"addi", "li x4, 0x7fffffff\naddi x2, x4, 1", math.MinInt32, "addi should wrap like add"},
+		{"addi below", "li x4, 0x80000000\naddi x2, x4, -1", math.MaxInt32, "addi should wrap downwards too"},
+		{"li", "li x2, 0x80000000", math.MinInt32, "a constant with bit 31 set is negative"},
+		{"sub", "li x4, 0x80000000\nli x5, 1\nsub x2, x4, x5", math.MaxInt32, "the most negative word minus 1 should wrap"},
+		{"sub into rs2", "li x4, 10\nli x2, 3\nsub x2, x4, x2", 7, "rd may be rs2, which is subtracted"},
+		{"sub into rs2 wraps", "li x4, 0x80000000\nli x2, 1\nsub x2, x4, x2", math.MaxInt32, "rd = rs2 should wrap as well"},
+		{"neg", "li x4, 0x80000000\nsub x2, x0, x4", math.MinInt32, "negating the most negative word gives it back"},
+		{"mul", "li x4, 0x10000\nmul x2, x4, x4", 0, "2^32 should keep only its low word"},
+		{"mul sign", "li x4, 0x7fffffff\nli x5, 2\nmul x2, x4, x5", -2, "the product's bit 31 is its sign"},
+		{"mul into rs2", "li x4, 0x40000000\nli x2, 6\nmul x2, x4, x2", math.MinInt32, "6 × 2^30 is 2^31 + 2^32"},
+		{"div", "li x4, 0x80000000\nli x5, -1\ndiv x2, x4, x5", math.MinInt32, "the quotient of the most negative word by -1 wraps"},
+		{"rem", "li x4, 0x80000000\nli x5, -1\nrem x2, x4, x5", 0, "the most negative word is a multiple of -1"},
+		{"div by zero", "li x4, 7\ndiv x2, x4, x0", -1, "the quotient of a division by zero has every bit set"},
+		{"rem by zero", "li x4, -7\nrem x2, x4, x0", -7, "the remainder of a division by zero is the dividend"},
+		{"div by a zero register", "li x4, 7\nli x5, 0\ndiv x2, x4, x5", -1, "a zero divisor in a register should be caught too"},
+		{"divu by zero", "li x4, 7\ndivu x2, x4, x0", -1, "divu by zero should set every bit"},
+		{"remu by zero", "li x4, -7\nremu x2, x4, x0", -7, "remu by zero should return the dividend"},
+		{"div into the divisor", "li x4, 85\nli x2, -2\ndiv x2, x4, x2", -42, "rd may be rs2"},
+		{"rem in rax and rdx", "li x1, -85\nli x4, 2\nrem x2, x1, x4", -1, "the operands may be in rax and rdx"},
+		{"slli", "li x4, 0x40000000\nslli x2, x4, 1", math.MinInt32, "a shift into bit 31 makes the word negative"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// x1 is 1 if x2 holds the expected word. In native code the branch
+			// compares whole x86 registers, so it also checks that the upper
+			// half of x2 is the sign extension of the lower.
+			check := fmt.Sprintf("\nli x3, %d\nli x1, 0\nbne x2, x3, done\nli x1, 1\ndone:\naddi x1, x1, 0", tc.expected)
+			runAgainstVM(t, tc.source+check, 1, tc.message)
+		})
+	}
+}
+
+func TestEndToEndX0MatchesTheVM(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+		message  string
+	}{
+		{"nop", "addi x0, x0, 0\nli x1, 42", 42, "addi x0, x0, 0 should lower to nothing"},
+		{"writes dropped", "li x2, 5\nadd x0, x2, x2\naddi x0, x2, 1\nmul x0, x2, x2\ndiv x0, x2, x0\nslli x0, x2, 3\nlui x0, 5\nslt x0, x0, x2\nadd x1, x0, x2", 5, "x0 should stay zero whatever is written to it"},
+		{"load into x0", "li x2, 42\nsw x2, 8(x0)\nlw x0, 8(x0)\nlb x0, 8(x0)\nlw x1, 8(x0)", 42, "a load into x0 should still read memory but keep nothing"},
+		{"store x0", "li x2, -1\nsw x2, 4(x0)\nsw x0, 4(x0)\nlw x1, 4(x0)", 0, "x0 should store as zero"},
+		{"x0 sources", "li x2, 7\nsub x3, x0, x2\nor x4, x0, x0\nadd x1, x3, x4\naddi x1, x1, 50", 43, "x0 should read as zero in either operand"},
+		{"x0 divided", "li x2, 3\ndiv x3, x0, x2\nrem x4, x0, x2\nadd x1, x3, x4\naddi x1, x1, 9", 9, "zero divided by anything is zero"},
+		{"x0 by x0", "div x2, x0, x0\nrem x3, x0, x0\nsub x1, x3, x2", 1, "0 / 0 has every bit set and 0 % 0 is 0"},
+		{"blt and bge from x0", "li x2, -1\nli x1, 1\nblt x0, x2, skip\nli x1, 2\nskip:\nbge x0, x2, done\nli x1, 99\ndone:\naddi x1, x1, 0", 2, "0 is not less than -1 but is at least -1"},
+		{"bltu from x0", "li x2, -1\nli x1, 0\nbltu x0, x2, taken\nli x1, 9\ntaken:\naddi x1, x1, 3", 3, "0 is below every other unsigned word"},
+		{"beq x0 x0", "li x1, 5\nbeq x0, x0, end\nli x1, 6\nend:\naddi x1, x1, 0", 5, "x0 always equals itself"},
+		{"bne to x0", "li x2, 4\nli x1, 0\nloop:\naddi x1, x1, 10\naddi x2, x2, -1\nbne x0, x2, loop", 40, "x0 as rs1 of a loop branch"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runAgainstVM(t, tc.source, tc.expected, tc.message)
+		})
+	}
+}
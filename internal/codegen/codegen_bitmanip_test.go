@@ -0,0 +1,57 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitManipulationLowersToBMI(t *testing.T) {
+	cg := NewCodeGen()
+
+	asm := generate(t, cg, []int{
+		int(opcodes.CLZ), 1, 2, 0,
+		int(opcodes.CPOP), 1, 2, 0,
+		int(opcodes.SH2ADD), 1, 2, 9,
+		int(opcodes.ANDN), 1, 2, 4,
+		int(opcodes.BSETI), 1, 2, 5,
+	})
+
+	assert.Contains(t, asm, "lzcntl %ebx, %eax")
+	assert.Contains(t, asm, "popcntl %ebx, %eax")
+	assert.Contains(t, asm, "leal (%r10,%rbx,4), %eax\nmovslq %eax, %rax")
+	assert.Contains(t, asm, "andnl (%rsp), %ecx, %ecx")
+	assert.Contains(t, asm, "btsl $5, (%rsp)")
+}
+
+func TestEndToEndBitManipulation(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+		message  string
+	}{
+		{"clz", "li x2, 0x00F00000\nclz x1, x2", 8, "0x00F00000 has eight leading zeros"},
+		{"clz of x0", "clz x1, x0", 32, "zero is all leading zeros"},
+		{"ctz", "li x2, 0x50\nctz x1, x2", 4, "0x50 has four trailing zeros"},
+		{"cpop", "li x2, -1\ncpop x1, x2", 32, "every bit of -1 is set"},
+		{"sext.b", "li x2, 0x1F0\nsext.b x2, x2\naddi x1, x2, 20", 4, "0xF0 is -16"},
+		{"zext.h", "li x2, -1\nzext.h x2, x2\nsrli x1, x2, 8", 0xFF, "the upper halfword should be cleared"},
+		{"min and max", "li x2, -3\nli x3, 2\nmin x4, x2, x3\nmax x5, x2, x3\nsub x1, x5, x4", 5, "2 - -3"},
+		{"minu and maxu", "li x2, -3\nli x3, 2\nminu x3, x2, x3\nmaxu x4, x2, x0\nsub x1, x3, x4", 5, "2 - (2^32 - 3) wraps to 5"},
+		{"rol", "li x2, 0x80000001\nli x3, 33\nrol x1, x2, x3", 3, "rotating by 33 is rotating by 1"},
+		{"ror into x3", "li x2, 0x180\nli x3, 4\nror x3, x2, x3\naddi x1, x3, 0", 0x18, "rd may be rs2 and x3"},
+		{"rori", "li x2, 0x0F\nrori x2, x2, 4\nsrli x1, x2, 24", 0xF0, "the low nibble should wrap to the top"},
+		{"andn orn xnor", "li x2, 0xFF\nli x3, 0x0F\nandn x4, x2, x3\norn x5, x0, x3\nxnor x6, x3, x3\nadd x1, x4, x5\nadd x1, x1, x6", 0xDF, "0xF0 + ~0x0F + -1"},
+		{"sh1add sh2add sh3add", "li x2, 5\nli x3, 1\nsh1add x4, x2, x3\nsh2add x5, x2, x0\nsh3add x6, x0, x3\nadd x1, x4, x5\nadd x1, x1, x6", 32, "11 + 20 + 1"},
+		{"bset bclr binv", "li x2, 36\nbset x4, x0, x2\nbclr x5, x4, x2\nli x6, 0x70\nbinvi x6, x6, 4\nadd x1, x4, x5\nadd x1, x1, x6", 0x70, "bit 36 is bit 4: 16 + 0 + 0x60"},
+		{"bext", "li x3, 0x10\nli x2, 4\nbext x4, x3, x2\nbexti x5, x3, 3\nslli x4, x4, 1\nadd x1, x4, x5", 2, "bit 4 is set and bit 3 is not"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runAgainstVM(t, tc.source, tc.expected, tc.message)
+		})
+	}
+}
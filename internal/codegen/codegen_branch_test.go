@@ -30,7 +30,7 @@ ret
 	}
 
 	cg := NewCodeGen()
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 	assert.Equal(t, expectedAsm, asm, "asm should have call, label, prologue/epilogue and return")
 }
 
@@ -57,7 +57,7 @@ ret
 	}
 
 	cg := NewCodeGen()
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	assert.Equal(t, expectedAsm, asm, "asm should have prologue and epilogue")
 }
@@ -72,7 +72,7 @@ func TestJALNotAtStart(t *testing.T) {
 	}
 
 	cg := NewCodeGen()
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 	assert.Contains(t, asm, "call L12", "JAL at IP=4 with offset=8 should call L12")
 	assert.Contains(t, asm, "L12:", "label should be at target IP=12")
 }
@@ -133,7 +133,7 @@ func TestBEQ(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			cg := NewCodeGen()
-			asm := cg.Generate(tc.bytecode)
+			asm := generate(t, cg, tc.bytecode)
 			for _, expected := range tc.shouldContain {
 				assert.Contains(t, asm, expected, tc.message)
 			}
@@ -175,7 +175,7 @@ func TestBLT(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			cg := NewCodeGen()
-			asm := cg.Generate(tc.bytecode)
+			asm := generate(t, cg, tc.bytecode)
 			for _, expected := range tc.shouldContain {
 				assert.Contains(t, asm, expected, tc.message)
 			}
@@ -217,7 +217,7 @@ func TestBNE(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			cg := NewCodeGen()
-			asm := cg.Generate(tc.bytecode)
+			asm := generate(t, cg, tc.bytecode)
 			for _, expected := range tc.shouldContain {
 				assert.Contains(t, asm, expected, tc.message)
 			}
@@ -259,7 +259,7 @@ func TestBGE(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			cg := NewCodeGen()
-			asm := cg.Generate(tc.bytecode)
+			asm := generate(t, cg, tc.bytecode)
 			for _, expected := range tc.shouldContain {
 				assert.Contains(t, asm, expected, tc.message)
 			}
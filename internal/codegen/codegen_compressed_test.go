@@ -0,0 +1,77 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedJumpsLowerLikeTheirExpansions(t *testing.T) {
+	cjal, _ := opcodes.ByOpCode(opcodes.CJAL)
+	cjr, _ := opcodes.ByOpCode(opcodes.CJR)
+	bytecode := []int{
+		int(opcodes.CJAL), cjal.Pack([4]int{int(opcodes.JAL), 1, 0, 2}),
+		int(opcodes.CJR), cjr.Pack([4]int{int(opcodes.JALR), 0, 1, 0}),
+	}
+
+	asm := generate(t, NewCodeGen(), bytecode)
+
+	assert.Contains(t, asm, "call L2", "c.jal should call the label two bytes on")
+	assert.Contains(t, asm, "L2:\npushq %rbp\nmovq %rsp, %rbp\nmovq %rbp, %rsp\npopq %rbp\nret", "c.jr x1 should return")
+}
+
+func TestEndToEndCompressedPrograms(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+		message  string
+	}{
+		{
+			"loop",
+			`
+			addi x8, x0, 10
+			addi x9, x0, 0
+			loop:
+			add x9, x9, x8
+			addi x8, x8, -1
+			bne x8, x0, loop
+			slli x9, x9, 1
+			add x1, x0, x9
+			`,
+			110, "twice the sum of 1 to 10",
+		},
+		{
+			"forward branches and logic",
+			`
+			addi x8, x0, 12
+			addi x9, x0, 10
+			and x8, x8, x9
+			beq x8, x0, zero
+			xor x8, x8, x9
+			srai x8, x8, 1
+			zero:
+			andi x8, x8, 7
+			bne x9, x0, done
+			addi x8, x0, 0
+			done:
+			addi x1, x8, 40
+			`,
+			41, "(12&10)^10 = 2, shifted to 1, plus 40",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assembler.NewAssembler()
+			a.EnableCompression()
+			bytecode := a.Assemble(tc.source)
+			full := assembler.NewAssembler().Assemble(tc.source)
+			assert.Less(t, len(bytecode), len(full), "some instructions should have been compressed")
+
+			runBytecodeAgainstVM(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
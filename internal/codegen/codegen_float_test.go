@@ -0,0 +1,256 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFloatArithmeticLowersToSSE(t *testing.T) {
+	cg := NewCodeGen()
+
+	asm := generate(t, cg, []int{
+		int(opcodes.FADDS), 1, 2, 3,
+		int(opcodes.FSUBD), 3, 2, 3,
+		int(opcodes.FLW), 4, 8, 2,
+	})
+
+	assert.Contains(t, asm, "movaps %xmm2, %xmm1\naddss %xmm3, %xmm1")
+	assert.Contains(t, asm, "movaps %xmm3, %xmm15\nmovaps %xmm2, %xmm3\nsubsd %xmm15, %xmm3", "fd = fs2 should move fs2 aside for a subtraction")
+	assert.Contains(t, asm, "movss mem+8(%rbx), %xmm4")
+}
+
+func TestFloatInstructionsNativeCodeCannotRunAreRejected(t *testing.T) {
+	cases := []struct {
+		name     string
+		bytecode []int
+		expected string
+	}{
+		{"rmm", []int{int(opcodes.FCVTWS), 1, 2, 4}, "fcvt.w.s with rounding mode 4 is not supported in x86-64 codegen"},
+		{"fcsr", []int{int(opcodes.CSRRS), 1, int(opcodes.FFLAGS), 0}, "csrrs of fflags at ip 0 is not supported in x86-64 codegen: native code keeps no float flags or rounding mode"},
+		{"frm", []int{int(opcodes.CSRRWI), 0, int(opcodes.FRM), 1}, "csrrwi of frm at ip 0 is not supported in x86-64 codegen: native code keeps no float flags or rounding mode"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cg := NewCodeGen()
+			_, err := cg.Generate(tc.bytecode)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestEndToEndFloatPrograms(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+		message  string
+	}{
+		{
+			"arithmetic",
+			`
+			li x2, 0x3fc00000
+			fmv.w.x f1, x2
+			li x3, 0x40100000
+			fmv.w.x f2, x3
+			fadd.s f3, f1, f2
+			fmul.s f3, f3, f2
+			fsub.s f3, f3, f1
+			fdiv.s f3, f3, f1
+			fcvt.w.s x1, f3, rup
+			`,
+			5, "((1.5 + 2.25) × 2.25 - 1.5) / 1.5 is 4.625, which rounds up to 5",
+		},
+		{
+			"rounding modes",
+			`
+			li x2, 50
+			fcvt.d.w f1, x2
+			fsqrt.d f2, f1
+			fcvt.w.d x3, f2, rdn
+			fcvt.w.d x4, f2, rup
+			fcvt.w.d x5, f2, rtz
+			fcvt.w.d x6, f2
+			add x1, x3, x4
+			add x1, x1, x5
+			add x1, x1, x6
+			`,
+			29, "the root of 50 is 7.07, so 7 + 8 + 7 + 7",
+		},
+		{
+			"comparisons, min, max and signs",
+			`
+			li x2, 0x80000000
+			fmv.w.x f1, x2
+			fmv.w.x f2, x0
+			fmin.s f3, f1, f2
+			fmv.x.w x3, f3
+			srli x3, x3, 31
+			fmax.s f4, f1, f2
+			fmv.x.w x4, f4
+			srli x4, x4, 30
+			li x5, 0x7fc00000
+			fmv.w.x f5, x5
+			li x6, 0x40000000
+			fmv.w.x f6, x6
+			fmin.s f7, f5, f6
+			feq.s x7, f7, f6
+			slli x7, x7, 2
+			flt.s x8, f5, f6
+			slli x8, x8, 3
+			fle.s x9, f1, f2
+			slli x9, x9, 4
+			fneg.s f8, f6
+			flt.s x10, f8, f6
+			slli x10, x10, 5
+			fabs.s f9, f8
+			feq.s x11, f9, f6
+			slli x11, x11, 6
+			fsgnjx.s f10, f6, f8
+			flt.s x12, f10, f2
+			slli x12, x12, 7
+			or x1, x3, x4
+			or x1, x1, x7
+			or x1, x1, x8
+			or x1, x1, x9
+			or x1, x1, x10
+			or x1, x1, x11
+			or x1, x1, x12
+			`,
+			245, "min(-0, +0) is -0, max is +0, a NaN loses to a number and is unordered",
+		},
+		{
+			"memory and unsigned conversions",
+			`
+			li x3, 9
+			fcvt.d.w f1, x3
+			li x2, 16
+			fsd f1, 8(x2)
+			fld f2, 8(x2)
+			fcvt.s.d f3, f2
+			fsw f3, 0(x2)
+			flw f4, 0(x2)
+			fcvt.w.s x1, f4
+			li x4, -1
+			fcvt.d.wu f5, x4
+			fcvt.wu.d x5, f5
+			add x1, x1, x5
+			li x6, 0x80000000
+			fcvt.s.wu f6, x6
+			fcvt.s.w f7, x6
+			fadd.s f8, f6, f7
+			fcvt.w.s x7, f8
+			add x1, x1, x7
+			`,
+			8, "9 survives the round trip through memory and 0xffffffff converts back to -1",
+		},
+		{
+			"conversions saturate",
+			`
+			li x2, 0x4f800000
+			fmv.w.x f1, x2
+			fneg.s f2, f1
+			li x5, 0x7fc00000
+			fmv.w.x f3, x5
+			li x11, 0x7fffffff
+			li x12, 0x80000000
+			fcvt.w.s x3, f1
+			sub x3, x3, x11
+			seqz x3, x3
+			fcvt.w.s x4, f2
+			sub x4, x4, x12
+			seqz x4, x4
+			slli x4, x4, 1
+			fcvt.w.s x6, f3
+			sub x6, x6, x11
+			seqz x6, x6
+			slli x6, x6, 2
+			fcvt.wu.s x7, f2
+			seqz x7, x7
+			slli x7, x7, 3
+			fcvt.wu.s x8, f1
+			addi x8, x8, 1
+			seqz x8, x8
+			slli x8, x8, 4
+			fcvt.d.wu f4, x12
+			fadd.d f4, f4, f4
+			fcvt.wu.d x10, f4
+			addi x10, x10, 1
+			seqz x10, x10
+			slli x10, x10, 5
+			or x1, x3, x4
+			or x1, x1, x6
+			or x1, x1, x7
+			or x1, x1, x8
+			or x1, x1, x10
+			`,
+			63, "2^32 saturates to the largest int, -2^32 to the smallest, a NaN to the largest; unsigned ones clamp to 0 and 0xffffffff",
+		},
+		{
+			"fclass",
+			`
+			li x2, 0xff800000
+			fmv.w.x f1, x2
+			fclass.s x3, f1
+			li x2, 0x80000000
+			fmv.w.x f2, x2
+			fclass.s x4, f2
+			li x2, 0x00000001
+			fmv.w.x f3, x2
+			fclass.s x5, f3
+			li x2, 0x3f800000
+			fmv.w.x f4, x2
+			fclass.s x6, f4
+			li x2, 0x7fa00000
+			fmv.w.x f5, x2
+			fclass.s x7, f5
+			li x8, -3
+			fcvt.d.w f6, x8
+			fclass.d x9, f6
+			fcvt.d.w f7, x0
+			fclass.d x10, f7
+			fdiv.d f8, f7, f7
+			fclass.d x12, f8
+			srli x7, x7, 6
+			srli x12, x12, 2
+			or x1, x3, x4
+			or x1, x1, x5
+			or x1, x1, x6
+			or x1, x1, x7
+			or x1, x1, x9
+			or x1, x1, x10
+			or x1, x1, x12
+			`,
+			0xff, "-inf, -0, a positive subnormal, 1, a signalling NaN, -3, +0 and a quiet NaN each set their own bit",
+		},
+		{
+			"registers above f14 spill",
+			`
+			li x2, 3
+			fcvt.s.w f20, x2
+			li x3, 4
+			fcvt.s.w f31, x3
+			fmul.s f15, f20, f31
+			fadd.s f15, f15, f20
+			fmv.s f1, f15
+			fadd.s f16, f1, f31
+			li x4, 64
+			fsw f16, 0(x4)
+			flw f17, 0(x4)
+			fcvt.w.s x1, f17
+			fsgnjn.s f18, f17, f17
+			feq.s x5, f18, f17
+			add x1, x1, x5
+			`,
+			19, "3 × 4 + 3 + 4 in f15 to f31 is 19, and -19 is not 19",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runAgainstVM(t, tc.source, tc.expected, tc.message)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package codegen
+
+import "testing"
+
+func TestEndToEndWordLoadsAndStores(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+		message  string
+	}{
+		{"base register", "li x2, 40\nli x3, 42\nsw x3, 8(x2)\nlw x1, 48(x0)", 42, "sw should store at base + offset"},
+		{"negative offset", "li x2, 40\nli x3, 42\nsw x3, -8(x2)\nlw x1, 32(x0)", 42, "the offset may be negative"},
+		{"sw writes four bytes", "li x2, 42\nsw x2, 12(x0)\nli x3, -1\nsw x3, 8(x0)\nlw x1, 12(x0)", 42, "sw should leave the next word alone"},
+		{"lw sign-extends", "li x2, -1\nsw x2, 0(x0)\nsw x0, 4(x0)\nlw x3, 0(x0)\nslt x1, x3, x0", 1, "lw should not read the next word into the upper bits"},
+		{
+			"array",
+			"li x2, 64\nli x3, 10\nli x4, 4\nfill:\nsw x3, 0(x2)\naddi x2, x2, 4\naddi x3, x3, 10\naddi x4, x4, -1\nbne x4, x0, fill\n" +
+				"li x2, 64\nli x5, 80\nsum:\nlw x6, 0(x2)\nadd x1, x1, x6\naddi x2, x2, 4\nbne x2, x5, sum",
+			100, "10 + 20 + 30 + 40, walked with a pointer",
+		},
+		{
+			"linked list",
+			"li x2, 5\nsw x2, 100(x0)\nli x2, 108\nsw x2, 104(x0)\nli x2, 7\nsw x2, 108(x0)\nli x2, 116\nsw x2, 112(x0)\nli x2, 30\nsw x2, 116(x0)\nsw x0, 120(x0)\n" +
+				"li x2, 100\nnext:\nlw x3, 0(x2)\nadd x1, x1, x3\nlw x2, 4(x2)\nbne x2, x0, next",
+			42, "each node's next pointer should be followed",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runAgainstVM(t, tc.source, tc.expected, tc.message)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package codegen
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocationSharesARegisterBetweenRangesThatDoNotOverlap(t *testing.T) {
+	a := NewCodeGen().allocate([]int{
+		int(opcodes.ADDI), 16, 0, 1,
+		int(opcodes.ADD), 1, 1, 16,
+		int(opcodes.ADDI), 31, 0, 2,
+		int(opcodes.ADD), 1, 1, 31,
+	})
+
+	assert.Equal(t, 2, a[0][16], "x16 should get the first free register")
+	assert.Equal(t, 2, a[2][31], "x31 is written after x16's last use, so it can reuse its register")
+	assert.Equal(t, 1, a[1][1], "x1 should stay in rax")
+	assert.Equal(t, 0, a[1][0], "x0 should stay zero")
+}
+
+func TestAllocationKeepsRangesLiveAroundALoop(t *testing.T) {
+	a := NewCodeGen().allocate([]int{
+		int(opcodes.ADDI), 23, 0, 2,
+		int(opcodes.ADDI), 22, 0, 3,
+		int(opcodes.ADD), 1, 1, 23,
+		int(opcodes.ADDI), 24, 0, 1,
+		int(opcodes.ADD), 1, 1, 24,
+		int(opcodes.ADDI), 22, 22, -1,
+		int(opcodes.BNE), 22, 0, -16,
+	})
+
+	assert.NotEqual(t, a[4][23], a[4][24], "x23 is read again on the next iteration, after x24 is written")
+	assert.Equal(t, a[0][23], a[6][23], "x23 should stay in one register around the loop")
+	assert.Less(t, a[4][23], spillBase)
+	assert.Less(t, a[4][24], spillBase)
+}
+
+func TestAllocationSpillsTheRangeThatEndsLast(t *testing.T) {
+	var bytecode []int
+	for r := 2; r <= 17; r++ {
+		bytecode = append(bytecode, int(opcodes.ADDI), r, 0, r)
+	}
+	for r := 17; r >= 2; r-- {
+		bytecode = append(bytecode, int(opcodes.ADD), 1, 1, r)
+	}
+
+	a := NewCodeGen().allocate(bytecode)
+	final := a[len(a)-1]
+
+	assert.Equal(t, framePointer, a[13][15], "without functions, x15 should get rbp")
+	assert.Equal(t, spillBase, final[2], "x2 is read last, so it should be spilled first")
+	assert.Equal(t, spillBase+1, a[len(a)-2][3], "x3 is read next to last")
+	assert.Equal(t, 2, a[14][16], "x16 should take the register x2 gave up")
+	assert.Equal(t, 3, a[15][17], "x17 should take the register x3 gave up")
+}
+
+func TestAllocationKeepsRbpForFunctions(t *testing.T) {
+	bytecode := []int{int(opcodes.JAL), 0, 0, 4}
+	for r := 2; r <= 16; r++ {
+		bytecode = append(bytecode, int(opcodes.ADDI), r, 0, r)
+	}
+	for r := 16; r >= 2; r-- {
+		bytecode = append(bytecode, int(opcodes.ADD), 1, 1, r)
+	}
+
+	a := NewCodeGen().allocate(bytecode)
+
+	for r := 2; r <= 16; r++ {
+		assert.NotEqual(t, framePointer, a[r-1][r], "x%d should not get rbp, the frame pointer of the function", r)
+	}
+	assert.Equal(t, spillBase, a[1][2], "with 13 registers, x2 should be spilled")
+	assert.Equal(t, spillBase+1, a[2][3], "with 13 registers, x3 should be spilled")
+}
+
+func TestAllocationGivesEachValueOfARegisterItsOwnWeb(t *testing.T) {
+	a := NewCodeGen().allocate(reusedRegister)
+
+	assert.Equal(t, 2, a[0][16], "the first value of x16 should get the first free register")
+	assert.Equal(t, 2, a[3][18], "x18 should take the register the first x16 gave up")
+	assert.Equal(t, 4, a[4][16], "the second value of x16 should get a register of its own")
+	assert.Equal(t, a[4][16], a[5][16], "the second x16 should be read where it was written")
+}
+
+// reusedRegister writes x16 twice with values whose lives do not overlap, and
+// takes the first one's register for x18 in between.
+var reusedRegister = []int{
+	int(opcodes.ADDI), 16, 0, 1,
+	int(opcodes.ADDI), 17, 0, 2,
+	int(opcodes.ADD), 1, 1, 16,
+	int(opcodes.ADDI), 18, 0, 5,
+	int(opcodes.ADDI), 16, 0, 3,
+	int(opcodes.ADD), 1, 1, 16,
+	int(opcodes.ADD), 1, 1, 18,
+	int(opcodes.ADD), 1, 1, 17,
+}
+
+func TestEndToEndRegisterAllocation(t *testing.T) {
+	var allLive []int
+	for r := 1; r < 32; r++ {
+		allLive = append(allLive, int(opcodes.ADDI), r, 0, r)
+	}
+	for r := 2; r < 32; r++ {
+		allLive = append(allLive, int(opcodes.ADD), 1, 1, r)
+	}
+
+	cases := []struct {
+		name     string
+		bytecode []int
+		expected int
+		message  string
+	}{
+		{
+			"short ranges",
+			[]int{
+				int(opcodes.ADDI), 16, 0, 40,
+				int(opcodes.ADD), 1, 16, 0,
+				int(opcodes.ADDI), 31, 0, 2,
+				int(opcodes.ADD), 1, 1, 31,
+			},
+			42, "x16 and x31 can share a register",
+		},
+		{
+			"loop",
+			[]int{
+				int(opcodes.ADDI), 23, 0, 2,
+				int(opcodes.ADDI), 22, 0, 3,
+				int(opcodes.ADD), 1, 1, 23,
+				int(opcodes.ADDI), 24, 0, 1,
+				int(opcodes.ADD), 1, 1, 24,
+				int(opcodes.ADDI), 22, 22, -1,
+				int(opcodes.BNE), 22, 0, -16,
+			},
+			9, "x23 should survive each iteration",
+		},
+		{
+			"memory",
+			[]int{
+				int(opcodes.ADDI), 16, 0, 8,
+				int(opcodes.ADDI), 17, 0, 42,
+				int(opcodes.SB), 17, 4, 16,
+				int(opcodes.LBU), 18, 4, 16,
+				int(opcodes.ADD), 1, 18, 0,
+			},
+			42, "allocated registers should serve as value and base",
+		},
+		{
+			"division",
+			[]int{
+				int(opcodes.ADDI), 18, 0, 85,
+				int(opcodes.ADDI), 19, 0, 2,
+				int(opcodes.DIV), 20, 18, 19,
+				int(opcodes.MOD), 21, 18, 19,
+				int(opcodes.ADD), 1, 20, 21,
+			},
+			43, "div and rem save rax and rdx around whatever holds their operands",
+		},
+		{
+			"reused register",
+			reusedRegister,
+			11, "each value of x16 should be read from where it was written",
+		},
+		{
+			"all live",
+			allLive,
+			(31 * 32 / 2) & 0xFF, "the ranges that do not fit should be spilled",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runEndToEnd(t, tc.bytecode, tc.expected, "fixed: "+tc.message)
+			runAllocatedEndToEnd(t, tc.bytecode, tc.expected, "linear scan: "+tc.message)
+		})
+	}
+}
+
+// highRegisterLoop sums 1 to 100000 a hundred times over with the counters
+// and the sum in registers the fixed map spills.
+var highRegisterLoop = []int{
+	int(opcodes.ADDI), 20, 0, 100,
+	int(opcodes.ADDI), 21, 0, 0,
+	int(opcodes.LUI), 22, 0, 24,
+	int(opcodes.ADDI), 22, 22, 1696,
+	int(opcodes.ADD), 21, 21, 22,
+	int(opcodes.ADDI), 22, 22, -1,
+	int(opcodes.BNE), 22, 0, -8,
+	int(opcodes.ADDI), 20, 20, -1,
+	int(opcodes.BNE), 20, 0, -24,
+	int(opcodes.ADD), 1, 21, 0,
+}
+
+func TestRegisterAllocationShrinksSpillingCode(t *testing.T) {
+	fixed := generate(t, NewCodeGen(), highRegisterLoop)
+	cg := NewCodeGen()
+	cg.EnableRegisterAllocation()
+	allocated := generate(t, cg, highRegisterLoop)
+
+	fixedLines, allocatedLines := strings.Count(fixed, "\n"), strings.Count(allocated, "\n")
+	t.Logf("fixed map: %d lines, linear scan: %d lines", fixedLines, allocatedLines)
+	assert.Less(t, allocatedLines, fixedLines)
+	assert.NotContains(t, allocated, "spill", "three live ranges fit in registers")
+}
+
+// BenchmarkRegisterAllocation runs highRegisterLoop compiled with the fixed
+// map and with linear scan.
+func BenchmarkRegisterAllocation(b *testing.B) {
+	allocated := NewCodeGen()
+	allocated.EnableRegisterAllocation()
+	for _, bm := range []struct {
+		name string
+		asm  string
+	}{
+		{"fixed", generate(b, NewCodeGen(), highRegisterLoop)},
+		{"linear scan", generate(b, allocated, highRegisterLoop)},
+	} {
+		dir := b.TempDir()
+		if err := os.WriteFile(dir+"/bench.s", []byte(bm.asm), 0644); err != nil {
+			b.Fatal(err)
+		}
+		if out, err := exec.Command("as", "-o", dir+"/bench.o", dir+"/bench.s").CombinedOutput(); err != nil {
+			b.Fatalf("assembler failed: %s", out)
+		}
+		if out, err := exec.Command("ld", "-o", dir+"/bench", dir+"/bench.o").CombinedOutput(); err != nil {
+			b.Fatalf("linker failed: %s", out)
+		}
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				exec.Command(dir + "/bench").Run()
+			}
+		})
+	}
+}
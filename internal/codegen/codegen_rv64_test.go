@@ -0,0 +1,96 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/phasecurve/zhuji/internal/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRV64LowersToQuadwordOperations(t *testing.T) {
+	cg := NewCodeGen()
+	cg.EnableRV64()
+
+	asm := generate(t, cg, []int{
+		int(opcodes.SLLI), 1, 2, 40,
+		int(opcodes.SLLIW), 1, 2, 4,
+		int(opcodes.SLT), 1, 2, 4,
+		int(opcodes.LD), 1, 8, 2,
+		int(opcodes.LWU), 1, 8, 2,
+		int(opcodes.SW), 1, 16, 0,
+		int(opcodes.LD), 0, 24, 2,
+	})
+
+	assert.Contains(t, asm, "shlq $40, %rax")
+	assert.Contains(t, asm, "shll $4, %eax\nmovslq %eax, %rax")
+	assert.Contains(t, asm, "cmpq %rdx, %rbx")
+	assert.Contains(t, asm, "movq mem+8(%rbx), %rax")
+	assert.Contains(t, asm, "movl mem+8(%rbx), %eax")
+	assert.Contains(t, asm, "movl %eax, mem+16(%rip)")
+	assert.Contains(t, asm, "cmpq $0, mem+24(%rbx)", "a load into x0 should keep only its access")
+}
+
+func TestRV64RejectsTheRV32OnlyExtensions(t *testing.T) {
+	cg := NewCodeGen()
+	cg.EnableRV64()
+
+	_, err := cg.Generate([]int{int(opcodes.CLZ), 1, 2, 0})
+	assert.EqualError(t, err, "clz is not supported in RV64 x86-64 codegen")
+}
+
+func TestRV32RejectsTheRV64Instructions(t *testing.T) {
+	_, err := NewCodeGen().Generate([]int{int(opcodes.LD), 1, 0, 0})
+	assert.EqualError(t, err, "unknown opcode 169 at ip 0")
+}
+
+func TestEndToEndRV64(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+		message  string
+	}{
+		{"add past 32 bits", "li x2, 0x7FFFFFFF\naddi x2, x2, 1\nsrli x1, x2, 24", 0x80, "2^31 should stay positive"},
+		{"addw wraps", "li x2, 0x7FFFFFFF\naddiw x2, x2, 1\nsrai x1, x2, 56", 0xFF, "addiw should sign-extend 2^31 to a negative doubleword"},
+		{"subw", "li x2, 1\nslli x2, x2, 32\nsubw x1, x0, x2\naddi x1, x1, 9", 9, "subw should ignore the upper word"},
+		{"shifts by six bits", "li x2, 1\nli x3, 63\nsll x4, x2, x3\nsrl x1, x4, x3\nslli x1, x1, 2", 4, "1 << 63 >> 63 is 1"},
+		{"sraw", "li x2, 0x80000000\nli x4, 28\nsraw x3, x2, x4\nsub x1, x0, x3", 8, "0x80000000 >> 28 is -8"},
+		{"srliw", "li x2, -1\nsrliw x2, x2, 28\naddi x1, x2, 0", 15, "srliw should shift zeros in at bit 31"},
+		{"sllw into x3", "li x2, 3\nli x3, 33\nsllw x3, x2, x3\naddi x1, x3, 0", 6, "sllw should take five bits of x3"},
+		{"sltu on doublewords", "li x2, 1\nslli x2, x2, 32\nli x4, -1\nsrli x4, x4, 32\nsltu x1, x4, x2", 1, "0xFFFFFFFF is below 2^32"},
+		{"ld and sd", "li x2, 0x12345678\nslli x2, x2, 20\nli x4, 16\nsd x2, 8(x4)\nld x3, 8(x4)\nsrli x1, x3, 40", 0x23, "the upper bytes should survive memory"},
+		{"lw and lwu", "li x2, -2\nsw x2, 0(x0)\nlw x3, 0(x0)\nlwu x4, 0(x0)\nsub x1, x4, x3\nsrli x1, x1, 32", 1, "lwu should zero-extend and lw sign-extend"},
+		{"mul", "li x2, 0x10000\nmul x3, x2, x2\nmul x3, x3, x2\nsrli x1, x3, 46", 4, "2^48 should not wrap"},
+		{"mulw", "li x2, 0x10000\nmulw x3, x2, x2\naddi x1, x3, 7", 7, "2^32 wraps to 0"},
+		{"mulh", "li x2, -1\nli x4, 5\nmulh x1, x2, x4\naddi x1, x1, 3", 2, "-5 has an upper doubleword of -1"},
+		{"mulhu", "li x2, -1\nmulhu x1, x2, x2\naddi x1, x1, 3", 1, "(2^64-1)^2 has an upper doubleword of 2^64-2"},
+		{"mulhsu", "li x2, -1\nli x4, -1\nmulhsu x1, x2, x4\naddi x1, x1, 4", 3, "-1 × (2^64-1) has an upper doubleword of -1"},
+		{"div", "li x2, -100\nli x4, 7\ndiv x3, x2, x4\nrem x5, x2, x4\nsub x1, x5, x3", 12, "-100 = 7 × -14 - 2"},
+		{"div by zero", "li x2, 9\ndiv x3, x2, x0\nremu x4, x2, x0\nadd x1, x3, x4", 8, "-1 + 9"},
+		{"div overflow", "li x2, 1\nslli x2, x2, 63\nli x4, -1\ndiv x3, x2, x4\nrem x5, x2, x4\nsrli x1, x3, 56\nadd x1, x1, x5", 0x80, "the most negative doubleword over -1 is itself"},
+		{"divuw", "li x2, -1\nli x4, 2\ndivuw x3, x2, x4\nsrli x1, x3, 24", 0x7F, "0xFFFFFFFF / 2 is positive"},
+		{"divw overflow", "li x2, 0x80000000\nli x4, -1\ndivw x3, x2, x4\nremw x5, x2, x4\nsrai x1, x3, 31\nadd x1, x1, x5", 0xFF, "the most negative word over -1 is itself"},
+		{"li of a doubleword", "li x2, 0x123456789ABCDEF0\nli x3, 0x123456789ABCDEEF\nsub x4, x2, x3\nsrli x1, x2, 56\nadd x1, x1, x4", 0x13, "li should load all 64 bits"},
+		{"li of 2^31", "li x2, 0x80000000\nsrli x1, x2, 24", 0x80, "0x80000000 is a positive doubleword on RV64"},
+		{"remw", "li x2, -7\nli x4, 3\nremw x1, x2, x4\naddi x1, x1, 2", 1, "-7 rem 3 is -1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assembler.NewAssembler()
+			a.EnableRV64()
+			bytecode := a.Assemble(tc.source)
+
+			rs := registers.NewRegisters64()
+			err := vm.NewRV64VM(rs, memory.NewMemory(1024)).Execute(bytecode)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, int(rs.Read(1))&0xFF, "the VM should agree: %s", tc.message)
+
+			runRV64EndToEnd(t, bytecode, tc.expected, tc.message)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/translator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStackModePushesAndPops(t *testing.T) {
+	cg := NewCodeGen()
+	cg.EnableStackMode()
+
+	asm := generate(t, cg, []int{
+		int(opcodes.PSH), 0, 0, 40,
+		int(opcodes.PSH), 0, 0, 2,
+		int(opcodes.ADD), 0, 0, 0,
+	})
+
+	assert.Contains(t, asm, "pushq $40")
+	assert.Contains(t, asm, "addl %eax, (%rsp)")
+	assert.NotContains(t, asm, "%rbx", "stack mode should not touch the register file mapping")
+}
+
+func TestStackModeRejectsRegisterInstructions(t *testing.T) {
+	cg := NewCodeGen()
+	cg.EnableStackMode()
+
+	_, err := cg.Generate([]int{int(opcodes.ADDI), 1, 0, 1})
+	assert.EqualError(t, err, "addi is not a stack-machine instruction")
+}
+
+func TestStackModeRejectsMalformedBytecode(t *testing.T) {
+	cases := []struct {
+		name     string
+		bytecode []int
+		expected string
+	}{
+		{"partial instruction", []int{int(opcodes.PSH), 0, 0, 1, int(opcodes.DUP), 0}, "bytecode of 6 slots is not a whole number of instructions"},
+		{"misaligned jump", []int{int(opcodes.PSH), 0, 0, 1, int(opcodes.JZ), 0, 0, 2}, "at ip 4: jz target 6 is not an instruction of the program"},
+		{"jump before the start", []int{int(opcodes.JMP), 0, 0, -4}, "at ip 0: jmp target -4 is not an instruction of the program"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cg := NewCodeGen()
+			cg.EnableStackMode()
+
+			_, err := cg.Generate(tc.bytecode)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestEndToEndStackArithmetic(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a, b     int
+		expected int
+	}{
+		{"add", opcodes.ADD, 40, 2, 42},
+		{"sub", opcodes.SUB, 50, 8, 42},
+		{"mul", opcodes.MUL, 6, 7, 42},
+		{"div", opcodes.DIV, 85, 2, 42},
+		{"div by zero", opcodes.DIV, 85, 0, 255},
+		{"div by -1", opcodes.DIV, -42, -1, 42},
+		{"lte", opcodes.LTE, 2, 2, 1},
+		{"gt", opcodes.GT, 2, 2, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bytecode := []int{
+				int(opcodes.PSH), 0, 0, tc.a,
+				int(opcodes.PSH), 0, 0, tc.b,
+				int(tc.op), 0, 0, 0,
+			}
+			runStackEndToEnd(t, bytecode, tc.expected, tc.name+" should leave its result on top of the stack")
+		})
+	}
+}
+
+func TestEndToEndStackShuffles(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.PSH), 0, 0, 1,
+		int(opcodes.PSH), 0, 0, 2,
+		int(opcodes.SWP), 0, 0, 0,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.SWP), 0, 0, 0,
+		int(opcodes.DRP), 0, 0, 0,
+	}
+	runStackEndToEnd(t, bytecode, 2, "swp, dup and drp should leave 1+1 on top")
+}
+
+func TestEndToEndStackEmptyExitsZero(t *testing.T) {
+	bytecode := []int{
+		int(opcodes.PSH), 0, 0, 7,
+		int(opcodes.DRP), 0, 0, 0,
+	}
+	runStackEndToEnd(t, bytecode, 0, "an empty stack should exit with 0")
+}
+
+func TestEndToEndStackLoop(t *testing.T) {
+	// Sums 10..1 by pushing the counters above a 0 marker and adding them
+	// back up, the same program the VM's stack tests run.
+	bytecode := []int{
+		int(opcodes.PSH), 0, 0, 0,
+		int(opcodes.PSH), 0, 0, 10,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.PSH), 0, 0, -1,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.JNZ), 0, 0, -16,
+		int(opcodes.DRP), 0, 0, 0,
+		int(opcodes.SWP), 0, 0, 0,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.JZ), 0, 0, 12,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.JMP), 0, 0, -16,
+		int(opcodes.DRP), 0, 0, 0,
+	}
+	runStackEndToEnd(t, bytecode, 55, "the loops should sum 1..10")
+}
+
+func TestEndToEndTranslatedStackPrograms(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int
+	}{
+		{"doubling loop", "psh 1\npsh 5\nloop:\nswp\ndup\nadd\nswp\npsh -1\nadd\ndup\njnz loop\ndrp", 32},
+		{"swap registers", "psh 3\ndup\nadd\npsh 4\ndup\nadd\nswp\nsub\npsh 100\nadd", 102},
+		{"lte", "psh 2\ndup\nadd\npsh 4\nlte", 1},
+		{"gt", "psh 2\ndup\nadd\npsh 4\ngt", 0},
+		{"mul", "psh 6\ndup\nadd\npsh 7\nmul", 84},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assembler.NewAssembler()
+			a.EnableStackMode()
+			program := a.Assemble(tc.source)
+			translated, err := translator.Translate(program)
+			assert.NoError(t, err)
+
+			runStackEndToEnd(t, program, tc.expected, "the stack program should compute the value natively")
+			runEndToEnd(t, translated, tc.expected, "its register translation should compute the same value")
+		})
+	}
+}
@@ -35,15 +35,15 @@ func TestAddi(t *testing.T) {
 				int(opcodes.ADDI), 1, 0, 10,
 				int(opcodes.ADDI), 1, 1, 5,
 			},
-			[]string{"movq $10, %rax", "addq $5, %rax"},
-			"adding to existing register value should use addq instruction",
+			[]string{"movq $10, %rax", "addl $5, %eax", "movslq %eax, %rax"},
+			"adding to existing register value should add the low words and sign-extend",
 		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			cg := NewCodeGen()
-			asm := cg.Generate(tc.bytecode)
+			asm := generate(t, cg, tc.bytecode)
 			for _, expected := range tc.shouldContain {
 				assert.Contains(t, asm, expected, tc.message)
 			}
@@ -65,8 +65,8 @@ func TestAdd(t *testing.T) {
 				int(opcodes.ADDI), 2, 0, 5,
 				int(opcodes.ADD), 1, 1, 2,
 			},
-			[]string{"movq $10, %rax", "movq $5, %rbx", "addq %rbx, %rax"},
-			"adding two registers should generate addq with register operands",
+			[]string{"movq $10, %rax", "movq $5, %rbx", "addl %ebx, %eax", "movslq %eax, %rax"},
+			"adding two registers should generate addl with register operands",
 		},
 		{
 			"different destination",
@@ -75,7 +75,7 @@ func TestAdd(t *testing.T) {
 				int(opcodes.ADDI), 2, 0, 5,
 				int(opcodes.ADD), 3, 1, 2,
 			},
-			[]string{"movq %rax, %rcx", "addq %rbx, %rcx"},
+			[]string{"movq %rax, %rcx", "addl %ebx, %ecx", "movslq %ecx, %rcx"},
 			"adding to different destination should move result to target register",
 		},
 		{
@@ -84,7 +84,7 @@ func TestAdd(t *testing.T) {
 				int(opcodes.ADDI), 1, 0, 42,
 				int(opcodes.ADD), 2, 1, 0,
 			},
-			[]string{"movq %rax, %rbx", "addq $0, %rbx"},
+			[]string{"movq %rax, %rbx", "addl $0, %ebx"},
 			"x0 source should generate add with zero immediate",
 		},
 	}
@@ -92,7 +92,7 @@ func TestAdd(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			cg := NewCodeGen()
-			asm := cg.Generate(tc.bytecode)
+			asm := generate(t, cg, tc.bytecode)
 			for _, expected := range tc.shouldContain {
 				assert.Contains(t, asm, expected, tc.message)
 			}
@@ -108,11 +108,11 @@ func TestSub(t *testing.T) {
 		int(opcodes.SUB), 1, 1, 2,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	assert.Contains(t, asm, "movq $10, %rax", "first operand should be in rax")
 	assert.Contains(t, asm, "movq $3, %rbx", "second operand should be in rbx")
-	assert.Contains(t, asm, "subq %rbx, %rax", "subtraction should use subq instruction")
+	assert.Contains(t, asm, "subl %ebx, %eax\nmovslq %eax, %rax", "subtraction should use subl and sign-extend")
 }
 
 func TestMul(t *testing.T) {
@@ -123,11 +123,11 @@ func TestMul(t *testing.T) {
 		int(opcodes.MUL), 1, 1, 2,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	assert.Contains(t, asm, "movq $6, %rax", "first operand should be in rax")
 	assert.Contains(t, asm, "movq $7, %rbx", "second operand should be in rbx")
-	assert.Contains(t, asm, "imulq %rbx, %rax", "multiplication should use imulq instruction")
+	assert.Contains(t, asm, "imull %ebx, %eax\nmovslq %eax, %rax", "multiplication should use imull and sign-extend")
 }
 
 func TestDiv(t *testing.T) {
@@ -138,12 +138,13 @@ func TestDiv(t *testing.T) {
 		int(opcodes.DIV), 1, 1, 2,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	assert.Contains(t, asm, "movq $42, %rax", "dividend should be in rax")
 	assert.Contains(t, asm, "movq $6, %rbx", "divisor should be in rbx")
-	assert.Contains(t, asm, "cqto", "division should sign-extend rax to rdx:rax")
-	assert.Contains(t, asm, "idivq %rbx", "division should use idivq instruction")
+	assert.Contains(t, asm, "cmpl $0, (%rsp)\nje .Ldivzero8", "division by zero should be caught before idivl")
+	assert.Contains(t, asm, "cmpl $-1, (%rsp)\nje .Ldivnegate8", "division by -1 should be caught before idivl")
+	assert.Contains(t, asm, "cltd\nidivl (%rsp)", "division should sign-extend eax to edx:eax and use idivl")
 }
 
 func TestMod(t *testing.T) {
@@ -154,13 +155,12 @@ func TestMod(t *testing.T) {
 		int(opcodes.MOD), 1, 1, 2,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	assert.Contains(t, asm, "movq $17, %rax", "dividend should be in rax")
 	assert.Contains(t, asm, "movq $5, %rbx", "divisor should be in rbx")
-	assert.Contains(t, asm, "cqto", "modulo should sign-extend rax to rdx:rax")
-	assert.Contains(t, asm, "idivq %rbx", "modulo should use idivq instruction")
-	assert.Contains(t, asm, "movq %rdx, %rax", "modulo should move remainder from rdx to result register")
+	assert.Contains(t, asm, "cltd\nidivl (%rsp)", "modulo should sign-extend eax to edx:eax and use idivl")
+	assert.Contains(t, asm, "movslq %edx, %rax", "modulo should take the remainder from edx")
 }
 
 func TestSW(t *testing.T) {
@@ -170,11 +170,11 @@ func TestSW(t *testing.T) {
 		int(opcodes.SW), 1, 0, 0,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	bssPos := strings.Index(asm, ".bss\nmem: .space 1024")
 	textPos := strings.Index(asm, ".global _start")
-	storePos := strings.Index(asm, "movq %rax, mem+0(%rip)")
+	storePos := strings.Index(asm, "movl %eax, mem+0(%rip)")
 
 	assert.NotEqual(t, -1, bssPos, "memory section must be declared")
 	assert.NotEqual(t, -1, textPos, "text section must be declared")
@@ -189,9 +189,22 @@ func TestLW(t *testing.T) {
 		int(opcodes.LW), 1, 0, 0,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
-	assert.Contains(t, asm, "movq mem+0(%rip), %rax", "load should read from memory offset into register")
+	assert.Contains(t, asm, "movslq mem+0(%rip), %rax", "load should sign-extend the word at the offset into the register")
+}
+
+func TestLWAndSWAddressFromTheBaseRegister(t *testing.T) {
+	cg := NewCodeGen()
+	bytecode := []int{
+		int(opcodes.SW), 3, -4, 2,
+		int(opcodes.LW), 1, 8, 2,
+	}
+
+	asm := generate(t, cg, bytecode)
+
+	assert.Contains(t, asm, "movl %ecx, mem+-4(%rbx)", "store should write the low word of rs2 at base + offset")
+	assert.Contains(t, asm, "movslq mem+8(%rbx), %rax", "load should read the word at base + offset")
 }
 
 func TestHasEntryPoint(t *testing.T) {
@@ -200,7 +213,7 @@ func TestHasEntryPoint(t *testing.T) {
 		int(opcodes.ADDI), 1, 0, 42,
 	}
 
-	asm := cg.Generate(bytecode)
+	asm := generate(t, cg, bytecode)
 
 	assert.Contains(t, asm, ".global _start", "generated code should export _start symbol")
 	assert.Contains(t, asm, "_start:", "generated code should have _start label")
@@ -216,7 +229,7 @@ func TestNoOutputByDefault(t *testing.T) {
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
-	cg.Generate(bytecode)
+	generate(t, cg, bytecode)
 
 	w.Close()
 	os.Stdout = old
@@ -227,3 +240,63 @@ func TestNoOutputByDefault(t *testing.T) {
 
 	assert.Empty(t, output, "code generation should not produce stdout output")
 }
+
+func TestHighRegistersAreSpilledThroughScratchRegisters(t *testing.T) {
+	asm := generate(t, NewCodeGen(), []int{
+		int(opcodes.ADD), 16, 15, 31,
+		int(opcodes.BEQ), 14, 17, 8,
+	})
+
+	assert.Contains(t, asm, "pushq %r15\nmovq spill+0(%rip), %r15\npushq %r14\nmovq spill+120(%rip), %r14\n", "x16 and x31 should be loaded into scratch registers")
+	assert.Contains(t, asm, "movq %r15, spill+0(%rip)\npopq %r14\npopq %r15\n", "x16 should be stored back before the scratch registers are restored")
+	assert.Contains(t, asm, "movq spill+8(%rip), %r14\ncmpq %r14, %r15\npopq %r14\nje L12", "x14 is r15, so x17 should take r14, restored before the jump")
+	assert.Contains(t, asm, "spill: .space 128")
+}
+
+func TestWritesToX0LowerToNothing(t *testing.T) {
+	asm := generate(t, NewCodeGen(), []int{
+		int(opcodes.ADDI), 0, 0, 0,
+		int(opcodes.ADD), 0, 1, 2,
+		int(opcodes.DIV), 0, 1, 2,
+		int(opcodes.LUI), 0, 0, 5,
+		int(opcodes.LW), 0, 4, 2,
+	})
+
+	assert.Contains(t, asm, "_start:\ncmpl $0, mem+4(%rbx)\nmovq %rax, %rdi\n", "only the load should be kept, for its access to memory")
+	assert.NotContains(t, asm, ", $0\n", "x0 should never be a destination")
+}
+
+func TestBranchFromX0ComparesAZeroOnTheStack(t *testing.T) {
+	asm := generate(t, NewCodeGen(), []int{
+		int(opcodes.BLT), 0, 1, 8,
+		int(opcodes.BEQ), 0, 0, 4,
+	})
+
+	assert.Contains(t, asm, "pushq $0\ncmpq %rax, (%rsp)\nleaq 8(%rsp), %rsp\njl L8\n")
+	assert.Contains(t, asm, "pushq $0\ncmpq $0, (%rsp)\nleaq 8(%rsp), %rsp\nje L8\n")
+}
+
+func TestEveryOpcodeHasALowering(t *testing.T) {
+	for _, info := range opcodes.Table {
+		if info.Is(opcodes.Pseudo) || info.Is(opcodes.Compressed) {
+			continue
+		}
+		l, ok := lowerings[info.Op]
+		if !assert.True(t, ok, "%s has no entry in lowerings", info.Mnemonic) {
+			continue
+		}
+		assert.Equal(t, info.Is(opcodes.Branch), l.kind == lowerBranch, "%s", info.Mnemonic)
+		assert.Equal(t, info.Is(opcodes.Float), l.kind == lowerFloat, "%s", info.Mnemonic)
+		assert.Equal(t, info.Is(opcodes.RV64), l.kind == lowerRV64, "%s", info.Mnemonic)
+		switch l.kind {
+		case lowerBranch:
+			assert.NotEmpty(t, l.jump, "%s needs a jump", info.Mnemonic)
+		case lowerArith, lowerImmediate, lowerShift, lowerShiftImmediate, lowerCall, lowerReturn:
+			assert.NotEmpty(t, l.x86, "%s needs an x86 instruction", info.Mnemonic)
+		}
+	}
+	for op := range lowerings {
+		_, ok := opcodes.RV64Set.ByOpCode(op)
+		assert.True(t, ok, "lowerings has opcode %d, which is not in opcodes.Table", op)
+	}
+}
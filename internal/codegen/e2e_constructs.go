@@ -5,6 +5,10 @@ import (
 	"os/exec"
 	"testing"
 
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/phasecurve/zhuji/internal/vm"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,7 +16,67 @@ func runEndToEnd(t *testing.T, bytecode []int, expectedExitCode int, message str
 	t.Helper()
 
 	cg := NewCodeGen()
-	asm := cg.Generate(bytecode)
+	runGenerated(t, generate(t, cg, bytecode), expectedExitCode, message)
+}
+
+// runAgainstVM assembles source, runs it in the VM and then natively, and
+// checks that both leave expected in the low byte of x1.
+func runAgainstVM(t *testing.T, source string, expected int, message string) {
+	t.Helper()
+
+	runBytecodeAgainstVM(t, assembler.NewAssembler().Assemble(source), expected, message)
+}
+
+// runBytecodeAgainstVM is runAgainstVM for a program already assembled.
+func runBytecodeAgainstVM(t *testing.T, bytecode []int, expected int, message string) {
+	t.Helper()
+
+	rs := registers.NewRegisters()
+	err := vm.NewVM(rs, memory.NewMemory(1024)).Execute(bytecode)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, int(rs.Read(1))&0xFF, "the VM should agree: %s", message)
+
+	runEndToEnd(t, bytecode, expected, message)
+}
+
+// runStackEndToEnd is runEndToEnd for a stack-machine program.
+func runStackEndToEnd(t *testing.T, bytecode []int, expectedExitCode int, message string) {
+	t.Helper()
+
+	cg := NewCodeGen()
+	cg.EnableStackMode()
+	runGenerated(t, generate(t, cg, bytecode), expectedExitCode, message)
+}
+
+// runRV64EndToEnd is runEndToEnd for a program assembled in RV64 mode.
+func runRV64EndToEnd(t *testing.T, bytecode []int, expectedExitCode int, message string) {
+	t.Helper()
+
+	cg := NewCodeGen()
+	cg.EnableRV64()
+	runGenerated(t, generate(t, cg, bytecode), expectedExitCode, message)
+}
+
+// runAllocatedEndToEnd is runEndToEnd with linear-scan register allocation.
+func runAllocatedEndToEnd(t *testing.T, bytecode []int, expectedExitCode int, message string) {
+	t.Helper()
+
+	cg := NewCodeGen()
+	cg.EnableRegisterAllocation()
+	runGenerated(t, generate(t, cg, bytecode), expectedExitCode, message)
+}
+
+// generate is cg.Generate for a program the test expects to compile.
+func generate(t testing.TB, cg *CodeGen, bytecode []int) string {
+	t.Helper()
+
+	asm, err := cg.Generate(bytecode)
+	assert.NoError(t, err)
+	return asm
+}
+
+func runGenerated(t *testing.T, asm string, expectedExitCode int, message string) {
+	t.Helper()
 
 	tmpDir := t.TempDir()
 	asmFile := tmpDir + "/test.s"
@@ -0,0 +1,430 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/fpu"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// scratchXMM is the SSE register left out of the float register mapping, for
+// lowerings that need somewhere to build a result.
+const scratchXMM = "%xmm15"
+
+// floatRegister maps f<n> to the SSE register that holds it. f0 to f14 map to
+// xmm0 to xmm14; floatOp borrows one of those for any other float register
+// before it gets here.
+func floatRegister(n int) string {
+	if n < 0 || n >= floatSpillBase {
+		panic(fmt.Sprintf("f%d has no x86-64 register: codegen maps f0 to f14", n))
+	}
+	return fmt.Sprintf("%%xmm%d", n)
+}
+
+// floatSpillBase is the first float register without an SSE register of its
+// own. f15 to f31 live in a spill area of their own, a quadword each.
+const floatSpillBase = 15
+
+// floatSpillSlot addresses the slot of spilled float register f.
+func floatSpillSlot(f int) string {
+	return fmt.Sprintf("fspill+%d(%s)", 8*(f-floatSpillBase), rip)
+}
+
+// floatSlots lists the slots holding the float registers an instruction
+// names.
+func floatSlots(info opcodes.Info) []int {
+	var slots []int
+	for _, f := range info.Format.Fields() {
+		if f.Kind == opcodes.FRegOperand {
+			slots = append(slots, f.Slot)
+		}
+	}
+	return slots
+}
+
+// floatSpillOp lowers a float instruction naming spilled float registers the
+// way spillOp does for integer ones: each gets an SSE register the
+// instruction does not name, saved on the stack around it, and a spilled
+// destination is stored back. xmm15 is never borrowed, as lowerings use it
+// as scratchXMM.
+func (c *CodeGen) floatSpillOp(info opcodes.Info, inst [4]int, ip int) {
+	named := map[int]bool{}
+	for _, slot := range floatSlots(info) {
+		named[inst[slot]] = true
+	}
+	scratch := map[int]int{}
+	var spilled []int
+	candidate := floatSpillBase - 1
+	rewritten := inst
+	for _, slot := range floatSlots(info) {
+		f := inst[slot]
+		if f < floatSpillBase {
+			continue
+		}
+		if _, ok := scratch[f]; !ok {
+			for named[candidate] {
+				candidate--
+			}
+			scratch[f] = candidate
+			candidate--
+			spilled = append(spilled, f)
+		}
+		rewritten[slot] = scratch[f]
+	}
+	for _, f := range spilled {
+		c.floatSpillEnd = max(c.floatSpillEnd, f+1)
+		c.emit("subq $8, %rsp")
+		c.emit(fmt.Sprintf("movsd %s, (%%rsp)", floatRegister(scratch[f])))
+		c.emit(fmt.Sprintf("movsd %s, %s", floatSpillSlot(f), floatRegister(scratch[f])))
+	}
+	c.floatOp(info, rewritten, ip)
+	fields := info.Format.Fields()
+	if fd := inst[1]; fields[0].Kind == opcodes.FRegOperand && !info.Is(opcodes.Stores) && fd >= floatSpillBase {
+		c.emit(fmt.Sprintf("movsd %s, %s", floatRegister(scratch[fd]), floatSpillSlot(fd)))
+	}
+	for i := len(spilled) - 1; i >= 0; i-- {
+		c.emit(fmt.Sprintf("movsd (%%rsp), %s", floatRegister(scratch[spilled[i]])))
+		c.emit("addq $8, %rsp")
+	}
+}
+
+// floatArith maps the F and D arithmetic to the SSE instruction for singles,
+// whose last letter becomes d for doubles.
+var floatArith = map[opcodes.OpCode]string{
+	opcodes.FADDS: "addss", opcodes.FADDD: "addss",
+	opcodes.FSUBS: "subss", opcodes.FSUBD: "subss",
+	opcodes.FMULS: "mulss", opcodes.FMULD: "mulss",
+	opcodes.FDIVS: "divss", opcodes.FDIVD: "divss",
+}
+
+// floatCompare maps feq, flt and fle to the SSE compare that sets every bit
+// of the low element when the condition holds.
+var floatCompare = map[opcodes.OpCode]string{
+	opcodes.FEQS: "cmpeqss", opcodes.FEQD: "cmpeqss",
+	opcodes.FLTS: "cmpltss", opcodes.FLTD: "cmpltss",
+	opcodes.FLES: "cmpless", opcodes.FLED: "cmpless",
+}
+
+// mxcsrRounding is the rounding control field of MXCSR for each static
+// rounding mode SSE has.
+var mxcsrRounding = map[fpu.RoundingMode]int{
+	fpu.RDN: 1 << 13, fpu.RUP: 2 << 13, fpu.RTZ: 3 << 13,
+}
+
+// floatOp lowers the F and D instructions to SSE2. Native code runs with
+// MXCSR's default round-to-nearest, which is what frm holds until a program
+// writes it; a static rounding mode is set in MXCSR around the one
+// instruction. There is no fcsr, so a program that reads or writes fflags,
+// frm or fcsr is rejected, and SSE has no rmm rounding mode, so an
+// instruction using it is rejected too. NaN results keep x86's bit patterns
+// rather than RISC-V's canonical NaN.
+func (c *CodeGen) floatOp(info opcodes.Info, inst [4]int, ip int) {
+	for _, slot := range floatSlots(info) {
+		if inst[slot] >= floatSpillBase {
+			c.floatSpillOp(info, inst, ip)
+			return
+		}
+	}
+	op := info.Op
+	a, b, rm := inst[1], inst[2], fpu.RoundingMode(inst[3])
+	double := info.Is(opcodes.Double)
+	suffix := func(mnemonic string) string {
+		if double {
+			return mnemonic[:len(mnemonic)-1] + "d"
+		}
+		return mnemonic
+	}
+	switch op {
+	case opcodes.FLW, opcodes.FLD:
+		base := riscTox86Regs[inst[3]]
+		c.emit(fmt.Sprintf("%s %s, %s", suffix("movss"), memoryOperand(base, b), floatRegister(a)))
+	case opcodes.FSW, opcodes.FSD:
+		base := riscTox86Regs[inst[3]]
+		c.emit(fmt.Sprintf("%s %s, %s", suffix("movss"), floatRegister(a), memoryOperand(base, b)))
+	case opcodes.FADDS, opcodes.FSUBS, opcodes.FMULS, opcodes.FDIVS,
+		opcodes.FADDD, opcodes.FSUBD, opcodes.FMULD, opcodes.FDIVD:
+		commutes := op == opcodes.FADDS || op == opcodes.FADDD || op == opcodes.FMULS || op == opcodes.FMULD
+		c.floatArithOp(suffix(floatArith[op]), floatRegister(a), floatRegister(b), floatRegister(inst[3]), commutes)
+	case opcodes.FSQRTS, opcodes.FSQRTD:
+		c.withRounding(info, rm, func() {
+			c.emit(fmt.Sprintf("%s %s, %s", suffix("sqrtss"), floatRegister(b), floatRegister(a)))
+		})
+	case opcodes.FMINS, opcodes.FMAXS, opcodes.FMIND, opcodes.FMAXD:
+		c.minMaxOp(op, double, floatRegister(a), floatRegister(b), floatRegister(inst[3]), ip)
+	case opcodes.FSGNJS, opcodes.FSGNJNS, opcodes.FSGNJXS,
+		opcodes.FSGNJD, opcodes.FSGNJND, opcodes.FSGNJXD:
+		c.signInjectionOp(op, double, floatRegister(a), floatRegister(b), floatRegister(inst[3]))
+	case opcodes.FCVTWS, opcodes.FCVTWUS, opcodes.FCVTWD, opcodes.FCVTWUD:
+		c.toIntegerOp(info, rm, riscTox86Regs[a], floatRegister(b), ip)
+	case opcodes.FCVTSW, opcodes.FCVTSWU, opcodes.FCVTDW, opcodes.FCVTDWU:
+		fd, rs := floatRegister(a), riscTox86Regs[b]
+		unsigned := op == opcodes.FCVTSWU || op == opcodes.FCVTDWU
+		c.withRounding(info, rm, func() {
+			c.fromIntegerOp(suffix("cvtsi2ss"), fd, rs, unsigned)
+		})
+	case opcodes.FCVTSD:
+		c.withRounding(info, rm, func() {
+			c.emit(fmt.Sprintf("cvtsd2ss %s, %s", floatRegister(b), floatRegister(a)))
+		})
+	case opcodes.FCVTDS:
+		c.emit(fmt.Sprintf("cvtss2sd %s, %s", floatRegister(b), floatRegister(a)))
+	case opcodes.FEQS, opcodes.FLTS, opcodes.FLES, opcodes.FEQD, opcodes.FLTD, opcodes.FLED:
+		rd := riscTox86Regs[a]
+		if rd == "$0" {
+			break
+		}
+		c.emit(fmt.Sprintf("movaps %s, %s", floatRegister(b), scratchXMM))
+		c.emit(fmt.Sprintf("%s %s, %s", suffix(floatCompare[op]), floatRegister(inst[3]), scratchXMM))
+		c.emit(fmt.Sprintf("movd %s, %s", scratchXMM, x86Regs32[rd]))
+		c.emit(fmt.Sprintf("andl $1, %s", x86Regs32[rd]))
+	case opcodes.FMVXW:
+		rd := riscTox86Regs[a]
+		if rd == "$0" {
+			break
+		}
+		c.emit(fmt.Sprintf("movd %s, %s", floatRegister(b), x86Regs32[rd]))
+		c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+	case opcodes.FCLASSS, opcodes.FCLASSD:
+		c.classifyOp(double, riscTox86Regs[a], floatRegister(b), ip)
+	case opcodes.FMVWX:
+		fd, rs := floatRegister(a), riscTox86Regs[b]
+		if rs == "$0" {
+			c.emit(fmt.Sprintf("xorps %s, %s", fd, fd))
+		} else {
+			c.emit(fmt.Sprintf("movd %s, %s", x86Regs32[rs], fd))
+		}
+	default:
+		c.unsupported("%s is not supported in x86-64 codegen", info.Mnemonic)
+	}
+}
+
+// floatArithOp lowers fd = fa op fb, which SSE only has in the two-operand
+// form fd = fd op fb. When fd is fb and the operation does not commute, fb is
+// copied out of the way first.
+func (c *CodeGen) floatArithOp(inst, fd, fa, fb string, commutes bool) {
+	switch {
+	case fd == fa:
+		c.emit(fmt.Sprintf("%s %s, %s", inst, fb, fd))
+	case fd == fb && commutes:
+		c.emit(fmt.Sprintf("%s %s, %s", inst, fa, fd))
+	case fd == fb:
+		c.emit(fmt.Sprintf("movaps %s, %s", fb, scratchXMM))
+		c.emit(fmt.Sprintf("movaps %s, %s", fa, fd))
+		c.emit(fmt.Sprintf("%s %s, %s", inst, scratchXMM, fd))
+	default:
+		c.emit(fmt.Sprintf("movaps %s, %s", fa, fd))
+		c.emit(fmt.Sprintf("%s %s, %s", inst, fb, fd))
+	}
+}
+
+// withRounding runs emit with MXCSR set to the static rounding mode rm, saved
+// and restored on the stack. dyn and rne need nothing, as native code never
+// leaves round-to-nearest.
+func (c *CodeGen) withRounding(info opcodes.Info, rm fpu.RoundingMode, emit func()) {
+	if rm == fpu.DYN || rm == fpu.RNE {
+		emit()
+		return
+	}
+	rounding, ok := mxcsrRounding[rm]
+	if !ok {
+		c.unsupported("%s with rounding mode %d is not supported in x86-64 codegen", info.Mnemonic, rm)
+		return
+	}
+	c.emit("subq $8, %rsp")
+	c.emit("stmxcsr (%rsp)")
+	c.emit("stmxcsr 4(%rsp)")
+	c.emit("andl $-24577, 4(%rsp)")
+	c.emit(fmt.Sprintf("orl $%d, 4(%%rsp)", rounding))
+	c.emit("ldmxcsr 4(%rsp)")
+	emit()
+	c.emit("ldmxcsr (%rsp)")
+	c.emit("addq $8, %rsp")
+}
+
+// minMaxOp lowers fmin and fmax. minss and maxss only agree with RISC-V when
+// the operands are ordered and differ, so equal operands, where the sign of a
+// zero decides, and NaNs, where the other operand wins, are handled apart.
+// The result is built in the scratch register, so fd may be either operand.
+func (c *CodeGen) minMaxOp(op opcodes.OpCode, double bool, fd, fa, fb string, ip int) {
+	inst, equal, compare := "minss", "orps", "ucomiss"
+	if op == opcodes.FMAXS || op == opcodes.FMAXD {
+		inst, equal = "maxss", "andps"
+	}
+	if double {
+		inst, compare = inst[:4]+"d", "ucomisd"
+	}
+	differ, unordered := c.localLabel(ip, "fdiffer"), c.localLabel(ip, "funordered")
+	done := c.localLabel(ip, "fminmax")
+	c.emit(fmt.Sprintf("movaps %s, %s", fa, scratchXMM))
+	c.emit(fmt.Sprintf("%s %s, %s", compare, fb, fa))
+	c.emit(fmt.Sprintf("jp %s", unordered))
+	c.emit(fmt.Sprintf("jne %s", differ))
+	c.emit(fmt.Sprintf("%s %s, %s", equal, fb, scratchXMM))
+	c.emit(fmt.Sprintf("jmp %s", done))
+	c.emit(fmt.Sprintf("%s:", differ))
+	c.emit(fmt.Sprintf("%s %s, %s", inst, fb, scratchXMM))
+	c.emit(fmt.Sprintf("jmp %s", done))
+	c.emit(fmt.Sprintf("%s:", unordered))
+	c.emit(fmt.Sprintf("%s %s, %s", compare, fa, fa))
+	c.emit(fmt.Sprintf("jnp %s", done))
+	c.emit(fmt.Sprintf("movaps %s, %s", fb, scratchXMM))
+	c.emit(fmt.Sprintf("%s %s, %s", compare, fb, fb))
+	c.emit(fmt.Sprintf("jnp %s", done))
+	if double {
+		c.emit("pushq $0")
+		c.emit("movl $0x7ff80000, 4(%rsp)")
+		c.emit(fmt.Sprintf("movsd (%%rsp), %s", scratchXMM))
+	} else {
+		c.emit("pushq $0x7fc00000")
+		c.emit(fmt.Sprintf("movss (%%rsp), %s", scratchXMM))
+	}
+	c.emit("addq $8, %rsp")
+	c.emit(fmt.Sprintf("%s:", done))
+	c.emit(fmt.Sprintf("movaps %s, %s", scratchXMM, fd))
+}
+
+// signInjectionOp lowers the fsgnj forms on the stack, where the word holding
+// each operand's sign bit can be worked on with integer instructions. rax is
+// saved around the lowering to hold the sign.
+func (c *CodeGen) signInjectionOp(op opcodes.OpCode, double bool, fd, fa, fb string) {
+	if (op == opcodes.FSGNJS || op == opcodes.FSGNJD) && fa == fb {
+		if fd != fa {
+			c.emit(fmt.Sprintf("movaps %s, %s", fa, fd))
+		}
+		return
+	}
+	size, move := 4, "movss"
+	if double {
+		size, move = 8, "movsd"
+	}
+	high := size - 4
+	c.emit("pushq %rax")
+	c.emit(fmt.Sprintf("subq $%d, %%rsp", 2*size))
+	c.emit(fmt.Sprintf("%s %s, (%%rsp)", move, fa))
+	c.emit(fmt.Sprintf("%s %s, %d(%%rsp)", move, fb, size))
+	c.emit(fmt.Sprintf("movl %d(%%rsp), %%eax", size+high))
+	switch op {
+	case opcodes.FSGNJNS, opcodes.FSGNJND:
+		c.emit("notl %eax")
+	case opcodes.FSGNJXS, opcodes.FSGNJXD:
+		c.emit(fmt.Sprintf("xorl %d(%%rsp), %%eax", high))
+	}
+	c.emit("andl $0x80000000, %eax")
+	c.emit(fmt.Sprintf("andl $0x7fffffff, %d(%%rsp)", high))
+	c.emit(fmt.Sprintf("orl %%eax, %d(%%rsp)", high))
+	c.emit(fmt.Sprintf("%s (%%rsp), %s", move, fd))
+	c.emit(fmt.Sprintf("addq $%d, %%rsp", 2*size))
+	c.emit("popq %rax")
+}
+
+// toIntegerOp lowers fcvt.w and fcvt.wu. An unsigned word is converted as a
+// 64-bit integer, which holds all of them, and like a signed one is then
+// sign-extended from 32 bits, the way every register is held. Out of range,
+// x86 gives the most negative integer where RISC-V saturates, so that result
+// is checked for and replaced: by the bound on the side of the source, or by
+// the largest value for a NaN.
+func (c *CodeGen) toIntegerOp(info opcodes.Info, rm fpu.RoundingMode, rd, fs string, ip int) {
+	if rd == "$0" {
+		return
+	}
+	inst, compare, dst := "cvtss2si", "ucomiss", x86Regs32[rd]
+	if info.Is(opcodes.Double) {
+		inst, compare = "cvtsd2si", "ucomisd"
+	}
+	unsigned := info.Op == opcodes.FCVTWUS || info.Op == opcodes.FCVTWUD
+	if unsigned {
+		dst = rd
+	}
+	if rm == fpu.RTZ {
+		c.emit(fmt.Sprintf("%s %s, %s", inst[:3]+"t"+inst[3:], fs, dst))
+	} else {
+		c.withRounding(info, rm, func() {
+			c.emit(fmt.Sprintf("%s %s, %s", inst, fs, dst))
+		})
+	}
+	done := c.localLabel(ip, "fcvtdone")
+	largest, smallest, inRange := "$2147483647", "$-2147483648", "jne"
+	if unsigned {
+		// Only a result with its upper half clear is in range.
+		largest, smallest, inRange = "$-1", "$0", "je"
+		c.emit(fmt.Sprintf("pushq %s", rd))
+		c.emit("cmpl $0, 4(%rsp)")
+		c.emit(fmt.Sprintf("popq %s", rd))
+	} else {
+		c.emit(fmt.Sprintf("cmpl %s, %s", smallest, dst))
+	}
+	c.emit(fmt.Sprintf("%s %s", inRange, done))
+	c.emit(fmt.Sprintf("xorps %s, %s", scratchXMM, scratchXMM))
+	c.emit(fmt.Sprintf("%s %s, %s", compare, scratchXMM, fs))
+	c.emit(fmt.Sprintf("movl %s, %s", largest, x86Regs32[rd]))
+	c.emit(fmt.Sprintf("jp %s", done))
+	c.emit(fmt.Sprintf("ja %s", done))
+	c.emit(fmt.Sprintf("movl %s, %s", smallest, x86Regs32[rd]))
+	c.emit(fmt.Sprintf("%s:", done))
+	c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+}
+
+// classifyOp lowers fclass, working on the bits of fs in rd. The bits are
+// kept on the stack, where the sign is read from their top byte, and are
+// shifted in rd to leave first the exponent, then the fraction, whose top
+// bit tells a quiet NaN from a signalling one.
+func (c *CodeGen) classifyOp(double bool, rd, fs string, ip int) {
+	move, reg, suffix, exponent, fraction, maxExponent, top := "movd", x86Regs32[rd], "l", 24, 9, 0xff, 3
+	if double {
+		move, reg, suffix, exponent, fraction, maxExponent, top = "movq", rd, "q", 53, 12, 0x7ff, 7
+	}
+	label := func(name string) string { return c.localLabel(ip, "fclass"+name) }
+	c.emit(fmt.Sprintf("%s %s, %s", move, fs, reg))
+	c.emit(fmt.Sprintf("pushq %s", rd))
+	c.emit(fmt.Sprintf("shl%s $1, %s", suffix, reg))
+	c.emit(fmt.Sprintf("shr%s $%d, %s", suffix, exponent, reg))
+	c.emit(fmt.Sprintf("cmp%s $%d, %s", suffix, maxExponent, reg))
+	c.emit(fmt.Sprintf("je %s", label("special")))
+	c.emit(fmt.Sprintf("test%s %s, %s", suffix, reg, reg))
+	c.emit(fmt.Sprintf("jne %s", label("normal")))
+	c.emit(fmt.Sprintf("mov%s (%%rsp), %s", suffix, reg))
+	c.emit(fmt.Sprintf("shl%s $%d, %s", suffix, fraction, reg))
+	c.emit(fmt.Sprintf("jne %s", label("subnormal")))
+	// Each class has one bit for a positive value and the mirror image of it
+	// for a negative one: bit 4 for +0 and bit 3 for -0.
+	signed := func(positive, negative int) {
+		c.emit(fmt.Sprintf("movl $%d, %s", 1<<positive, x86Regs32[rd]))
+		c.emit(fmt.Sprintf("cmpb $0, %d(%%rsp)", top))
+		c.emit(fmt.Sprintf("jns %s", label("done")))
+		c.emit(fmt.Sprintf("movl $%d, %s", 1<<negative, x86Regs32[rd]))
+		c.emit(fmt.Sprintf("jmp %s", label("done")))
+	}
+	signed(4, 3)
+	c.emit(fmt.Sprintf("%s:", label("subnormal")))
+	signed(5, 2)
+	c.emit(fmt.Sprintf("%s:", label("normal")))
+	signed(6, 1)
+	c.emit(fmt.Sprintf("%s:", label("special")))
+	c.emit(fmt.Sprintf("mov%s (%%rsp), %s", suffix, reg))
+	c.emit(fmt.Sprintf("shl%s $%d, %s", suffix, fraction, reg))
+	c.emit(fmt.Sprintf("je %s", label("infinite")))
+	c.emit(fmt.Sprintf("movl $%d, %s", 1<<9, x86Regs32[rd]))
+	c.emit(fmt.Sprintf("js %s", label("done")))
+	c.emit(fmt.Sprintf("movl $%d, %s", 1<<8, x86Regs32[rd]))
+	c.emit(fmt.Sprintf("jmp %s", label("done")))
+	c.emit(fmt.Sprintf("%s:", label("infinite")))
+	signed(7, 0)
+	c.emit(fmt.Sprintf("%s:", label("done")))
+	c.emit("addq $8, %rsp")
+}
+
+// fromIntegerOp lowers fcvt.s.w and its relatives. An unsigned word is
+// zero-extended on the stack and converted as a 64-bit integer.
+func (c *CodeGen) fromIntegerOp(inst, fd, rs string, unsigned bool) {
+	switch {
+	case rs == "$0":
+		c.emit(fmt.Sprintf("xorps %s, %s", fd, fd))
+	case unsigned:
+		c.emit(fmt.Sprintf("pushq %s", rs))
+		c.emit("movl $0, 4(%rsp)")
+		c.emit(fmt.Sprintf("%sq (%%rsp), %s", inst, fd))
+		c.emit("addq $8, %rsp")
+	default:
+		c.emit(fmt.Sprintf("%sl %s, %s", inst, x86Regs32[rs], fd))
+	}
+}
@@ -0,0 +1,242 @@
+package codegen
+
+import (
+	"slices"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// allocatable are the registers linear scan hands out, named by the RISC-V
+// register the fixed map gives each x86 one: x2 to x15, rbx to r15 and rbp.
+// x1 keeps rax, where the program leaves its exit status. rbp is the frame
+// pointer of functions, so a program with any keeps it back and has 13
+// registers to use instead of 14.
+var allocatable = []int{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// framePointer is the register in the fixed map that holds rbp.
+const framePointer = 15
+
+// allocation maps each RISC-V register of each instruction of a program, by
+// index, to the register in the fixed map that holds it there, or to a
+// register from spillBase up whose slot in the spill area holds it.
+type allocation [][32]int
+
+// rename rewrites the registers the instruction at index i names to where
+// the allocation put them, so that the instruction can be lowered as though
+// written for the fixed map.
+func (a allocation) rename(i int, info opcodes.Info, inst [4]int) [4]int {
+	for _, slot := range info.RegisterSlots() {
+		if r := inst[slot]; r >= 0 && r < len(a[i]) {
+			inst[slot] = a[i][r]
+		}
+	}
+	return inst
+}
+
+// web is one value of a register: the instructions, by index, at which it is
+// written, read or live, joined along the edges of the control flow graph it
+// stays live across. Writing a register again starts a new web, so one
+// register may have several, each allocated on its own. start and end are
+// the first and last of its instructions.
+type web struct {
+	reg, start, end int
+	insts           []int
+}
+
+// flowInstruction is one instruction of the program with the registers it
+// reads and writes, as bit sets, and the instructions control can go to
+// next. A successor of -1 is the end of the program.
+type flowInstruction struct {
+	uses, defs uint32
+	succs      []int
+}
+
+// allocate assigns registers to the program by linear scan over the webs a
+// liveness analysis of its control flow graph finds, each taken to span the
+// instructions from its start to its end. Webs that do not overlap share a
+// register; when more overlap than there are registers, the one that ends
+// last is spilled. rbp is only handed out to a program without functions.
+func (c *CodeGen) allocate(bytecode []int) allocation {
+	insts := c.flowGraph(bytecode)
+	liveIn, liveOut := liveness(insts)
+
+	var webs []web
+	for r := 2; r < 32; r++ {
+		webs = append(webs, findWebs(insts, liveIn, liveOut, r)...)
+	}
+	slices.SortStableFunc(webs, func(a, b web) int { return a.start - b.start })
+
+	free := slices.Clone(allocatable)
+	if len(c.findFunctions(bytecode)) > 0 {
+		free = slices.DeleteFunc(free, func(r int) bool { return r == framePointer })
+	}
+	placed := make([]int, len(webs))
+	var active []int
+	spill := spillBase
+	for w := range webs {
+		active = slices.DeleteFunc(active, func(old int) bool {
+			if webs[old].end < webs[w].start {
+				free = append(free, placed[old])
+				return true
+			}
+			return false
+		})
+		slices.Sort(free)
+		if len(free) > 0 {
+			placed[w], free = free[0], free[1:]
+			active = append(active, w)
+			continue
+		}
+		last := 0
+		for i := range active {
+			if webs[active[i]].end > webs[active[last]].end {
+				last = i
+			}
+		}
+		if webs[active[last]].end > webs[w].end {
+			placed[w], placed[active[last]] = placed[active[last]], spill
+			active[last] = w
+		} else {
+			placed[w] = spill
+		}
+		spill++
+	}
+
+	a := make(allocation, len(insts))
+	for i := range a {
+		for r := range a[i] {
+			a[i][r] = r
+		}
+	}
+	for w, wb := range webs {
+		for _, i := range wb.insts {
+			a[i][wb.reg] = placed[w]
+		}
+	}
+	return a
+}
+
+// findWebs splits the instructions at which register r is written, read or
+// live into webs, joining each to the successors it is live into.
+func findWebs(insts []flowInstruction, liveIn, liveOut []uint32, r int) []web {
+	bit := uint32(1) << r
+	parent := make([]int, len(insts))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for i, in := range insts {
+		if liveOut[i]&bit == 0 {
+			continue
+		}
+		for _, s := range in.succs {
+			if s >= 0 && liveIn[s]&bit != 0 {
+				parent[root(s)] = root(i)
+			}
+		}
+	}
+
+	var webs []web
+	byRoot := map[int]int{}
+	for i, in := range insts {
+		if (in.uses|in.defs|liveIn[i]|liveOut[i])&bit == 0 {
+			continue
+		}
+		w, ok := byRoot[root(i)]
+		if !ok {
+			w = len(webs)
+			byRoot[root(i)] = w
+			webs = append(webs, web{reg: r, start: i})
+		}
+		webs[w].end = i
+		webs[w].insts = append(webs[w].insts, i)
+	}
+	return webs
+}
+
+// flowGraph lists the instructions of the program with what they read and
+// write and where control goes after each. JAL is lowered to a call, so it
+// goes both to its target and, once the call returns, to the next
+// instruction; JALR is lowered to ret and may go back after any JAL. x0 is
+// never allocated and is left out.
+func (c *CodeGen) flowGraph(bytecode []int) []flowInstruction {
+	var ips []int
+	index := map[int]int{}
+	for ip := 0; ip < len(bytecode); {
+		_, size, _ := c.set.Fetch(bytecode, ip)
+		index[ip] = len(ips)
+		ips = append(ips, ip)
+		ip += size
+	}
+	index[len(bytecode)] = -1
+	at := func(ip int) int {
+		if i, ok := index[ip]; ok {
+			return i
+		}
+		return -1
+	}
+
+	insts := make([]flowInstruction, len(ips))
+	var returns []int
+	for i, ip := range ips {
+		inst, size, _ := c.set.Fetch(bytecode, ip)
+		info, _ := c.set.ByOpCode(opcodes.OpCode(inst[0]))
+		for _, slot := range info.RegisterSlots() {
+			if r := inst[slot]; r <= 0 || r >= 32 {
+				continue
+			} else if slot == 1 && writesRegister(info) {
+				insts[i].defs |= 1 << r
+			} else {
+				insts[i].uses |= 1 << r
+			}
+		}
+		next := at(ip + size)
+		switch {
+		case info.Is(opcodes.Branch):
+			insts[i].succs = []int{next, at(ip + inst[3])}
+		case info.Op == opcodes.JAL:
+			insts[i].succs = []int{at(ip + inst[3]), next}
+			returns = append(returns, next)
+		case info.Op != opcodes.JALR:
+			insts[i].succs = []int{next}
+		}
+	}
+	for i, ip := range ips {
+		if inst, _, _ := c.set.Fetch(bytecode, ip); opcodes.OpCode(inst[0]) == opcodes.JALR {
+			insts[i].succs = append(slices.Clone(returns), -1)
+		}
+	}
+	return insts
+}
+
+// liveness finds the registers live into and out of each instruction by
+// iterating the dataflow equations to a fixed point. x1 is live at the end
+// of the program, which exits with it.
+func liveness(insts []flowInstruction) (liveIn, liveOut []uint32) {
+	liveIn = make([]uint32, len(insts))
+	liveOut = make([]uint32, len(insts))
+	for changed := true; changed; {
+		changed = false
+		for i := len(insts) - 1; i >= 0; i-- {
+			var out uint32
+			for _, s := range insts[i].succs {
+				if s < 0 {
+					out |= 1 << 1
+				} else {
+					out |= liveIn[s]
+				}
+			}
+			in := insts[i].uses | out&^insts[i].defs
+			if in != liveIn[i] || out != liveOut[i] {
+				liveIn[i], liveOut[i], changed = in, out, true
+			}
+		}
+	}
+	return liveIn, liveOut
+}
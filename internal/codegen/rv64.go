@@ -0,0 +1,218 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// shifts64 maps each RV64 shift to the x86 one: a quadword shift for the
+// doubleword forms and a long one, masked to five bits, for the W forms.
+var shifts64 = map[opcodes.OpCode]string{
+	opcodes.SLL: "shlq", opcodes.SLLI: "shlq",
+	opcodes.SRL: "shrq", opcodes.SRLI: "shrq",
+	opcodes.SRA: "sarq", opcodes.SRAI: "sarq",
+	opcodes.SLLW: "shll", opcodes.SLLIW: "shll",
+	opcodes.SRLW: "shrl", opcodes.SRLIW: "shrl",
+	opcodes.SRAW: "sarl", opcodes.SRAIW: "sarl",
+}
+
+// mWidth names the forms of rax and rdx, the instruction suffix and the
+// sign extension into rdx for an M-extension operation on doublewords or on
+// words.
+type mWidth struct {
+	suffix, ax, dx, extend string
+}
+
+var (
+	doublewordWidth = mWidth{"q", "%rax", "%rdx", "cqto"}
+	wordWidth       = mWidth{"l", "%eax", "%edx", "cltd"}
+)
+
+// rv64Op lowers the instructions whose meaning changes with XLEN=64 and
+// reports whether inst was one of them. The rest, such as ADD or the
+// branches, already work on the whole register and are lowered as on RV32.
+// The F, D and B extensions are RV32-only here.
+func (c *CodeGen) rv64Op(info opcodes.Info, inst [4]int, ip int) bool {
+	if k := lowerings[info.Op].kind; k == lowerFloat || k == lowerBitmanip {
+		c.unsupported("%s is not supported in RV64 x86-64 codegen", info.Mnemonic)
+		return true
+	}
+	switch op := info.Op; op {
+	case opcodes.SLLI, opcodes.SRLI, opcodes.SRAI:
+		c.immediateShift(shifts64[op], inst[3]&63, false, inst)
+	case opcodes.SLLIW, opcodes.SRLIW, opcodes.SRAIW:
+		c.immediateShift(shifts64[op], inst[3]&31, true, inst)
+	case opcodes.SLL, opcodes.SRL, opcodes.SRA:
+		c.registerShift(shifts64[op], false, inst)
+	case opcodes.SLLW, opcodes.SRLW, opcodes.SRAW:
+		c.registerShift(shifts64[op], true, inst)
+	case opcodes.ADDIW:
+		c.addImmediateWordOp(inst)
+	case opcodes.ADDW, opcodes.SUBW:
+		c.wordOp(op, inst)
+	case opcodes.MULH, opcodes.MULHU, opcodes.MULHSU, opcodes.MULW,
+		opcodes.DIV, opcodes.REM, opcodes.DIVU, opcodes.REMU,
+		opcodes.DIVW, opcodes.REMW, opcodes.DIVUW, opcodes.REMUW:
+		c.mExtension64Op(op, inst, ip)
+	case opcodes.LW, opcodes.LWU, opcodes.LD:
+		c.load64Op(op, inst)
+	case opcodes.SW, opcodes.SD:
+		c.store64Op(op, inst)
+	default:
+		return false
+	}
+	return true
+}
+
+// addImmediateWordOp lowers ADDIW, and so sext.w, to a 32-bit add whose
+// result is sign-extended back over rd.
+func (c *CodeGen) addImmediateWordOp(inst [4]int) {
+	rd := riscTox86Regs[inst[1]]
+	rs := riscTox86Regs[inst[2]]
+	if rd == "$0" {
+		return
+	}
+	if rd != rs {
+		c.emit(fmt.Sprintf("movq %s, %s", rs, rd))
+	}
+	c.emit(fmt.Sprintf("addl $%d, %s", inst[3], x86Regs32[rd]))
+	c.emit(fmt.Sprintf("movslq %s, %s", x86Regs32[rd], rd))
+}
+
+// wordOp lowers ADDW and SUBW on a copy of rs1 on the stack, so that rd may
+// be either source.
+func (c *CodeGen) wordOp(op opcodes.OpCode, inst [4]int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	rs2 := riscTox86Regs[inst[3]]
+	if rd == "$0" {
+		return
+	}
+	operation := "addl"
+	if op == opcodes.SUBW {
+		operation = "subl"
+	}
+	c.emit(fmt.Sprintf("pushq %s", rs1))
+	c.emit(fmt.Sprintf("%s %s, (%%rsp)", operation, x86Regs32[rs2]))
+	c.emit(fmt.Sprintf("movslq (%%rsp), %s", rd))
+	c.emit("addq $8, %rsp")
+}
+
+// mExtension64Op lowers the RV64 multiplies and divisions that need rax and
+// rdx, saving them around the operation as mExtensionOp does. The W forms
+// work on the low words and sign-extend their result.
+func (c *CodeGen) mExtension64Op(op opcodes.OpCode, inst [4]int, ip int) {
+	rd := riscTox86Regs[inst[1]]
+	rs1 := riscTox86Regs[inst[2]]
+	rs2 := riscTox86Regs[inst[3]]
+	c.emit("pushq %rax")
+	c.emit("pushq %rdx")
+	c.emit(fmt.Sprintf("pushq %s", rs2))
+	c.emit(fmt.Sprintf("movq %s, %%rax", rs1))
+	width, result := doublewordWidth, "%rax"
+	switch op {
+	case opcodes.MULH:
+		c.emit("imulq (%rsp)")
+		result = "%rdx"
+	case opcodes.MULHU:
+		c.emit("mulq (%rsp)")
+		result = "%rdx"
+	case opcodes.MULHSU:
+		// The unsigned product of rs1's bits is too large by rs2 << 64 when
+		// rs1 is negative, so rs2 comes off the upper doubleword.
+		c.emit("movq %rax, %rdx")
+		c.emit("sarq $63, %rdx")
+		c.emit("andq (%rsp), %rdx")
+		c.emit("pushq %rdx")
+		c.emit("mulq 8(%rsp)")
+		c.emit("subq (%rsp), %rdx")
+		c.emit("addq $8, %rsp")
+		result = "%rdx"
+	case opcodes.MULW:
+		c.emit("imull (%rsp)")
+		width, result = wordWidth, "%eax"
+	default:
+		if op == opcodes.DIVW || op == opcodes.REMW || op == opcodes.DIVUW || op == opcodes.REMUW {
+			width = wordWidth
+		}
+		result = width.ax
+		if op == opcodes.REM || op == opcodes.REMU || op == opcodes.REMW || op == opcodes.REMUW {
+			result = width.dx
+		}
+		signed := op == opcodes.DIV || op == opcodes.REM || op == opcodes.DIVW || op == opcodes.REMW
+		c.divide(width, signed, ip)
+	}
+	if width == wordWidth {
+		c.emit(fmt.Sprintf("movslq %s, %%rax", result))
+	} else if result != "%rax" {
+		c.emit(fmt.Sprintf("movq %s, %%rax", result))
+	}
+	c.emit("movq %rax, (%rsp)")
+	c.emit("movq 8(%rsp), %rdx")
+	c.emit("movq 16(%rsp), %rax")
+	if rd != "$0" {
+		c.emit(fmt.Sprintf("movq (%%rsp), %s", rd))
+	}
+	c.emit("addq $24, %rsp")
+}
+
+// divide divides the dividend in rax by the divisor on top of the stack,
+// leaving the quotient in rax and the remainder in rdx with the RISC-V
+// results for the cases x86 faults on: division by zero gives a quotient
+// with all bits set and the dividend as remainder, and a signed division by
+// -1, which overflows for the most negative dividend, is a wrapping negation
+// with no remainder.
+func (c *CodeGen) divide(w mWidth, signed bool, ip int) {
+	zero, done := c.localLabel(ip, "divzero"), c.localLabel(ip, "divdone")
+	c.emit(fmt.Sprintf("cmp%s $0, (%%rsp)", w.suffix))
+	c.emit(fmt.Sprintf("je %s", zero))
+	if signed {
+		negate := c.localLabel(ip, "divnegate")
+		c.emit(fmt.Sprintf("cmp%s $-1, (%%rsp)", w.suffix))
+		c.emit(fmt.Sprintf("je %s", negate))
+		c.emit(w.extend)
+		c.emit(fmt.Sprintf("idiv%s (%%rsp)", w.suffix))
+		c.emit(fmt.Sprintf("jmp %s", done))
+		c.emit(fmt.Sprintf("%s:", negate))
+		c.emit(fmt.Sprintf("neg%s %s", w.suffix, w.ax))
+		c.emit("xorl %edx, %edx")
+	} else {
+		c.emit("xorl %edx, %edx")
+		c.emit(fmt.Sprintf("div%s (%%rsp)", w.suffix))
+	}
+	c.emit(fmt.Sprintf("jmp %s", done))
+	c.emit(fmt.Sprintf("%s:", zero))
+	c.emit(fmt.Sprintf("mov%s %s, %s", w.suffix, w.ax, w.dx))
+	c.emit(fmt.Sprintf("mov%s $-1, %s", w.suffix, w.ax))
+	c.emit(fmt.Sprintf("%s:", done))
+}
+
+// load64Op lowers the word and doubleword loads: LW sign-extends, and LWU
+// writes the low word, which zero-extends over the rest of rd.
+func (c *CodeGen) load64Op(op opcodes.OpCode, inst [4]int) {
+	rd := riscTox86Regs[inst[1]]
+	source := memoryOperand(riscTox86Regs[inst[3]], inst[2])
+	switch {
+	case rd == "$0":
+		c.discardLoad(op, source)
+	case op == opcodes.LW:
+		c.emit(fmt.Sprintf("movslq %s, %s", source, rd))
+	case op == opcodes.LWU:
+		c.emit(fmt.Sprintf("movl %s, %s", source, x86Regs32[rd]))
+	default:
+		c.emit(fmt.Sprintf("movq %s, %s", source, rd))
+	}
+}
+
+// store64Op lowers SW to a store of the low word of rs2 and SD to a store of
+// all of it.
+func (c *CodeGen) store64Op(op opcodes.OpCode, inst [4]int) {
+	rs2 := riscTox86Regs[inst[1]]
+	target := memoryOperand(riscTox86Regs[inst[3]], inst[2])
+	if op == opcodes.SW {
+		c.emit(fmt.Sprintf("movl %s, %s", x86Regs32[rs2], target))
+		return
+	}
+	c.emit(fmt.Sprintf("movq %s, %s", rs2, target))
+}
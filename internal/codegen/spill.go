@@ -0,0 +1,107 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// spillBase is the first register without an x86 register of its own. x16
+// to x31 live in the spill area in .bss, a quadword each. Register
+// allocation may spill more registers than that, numbering them on from x31.
+const spillBase = 16
+
+// scratchCandidates are the registers spillOp may borrow for spilled ones, in
+// the order it tries them. No lowering uses any of them implicitly, as some
+// use rax, rcx and rdx.
+var scratchCandidates = []int{14, 13, 12, 11, 10, 9, 8}
+
+// spillSlot addresses the slot of spilled register r.
+func spillSlot(r int) string {
+	return fmt.Sprintf("spill+%d(%s)", 8*(r-spillBase), rip)
+}
+
+// spills reports whether an instruction names a spilled register. JAL and
+// JALR are lowered to call and ret, which never read theirs.
+func (c *CodeGen) spills(info opcodes.Info, inst [4]int) bool {
+	if info.Op == opcodes.JAL || info.Op == opcodes.JALR {
+		return false
+	}
+	for _, r := range info.Registers(inst) {
+		if r >= spillBase {
+			return true
+		}
+	}
+	return false
+}
+
+// spillOp lowers an instruction naming spilled registers. Each of them is
+// given a scratch register the instruction does not name, saved on the stack
+// around it and loaded from the spill area; the instruction is lowered as if
+// it named the scratch registers, and its destination, if spilled, is stored
+// back. A branch restores the scratch registers between its compare and its
+// jump, as pop leaves the flags alone.
+func (c *CodeGen) spillOp(info opcodes.Info, inst [4]int, ip int, branches, functions map[int]string) {
+	named := map[int]bool{}
+	for _, r := range info.Registers(inst) {
+		named[r] = true
+	}
+	scratch := map[int]int{}
+	var spilled []int
+	candidates := scratchCandidates
+	rewritten := inst
+	for _, slot := range info.RegisterSlots() {
+		r := inst[slot]
+		if r < spillBase {
+			continue
+		}
+		if _, ok := scratch[r]; !ok {
+			for named[candidates[0]] {
+				candidates = candidates[1:]
+			}
+			scratch[r], candidates = candidates[0], candidates[1:]
+			spilled = append(spilled, r)
+		}
+		rewritten[slot] = scratch[r]
+	}
+	for _, r := range spilled {
+		c.spillEnd = max(c.spillEnd, r+1)
+		c.emit(fmt.Sprintf("pushq %s", riscTox86Regs[scratch[r]]))
+		c.emit(fmt.Sprintf("movq %s, %s", spillSlot(r), riscTox86Regs[scratch[r]]))
+	}
+	if info.Is(opcodes.Branch) {
+		c.branchCompare(rewritten)
+	} else {
+		c.lower(info, true, rewritten, ip, branches, functions)
+		if rd := inst[1]; writesRegister(info) && rd >= spillBase {
+			c.emit(fmt.Sprintf("movq %s, %s", riscTox86Regs[scratch[rd]], spillSlot(rd)))
+		}
+	}
+	for i := len(spilled) - 1; i >= 0; i-- {
+		c.emit(fmt.Sprintf("popq %s", riscTox86Regs[scratch[spilled[i]]]))
+	}
+	if info.Is(opcodes.Branch) {
+		c.branchJump(info.Op, branches, rewritten, ip)
+	}
+}
+
+// writesRegister reports whether an instruction writes the integer register
+// in slot 1.
+func writesRegister(info opcodes.Info) bool {
+	fields := info.Format.Fields()
+	return len(fields) > 0 && fields[0].Kind == opcodes.RegOperand && fields[0].Slot == 1 &&
+		!info.Is(opcodes.Stores) && !info.Is(opcodes.Branch)
+}
+
+// appendSpillArea reserves the spill areas for integer and float registers,
+// each up to the highest slot the program used, if it used any.
+func (c *CodeGen) appendSpillArea() {
+	if c.spillEnd > 0 {
+		c.emit(".bss")
+		c.emit(fmt.Sprintf("spill: .space %d", 8*(c.spillEnd-spillBase)))
+	}
+	if c.floatSpillEnd > 0 {
+		c.emit(".bss")
+		c.emit(fmt.Sprintf("fspill: .space %d", 8*(c.floatSpillEnd-floatSpillBase)))
+	}
+}
@@ -0,0 +1,136 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// stackCompare maps the stack machine's comparisons to the setcc that reads
+// their result from a compare of the value below the top with the top.
+var stackCompare = map[opcodes.OpCode]string{
+	opcodes.LTE: "setle",
+	opcodes.GT:  "setg",
+}
+
+// generateStack lowers a stack-machine program onto the native stack. Every
+// value takes a quadword slot holding it in its low 32 bits, the operations
+// work on those bits alone, and rbp marks the bottom of the stack so that the
+// program can exit with whatever is left on top, or 0 when nothing is.
+// Nothing checks the stack for underflow at run time: a program that pops
+// more than it pushed is rejected by the VM, not by the native code.
+func (c *CodeGen) generateStack(bytecode []int) (string, error) {
+	if len(bytecode)%4 != 0 {
+		return "", fmt.Errorf("bytecode of %d slots is not a whole number of instructions", len(bytecode))
+	}
+	targets, err := c.findStackTargets(bytecode)
+	if err != nil {
+		return "", err
+	}
+	c.emit("movq %rsp, %rbp")
+	for ip := 0; ip < len(bytecode); ip += 4 {
+		if label, ok := targets[ip]; ok {
+			c.emit(fmt.Sprintf("%s:", label))
+		}
+		op := opcodes.OpCode(bytecode[ip])
+		operand := bytecode[ip+3]
+		switch op {
+		case opcodes.PSH:
+			c.emit(fmt.Sprintf("pushq $%d", int32(operand)))
+		case opcodes.DUP:
+			c.emit("pushq (%rsp)")
+		case opcodes.SWP:
+			c.emit("popq %rax")
+			c.emit("xchgq %rax, (%rsp)")
+			c.emit("pushq %rax")
+		case opcodes.DRP:
+			c.emit("addq $8, %rsp")
+		case opcodes.ADD:
+			c.emit("popq %rax")
+			c.emit("addl %eax, (%rsp)")
+		case opcodes.SUB:
+			c.emit("popq %rax")
+			c.emit("subl %eax, (%rsp)")
+		case opcodes.MUL:
+			c.emit("popq %rax")
+			c.emit("imull (%rsp), %eax")
+			c.emit("movl %eax, (%rsp)")
+		case opcodes.DIV:
+			c.stackDivide(ip)
+		case opcodes.LTE, opcodes.GT:
+			c.emit("popq %rax")
+			c.emit("cmpl %eax, (%rsp)")
+			c.emit(fmt.Sprintf("%s %%al", stackCompare[op]))
+			c.emit("movzbq %al, %rax")
+			c.emit("movq %rax, (%rsp)")
+		case opcodes.JMP:
+			c.emit(fmt.Sprintf("jmp %s", targets[ip+operand]))
+		case opcodes.JZ, opcodes.JNZ:
+			jump := "jz"
+			if op == opcodes.JNZ {
+				jump = "jnz"
+			}
+			c.emit("popq %rax")
+			c.emit("testl %eax, %eax")
+			c.emit(fmt.Sprintf("%s %s", jump, targets[ip+operand]))
+		default:
+			if info, ok := opcodes.ByOpCode(op); ok {
+				return "", fmt.Errorf("%s is not a stack-machine instruction", info.Mnemonic)
+			}
+			return "", fmt.Errorf("unknown opcode %d at ip %d", op, ip)
+		}
+	}
+	if label, ok := targets[len(bytecode)]; ok {
+		c.emit(fmt.Sprintf("%s:", label))
+	}
+	c.emit("xorl %edi, %edi")
+	c.emit("cmpq %rsp, %rbp")
+	c.emit("je .Lstackempty")
+	c.emit("movq (%rsp), %rdi")
+	c.emit(".Lstackempty:")
+	c.emit("movq $60, %rax")
+	c.emit("syscall")
+	asm := c.assembler.String()
+	c.trace("asm:\n%s\n", asm)
+	return asm, nil
+}
+
+// stackDivide lowers DIV with the RISC-V results where x86 would fault: a
+// quotient with every bit set for division by zero, and the dividend itself,
+// negated, for division by -1, which covers the one quotient that overflows.
+func (c *CodeGen) stackDivide(ip int) {
+	c.emit("popq %rcx")
+	c.emit("popq %rax")
+	c.emit("cmpl $0, %ecx")
+	c.emit(fmt.Sprintf("je %s", c.localLabel(ip, "divzero")))
+	c.emit("cmpl $-1, %ecx")
+	c.emit(fmt.Sprintf("je %s", c.localLabel(ip, "divneg")))
+	c.emit("cltd")
+	c.emit("idivl %ecx")
+	c.emit(fmt.Sprintf("jmp %s", c.localLabel(ip, "divdone")))
+	c.emit(fmt.Sprintf("%s:", c.localLabel(ip, "divneg")))
+	c.emit("negl %eax")
+	c.emit(fmt.Sprintf("jmp %s", c.localLabel(ip, "divdone")))
+	c.emit(fmt.Sprintf("%s:", c.localLabel(ip, "divzero")))
+	c.emit("movl $-1, %eax")
+	c.emit(fmt.Sprintf("%s:", c.localLabel(ip, "divdone")))
+	c.emit("pushq %rax")
+}
+
+// findStackTargets labels every instruction a jump lands on, the way
+// findBranches does for the register machine. A jump anywhere but to an
+// instruction of the program or its end is rejected, as the VM rejects it.
+func (c *CodeGen) findStackTargets(bytecode []int) (map[int]string, error) {
+	targets := map[int]string{}
+	for ip := 0; ip < len(bytecode); ip += 4 {
+		info, _ := opcodes.StackSet.ByOpCode(opcodes.OpCode(bytecode[ip]))
+		if info.Is(opcodes.Branch) || info.Is(opcodes.Jump) {
+			target := ip + bytecode[ip+3]
+			if target < 0 || target > len(bytecode) || target%4 != 0 {
+				return nil, fmt.Errorf("at ip %d: %s target %d is not an instruction of the program", ip, info.Mnemonic, target)
+			}
+			targets[target] = fmt.Sprintf("L%d", target)
+		}
+	}
+	return targets, nil
+}
@@ -5,7 +5,7 @@ import (
 	"github.com/phasecurve/zhuji/internal/codegen"
 )
 
-func Compile(riscvAsm string) string {
+func Compile(riscvAsm string) (string, error) {
 	asm := assembler.NewAssembler()
 	bytecode := asm.Assemble(riscvAsm)
 
@@ -8,8 +8,11 @@ import (
 func TestCompileProducesX86Assembly(t *testing.T) {
 	riscvAsm := "addi x1, x0, 42"
 
-	result := Compile(riscvAsm)
+	result, err := Compile(riscvAsm)
 
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !strings.Contains(result, ".global _start") {
 		t.Error("expected x86-64 assembly to contain .global _start")
 	}
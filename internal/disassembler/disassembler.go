@@ -0,0 +1,132 @@
+// Package disassembler turns bytecode back into assembly text the assembler
+// accepts, using the operand layout the opcode table gives each format.
+package disassembler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phasecurve/zhuji/internal/fpu"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+var (
+	csrNames          = map[int]string{}
+	roundingModeNames = map[int]string{}
+)
+
+func init() {
+	for name, csr := range opcodes.CSRNames {
+		csrNames[int(csr)] = name
+	}
+	for name, rm := range fpu.RoundingModeNames {
+		roundingModeNames[int(rm)] = name
+	}
+}
+
+// Disassemble prints one instruction per line. Branch and jump targets are
+// written as byte offsets, which assemble back to the same bytecode.
+func Disassemble(byteCode []int) (string, error) {
+	return disassemble(opcodes.RegisterSet, byteCode)
+}
+
+// DisassembleStack is Disassemble for a stack-machine program.
+func DisassembleStack(byteCode []int) (string, error) {
+	return disassemble(opcodes.StackSet, byteCode)
+}
+
+// DisassembleRV64 is Disassemble for a program assembled in RV64 mode.
+func DisassembleRV64(byteCode []int) (string, error) {
+	return disassemble(opcodes.RV64Set, byteCode)
+}
+
+func disassemble(set *opcodes.Set, byteCode []int) (string, error) {
+	var out strings.Builder
+	for ip := 0; ip < len(byteCode); {
+		inst, size, err := instruction(set, byteCode, ip)
+		if err != nil {
+			return "", fmt.Errorf("at ip %d: %w", ip, err)
+		}
+		out.WriteString(inst + "\n")
+		ip += size
+	}
+	return out.String(), nil
+}
+
+// Instruction prints the instruction at ip, or its raw slots when the opcode
+// is not one the table knows.
+func Instruction(byteCode []int, ip int) string {
+	return rawOnError(opcodes.RegisterSet, byteCode, ip)
+}
+
+// StackInstruction is Instruction for a stack-machine program.
+func StackInstruction(byteCode []int, ip int) string {
+	return rawOnError(opcodes.StackSet, byteCode, ip)
+}
+
+// RV64Instruction is Instruction for a program assembled in RV64 mode.
+func RV64Instruction(byteCode []int, ip int) string {
+	return rawOnError(opcodes.RV64Set, byteCode, ip)
+}
+
+func rawOnError(set *opcodes.Set, byteCode []int, ip int) string {
+	inst, _, err := instruction(set, byteCode, ip)
+	if err != nil {
+		raw := fmt.Sprint(byteCode[ip+1 : min(ip+4, len(byteCode))])
+		return fmt.Sprintf("%d %s", byteCode[ip], strings.ReplaceAll(raw[1:len(raw)-1], " ", ", "))
+	}
+	return inst
+}
+
+// instruction prints the instruction at ip and returns its size. A
+// compressed instruction is printed with its own mnemonic, its operands
+// read from the base instruction it expands to.
+func instruction(set *opcodes.Set, byteCode []int, ip int) (string, int, error) {
+	info, ok := set.ByOpCode(opcodes.OpCode(byteCode[ip]))
+	if !ok {
+		return "", 0, fmt.Errorf("unknown opcode %d", byteCode[ip])
+	}
+	inst, size, ok := set.Fetch(byteCode, ip)
+	if !ok {
+		return "", 0, fmt.Errorf("%s is cut short by the end of the bytecode", info.Mnemonic)
+	}
+	slots := inst[:]
+	fields := info.Format.Fields()
+	if len(fields) == 0 {
+		return info.Mnemonic, size, nil
+	}
+	operands := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field.Kind == opcodes.RMOperand && slots[field.Slot] == int(fpu.DYN) {
+			continue
+		}
+		operands = append(operands, operand(field, slots))
+	}
+	return info.Mnemonic + " " + strings.Join(operands, ", "), size, nil
+}
+
+func operand(field opcodes.Field, slots []int) string {
+	value := slots[field.Slot]
+	switch field.Kind {
+	case opcodes.RegOperand:
+		return fmt.Sprintf("x%d", value)
+	case opcodes.FRegOperand:
+		return fmt.Sprintf("f%d", value)
+	case opcodes.RMOperand:
+		if name, ok := roundingModeNames[value]; ok {
+			return name
+		}
+		return fmt.Sprintf("%d", value)
+	case opcodes.MemOperand:
+		return fmt.Sprintf("%d(x%d)", value, slots[field.Base])
+	case opcodes.AddrOperand:
+		return fmt.Sprintf("(x%d)", value)
+	case opcodes.CSROperand:
+		if name, ok := csrNames[value]; ok {
+			return name
+		}
+		return fmt.Sprintf("%#x", value)
+	default:
+		return fmt.Sprintf("%d", value)
+	}
+}
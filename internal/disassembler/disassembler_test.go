@@ -0,0 +1,179 @@
+package disassembler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisassembleFormats(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    []int
+		expected string
+	}{
+		{"register", []int{int(opcodes.ADD), 1, 2, 3}, "add x1, x2, x3\n"},
+		{"immediate", []int{int(opcodes.ADDI), 1, 0, -5}, "addi x1, x0, -5\n"},
+		{"upper", []int{int(opcodes.LUI), 1, 0, 74565}, "lui x1, 74565\n"},
+		{"load", []int{int(opcodes.LW), 1, 8, 2}, "lw x1, 8(x2)\n"},
+		{"store", []int{int(opcodes.SB), 3, -1, 2}, "sb x3, -1(x2)\n"},
+		{"branch", []int{int(opcodes.BLTU), 1, 2, -8}, "bltu x1, x2, -8\n"},
+		{"jal", []int{int(opcodes.JAL), 1, 0, 12}, "jal x1, 12\n"},
+		{"jalr", []int{int(opcodes.JALR), 0, 1, 0}, "jalr x0, 0(x1)\n"},
+		{"lr.w", []int{int(opcodes.LRW), 1, 2, 0}, "lr.w x1, (x2)\n"},
+		{"amo", []int{int(opcodes.AMOADDW), 1, 2, 3}, "amoadd.w x1, x3, (x2)\n"},
+		{"csr", []int{int(opcodes.CSRRS), 1, int(opcodes.MHARTID), 0}, "csrrs x1, mhartid, x0\n"},
+		{"csr by number", []int{int(opcodes.CSRRWI), 0, 0x7C0, 3}, "csrrwi x0, 0x7c0, 3\n"},
+		{"mret", []int{int(opcodes.MRET), 0, 0, 0}, "mret\n"},
+		{"float", []int{int(opcodes.FADDD), 1, 2, 3}, "fadd.d f1, f2, f3\n"},
+		{"float load", []int{int(opcodes.FLW), 1, 8, 2}, "flw f1, 8(x2)\n"},
+		{"rounding mode", []int{int(opcodes.FCVTWS), 1, 2, 1}, "fcvt.w.s x1, f2, rtz\n"},
+		{"dynamic rounding", []int{int(opcodes.FSQRTS), 1, 2, 7}, "fsqrt.s f1, f2\n"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			text, err := Disassemble(tc.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, text)
+		})
+	}
+}
+
+func TestDisassembleRoundTripsEveryInstruction(t *testing.T) {
+	for _, info := range opcodes.Table {
+		if info.Is(opcodes.Pseudo) || info.Is(opcodes.Compressed) {
+			continue
+		}
+		t.Run(info.Mnemonic, func(t *testing.T) {
+			inst := []int{int(info.Op), 0, 0, 0}
+			for i, field := range info.Format.Fields() {
+				switch field.Kind {
+				case opcodes.CSROperand:
+					inst[field.Slot] = int(opcodes.MSCRATCH)
+				case opcodes.MemOperand:
+					inst[field.Slot], inst[field.Base] = -4, i+1
+				default:
+					inst[field.Slot] = i + 1
+				}
+			}
+
+			disassemble, a := Disassemble, assembler.NewAssembler()
+			if info.Is(opcodes.RV64) {
+				disassemble = DisassembleRV64
+				a.EnableRV64()
+			}
+			text, err := disassemble(inst)
+			assert.NoError(t, err)
+			again, err := a.TryAssemble(text)
+
+			assert.NoError(t, err, text)
+			assert.Equal(t, inst, again, "%q should assemble back to the same bytecode", text)
+		})
+	}
+}
+
+func TestDisassembleRejectsRV64InstructionsInRV32(t *testing.T) {
+	_, err := Disassemble([]int{int(opcodes.LD), 1, 0, 2})
+
+	assert.Error(t, err, "ld is not an RV32 instruction")
+}
+
+func TestDisassembleRoundTripsCompressedInstructions(t *testing.T) {
+	source := `c.addi4spn x8, 16
+c.lw x9, 4(x10)
+c.sw x11, 124(x12)
+c.nop
+c.addi x5, -3
+c.jal -8
+c.li x6, 31
+c.addi16sp -64
+c.lui x7, 1048575
+c.srli x13, 3
+c.srai x14, 31
+c.andi x15, -32
+c.sub x8, x9
+c.xor x10, x11
+c.or x12, x13
+c.and x14, x15
+c.j 2046
+c.beqz x8, -256
+c.bnez x9, 254
+c.slli x31, 1
+c.lwsp x1, 252(x2)
+c.jr x1
+c.mv x3, x4
+c.jalr x5
+c.add x6, x7
+c.swsp x8, 0(x2)
+`
+	program, err := assembler.NewAssembler().TryAssemble(source)
+	assert.NoError(t, err)
+
+	text, err := Disassemble(program)
+
+	assert.NoError(t, err)
+	assert.Equal(t, source, text)
+	covered := map[string]bool{}
+	for _, line := range strings.Split(source, "\n") {
+		covered[strings.Split(line, " ")[0]] = true
+	}
+	for _, info := range opcodes.Table {
+		if info.Is(opcodes.Compressed) {
+			assert.True(t, covered[info.Mnemonic], "%s should be in the program", info.Mnemonic)
+		}
+	}
+}
+
+func TestDisassembleMixesInstructionSizes(t *testing.T) {
+	cli, _ := opcodes.ByOpCode(opcodes.CLI)
+	program := []int{
+		int(opcodes.CLI), cli.Pack([4]int{int(opcodes.ADDI), 8, 0, 3}),
+		int(opcodes.ADDI), 1, 0, 5,
+		int(opcodes.CNOP), 0,
+	}
+
+	text, err := Disassemble(program)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "c.li x8, 3\naddi x1, x0, 5\nc.nop\n", text)
+}
+
+func TestDisassembleRejectsCutShortInstructions(t *testing.T) {
+	_, err := Disassemble([]int{int(opcodes.CNOP), 0, int(opcodes.ADDI), 1})
+
+	assert.EqualError(t, err, "at ip 2: addi is cut short by the end of the bytecode")
+}
+
+func TestDisassembleRejectsUnknownOpcodes(t *testing.T) {
+	_, err := Disassemble([]int{int(opcodes.ADDI), 1, 0, 1, 999, 0, 0, 0})
+
+	assert.EqualError(t, err, "at ip 4: unknown opcode 999")
+}
+
+func TestInstructionFallsBackToRawSlots(t *testing.T) {
+	assert.Equal(t, "999 1, 2, 3", Instruction([]int{999, 1, 2, 3}, 0))
+}
+
+func TestDisassembleStackRoundTripsEveryInstruction(t *testing.T) {
+	var program []int
+	for i, info := range opcodes.StackTable {
+		inst := []int{int(info.Op), 0, 0, 0}
+		if len(info.Format.Fields()) > 0 {
+			inst[3] = -4 * i
+		}
+		program = append(program, inst...)
+	}
+
+	text, err := DisassembleStack(program)
+	assert.NoError(t, err)
+	asm := assembler.NewAssembler()
+	asm.EnableStackMode()
+	again, err := asm.TryAssemble(text)
+
+	assert.NoError(t, err, text)
+	assert.Equal(t, program, again, "%q should assemble back to the same bytecode", text)
+}
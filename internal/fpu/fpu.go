@@ -0,0 +1,523 @@
+// Package fpu does IEEE 754 binary32 and binary64 arithmetic the way the
+// RISC-V F and D extensions define it: in every rounding mode, raising the
+// five exception flags, and returning the canonical NaN wherever a result is
+// not a number. Values are passed as their bit patterns, a single-precision
+// one in the low 32 bits, so that NaN payloads and the signs of zeros
+// survive.
+//
+// The host's float64 arithmetic only rounds to nearest, so finite results are
+// computed exactly, or truncated with a sticky bit, with math/big and then
+// rounded here. That also rounds subnormal results once, at the precision
+// left to them, rather than twice.
+package fpu
+
+import (
+	"math"
+	"math/big"
+)
+
+// Format is one of the two floating-point formats.
+type Format int
+
+const (
+	Single Format = iota
+	Double
+)
+
+// RoundingMode is the rm field of an instruction or the frm CSR. DYN, only
+// valid in an instruction, means the mode in frm.
+type RoundingMode uint32
+
+const (
+	RNE RoundingMode = 0 // to nearest, ties to even
+	RTZ RoundingMode = 1 // towards zero
+	RDN RoundingMode = 2 // down, towards -inf
+	RUP RoundingMode = 3 // up, towards +inf
+	RMM RoundingMode = 4 // to nearest, ties away from zero
+	DYN RoundingMode = 7
+)
+
+// Valid reports whether the mode names a rounding direction, which excludes
+// DYN and the reserved values.
+func (rm RoundingMode) Valid() bool {
+	return rm <= RMM
+}
+
+// RoundingModeNames maps the assembler names of the rounding modes to them.
+var RoundingModeNames = map[string]RoundingMode{
+	"rne": RNE, "rtz": RTZ, "rdn": RDN, "rup": RUP, "rmm": RMM, "dyn": DYN,
+}
+
+var bigModes = map[RoundingMode]big.RoundingMode{
+	RNE: big.ToNearestEven,
+	RTZ: big.ToZero,
+	RDN: big.ToNegativeInf,
+	RUP: big.ToPositiveInf,
+	RMM: big.ToNearestAway,
+}
+
+// Flags are the accrued exception flags of fflags, in its bit order.
+type Flags uint32
+
+const (
+	Inexact Flags = 1 << iota
+	Underflow
+	Overflow
+	DivideByZero
+	Invalid
+)
+
+// The layout of each format. A finite value is held by math/big as a
+// mantissa in [0.5, 1) times 2^exp, so minExp is the exponent of the
+// smallest normal value, maxExp one past that of the largest, and
+// subnormalBits how many bits a value with exponent exp keeps when it is
+// subnormal, less exp.
+type layout struct {
+	precision     uint
+	minExp        int
+	maxExp        int
+	subnormalBits int
+	signBit       uint64
+	quietBit      uint64
+	expMask       uint64
+	fracMask      uint64
+	canonicalNaN  uint64
+}
+
+var layouts = [...]layout{
+	Single: {
+		precision: 24, minExp: -125, maxExp: 128, subnormalBits: 149,
+		signBit: 1 << 31, quietBit: 1 << 22, expMask: 0xFF << 23, fracMask: 1<<23 - 1,
+		canonicalNaN: 0x7FC00000,
+	},
+	Double: {
+		precision: 53, minExp: -1021, maxExp: 1024, subnormalBits: 1074,
+		signBit: 1 << 63, quietBit: 1 << 51, expMask: 0x7FF << 52, fracMask: 1<<52 - 1,
+		canonicalNaN: 0x7FF8000000000000,
+	},
+}
+
+func (f Format) layout() *layout {
+	return &layouts[f]
+}
+
+// CanonicalNaN is the quiet NaN every operation returns in place of a NaN.
+func (f Format) CanonicalNaN() uint64 {
+	return f.layout().canonicalNaN
+}
+
+func (f Format) isNaN(a uint64) bool {
+	l := f.layout()
+	return a&l.expMask == l.expMask && a&l.fracMask != 0
+}
+
+func (f Format) isSignaling(a uint64) bool {
+	return f.isNaN(a) && a&f.layout().quietBit == 0
+}
+
+func (f Format) negative(a uint64) bool {
+	return a&f.layout().signBit != 0
+}
+
+// invalidIfSignaling is Invalid when any operand is a signaling NaN.
+func (f Format) invalidIfSignaling(operands ...uint64) Flags {
+	for _, a := range operands {
+		if f.isSignaling(a) {
+			return Invalid
+		}
+	}
+	return 0
+}
+
+// float64 widens a value that is not a NaN to float64, which holds every
+// single- and double-precision value exactly.
+func (f Format) float64(a uint64) float64 {
+	if f == Single {
+		return float64(math.Float32frombits(uint32(a)))
+	}
+	return math.Float64frombits(a)
+}
+
+// bits is the encoding of x, which must be exactly representable in f.
+func (f Format) bits(x float64) uint64 {
+	if f == Single {
+		return uint64(math.Float32bits(float32(x)))
+	}
+	return math.Float64bits(x)
+}
+
+func (f Format) zero(negative bool) uint64 {
+	if negative {
+		return f.layout().signBit
+	}
+	return 0
+}
+
+func (f Format) infinity(negative bool) uint64 {
+	return f.zero(negative) | f.layout().expMask
+}
+
+// exact is a finite non-zero value as math/big holds it exactly.
+func exact(x float64) *big.Float {
+	return new(big.Float).SetFloat64(x)
+}
+
+// scaled is mant × 2^exp as an exact big.Float.
+func scaled(negative bool, mant *big.Int, exp int) *big.Float {
+	v := new(big.Float).SetInt(mant)
+	v.SetMantExp(v, exp)
+	if negative {
+		v.Neg(v)
+	}
+	return v
+}
+
+// integer splits a finite non-zero float64 into an integer mantissa and a
+// binary exponent.
+func integer(x float64) (*big.Int, int) {
+	frac, exp := math.Frexp(math.Abs(x))
+	return new(big.Int).SetUint64(uint64(math.Ldexp(frac, 53))), exp - 53
+}
+
+// round rounds v, which is exact, or truncated towards zero with a 1 bit
+// appended below its last one for whatever was cut off, to f in mode rm.
+func (f Format) round(v *big.Float, rm RoundingMode) (uint64, Flags) {
+	l := f.layout()
+	mode := bigModes[rm]
+	negative := v.Signbit()
+	z := new(big.Float).SetPrec(l.precision).SetMode(mode).Set(v)
+	flags := Flags(0)
+	if z.Acc() != big.Exact {
+		flags |= Inexact
+	}
+	if z.MantExp(nil) > l.maxExp {
+		return f.overflow(negative, rm), Overflow | Inexact
+	}
+	if z.MantExp(nil) < l.minExp {
+		exp := v.MantExp(nil)
+		bits := exp + l.subnormalBits
+		if bits < 1 {
+			return f.belowSubnormal(v, exp, rm), Underflow | Inexact
+		}
+		z.SetPrec(uint(bits)).SetMode(mode).Set(v)
+		if z.Acc() != big.Exact {
+			flags = Underflow | Inexact
+		}
+	}
+	if f == Single {
+		x, _ := z.Float32()
+		return uint64(math.Float32bits(x)), flags
+	}
+	x, _ := z.Float64()
+	return math.Float64bits(x), flags
+}
+
+// overflow is what a result too large for the format rounds to: infinity,
+// or the largest finite value when the mode rounds towards it.
+func (f Format) overflow(negative bool, rm RoundingMode) uint64 {
+	toMax := rm == RTZ || (rm == RDN && !negative) || (rm == RUP && negative)
+	if toMax {
+		return f.infinity(negative) - 1
+	}
+	return f.infinity(negative)
+}
+
+// belowSubnormal rounds a value smaller than the smallest subnormal, with
+// exponent exp, to either that or zero.
+func (f Format) belowSubnormal(v *big.Float, exp int, rm RoundingMode) uint64 {
+	negative := v.Signbit()
+	half := exp == 1-f.layout().subnormalBits
+	var up bool
+	switch rm {
+	case RNE:
+		mant := new(big.Float)
+		v.MantExp(mant)
+		up = half && mant.Cmp(big.NewFloat(0.5)) != 0 && mant.Cmp(big.NewFloat(-0.5)) != 0
+	case RMM:
+		up = half
+	case RDN:
+		up = negative
+	case RUP:
+		up = !negative
+	}
+	if up {
+		return f.zero(negative) | 1
+	}
+	return f.zero(negative)
+}
+
+// Add returns a + b.
+func Add(f Format, a, b uint64, rm RoundingMode) (uint64, Flags) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.CanonicalNaN(), f.invalidIfSignaling(a, b)
+	}
+	x, y := f.float64(a), f.float64(b)
+	if math.IsInf(x, 0) || math.IsInf(y, 0) {
+		if sum := x + y; !math.IsNaN(sum) {
+			return f.bits(sum), 0
+		}
+		return f.CanonicalNaN(), Invalid
+	}
+	if x == -y {
+		if x == 0 && f.negative(a) == f.negative(b) {
+			return a, 0
+		}
+		return f.zero(rm == RDN), 0
+	}
+	if x == 0 {
+		return b, 0
+	}
+	if y == 0 {
+		return a, 0
+	}
+	sum := new(big.Float).SetPrec(2*uint(f.layout().subnormalBits)).Add(exact(x), exact(y))
+	return f.round(sum, rm)
+}
+
+// Sub returns a - b.
+func Sub(f Format, a, b uint64, rm RoundingMode) (uint64, Flags) {
+	if f.isNaN(b) {
+		return Add(f, a, b, rm)
+	}
+	return Add(f, a, b^f.layout().signBit, rm)
+}
+
+// Mul returns a × b.
+func Mul(f Format, a, b uint64, rm RoundingMode) (uint64, Flags) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.CanonicalNaN(), f.invalidIfSignaling(a, b)
+	}
+	x, y := f.float64(a), f.float64(b)
+	negative := f.negative(a) != f.negative(b)
+	switch {
+	case math.IsInf(x, 0) || math.IsInf(y, 0):
+		if x == 0 || y == 0 {
+			return f.CanonicalNaN(), Invalid
+		}
+		return f.infinity(negative), 0
+	case x == 0 || y == 0:
+		return f.zero(negative), 0
+	}
+	return f.round(new(big.Float).SetPrec(128).Mul(exact(x), exact(y)), rm)
+}
+
+// Div returns a / b.
+func Div(f Format, a, b uint64, rm RoundingMode) (uint64, Flags) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.CanonicalNaN(), f.invalidIfSignaling(a, b)
+	}
+	x, y := f.float64(a), f.float64(b)
+	negative := f.negative(a) != f.negative(b)
+	switch {
+	case math.IsInf(x, 0) && math.IsInf(y, 0), x == 0 && y == 0:
+		return f.CanonicalNaN(), Invalid
+	case math.IsInf(x, 0):
+		return f.infinity(negative), 0
+	case math.IsInf(y, 0), x == 0:
+		return f.zero(negative), 0
+	case y == 0:
+		return f.infinity(negative), DivideByZero
+	}
+	// Dividing the mantissas scaled well past the precision of either format
+	// leaves a quotient whose remainder only decides the sticky bit.
+	const extra = 128
+	mx, ex := integer(x)
+	my, ey := integer(y)
+	mx.Lsh(mx, extra)
+	q, r := new(big.Int).QuoRem(mx, my, new(big.Int))
+	exp := ex - ey - extra
+	if r.Sign() != 0 {
+		q.Lsh(q, 1).SetBit(q, 0, 1)
+		exp--
+	}
+	return f.round(scaled(negative, q, exp), rm)
+}
+
+// Sqrt returns the square root of a.
+func Sqrt(f Format, a uint64, rm RoundingMode) (uint64, Flags) {
+	if f.isNaN(a) {
+		return f.CanonicalNaN(), f.invalidIfSignaling(a)
+	}
+	x := f.float64(a)
+	switch {
+	case x == 0:
+		return a, 0
+	case x < 0:
+		return f.CanonicalNaN(), Invalid
+	case math.IsInf(x, 1):
+		return a, 0
+	}
+	// The root of the mantissa, scaled by an even power of two to well past
+	// the precision of either format, is exact only if it squares back.
+	const extra = 256
+	m, exp := integer(x)
+	if exp%2 != 0 {
+		m.Lsh(m, 1)
+		exp--
+	}
+	m.Lsh(m, extra)
+	s := new(big.Int).Sqrt(m)
+	exp = (exp - extra) / 2
+	if new(big.Int).Mul(s, s).Cmp(m) != 0 {
+		s.Lsh(s, 1).SetBit(s, 0, 1)
+		exp--
+	}
+	return f.round(scaled(false, s, exp), rm)
+}
+
+// Min returns the smaller of a and b, taking -0 as less than +0. When only
+// one of them is a NaN the other is returned.
+func Min(f Format, a, b uint64) (uint64, Flags) {
+	return f.minMax(a, b, true)
+}
+
+// Max returns the larger of a and b, taking +0 as greater than -0. When only
+// one of them is a NaN the other is returned.
+func Max(f Format, a, b uint64) (uint64, Flags) {
+	return f.minMax(a, b, false)
+}
+
+func (f Format) minMax(a, b uint64, min bool) (uint64, Flags) {
+	flags := f.invalidIfSignaling(a, b)
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.CanonicalNaN(), flags
+	case f.isNaN(a):
+		return b, flags
+	case f.isNaN(b):
+		return a, flags
+	}
+	x, y := f.float64(a), f.float64(b)
+	if x == y {
+		if f.negative(a) == min {
+			return a, flags
+		}
+		return b, flags
+	}
+	if (x < y) == min {
+		return a, flags
+	}
+	return b, flags
+}
+
+// Eq reports whether a equals b. Only a signaling NaN is invalid.
+func Eq(f Format, a, b uint64) (bool, Flags) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return false, f.invalidIfSignaling(a, b)
+	}
+	return f.float64(a) == f.float64(b), 0
+}
+
+// Lt reports whether a is less than b. Any NaN is invalid.
+func Lt(f Format, a, b uint64) (bool, Flags) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return false, Invalid
+	}
+	return f.float64(a) < f.float64(b), 0
+}
+
+// Le reports whether a is less than or equal to b. Any NaN is invalid.
+func Le(f Format, a, b uint64) (bool, Flags) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return false, Invalid
+	}
+	return f.float64(a) <= f.float64(b), 0
+}
+
+// roundToInteger rounds x, which is finite, to an integer in mode rm.
+func roundToInteger(x float64, rm RoundingMode) float64 {
+	switch rm {
+	case RTZ:
+		return math.Trunc(x)
+	case RDN:
+		return math.Floor(x)
+	case RUP:
+		return math.Ceil(x)
+	case RMM:
+		return math.Round(x)
+	}
+	return math.RoundToEven(x)
+}
+
+// toInteger converts a to an integer in [lo, hi]. A NaN or a value that
+// rounds outside the range is invalid and gives the nearer bound, or hi for
+// a NaN.
+func (f Format) toInteger(a uint64, rm RoundingMode, lo, hi float64) (float64, Flags) {
+	if f.isNaN(a) {
+		return hi, Invalid
+	}
+	x := f.float64(a)
+	if math.IsInf(x, 0) {
+		return math.Max(lo, math.Min(hi, x)), Invalid
+	}
+	r := roundToInteger(x, rm)
+	switch {
+	case r < lo:
+		return lo, Invalid
+	case r > hi:
+		return hi, Invalid
+	case r != x:
+		return r, Inexact
+	}
+	return r, 0
+}
+
+// ToInt32 converts a to a signed word, as fcvt.w does.
+func ToInt32(f Format, a uint64, rm RoundingMode) (int32, Flags) {
+	r, flags := f.toInteger(a, rm, math.MinInt32, math.MaxInt32)
+	return int32(r), flags
+}
+
+// ToUint32 converts a to an unsigned word, as fcvt.wu does.
+func ToUint32(f Format, a uint64, rm RoundingMode) (uint32, Flags) {
+	r, flags := f.toInteger(a, rm, 0, math.MaxUint32)
+	return uint32(r), flags
+}
+
+// FromInt64 converts n, a signed or unsigned word, to f.
+func FromInt64(f Format, n int64, rm RoundingMode) (uint64, Flags) {
+	if n == 0 {
+		return 0, 0
+	}
+	return f.round(new(big.Float).SetInt64(n), rm)
+}
+
+// Convert converts a from one format to the other.
+func Convert(from, to Format, a uint64, rm RoundingMode) (uint64, Flags) {
+	if from.isNaN(a) {
+		return to.CanonicalNaN(), from.invalidIfSignaling(a)
+	}
+	x := from.float64(a)
+	if x == 0 || math.IsInf(x, 0) {
+		return to.bits(x), 0
+	}
+	return to.round(exact(x), rm)
+}
+
+// Classify returns the fclass mask of a: one bit set, in order, for -inf, a
+// negative normal, subnormal or zero, +0, a positive subnormal or normal,
+// +inf, a signaling NaN and a quiet NaN.
+func Classify(f Format, a uint64) uint32 {
+	l := f.layout()
+	negative := f.negative(a)
+	exp, frac := a&l.expMask, a&l.fracMask
+	var class uint
+	switch {
+	case f.isSignaling(a):
+		return 1 << 8
+	case f.isNaN(a):
+		return 1 << 9
+	case exp == l.expMask:
+		class = 7
+	case exp != 0:
+		class = 6
+	case frac != 0:
+		class = 5
+	default:
+		class = 4
+	}
+	if negative {
+		class = 7 - class
+	}
+	return 1 << class
+}
@@ -0,0 +1,239 @@
+package fpu
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func single(x float32) uint64 {
+	return uint64(math.Float32bits(x))
+}
+
+func double(x float64) uint64 {
+	return math.Float64bits(x)
+}
+
+const (
+	signalingSingle = 0x7F800001
+	quietSingle     = 0x7FC00001
+	minSubnormal    = 1
+	maxSingle       = 0x7F7FFFFF
+	infSingle       = 0x7F800000
+)
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    func(Format, uint64, uint64, RoundingMode) (uint64, Flags)
+		f     Format
+		a, b  uint64
+		rm    RoundingMode
+		want  uint64
+		flags Flags
+	}{
+		{"exact sum", Add, Single, single(1.5), single(2.25), RNE, single(3.75), 0},
+		{"inexact sum rounds to even", Add, Single, single(1), single(0x1p-24), RNE, single(1), Inexact},
+		{"inexact sum rounds up", Add, Single, single(1), single(0x1p-24), RUP, single(1 + 0x1p-23), Inexact},
+		{"tie rounds away in rmm", Add, Single, single(1), single(0x1p-24), RMM, single(1 + 0x1p-23), Inexact},
+		{"cancellation is +0", Sub, Single, single(2), single(2), RNE, single(0), 0},
+		{"cancellation is -0 rounding down", Sub, Single, single(2), single(2), RDN, single(float32(math.Copysign(0, -1))), 0},
+		{"-0 plus -0 is -0", Add, Single, 1 << 31, 1 << 31, RNE, 1 << 31, 0},
+		{"inf minus inf is invalid", Sub, Single, infSingle, infSingle, RNE, 0x7FC00000, Invalid},
+		{"quiet NaN is canonicalised quietly", Add, Single, quietSingle, single(1), RNE, 0x7FC00000, 0},
+		{"signaling NaN is invalid", Add, Single, signalingSingle, single(1), RNE, 0x7FC00000, Invalid},
+		{"overflow to inf", Mul, Single, maxSingle, single(2), RNE, infSingle, Overflow | Inexact},
+		{"overflow towards zero stops at max", Mul, Single, maxSingle, single(2), RTZ, maxSingle, Overflow | Inexact},
+		{"negative overflow rounding up stops at -max", Mul, Single, maxSingle | 1<<31, single(2), RUP, maxSingle | 1<<31, Overflow | Inexact},
+		{"exact subnormal has no flags", Mul, Single, single(0x1p-126), single(0.5), RNE, 1 << 22, 0},
+		{"inexact subnormal underflows", Mul, Single, single(0x1.000002p-126), single(0.5), RNE, 1 << 22, Underflow | Inexact},
+		{"below the smallest subnormal rounds to zero", Mul, Single, minSubnormal, single(0.25), RNE, 0, Underflow | Inexact},
+		{"below the smallest subnormal rounds up", Mul, Single, minSubnormal, single(0.25), RUP, minSubnormal, Underflow | Inexact},
+		{"a tie below the smallest subnormal goes to even", Mul, Single, minSubnormal, single(0.5), RNE, 0, Underflow | Inexact},
+		{"inf times zero is invalid", Mul, Single, infSingle, 0, RNE, 0x7FC00000, Invalid},
+		{"third rounds down to nearest", Div, Single, single(1), single(3), RNE, 0x3EAAAAAB, Inexact},
+		{"third truncates", Div, Single, single(1), single(3), RTZ, 0x3EAAAAAA, Inexact},
+		{"divide by zero", Div, Single, single(-1), 0, RNE, infSingle | 1<<31, DivideByZero},
+		{"zero by zero is invalid", Div, Single, 0, 0, RNE, 0x7FC00000, Invalid},
+		{"double third", Div, Double, double(1), double(3), RNE, double(1.0 / 3), Inexact},
+		{"double sum", Add, Double, double(0.1), double(0.2), RNE, 0x3FD3333333333334, Inexact},
+		{"double subnormal", Mul, Double, double(0x1p-1022), double(0x1p-10), RNE, double(0x1p-1032), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, flags := tt.op(tt.f, tt.a, tt.b, tt.rm)
+
+			assert.Equal(t, tt.want, got, "result %#x", got)
+			assert.Equal(t, tt.flags, flags)
+		})
+	}
+}
+
+func TestSqrt(t *testing.T) {
+	tests := []struct {
+		name  string
+		f     Format
+		a     uint64
+		rm    RoundingMode
+		want  uint64
+		flags Flags
+	}{
+		{"exact", Single, single(2.25), RNE, single(1.5), 0},
+		{"two", Single, single(2), RNE, single(float32(math.Sqrt2)), Inexact},
+		{"two truncated", Single, single(2), RTZ, 0x3FB504F3, Inexact},
+		{"two rounded up", Single, single(2), RUP, 0x3FB504F4, Inexact},
+		{"double two", Double, double(2), RNE, double(math.Sqrt2), Inexact},
+		{"negative is invalid", Single, single(-4), RNE, 0x7FC00000, Invalid},
+		{"-0 is -0", Single, 1 << 31, RNE, 1 << 31, 0},
+		{"subnormal", Single, minSubnormal << 3, RNE, single(0x1p-73), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, flags := Sqrt(tt.f, tt.a, tt.rm)
+
+			assert.Equal(t, tt.want, got, "result %#x", got)
+			assert.Equal(t, tt.flags, flags)
+		})
+	}
+}
+
+func TestMinAndMax(t *testing.T) {
+	negativeZero := uint64(1 << 31)
+	tests := []struct {
+		name     string
+		a, b     uint64
+		min, max uint64
+		flags    Flags
+	}{
+		{"ordered", single(1), single(2), single(1), single(2), 0},
+		{"zeros", 0, negativeZero, negativeZero, 0, 0},
+		{"one quiet NaN", quietSingle, single(2), single(2), single(2), 0},
+		{"one signaling NaN", single(2), signalingSingle, single(2), single(2), Invalid},
+		{"both NaN", quietSingle, quietSingle, 0x7FC00000, 0x7FC00000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			min, flags := Min(Single, tt.a, tt.b)
+			max, _ := Max(Single, tt.a, tt.b)
+
+			assert.Equal(t, tt.min, min)
+			assert.Equal(t, tt.max, max)
+			assert.Equal(t, tt.flags, flags)
+		})
+	}
+}
+
+func TestComparisons(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       uint64
+		eq, lt, le bool
+		eqFlags    Flags
+		ltFlags    Flags
+	}{
+		{"less", single(1), single(2), false, true, true, 0, 0},
+		{"zeros are equal", 0, 1 << 31, true, false, true, 0, 0},
+		{"quiet NaN is only invalid when ordered", quietSingle, single(1), false, false, false, 0, Invalid},
+		{"signaling NaN is always invalid", signalingSingle, single(1), false, false, false, Invalid, Invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eq, eqFlags := Eq(Single, tt.a, tt.b)
+			lt, ltFlags := Lt(Single, tt.a, tt.b)
+			le, _ := Le(Single, tt.a, tt.b)
+
+			assert.Equal(t, []bool{tt.eq, tt.lt, tt.le}, []bool{eq, lt, le})
+			assert.Equal(t, tt.eqFlags, eqFlags)
+			assert.Equal(t, tt.ltFlags, ltFlags)
+		})
+	}
+}
+
+func TestConversionsToIntegers(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      uint64
+		rm     RoundingMode
+		signed int32
+		flags  Flags
+		wu     uint32
+	}{
+		{"exact", single(7), RNE, 7, 0, 7},
+		{"half to even", single(2.5), RNE, 2, Inexact, 2},
+		{"half away", single(2.5), RMM, 3, Inexact, 3},
+		{"negative truncated", single(-2.5), RTZ, -2, Inexact, 0},
+		{"negative floor", single(-2.5), RDN, -3, Inexact, 0},
+		{"too large saturates", single(3e9), RNE, math.MaxInt32, Invalid, 3000000000},
+		{"NaN is the largest", 0x7FC00000, RNE, math.MaxInt32, Invalid, math.MaxUint32},
+		{"-inf is the smallest", infSingle | 1<<31, RNE, math.MinInt32, Invalid, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, flags := ToInt32(Single, tt.a, tt.rm)
+			wu, _ := ToUint32(Single, tt.a, tt.rm)
+
+			assert.Equal(t, tt.signed, got)
+			assert.Equal(t, tt.flags, flags)
+			assert.Equal(t, tt.wu, wu)
+		})
+	}
+}
+
+func TestUnsignedConversionOfANegativeValueIsInvalid(t *testing.T) {
+	got, flags := ToUint32(Single, single(-1), RNE)
+
+	assert.Equal(t, uint32(0), got)
+	assert.Equal(t, Invalid, flags)
+}
+
+func TestConversionsFromIntegersAndBetweenFormats(t *testing.T) {
+	got, flags := FromInt64(Single, 16777217, RNE)
+	assert.Equal(t, single(16777216), got)
+	assert.Equal(t, Inexact, flags)
+
+	got, flags = FromInt64(Single, 16777217, RUP)
+	assert.Equal(t, single(16777218), got)
+	assert.Equal(t, Inexact, flags)
+
+	got, flags = FromInt64(Double, math.MaxUint32, RNE)
+	assert.Equal(t, double(math.MaxUint32), got)
+	assert.Equal(t, Flags(0), flags)
+
+	got, flags = Convert(Double, Single, double(0.1), RNE)
+	assert.Equal(t, single(0.1), got)
+	assert.Equal(t, Inexact, flags)
+
+	got, flags = Convert(Double, Single, double(1e300), RNE)
+	assert.Equal(t, uint64(infSingle), got)
+	assert.Equal(t, Overflow|Inexact, flags)
+
+	got, flags = Convert(Single, Double, single(0.1), RNE)
+	assert.Equal(t, double(float64(float32(0.1))), got)
+	assert.Equal(t, Flags(0), flags)
+
+	got, flags = Convert(Single, Double, signalingSingle, RNE)
+	assert.Equal(t, Double.CanonicalNaN(), got)
+	assert.Equal(t, Invalid, flags)
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		a    uint64
+		want uint32
+	}{
+		{infSingle | 1<<31, 1 << 0},
+		{single(-1), 1 << 1},
+		{minSubnormal | 1<<31, 1 << 2},
+		{1 << 31, 1 << 3},
+		{0, 1 << 4},
+		{minSubnormal, 1 << 5},
+		{single(1), 1 << 6},
+		{infSingle, 1 << 7},
+		{signalingSingle, 1 << 8},
+		{quietSingle, 1 << 9},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Classify(Single, tt.a), "fclass %#x", tt.a)
+	}
+}
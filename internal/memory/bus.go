@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnmapped is returned for an access to an address that neither RAM nor
+// any device answers to.
+var ErrUnmapped = errors.New("nothing mapped at address")
+
+// Device is a peripheral sitting on the bus. Offsets are relative to the
+// start of the range it was attached at and width is the size of the access
+// in bytes: 1, 2 or 4. Values travel in the low bits of a uint32.
+type Device interface {
+	Load(offset, width int) (uint32, error)
+	Store(offset, width int, value uint32) error
+}
+
+type mapping struct {
+	base, size int
+	device     Device
+}
+
+func (m mapping) covers(addr, width int) bool {
+	return addr >= m.base && addr+width <= m.base+m.size
+}
+
+// Bus routes addresses to RAM, which starts at address zero, or to whichever
+// device has been attached over them.
+type Bus struct {
+	ram     *Memory
+	devices []mapping
+}
+
+func NewBus(ram *Memory) *Bus {
+	return &Bus{ram: ram}
+}
+
+// Attach maps device at [base, base+size). The range must not overlap RAM or
+// another device.
+func (b *Bus) Attach(base, size int, device Device) error {
+	if base < 0 || size <= 0 {
+		return fmt.Errorf("cannot attach device at %#x with size %d", base, size)
+	}
+	if base < b.ram.Size() {
+		return fmt.Errorf("device at %#x overlaps RAM ending at %#x", base, b.ram.Size())
+	}
+	for _, m := range b.devices {
+		if base < m.base+m.size && m.base < base+size {
+			return fmt.Errorf("device at %#x overlaps the device at %#x", base, m.base)
+		}
+	}
+	b.devices = append(b.devices, mapping{base: base, size: size, device: device})
+	return nil
+}
+
+func (b *Bus) find(addr, width int) (mapping, error) {
+	for _, m := range b.devices {
+		if m.covers(addr, width) {
+			return m, nil
+		}
+	}
+	return mapping{}, fmt.Errorf("%w %#x", ErrUnmapped, uint32(addr))
+}
+
+func (b *Bus) load(addr, width int) (uint32, error) {
+	m, err := b.find(addr, width)
+	if err != nil {
+		return 0, err
+	}
+	return m.device.Load(addr-m.base, width)
+}
+
+func (b *Bus) store(addr, width int, value uint32) error {
+	m, err := b.find(addr, width)
+	if err != nil {
+		return err
+	}
+	return m.device.Store(addr-m.base, width, value)
+}
+
+func (b *Bus) inRAM(addr, width int) bool {
+	return addr >= 0 && addr+width <= len(b.ram.data)
+}
+
+func (b *Bus) LoadWord(addr int) (int32, error) {
+	if b.inRAM(addr, 4) {
+		return b.ram.LoadWord(addr), nil
+	}
+	value, err := b.load(addr, 4)
+	return int32(value), err
+}
+
+func (b *Bus) StoreWord(addr int, value int32) error {
+	if b.inRAM(addr, 4) {
+		b.ram.StoreWord(addr, value)
+		return nil
+	}
+	return b.store(addr, 4, uint32(value))
+}
+
+func (b *Bus) LoadHalfword(addr int) (uint16, error) {
+	if b.inRAM(addr, 2) {
+		return b.ram.LoadHalfword(addr), nil
+	}
+	value, err := b.load(addr, 2)
+	return uint16(value), err
+}
+
+func (b *Bus) StoreHalfword(addr int, value uint16) error {
+	if b.inRAM(addr, 2) {
+		b.ram.StoreHalfword(addr, value)
+		return nil
+	}
+	return b.store(addr, 2, uint32(value))
+}
+
+func (b *Bus) LoadByte(addr int) (byte, error) {
+	if b.inRAM(addr, 1) {
+		return b.ram.LoadByte(addr), nil
+	}
+	value, err := b.load(addr, 1)
+	return byte(value), err
+}
+
+func (b *Bus) StoreByte(addr int, value byte) error {
+	if b.inRAM(addr, 1) {
+		b.ram.StoreByte(addr, value)
+		return nil
+	}
+	return b.store(addr, 1, uint32(value))
+}
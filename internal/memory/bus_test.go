@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// latch remembers the last store made to it, with the offset and width it
+// was made at.
+type latch struct {
+	offset, width int
+	value         uint32
+}
+
+func (l *latch) Load(offset, width int) (uint32, error) {
+	return l.value + uint32(offset), nil
+}
+
+func (l *latch) Store(offset, width int, value uint32) error {
+	l.offset, l.width, l.value = offset, width, value
+	return nil
+}
+
+func TestBusRoutesAddressesToRAMOrDevice(t *testing.T) {
+	ram := NewMemory(1024)
+	bus := NewBus(ram)
+	dev := &latch{}
+	assert.NoError(t, bus.Attach(0x1000, 16, dev))
+
+	bus.StoreWord(8, 42)
+	bus.StoreWord(0x1004, 7)
+	bus.StoreByte(0x100C, 0xAB)
+
+	assert.Equal(t, int32(42), ram.LoadWord(8), "addresses below the RAM size should reach RAM")
+	assert.Equal(t, &latch{offset: 12, width: 1, value: 0xAB}, dev, "the device should see offsets relative to its base")
+	word, err := bus.LoadWord(0x1004)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0xAB+4), word, "loads should reach the device")
+}
+
+func TestBusReportsUnmappedAddresses(t *testing.T) {
+	bus := NewBus(NewMemory(1024))
+	bus.Attach(0x1000, 16, &latch{})
+
+	cases := []struct {
+		name string
+		addr int
+	}{
+		{"past RAM", 1024},
+		{"straddling the end of RAM", 1022},
+		{"between devices", 0x2000},
+		{"straddling the end of a device", 0x100E},
+		{"negative", -4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := bus.LoadWord(tc.addr)
+			assert.ErrorIs(t, err, ErrUnmapped)
+			assert.ErrorIs(t, bus.StoreWord(tc.addr, 1), ErrUnmapped)
+		})
+	}
+}
+
+func TestBusRejectsOverlappingDevices(t *testing.T) {
+	bus := NewBus(NewMemory(1024))
+	assert.NoError(t, bus.Attach(0x1000, 16, &latch{}))
+
+	assert.Error(t, bus.Attach(512, 16, &latch{}), "a device should not shadow RAM")
+	assert.Error(t, bus.Attach(0x100C, 16, &latch{}), "a device should not overlap another")
+	assert.Error(t, bus.Attach(0x2000, 0, &latch{}), "a device needs a size")
+	assert.NoError(t, bus.Attach(0x1010, 16, &latch{}), "devices may sit back to back")
+}
@@ -33,3 +33,23 @@ func (m *Memory) LoadByte(address int) byte {
 func (m *Memory) StoreByte(address int, value byte) {
 	m.data[address] = value
 }
+
+func (m *Memory) LoadHalfword(address int) uint16 {
+	return uint16(m.data[address]) | uint16(m.data[address+1])<<8
+}
+
+func (m *Memory) StoreHalfword(address int, value uint16) {
+	m.data[address] = byte(value)
+	m.data[address+1] = byte(value >> 8)
+}
+
+// Bytes returns the storage behind memory, for a caller that reads and
+// writes RAM directly rather than a word at a time.
+func (m *Memory) Bytes() []byte {
+	return m.data
+}
+
+// Size is the number of bytes of memory.
+func (m *Memory) Size() int {
+	return len(m.data)
+}
@@ -70,3 +70,13 @@ func TestStoreByteThenLoadIt(t *testing.T) {
 	assert.Equal(t, byte(0xFF), m.LoadByte(0), "stored byte should be retrievable at address 0")
 	assert.Equal(t, byte(0xAA), m.LoadByte(1), "stored byte should be retrievable at address 1")
 }
+
+func TestStoreHalfwordThenLoadIt(t *testing.T) {
+	m := NewMemory(1024)
+
+	m.StoreHalfword(2, 0xBEEF)
+
+	assert.Equal(t, uint16(0xBEEF), m.LoadHalfword(2), "stored halfword should be retrievable")
+	assert.Equal(t, byte(0xEF), m.LoadByte(2), "the low byte should come first (little-endian)")
+	assert.Equal(t, int32(-0x41110000), m.LoadWord(0), "a halfword store should touch only its two bytes")
+}
@@ -0,0 +1,127 @@
+package opcodes
+
+import "fmt"
+
+// Constraint is what the operands of a compressed instruction must satisfy
+// beyond what the instruction it expands to accepts. Its slots are slots of
+// the expansion.
+type Constraint struct {
+	Compact    []int // slots holding a register that must be one of x8 to x15
+	NonZero    []int // slots holding a register that must not be x0
+	SP         int   // a slot that must hold x2, or 0
+	NotSP      int   // a slot that must not hold x2, or 0
+	Imm        int   // the slot holding the immediate, offset or target, or 0
+	Min, Max   int   // the range Imm must lie in
+	Scale      int   // what Imm must be a multiple of, when more than 1
+	NonZeroImm bool  // Imm must not be zero
+	Upper      bool  // Imm is a 20-bit upper immediate, checked sign-extended
+}
+
+// Check reports the first operand of the expanded instruction that does not
+// fit the compressed one.
+func (c Constraint) Check(inst [4]int) error {
+	for _, slot := range c.Compact {
+		if r := inst[slot]; r < 8 || r > 15 {
+			return fmt.Errorf("x%d is not one of x8 to x15", r)
+		}
+	}
+	for _, slot := range c.NonZero {
+		if inst[slot] == 0 {
+			return fmt.Errorf("x0 is not allowed here")
+		}
+	}
+	if c.SP != 0 && inst[c.SP] != 2 {
+		return fmt.Errorf("base must be x2, not x%d", inst[c.SP])
+	}
+	if c.NotSP != 0 && inst[c.NotSP] == 2 {
+		return fmt.Errorf("x2 is not allowed here")
+	}
+	if c.Imm == 0 {
+		return nil
+	}
+	v := inst[c.Imm]
+	if c.Upper {
+		v = int(int32(uint32(v)<<12) >> 12)
+	}
+	switch {
+	case v < c.Min || v > c.Max:
+		return fmt.Errorf("%d is out of range %d to %d", v, c.Min, c.Max)
+	case c.Scale > 1 && v%c.Scale != 0:
+		return fmt.Errorf("%d is not a multiple of %d", v, c.Scale)
+	case c.NonZeroImm && v == 0:
+		return fmt.Errorf("the immediate must not be zero")
+	}
+	return nil
+}
+
+// Size is how many slots, and so bytes, the instruction takes up.
+func (i Info) Size() int {
+	if i.Is(Compressed) {
+		return 2
+	}
+	return 4
+}
+
+// wideSlot is the slot of a base instruction that a compressed one keeps
+// above its two register slots: the offset of a load or store, otherwise
+// the immediate or target in slot 3.
+func wideSlot(f Format) int {
+	if f == LoadType || f == StoreType {
+		return 2
+	}
+	return 3
+}
+
+// Pack fits the expansion of a compressed instruction into its one operand
+// slot: the two register slots in five bits each and the signed immediate
+// above them.
+func (i Info) Pack(inst [4]int) int {
+	base, _ := ByOpCode(i.Base)
+	wide := wideSlot(base.Format)
+	packed, shift := inst[wide]<<10, 0
+	for slot := 1; slot <= 3; slot++ {
+		if slot != wide {
+			packed |= inst[slot] << shift
+			shift += 5
+		}
+	}
+	return packed
+}
+
+// Unpack is the inverse of Pack, giving back the instruction a compressed
+// one stands for.
+func (i Info) Unpack(packed int) [4]int {
+	base, _ := ByOpCode(i.Base)
+	wide := wideSlot(base.Format)
+	inst := [4]int{int(i.Base)}
+	inst[wide] = packed >> 10
+	shift := 0
+	for slot := 1; slot <= 3; slot++ {
+		if slot != wide {
+			inst[slot] = packed >> shift & 31
+			shift += 5
+		}
+	}
+	return inst
+}
+
+// Fetch reads the instruction at ip, expanding a compressed one, and returns
+// it with its size. ok is false when the bytecode ends partway through it,
+// and then only the opcode is filled in.
+func (s *Set) Fetch(byteCode []int, ip int) (inst [4]int, size int, ok bool) {
+	info, _ := s.ByOpCode(OpCode(byteCode[ip]))
+	size = info.Size()
+	if ip+size > len(byteCode) {
+		return [4]int{byteCode[ip]}, size, false
+	}
+	if info.Is(Compressed) {
+		return info.Unpack(byteCode[ip+1]), size, true
+	}
+	copy(inst[:], byteCode[ip:ip+4])
+	return inst, size, true
+}
+
+// Fetch reads the RISC-V instruction at ip.
+func Fetch(byteCode []int, ip int) ([4]int, int, bool) {
+	return RegisterSet.Fetch(byteCode, ip)
+}
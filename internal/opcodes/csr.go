@@ -0,0 +1,71 @@
+package opcodes
+
+// CSR is the address of a control and status register.
+type CSR int
+
+const (
+	FFLAGS   CSR = 0x001
+	FRM      CSR = 0x002
+	FCSR     CSR = 0x003
+	MSTATUS  CSR = 0x300
+	MIE      CSR = 0x304
+	MTVEC    CSR = 0x305
+	MSCRATCH CSR = 0x340
+	MEPC     CSR = 0x341
+	MCAUSE   CSR = 0x342
+	MTVAL    CSR = 0x343
+	MIP      CSR = 0x344
+	CYCLE    CSR = 0xC00
+	TIME     CSR = 0xC01
+	INSTRET  CSR = 0xC02
+	CYCLEH   CSR = 0xC80
+	TIMEH    CSR = 0xC81
+	INSTRETH CSR = 0xC82
+	MHARTID  CSR = 0xF14
+)
+
+// CSRNames maps the assembler names of the control and status registers to
+// their addresses.
+var CSRNames = map[string]CSR{
+	"fflags":   FFLAGS,
+	"frm":      FRM,
+	"fcsr":     FCSR,
+	"mstatus":  MSTATUS,
+	"mie":      MIE,
+	"mtvec":    MTVEC,
+	"mscratch": MSCRATCH,
+	"mepc":     MEPC,
+	"mcause":   MCAUSE,
+	"mtval":    MTVAL,
+	"mip":      MIP,
+	"cycle":    CYCLE,
+	"time":     TIME,
+	"instret":  INSTRET,
+	"cycleh":   CYCLEH,
+	"timeh":    TIMEH,
+	"instreth": INSTRETH,
+	"mhartid":  MHARTID,
+}
+
+// ReadOnly reports whether the CSR is read-only, which the address encodes in
+// its top two bits.
+func (c CSR) ReadOnly() bool {
+	return c>>10&3 == 3
+}
+
+// Bits of mstatus, mie and mip.
+const (
+	MstatusMIE  = 1 << 3
+	MstatusMPIE = 1 << 7
+	MstatusMPP  = 3 << 11
+	MTIE        = 1 << 7
+	MTIP        = 1 << 7
+)
+
+// Fields of fcsr: the accrued exception flags, which fflags also reaches, and
+// the dynamic rounding mode above them, which is frm.
+const (
+	FcsrFlags   = 0x1F
+	FcsrRMShift = 5
+	FcsrRM      = 7 << FcsrRMShift
+)
@@ -28,3 +28,245 @@ const (
 	JAL  OpCode = 21
 	JALR OpCode = 22
 )
+
+// The RV32A atomic memory operations. LRW and SCW take a reservation on a
+// word and conditionally store to it; the AMOs read, modify and write a word
+// as one indivisible step.
+const (
+	LRW      OpCode = 23
+	SCW      OpCode = 24
+	AMOSWAPW OpCode = 25
+	AMOADDW  OpCode = 26
+	AMOXORW  OpCode = 27
+	AMOANDW  OpCode = 28
+	AMOORW   OpCode = 29
+	AMOMINW  OpCode = 30
+	AMOMAXW  OpCode = 31
+	AMOMINUW OpCode = 32
+	AMOMAXUW OpCode = 33
+)
+
+// The Zicsr instructions and the return from a machine-mode trap. The CSR
+// instructions atomically read a control and status register into rd and
+// write, set or clear bits in it from rs1, or from a 5-bit immediate in the
+// ...I forms.
+const (
+	CSRRS  OpCode = 34
+	CSRRW  OpCode = 35
+	CSRRC  OpCode = 36
+	CSRRWI OpCode = 37
+	CSRRSI OpCode = 38
+	CSRRCI OpCode = 39
+	MRET   OpCode = 40
+)
+
+// The rest of the RV32M extension. MUL, DIV and MOD come first, from before
+// the extension was complete; MOD is the signed remainder RISC-V calls REM.
+// The MULH forms return the upper word of the 64-bit product with each
+// operand taken as signed or unsigned as the mnemonic says.
+const (
+	MULH   OpCode = 41
+	MULHU  OpCode = 42
+	MULHSU OpCode = 43
+	DIVU   OpCode = 44
+	REMU   OpCode = 45
+
+	REM = MOD
+)
+
+// The RV32I logic and shift instructions, in register and immediate forms.
+// Shift amounts are taken from the low five bits of rs2 or the immediate.
+const (
+	AND  OpCode = 46
+	OR   OpCode = 47
+	XOR  OpCode = 48
+	SLL  OpCode = 49
+	SRL  OpCode = 50
+	SRA  OpCode = 51
+	ANDI OpCode = 52
+	ORI  OpCode = 53
+	XORI OpCode = 54
+	SLLI OpCode = 55
+	SRLI OpCode = 56
+	SRAI OpCode = 57
+)
+
+// The RV32I set-less-than instructions write 1 to rd when rs1 is less than
+// rs2 or the immediate, and 0 otherwise. The U forms compare unsigned, after
+// SLTIU has sign-extended its immediate like every other.
+const (
+	SLT   OpCode = 58
+	SLTU  OpCode = 59
+	SLTI  OpCode = 60
+	SLTIU OpCode = 61
+)
+
+// LUI and AUIPC build 32-bit constants and addresses 20 bits at a time: LUI
+// loads its immediate into the upper bits of rd, and AUIPC adds it, shifted
+// the same way, to the address of the AUIPC itself.
+const (
+	LUI   OpCode = 62
+	AUIPC OpCode = 63
+)
+
+// The sub-word loads and stores. LB and LH sign-extend what they load into
+// rd, LBU and LHU zero-extend it, and SB and SH store the low bits of rs2.
+// They share the operand layout of LW and SW.
+const (
+	LB  OpCode = 64
+	LBU OpCode = 65
+	LH  OpCode = 66
+	LHU OpCode = 67
+	SB  OpCode = 68
+	SH  OpCode = 69
+)
+
+// BLTU and BGEU branch on an unsigned comparison of rs1 and rs2, for loop
+// bounds and pointers. They share the operand layout of BLT and BGE.
+const (
+	BLTU OpCode = 70
+	BGEU OpCode = 71
+)
+
+// The RV32F and RV32D extensions. FLW, FSW, FLD and FSD move values between
+// memory and the float registers; the arithmetic, FSQRT and the conversions
+// round in the mode their rm operand names, or in frm; FSGNJ, FSGNJN and
+// FSGNJX copy the magnitude of fs1 with a sign taken from fs2, its inverse or
+// the two signs' XOR; FMV.X.W and FMV.W.X move a single's bits to and from an
+// integer register unchanged; FCLASS writes a mask of what kind of value fs1
+// holds.
+const (
+	FLW     OpCode = 72
+	FSW     OpCode = 73
+	FADDS   OpCode = 74
+	FSUBS   OpCode = 75
+	FMULS   OpCode = 76
+	FDIVS   OpCode = 77
+	FSQRTS  OpCode = 78
+	FMINS   OpCode = 79
+	FMAXS   OpCode = 80
+	FSGNJS  OpCode = 81
+	FSGNJNS OpCode = 82
+	FSGNJXS OpCode = 83
+	FCVTWS  OpCode = 84
+	FCVTWUS OpCode = 85
+	FCVTSW  OpCode = 86
+	FCVTSWU OpCode = 87
+	FEQS    OpCode = 88
+	FLTS    OpCode = 89
+	FLES    OpCode = 90
+	FMVXW   OpCode = 91
+	FMVWX   OpCode = 92
+	FCLASSS OpCode = 93
+
+	FLD     OpCode = 94
+	FSD     OpCode = 95
+	FADDD   OpCode = 96
+	FSUBD   OpCode = 97
+	FMULD   OpCode = 98
+	FDIVD   OpCode = 99
+	FSQRTD  OpCode = 100
+	FMIND   OpCode = 101
+	FMAXD   OpCode = 102
+	FSGNJD  OpCode = 103
+	FSGNJND OpCode = 104
+	FSGNJXD OpCode = 105
+	FCVTWD  OpCode = 106
+	FCVTWUD OpCode = 107
+	FCVTDW  OpCode = 108
+	FCVTDWU OpCode = 109
+	FCVTSD  OpCode = 110
+	FCVTDS  OpCode = 111
+	FEQD    OpCode = 112
+	FLTD    OpCode = 113
+	FLED    OpCode = 114
+	FCLASSD OpCode = 115
+
+	CADDI4SPN OpCode = 116
+	CLW       OpCode = 117
+	CSW       OpCode = 118
+	CNOP      OpCode = 119
+	CADDI     OpCode = 120
+	CJAL      OpCode = 121
+	CLI       OpCode = 122
+	CADDI16SP OpCode = 123
+	CLUI      OpCode = 124
+	CSRLI     OpCode = 125
+	CSRAI     OpCode = 126
+	CANDI     OpCode = 127
+	CSUB      OpCode = 128
+	CXOR      OpCode = 129
+	COR       OpCode = 130
+	CAND      OpCode = 131
+	CJ        OpCode = 132
+	CBEQZ     OpCode = 133
+	CBNEZ     OpCode = 134
+	CSLLI     OpCode = 135
+	CLWSP     OpCode = 136
+	CJR       OpCode = 137
+	CMV       OpCode = 138
+	CJALR     OpCode = 139
+	CADD      OpCode = 140
+	CSWSP     OpCode = 141
+)
+
+// The Zba, Zbb and Zbs bit-manipulation extensions. CLZ, CTZ and CPOP count
+// leading zeros, trailing zeros and set bits in rs1; MIN and MAX pick one of
+// two words, signed or unsigned; ROL and ROR rotate; ANDN, ORN and XNOR
+// invert rs2 before combining it; SEXT.B, SEXT.H and ZEXT.H extend the low
+// byte or halfword; SHnADD adds rs1 shifted left by n to rs2; BSET, BCLR,
+// BINV and BEXT set, clear, invert or extract the bit of rs1 that rs2 or the
+// immediate numbers.
+const (
+	CLZ    OpCode = 142
+	CTZ    OpCode = 143
+	CPOP   OpCode = 144
+	MIN    OpCode = 145
+	MAX    OpCode = 146
+	MINU   OpCode = 147
+	MAXU   OpCode = 148
+	ROL    OpCode = 149
+	ROR    OpCode = 150
+	RORI   OpCode = 151
+	ANDN   OpCode = 152
+	ORN    OpCode = 153
+	XNOR   OpCode = 154
+	SEXTB  OpCode = 155
+	SEXTH  OpCode = 156
+	ZEXTH  OpCode = 157
+	SH1ADD OpCode = 158
+	SH2ADD OpCode = 159
+	SH3ADD OpCode = 160
+	BSET   OpCode = 161
+	BCLR   OpCode = 162
+	BINV   OpCode = 163
+	BEXT   OpCode = 164
+	BSETI  OpCode = 165
+	BCLRI  OpCode = 166
+	BINVI  OpCode = 167
+	BEXTI  OpCode = 168
+)
+
+// The instructions only RV64 has. LD and SD move doublewords and LWU loads a
+// word zero-extended, where LW sign-extends it. The W forms work on the low
+// 32 bits of their operands, as RV32 would, and sign-extend the 32-bit result
+// to 64; their shifts take five-bit amounts.
+const (
+	LD    OpCode = 169
+	SD    OpCode = 170
+	LWU   OpCode = 171
+	ADDIW OpCode = 172
+	SLLIW OpCode = 173
+	SRLIW OpCode = 174
+	SRAIW OpCode = 175
+	ADDW  OpCode = 176
+	SUBW  OpCode = 177
+	SLLW  OpCode = 178
+	SRLW  OpCode = 179
+	SRAW  OpCode = 180
+	MULW  OpCode = 181
+	DIVW  OpCode = 182
+	DIVUW OpCode = 183
+	REMW  OpCode = 184
+	REMUW OpCode = 185
+)
@@ -0,0 +1,527 @@
+package opcodes
+
+import (
+	"slices"
+	"strings"
+)
+
+// Operand is the kind of one operand of an instruction as it is written in
+// assembly.
+type Operand int
+
+const (
+	RegOperand    Operand = iota // an integer register, x0 to x31
+	ImmOperand                   // a signed 12-bit immediate
+	ShamtOperand                 // a shift amount, 0 to 31
+	UImmOperand                  // the 5-bit unsigned immediate of the CSR ...I forms
+	UpperOperand                 // the 20-bit immediate of LUI and AUIPC
+	TargetOperand                // a label, or a byte offset from the instruction
+	MemOperand                   // offset(base), a 12-bit offset from a register
+	AddrOperand                  // (base), an address held in a register
+	CSROperand                   // a control and status register, by name or number
+	WordOperand                  // any 32-bit constant
+	FRegOperand                  // a float register, f0 to f31
+	RMOperand                    // a rounding mode by name, rne to rmm or dyn
+)
+
+// Field places one assembly operand in the bytecode. Slot is the index, 1 to
+// 3, of the slot it fills; a MemOperand puts its offset there and its base
+// register in Base, and an AddrOperand its register in Slot. An Optional
+// field may be left off the end of the operands: a rounding mode then
+// defaults to dyn.
+type Field struct {
+	Kind     Operand
+	Slot     int
+	Base     int
+	Optional bool
+}
+
+// Format is the shape of an instruction: the operands it is written with and
+// where each of them goes in the bytecode. Slots no field fills are zero. The
+// fields of a compressed instruction name slots of the instruction it
+// expands to, as that is what its two slots hold packed together.
+type Format int
+
+const (
+	RType        Format = iota // rd, rs1, rs2
+	IType                      // rd, rs1, imm
+	ShiftType                  // rd, rs1, shamt
+	R2Type                     // rd, rs1
+	UType                      // rd, imm20
+	LoadType                   // rd, offset(base)
+	StoreType                  // rs2, offset(base)
+	BType                      // rs1, rs2, target
+	JType                      // rd, target
+	JRType                     // rd, offset(rs1)
+	LRType                     // rd, (rs1)
+	AMOType                    // rd, rs2, (rs1)
+	CSRType                    // rd, csr, rs1
+	CSRIType                   // rd, csr, uimm
+	NoOperands                 // mret
+	PushType                   // word, for PSH
+	JumpType                   // target, for the stack machine's jumps
+	FRType                     // fd, fs1, fs2
+	FR2Type                    // fd, fs1[, rm]
+	FToXType                   // rd, fs1[, rm]
+	FFromXType                 // fd, rs1[, rm]
+	FCmpType                   // rd, fs1, fs2
+	FMvToXType                 // rd, fs1
+	FMvFromXType               // fd, rs1
+	FLoadType                  // fd, offset(base)
+	FStoreType                 // fs2, offset(base)
+	CIType                     // rd, imm, for a compressed instruction
+	CShiftType                 // rd, shamt
+	CUType                     // rd, imm20
+	CRType                     // rd, rs2
+	CBType                     // rs1, target
+	CJRType                    // rs1
+	CSPType                    // imm, for c.addi16sp
+)
+
+var formatFields = map[Format][]Field{
+	RType:      {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}, {Kind: RegOperand, Slot: 3}},
+	IType:      {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}, {Kind: ImmOperand, Slot: 3}},
+	ShiftType:  {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}, {Kind: ShamtOperand, Slot: 3}},
+	R2Type:     {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}},
+	UType:      {{Kind: RegOperand, Slot: 1}, {Kind: UpperOperand, Slot: 3}},
+	LoadType:   {{Kind: RegOperand, Slot: 1}, {Kind: MemOperand, Slot: 2, Base: 3}},
+	StoreType:  {{Kind: RegOperand, Slot: 1}, {Kind: MemOperand, Slot: 2, Base: 3}},
+	BType:      {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}, {Kind: TargetOperand, Slot: 3}},
+	JType:      {{Kind: RegOperand, Slot: 1}, {Kind: TargetOperand, Slot: 3}},
+	JRType:     {{Kind: RegOperand, Slot: 1}, {Kind: MemOperand, Slot: 3, Base: 2}},
+	LRType:     {{Kind: RegOperand, Slot: 1}, {Kind: AddrOperand, Slot: 2}},
+	AMOType:    {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 3}, {Kind: AddrOperand, Slot: 2}},
+	CSRType:    {{Kind: RegOperand, Slot: 1}, {Kind: CSROperand, Slot: 2}, {Kind: RegOperand, Slot: 3}},
+	CSRIType:   {{Kind: RegOperand, Slot: 1}, {Kind: CSROperand, Slot: 2}, {Kind: UImmOperand, Slot: 3}},
+	NoOperands: nil,
+	PushType:   {{Kind: WordOperand, Slot: 3}},
+	JumpType:   {{Kind: TargetOperand, Slot: 3}},
+
+	FRType:       {{Kind: FRegOperand, Slot: 1}, {Kind: FRegOperand, Slot: 2}, {Kind: FRegOperand, Slot: 3}},
+	FR2Type:      {{Kind: FRegOperand, Slot: 1}, {Kind: FRegOperand, Slot: 2}, {Kind: RMOperand, Slot: 3, Optional: true}},
+	FToXType:     {{Kind: RegOperand, Slot: 1}, {Kind: FRegOperand, Slot: 2}, {Kind: RMOperand, Slot: 3, Optional: true}},
+	FFromXType:   {{Kind: FRegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}, {Kind: RMOperand, Slot: 3, Optional: true}},
+	FCmpType:     {{Kind: RegOperand, Slot: 1}, {Kind: FRegOperand, Slot: 2}, {Kind: FRegOperand, Slot: 3}},
+	FMvToXType:   {{Kind: RegOperand, Slot: 1}, {Kind: FRegOperand, Slot: 2}},
+	FMvFromXType: {{Kind: FRegOperand, Slot: 1}, {Kind: RegOperand, Slot: 2}},
+	FLoadType:    {{Kind: FRegOperand, Slot: 1}, {Kind: MemOperand, Slot: 2, Base: 3}},
+	FStoreType:   {{Kind: FRegOperand, Slot: 1}, {Kind: MemOperand, Slot: 2, Base: 3}},
+
+	CIType:     {{Kind: RegOperand, Slot: 1}, {Kind: ImmOperand, Slot: 3}},
+	CShiftType: {{Kind: RegOperand, Slot: 1}, {Kind: ShamtOperand, Slot: 3}},
+	CUType:     {{Kind: RegOperand, Slot: 1}, {Kind: UpperOperand, Slot: 3}},
+	CRType:     {{Kind: RegOperand, Slot: 1}, {Kind: RegOperand, Slot: 3}},
+	CBType:     {{Kind: RegOperand, Slot: 1}, {Kind: TargetOperand, Slot: 3}},
+	CJRType:    {{Kind: RegOperand, Slot: 2}},
+	CSPType:    {{Kind: ImmOperand, Slot: 3}},
+}
+
+// Fields lists the operands of the format in the order they are written.
+func (f Format) Fields() []Field {
+	return formatFields[f]
+}
+
+// Flag marks what an instruction does beyond computing a value into rd.
+type Flag int
+
+const (
+	Branch     Flag = 1 << iota // branches to its target when a condition holds
+	Jump                        // always transfers control
+	Loads                       // reads memory
+	Stores                      // writes memory
+	Pseudo                      // stands for other instructions
+	Float                       // works on the float registers
+	Double                      // works on doubles rather than singles
+	Compressed                  // a 16-bit C extension instruction, two slots long
+	RV64                        // only assembled and run in RV64 mode
+)
+
+// Info describes one mnemonic. A pseudo-instruction has no opcode or format
+// of its own: it assembles to Expansion, with %1, %2, ... replaced by its
+// operands. li and la have no Expansion, as what they become depends on the
+// value or label they load. Pops and Pushes are how many values a
+// stack-machine instruction takes off the operand stack and puts back.
+//
+// A compressed instruction has an opcode of its own but also an Expansion:
+// the base instruction it stands for, whose opcode is its Base. Constraint
+// is what it takes on top of that for the operands to fit in 16 bits.
+type Info struct {
+	Op         OpCode
+	Mnemonic   string
+	Format     Format
+	Flags      Flag
+	Expansion  string
+	Base       OpCode
+	Constraint Constraint
+	Pops       int
+	Pushes     int
+}
+
+// Is reports whether the instruction has every one of the flags.
+func (i Info) Is(flags Flag) bool {
+	return i.Flags&flags == flags
+}
+
+// RegisterSlots lists the slots holding the integer registers an instruction
+// in this format names, sources and destination alike.
+func (i Info) RegisterSlots() []int {
+	var slots []int
+	for _, f := range i.Format.Fields() {
+		switch f.Kind {
+		case RegOperand, AddrOperand:
+			slots = append(slots, f.Slot)
+		case MemOperand:
+			slots = append(slots, f.Base)
+		}
+	}
+	return slots
+}
+
+// Registers lists the integer registers inst, an instruction in this format,
+// names, in the order of RegisterSlots.
+func (i Info) Registers(inst [4]int) []int {
+	var regs []int
+	for _, slot := range i.RegisterSlots() {
+		regs = append(regs, inst[slot])
+	}
+	return regs
+}
+
+// Table is every instruction the assembler accepts, VM runs and disassembler
+// prints. Adding an instruction starts here; the VM's decoder then needs a
+// case for it and the code generator an entry in its own table of lowerings,
+// and a test in each package checks them against this one.
+var Table = []Info{
+	{Op: ADD, Mnemonic: "add", Format: RType},
+	{Op: SUB, Mnemonic: "sub", Format: RType},
+	{Op: MUL, Mnemonic: "mul", Format: RType},
+	{Op: MULH, Mnemonic: "mulh", Format: RType},
+	{Op: MULHU, Mnemonic: "mulhu", Format: RType},
+	{Op: MULHSU, Mnemonic: "mulhsu", Format: RType},
+	{Op: DIV, Mnemonic: "div", Format: RType},
+	{Op: DIVU, Mnemonic: "divu", Format: RType},
+	{Op: REM, Mnemonic: "rem", Format: RType},
+	{Op: REMU, Mnemonic: "remu", Format: RType},
+	{Op: AND, Mnemonic: "and", Format: RType},
+	{Op: OR, Mnemonic: "or", Format: RType},
+	{Op: XOR, Mnemonic: "xor", Format: RType},
+	{Op: SLL, Mnemonic: "sll", Format: RType},
+	{Op: SRL, Mnemonic: "srl", Format: RType},
+	{Op: SRA, Mnemonic: "sra", Format: RType},
+	{Op: SLT, Mnemonic: "slt", Format: RType},
+	{Op: SLTU, Mnemonic: "sltu", Format: RType},
+
+	{Op: ADDI, Mnemonic: "addi", Format: IType},
+	{Op: ANDI, Mnemonic: "andi", Format: IType},
+	{Op: ORI, Mnemonic: "ori", Format: IType},
+	{Op: XORI, Mnemonic: "xori", Format: IType},
+	{Op: SLTI, Mnemonic: "slti", Format: IType},
+	{Op: SLTIU, Mnemonic: "sltiu", Format: IType},
+	{Op: SLLI, Mnemonic: "slli", Format: ShiftType},
+	{Op: SRLI, Mnemonic: "srli", Format: ShiftType},
+	{Op: SRAI, Mnemonic: "srai", Format: ShiftType},
+	{Op: LUI, Mnemonic: "lui", Format: UType},
+	{Op: AUIPC, Mnemonic: "auipc", Format: UType},
+
+	{Op: CLZ, Mnemonic: "clz", Format: R2Type},
+	{Op: CTZ, Mnemonic: "ctz", Format: R2Type},
+	{Op: CPOP, Mnemonic: "cpop", Format: R2Type},
+	{Op: MIN, Mnemonic: "min", Format: RType},
+	{Op: MAX, Mnemonic: "max", Format: RType},
+	{Op: MINU, Mnemonic: "minu", Format: RType},
+	{Op: MAXU, Mnemonic: "maxu", Format: RType},
+	{Op: ROL, Mnemonic: "rol", Format: RType},
+	{Op: ROR, Mnemonic: "ror", Format: RType},
+	{Op: RORI, Mnemonic: "rori", Format: ShiftType},
+	{Op: ANDN, Mnemonic: "andn", Format: RType},
+	{Op: ORN, Mnemonic: "orn", Format: RType},
+	{Op: XNOR, Mnemonic: "xnor", Format: RType},
+	{Op: SEXTB, Mnemonic: "sext.b", Format: R2Type},
+	{Op: SEXTH, Mnemonic: "sext.h", Format: R2Type},
+	{Op: ZEXTH, Mnemonic: "zext.h", Format: R2Type},
+	{Op: SH1ADD, Mnemonic: "sh1add", Format: RType},
+	{Op: SH2ADD, Mnemonic: "sh2add", Format: RType},
+	{Op: SH3ADD, Mnemonic: "sh3add", Format: RType},
+	{Op: BSET, Mnemonic: "bset", Format: RType},
+	{Op: BCLR, Mnemonic: "bclr", Format: RType},
+	{Op: BINV, Mnemonic: "binv", Format: RType},
+	{Op: BEXT, Mnemonic: "bext", Format: RType},
+	{Op: BSETI, Mnemonic: "bseti", Format: ShiftType},
+	{Op: BCLRI, Mnemonic: "bclri", Format: ShiftType},
+	{Op: BINVI, Mnemonic: "binvi", Format: ShiftType},
+	{Op: BEXTI, Mnemonic: "bexti", Format: ShiftType},
+
+	{Op: LW, Mnemonic: "lw", Format: LoadType, Flags: Loads},
+	{Op: LB, Mnemonic: "lb", Format: LoadType, Flags: Loads},
+	{Op: LBU, Mnemonic: "lbu", Format: LoadType, Flags: Loads},
+	{Op: LH, Mnemonic: "lh", Format: LoadType, Flags: Loads},
+	{Op: LHU, Mnemonic: "lhu", Format: LoadType, Flags: Loads},
+	{Op: SW, Mnemonic: "sw", Format: StoreType, Flags: Stores},
+	{Op: SB, Mnemonic: "sb", Format: StoreType, Flags: Stores},
+	{Op: SH, Mnemonic: "sh", Format: StoreType, Flags: Stores},
+
+	{Op: BEQ, Mnemonic: "beq", Format: BType, Flags: Branch},
+	{Op: BNE, Mnemonic: "bne", Format: BType, Flags: Branch},
+	{Op: BLT, Mnemonic: "blt", Format: BType, Flags: Branch},
+	{Op: BGE, Mnemonic: "bge", Format: BType, Flags: Branch},
+	{Op: BLTU, Mnemonic: "bltu", Format: BType, Flags: Branch},
+	{Op: BGEU, Mnemonic: "bgeu", Format: BType, Flags: Branch},
+	{Op: JAL, Mnemonic: "jal", Format: JType, Flags: Jump},
+	{Op: JALR, Mnemonic: "jalr", Format: JRType, Flags: Jump},
+
+	{Op: LRW, Mnemonic: "lr.w", Format: LRType, Flags: Loads},
+	{Op: SCW, Mnemonic: "sc.w", Format: AMOType, Flags: Stores},
+	{Op: AMOSWAPW, Mnemonic: "amoswap.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOADDW, Mnemonic: "amoadd.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOXORW, Mnemonic: "amoxor.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOANDW, Mnemonic: "amoand.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOORW, Mnemonic: "amoor.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOMINW, Mnemonic: "amomin.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOMAXW, Mnemonic: "amomax.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOMINUW, Mnemonic: "amominu.w", Format: AMOType, Flags: Loads | Stores},
+	{Op: AMOMAXUW, Mnemonic: "amomaxu.w", Format: AMOType, Flags: Loads | Stores},
+
+	{Op: CSRRW, Mnemonic: "csrrw", Format: CSRType},
+	{Op: CSRRS, Mnemonic: "csrrs", Format: CSRType},
+	{Op: CSRRC, Mnemonic: "csrrc", Format: CSRType},
+	{Op: CSRRWI, Mnemonic: "csrrwi", Format: CSRIType},
+	{Op: CSRRSI, Mnemonic: "csrrsi", Format: CSRIType},
+	{Op: CSRRCI, Mnemonic: "csrrci", Format: CSRIType},
+	{Op: MRET, Mnemonic: "mret", Format: NoOperands, Flags: Jump},
+
+	{Op: FLW, Mnemonic: "flw", Format: FLoadType, Flags: Float | Loads},
+	{Op: FSW, Mnemonic: "fsw", Format: FStoreType, Flags: Float | Stores},
+	{Op: FADDS, Mnemonic: "fadd.s", Format: FRType, Flags: Float},
+	{Op: FSUBS, Mnemonic: "fsub.s", Format: FRType, Flags: Float},
+	{Op: FMULS, Mnemonic: "fmul.s", Format: FRType, Flags: Float},
+	{Op: FDIVS, Mnemonic: "fdiv.s", Format: FRType, Flags: Float},
+	{Op: FSQRTS, Mnemonic: "fsqrt.s", Format: FR2Type, Flags: Float},
+	{Op: FMINS, Mnemonic: "fmin.s", Format: FRType, Flags: Float},
+	{Op: FMAXS, Mnemonic: "fmax.s", Format: FRType, Flags: Float},
+	{Op: FSGNJS, Mnemonic: "fsgnj.s", Format: FRType, Flags: Float},
+	{Op: FSGNJNS, Mnemonic: "fsgnjn.s", Format: FRType, Flags: Float},
+	{Op: FSGNJXS, Mnemonic: "fsgnjx.s", Format: FRType, Flags: Float},
+	{Op: FCVTWS, Mnemonic: "fcvt.w.s", Format: FToXType, Flags: Float},
+	{Op: FCVTWUS, Mnemonic: "fcvt.wu.s", Format: FToXType, Flags: Float},
+	{Op: FCVTSW, Mnemonic: "fcvt.s.w", Format: FFromXType, Flags: Float},
+	{Op: FCVTSWU, Mnemonic: "fcvt.s.wu", Format: FFromXType, Flags: Float},
+	{Op: FEQS, Mnemonic: "feq.s", Format: FCmpType, Flags: Float},
+	{Op: FLTS, Mnemonic: "flt.s", Format: FCmpType, Flags: Float},
+	{Op: FLES, Mnemonic: "fle.s", Format: FCmpType, Flags: Float},
+	{Op: FMVXW, Mnemonic: "fmv.x.w", Format: FMvToXType, Flags: Float},
+	{Op: FMVWX, Mnemonic: "fmv.w.x", Format: FMvFromXType, Flags: Float},
+	{Op: FCLASSS, Mnemonic: "fclass.s", Format: FMvToXType, Flags: Float},
+
+	{Op: FLD, Mnemonic: "fld", Format: FLoadType, Flags: Float | Double | Loads},
+	{Op: FSD, Mnemonic: "fsd", Format: FStoreType, Flags: Float | Double | Stores},
+	{Op: FADDD, Mnemonic: "fadd.d", Format: FRType, Flags: Float | Double},
+	{Op: FSUBD, Mnemonic: "fsub.d", Format: FRType, Flags: Float | Double},
+	{Op: FMULD, Mnemonic: "fmul.d", Format: FRType, Flags: Float | Double},
+	{Op: FDIVD, Mnemonic: "fdiv.d", Format: FRType, Flags: Float | Double},
+	{Op: FSQRTD, Mnemonic: "fsqrt.d", Format: FR2Type, Flags: Float | Double},
+	{Op: FMIND, Mnemonic: "fmin.d", Format: FRType, Flags: Float | Double},
+	{Op: FMAXD, Mnemonic: "fmax.d", Format: FRType, Flags: Float | Double},
+	{Op: FSGNJD, Mnemonic: "fsgnj.d", Format: FRType, Flags: Float | Double},
+	{Op: FSGNJND, Mnemonic: "fsgnjn.d", Format: FRType, Flags: Float | Double},
+	{Op: FSGNJXD, Mnemonic: "fsgnjx.d", Format: FRType, Flags: Float | Double},
+	{Op: FCVTWD, Mnemonic: "fcvt.w.d", Format: FToXType, Flags: Float | Double},
+	{Op: FCVTWUD, Mnemonic: "fcvt.wu.d", Format: FToXType, Flags: Float | Double},
+	{Op: FCVTDW, Mnemonic: "fcvt.d.w", Format: FFromXType, Flags: Float | Double},
+	{Op: FCVTDWU, Mnemonic: "fcvt.d.wu", Format: FFromXType, Flags: Float | Double},
+	{Op: FCVTSD, Mnemonic: "fcvt.s.d", Format: FR2Type, Flags: Float | Double},
+	{Op: FCVTDS, Mnemonic: "fcvt.d.s", Format: FR2Type, Flags: Float | Double},
+	{Op: FEQD, Mnemonic: "feq.d", Format: FCmpType, Flags: Float | Double},
+	{Op: FLTD, Mnemonic: "flt.d", Format: FCmpType, Flags: Float | Double},
+	{Op: FLED, Mnemonic: "fle.d", Format: FCmpType, Flags: Float | Double},
+	{Op: FCLASSD, Mnemonic: "fclass.d", Format: FMvToXType, Flags: Float | Double},
+
+	{Op: CADDI4SPN, Mnemonic: "c.addi4spn", Format: CIType, Flags: Compressed, Expansion: "addi %1, x2, %2",
+		Constraint: Constraint{Compact: []int{1}, Imm: 3, Min: 4, Max: 1020, Scale: 4}},
+	{Op: CLW, Mnemonic: "c.lw", Format: LoadType, Flags: Compressed | Loads, Expansion: "lw %1, %2",
+		Constraint: Constraint{Compact: []int{1, 3}, Imm: 2, Max: 124, Scale: 4}},
+	{Op: CSW, Mnemonic: "c.sw", Format: StoreType, Flags: Compressed | Stores, Expansion: "sw %1, %2",
+		Constraint: Constraint{Compact: []int{1, 3}, Imm: 2, Max: 124, Scale: 4}},
+	{Op: CNOP, Mnemonic: "c.nop", Format: NoOperands, Flags: Compressed, Expansion: "addi x0, x0, 0"},
+	{Op: CADDI, Mnemonic: "c.addi", Format: CIType, Flags: Compressed, Expansion: "addi %1, %1, %2",
+		Constraint: Constraint{NonZero: []int{1}, Imm: 3, Min: -32, Max: 31, NonZeroImm: true}},
+	{Op: CJAL, Mnemonic: "c.jal", Format: JumpType, Flags: Compressed | Jump, Expansion: "jal x1, %1",
+		Constraint: Constraint{Imm: 3, Min: -2048, Max: 2046, Scale: 2}},
+	{Op: CLI, Mnemonic: "c.li", Format: CIType, Flags: Compressed, Expansion: "addi %1, x0, %2",
+		Constraint: Constraint{NonZero: []int{1}, Imm: 3, Min: -32, Max: 31}},
+	{Op: CADDI16SP, Mnemonic: "c.addi16sp", Format: CSPType, Flags: Compressed, Expansion: "addi x2, x2, %1",
+		Constraint: Constraint{Imm: 3, Min: -512, Max: 496, Scale: 16, NonZeroImm: true}},
+	{Op: CLUI, Mnemonic: "c.lui", Format: CUType, Flags: Compressed, Expansion: "lui %1, %2",
+		Constraint: Constraint{NonZero: []int{1}, NotSP: 1, Imm: 3, Min: -32, Max: 31, NonZeroImm: true, Upper: true}},
+	{Op: CSRLI, Mnemonic: "c.srli", Format: CShiftType, Flags: Compressed, Expansion: "srli %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1}, Imm: 3, Min: 1, Max: 31}},
+	{Op: CSRAI, Mnemonic: "c.srai", Format: CShiftType, Flags: Compressed, Expansion: "srai %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1}, Imm: 3, Min: 1, Max: 31}},
+	{Op: CANDI, Mnemonic: "c.andi", Format: CIType, Flags: Compressed, Expansion: "andi %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1}, Imm: 3, Min: -32, Max: 31}},
+	{Op: CSUB, Mnemonic: "c.sub", Format: CRType, Flags: Compressed, Expansion: "sub %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1, 3}}},
+	{Op: CXOR, Mnemonic: "c.xor", Format: CRType, Flags: Compressed, Expansion: "xor %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1, 3}}},
+	{Op: COR, Mnemonic: "c.or", Format: CRType, Flags: Compressed, Expansion: "or %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1, 3}}},
+	{Op: CAND, Mnemonic: "c.and", Format: CRType, Flags: Compressed, Expansion: "and %1, %1, %2",
+		Constraint: Constraint{Compact: []int{1, 3}}},
+	{Op: CJ, Mnemonic: "c.j", Format: JumpType, Flags: Compressed | Jump, Expansion: "jal x0, %1",
+		Constraint: Constraint{Imm: 3, Min: -2048, Max: 2046, Scale: 2}},
+	{Op: CBEQZ, Mnemonic: "c.beqz", Format: CBType, Flags: Compressed | Branch, Expansion: "beq %1, x0, %2",
+		Constraint: Constraint{Compact: []int{1}, Imm: 3, Min: -256, Max: 254, Scale: 2}},
+	{Op: CBNEZ, Mnemonic: "c.bnez", Format: CBType, Flags: Compressed | Branch, Expansion: "bne %1, x0, %2",
+		Constraint: Constraint{Compact: []int{1}, Imm: 3, Min: -256, Max: 254, Scale: 2}},
+	{Op: CSLLI, Mnemonic: "c.slli", Format: CShiftType, Flags: Compressed, Expansion: "slli %1, %1, %2",
+		Constraint: Constraint{NonZero: []int{1}, Imm: 3, Min: 1, Max: 31}},
+	{Op: CLWSP, Mnemonic: "c.lwsp", Format: LoadType, Flags: Compressed | Loads, Expansion: "lw %1, %2",
+		Constraint: Constraint{NonZero: []int{1}, SP: 3, Imm: 2, Max: 252, Scale: 4}},
+	{Op: CJR, Mnemonic: "c.jr", Format: CJRType, Flags: Compressed | Jump, Expansion: "jalr x0, 0(%1)",
+		Constraint: Constraint{NonZero: []int{2}}},
+	{Op: CMV, Mnemonic: "c.mv", Format: CRType, Flags: Compressed, Expansion: "add %1, x0, %2",
+		Constraint: Constraint{NonZero: []int{1, 3}}},
+	{Op: CJALR, Mnemonic: "c.jalr", Format: CJRType, Flags: Compressed | Jump, Expansion: "jalr x1, 0(%1)",
+		Constraint: Constraint{NonZero: []int{2}}},
+	{Op: CADD, Mnemonic: "c.add", Format: CRType, Flags: Compressed, Expansion: "add %1, %1, %2",
+		Constraint: Constraint{NonZero: []int{1, 3}}},
+	{Op: CSWSP, Mnemonic: "c.swsp", Format: StoreType, Flags: Compressed | Stores, Expansion: "sw %1, %2",
+		Constraint: Constraint{SP: 3, Imm: 2, Max: 252, Scale: 4}},
+
+	{Op: LD, Mnemonic: "ld", Format: LoadType, Flags: RV64 | Loads},
+	{Op: LWU, Mnemonic: "lwu", Format: LoadType, Flags: RV64 | Loads},
+	{Op: SD, Mnemonic: "sd", Format: StoreType, Flags: RV64 | Stores},
+	{Op: ADDIW, Mnemonic: "addiw", Format: IType, Flags: RV64},
+	{Op: SLLIW, Mnemonic: "slliw", Format: ShiftType, Flags: RV64},
+	{Op: SRLIW, Mnemonic: "srliw", Format: ShiftType, Flags: RV64},
+	{Op: SRAIW, Mnemonic: "sraiw", Format: ShiftType, Flags: RV64},
+	{Op: ADDW, Mnemonic: "addw", Format: RType, Flags: RV64},
+	{Op: SUBW, Mnemonic: "subw", Format: RType, Flags: RV64},
+	{Op: SLLW, Mnemonic: "sllw", Format: RType, Flags: RV64},
+	{Op: SRLW, Mnemonic: "srlw", Format: RType, Flags: RV64},
+	{Op: SRAW, Mnemonic: "sraw", Format: RType, Flags: RV64},
+	{Op: MULW, Mnemonic: "mulw", Format: RType, Flags: RV64},
+	{Op: DIVW, Mnemonic: "divw", Format: RType, Flags: RV64},
+	{Op: DIVUW, Mnemonic: "divuw", Format: RType, Flags: RV64},
+	{Op: REMW, Mnemonic: "remw", Format: RType, Flags: RV64},
+	{Op: REMUW, Mnemonic: "remuw", Format: RType, Flags: RV64},
+
+	{Mnemonic: "li", Flags: Pseudo},
+	{Mnemonic: "la", Flags: Pseudo},
+	{Mnemonic: "mv", Flags: Pseudo, Expansion: "addi %1, %2, 0"},
+	{Mnemonic: "not", Flags: Pseudo, Expansion: "xori %1, %2, -1"},
+	{Mnemonic: "mod", Flags: Pseudo, Expansion: "rem %1, %2, %3"},
+	{Mnemonic: "seqz", Flags: Pseudo, Expansion: "sltiu %1, %2, 1"},
+	{Mnemonic: "snez", Flags: Pseudo, Expansion: "sltu %1, x0, %2"},
+	{Mnemonic: "sltz", Flags: Pseudo, Expansion: "slt %1, %2, x0"},
+	{Mnemonic: "sgtz", Flags: Pseudo, Expansion: "slt %1, x0, %2"},
+	{Mnemonic: "bgtu", Flags: Pseudo, Expansion: "bltu %2, %1, %3"},
+	{Mnemonic: "bleu", Flags: Pseudo, Expansion: "bgeu %2, %1, %3"},
+	{Mnemonic: "csrr", Flags: Pseudo, Expansion: "csrrs %1, %2, x0"},
+	{Mnemonic: "csrw", Flags: Pseudo, Expansion: "csrrw x0, %1, %2"},
+	{Mnemonic: "csrs", Flags: Pseudo, Expansion: "csrrs x0, %1, %2"},
+	{Mnemonic: "csrc", Flags: Pseudo, Expansion: "csrrc x0, %1, %2"},
+	{Mnemonic: "csrwi", Flags: Pseudo, Expansion: "csrrwi x0, %1, %2"},
+	{Mnemonic: "csrsi", Flags: Pseudo, Expansion: "csrrsi x0, %1, %2"},
+	{Mnemonic: "csrci", Flags: Pseudo, Expansion: "csrrci x0, %1, %2"},
+	{Mnemonic: "rdcycle", Flags: Pseudo, Expansion: "csrrs %1, cycle, x0"},
+	{Mnemonic: "rdtime", Flags: Pseudo, Expansion: "csrrs %1, time, x0"},
+	{Mnemonic: "rdinstret", Flags: Pseudo, Expansion: "csrrs %1, instret, x0"},
+	{Mnemonic: "rdcycleh", Flags: Pseudo, Expansion: "csrrs %1, cycleh, x0"},
+	{Mnemonic: "rdtimeh", Flags: Pseudo, Expansion: "csrrs %1, timeh, x0"},
+	{Mnemonic: "rdinstreth", Flags: Pseudo, Expansion: "csrrs %1, instreth, x0"},
+	{Mnemonic: "fmv.s", Flags: Pseudo, Expansion: "fsgnj.s %1, %2, %2"},
+	{Mnemonic: "fneg.s", Flags: Pseudo, Expansion: "fsgnjn.s %1, %2, %2"},
+	{Mnemonic: "fabs.s", Flags: Pseudo, Expansion: "fsgnjx.s %1, %2, %2"},
+	{Mnemonic: "fmv.d", Flags: Pseudo, Expansion: "fsgnj.d %1, %2, %2"},
+	{Mnemonic: "fneg.d", Flags: Pseudo, Expansion: "fsgnjn.d %1, %2, %2"},
+	{Mnemonic: "fabs.d", Flags: Pseudo, Expansion: "fsgnjx.d %1, %2, %2"},
+	{Mnemonic: "frcsr", Flags: Pseudo, Expansion: "csrrs %1, fcsr, x0"},
+	{Mnemonic: "fscsr", Flags: Pseudo, Expansion: "csrrw x0, fcsr, %1"},
+	{Mnemonic: "frrm", Flags: Pseudo, Expansion: "csrrs %1, frm, x0"},
+	{Mnemonic: "fsrm", Flags: Pseudo, Expansion: "csrrw x0, frm, %1"},
+	{Mnemonic: "frflags", Flags: Pseudo, Expansion: "csrrs %1, fflags, x0"},
+	{Mnemonic: "fsflags", Flags: Pseudo, Expansion: "csrrw x0, fflags, %1"},
+	{Mnemonic: "sext.w", Flags: Pseudo | RV64, Expansion: "addiw %1, %2, 0"},
+	{Mnemonic: "negw", Flags: Pseudo | RV64, Expansion: "subw %1, x0, %2"},
+}
+
+// StackTable is the stack-machine instruction set. Every instruction takes
+// its operands from the operand stack and pushes its result back, so ADD,
+// SUB, MUL and DIV keep their opcodes but have no register operands. A
+// program is written entirely in one set or the other.
+var StackTable = []Info{
+	{Op: PSH, Mnemonic: "psh", Format: PushType, Pushes: 1},
+	{Op: DUP, Mnemonic: "dup", Format: NoOperands, Pops: 1, Pushes: 2},
+	{Op: SWP, Mnemonic: "swp", Format: NoOperands, Pops: 2, Pushes: 2},
+	{Op: DRP, Mnemonic: "drp", Format: NoOperands, Pops: 1},
+	{Op: ADD, Mnemonic: "add", Format: NoOperands, Pops: 2, Pushes: 1},
+	{Op: SUB, Mnemonic: "sub", Format: NoOperands, Pops: 2, Pushes: 1},
+	{Op: MUL, Mnemonic: "mul", Format: NoOperands, Pops: 2, Pushes: 1},
+	{Op: DIV, Mnemonic: "div", Format: NoOperands, Pops: 2, Pushes: 1},
+	{Op: LTE, Mnemonic: "lte", Format: NoOperands, Pops: 2, Pushes: 1},
+	{Op: GT, Mnemonic: "gt", Format: NoOperands, Pops: 2, Pushes: 1},
+	{Op: JMP, Mnemonic: "jmp", Format: JumpType, Flags: Jump},
+	{Op: JZ, Mnemonic: "jz", Format: JumpType, Flags: Branch, Pops: 1},
+	{Op: JNZ, Mnemonic: "jnz", Format: JumpType, Flags: Branch, Pops: 1},
+}
+
+// Set is one instruction set, indexed by mnemonic and by opcode, with the
+// compressed forms of each base instruction.
+type Set struct {
+	byMnemonic   map[string]Info
+	byOpCode     map[OpCode]Info
+	compressions map[OpCode][]Info
+}
+
+// RegisterSet is the RV32 instruction set in Table, RV64Set all of Table
+// with the RV64 instructions, and StackSet the stack-machine set in
+// StackTable.
+var (
+	RegisterSet = newSet(slices.DeleteFunc(slices.Clone(Table), func(i Info) bool { return i.Is(RV64) }))
+	RV64Set     = newSet(Table)
+	StackSet    = newSet(StackTable)
+)
+
+func newSet(table []Info) *Set {
+	s := &Set{byMnemonic: map[string]Info{}, byOpCode: map[OpCode]Info{}, compressions: map[OpCode][]Info{}}
+	for _, info := range table {
+		if info.Is(Compressed) {
+			base := strings.Fields(info.Expansion)[0]
+			info.Base = table[slices.IndexFunc(table, func(i Info) bool { return i.Mnemonic == base })].Op
+			s.compressions[info.Base] = append(s.compressions[info.Base], info)
+		}
+		s.byMnemonic[info.Mnemonic] = info
+		if !info.Is(Pseudo) {
+			s.byOpCode[info.Op] = info
+		}
+	}
+	return s
+}
+
+// ByMnemonic looks an instruction or pseudo-instruction up by name.
+func (s *Set) ByMnemonic(mnemonic string) (Info, bool) {
+	info, ok := s.byMnemonic[mnemonic]
+	return info, ok
+}
+
+// ByOpCode looks up the instruction an opcode encodes.
+func (s *Set) ByOpCode(op OpCode) (Info, bool) {
+	info, ok := s.byOpCode[op]
+	return info, ok
+}
+
+// Compressions lists the compressed instructions that expand to the base
+// instruction op, in table order.
+func (s *Set) Compressions(op OpCode) []Info {
+	return s.compressions[op]
+}
+
+// ByMnemonic looks a RISC-V instruction or pseudo-instruction up by name.
+func ByMnemonic(mnemonic string) (Info, bool) {
+	return RegisterSet.ByMnemonic(mnemonic)
+}
+
+// ByOpCode looks up the RISC-V instruction an opcode encodes.
+func ByOpCode(op OpCode) (Info, bool) {
+	return RegisterSet.ByOpCode(op)
+}
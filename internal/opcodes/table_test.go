@@ -0,0 +1,139 @@
+package opcodes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableMnemonicsAreUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for _, info := range Table {
+		assert.False(t, seen[info.Mnemonic], "%s is in the table twice", info.Mnemonic)
+		seen[info.Mnemonic] = true
+	}
+}
+
+func TestTableOpCodesAreUnique(t *testing.T) {
+	seen := map[OpCode]string{}
+	for _, info := range Table {
+		if info.Is(Pseudo) {
+			continue
+		}
+		other, dup := seen[info.Op]
+		assert.False(t, dup, "%s and %s share opcode %d", info.Mnemonic, other, info.Op)
+		seen[info.Op] = info.Mnemonic
+	}
+}
+
+func TestPseudoInstructionsExpandToRealOnes(t *testing.T) {
+	for _, info := range Table {
+		if info.Expansion == "" {
+			continue
+		}
+		target, ok := RV64Set.ByMnemonic(strings.Fields(info.Expansion)[0])
+		assert.True(t, ok, "%s expands to an unknown instruction", info.Mnemonic)
+		assert.False(t, target.Is(Pseudo), "%s expands to another pseudo-instruction", info.Mnemonic)
+	}
+}
+
+func TestByOpCodeSkipsPseudoInstructions(t *testing.T) {
+	info, ok := ByOpCode(REM)
+
+	assert.True(t, ok)
+	assert.Equal(t, "rem", info.Mnemonic, "mod is only a spelling of rem")
+}
+
+func TestStackTableIsItsOwnSet(t *testing.T) {
+	seen := map[OpCode]string{}
+	for _, info := range StackTable {
+		other, dup := seen[info.Op]
+		assert.False(t, dup, "%s and %s share opcode %d", info.Mnemonic, other, info.Op)
+		seen[info.Op] = info.Mnemonic
+	}
+
+	info, ok := StackSet.ByMnemonic("add")
+	assert.True(t, ok)
+	assert.Equal(t, NoOperands, info.Format, "stack add takes its operands from the stack")
+	_, ok = StackSet.ByMnemonic("addi")
+	assert.False(t, ok, "register instructions are not part of the stack set")
+}
+
+func TestRV64InstructionsAreOnlyInTheRV64Set(t *testing.T) {
+	for _, info := range Table {
+		_, inRV32 := RegisterSet.ByMnemonic(info.Mnemonic)
+		_, inRV64 := RV64Set.ByMnemonic(info.Mnemonic)
+
+		assert.True(t, inRV64, "RV64 should have every instruction, but not %s", info.Mnemonic)
+		assert.Equal(t, !info.Is(RV64), inRV32, "%s should be in RV32 only if it is not RV64-only", info.Mnemonic)
+	}
+}
+
+func TestCompressedInstructionsExpandToTheirBase(t *testing.T) {
+	for _, info := range Table {
+		if !info.Is(Compressed) {
+			continue
+		}
+		compressed, _ := ByOpCode(info.Op)
+		base, ok := ByOpCode(compressed.Base)
+		assert.True(t, ok, "%s should have a base instruction", info.Mnemonic)
+		assert.Equal(t, strings.Fields(info.Expansion)[0], base.Mnemonic)
+		assert.Equal(t, base.Flags, compressed.Flags&^Compressed, "%s should do what %s does", info.Mnemonic, base.Mnemonic)
+		assert.Contains(t, RegisterSet.Compressions(base.Op), compressed)
+	}
+}
+
+func TestPackRoundTripsTheExpansion(t *testing.T) {
+	cases := []struct {
+		op   OpCode
+		inst [4]int
+	}{
+		{CADDI, [4]int{int(ADDI), 31, 31, -32}},
+		{CLUI, [4]int{int(LUI), 9, 0, 0xFFFFF}},
+		{CLW, [4]int{int(LW), 15, 124, 8}},
+		{CSWSP, [4]int{int(SW), 31, 252, 2}},
+		{CBNEZ, [4]int{int(BNE), 8, 0, -256}},
+		{CJALR, [4]int{int(JALR), 1, 31, 0}},
+	}
+
+	for _, tc := range cases {
+		info, _ := ByOpCode(tc.op)
+		byteCode := []int{int(tc.op), info.Pack(tc.inst)}
+
+		inst, size, ok := Fetch(byteCode, 0)
+
+		assert.True(t, ok)
+		assert.Equal(t, 2, size)
+		assert.Equal(t, tc.inst, inst, "%s should unpack to what was packed", info.Mnemonic)
+	}
+}
+
+func TestFetchReportsInstructionsCutShort(t *testing.T) {
+	inst, size, ok := Fetch([]int{int(CNOP), 0, int(ADDI), 1, 0}, 2)
+
+	assert.False(t, ok)
+	assert.Equal(t, 4, size)
+	assert.Equal(t, [4]int{int(ADDI)}, inst, "only the opcode should be filled in")
+}
+
+func TestRegistersListsEveryIntegerRegisterNamed(t *testing.T) {
+	cases := []struct {
+		op       OpCode
+		inst     [4]int
+		expected []int
+	}{
+		{ADD, [4]int{int(ADD), 1, 2, 3}, []int{1, 2, 3}},
+		{ADDI, [4]int{int(ADDI), 4, 5, 100}, []int{4, 5}},
+		{SW, [4]int{int(SW), 6, 8, 7}, []int{6, 7}},
+		{JALR, [4]int{int(JALR), 0, 1, 0}, []int{0, 1}},
+		{AMOADDW, [4]int{int(AMOADDW), 1, 2, 3}, []int{1, 3, 2}},
+		{FADDS, [4]int{int(FADDS), 1, 2, 3}, nil},
+		{FCVTWS, [4]int{int(FCVTWS), 17, 2, 0}, []int{17}},
+	}
+
+	for _, tc := range cases {
+		info, _ := ByOpCode(tc.op)
+		assert.Equal(t, tc.expected, info.Registers(tc.inst), info.Mnemonic)
+	}
+}
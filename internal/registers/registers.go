@@ -1,20 +1,145 @@
 // Package registers conceptualises haw registers will work
 package registers
 
+import "fmt"
+
 type Registers struct {
-	values [32]int32
+	values   [32]int32
+	embedded bool
 }
 
 func NewRegisters() *Registers {
 	return &Registers{}
 }
 
+// NewRegistersE returns the register file of RV32E, which has only x0 to
+// x15. Count tells the VM to treat an instruction naming any of the others as
+// illegal, and Read, Write and Ref panic if given one, as they do for a
+// register past x31.
+func NewRegistersE() *Registers {
+	return &Registers{embedded: true}
+}
+
+// Count is the number of integer registers, 32, or 16 in RV32E.
+func (r *Registers) Count() int {
+	if r.embedded {
+		return 16
+	}
+	return 32
+}
+
+// exists panics if the register file has no such register. Past x31 the
+// array index does that by itself; RV32E has to stop at x15.
+func (r *Registers) exists(register int) {
+	if r.embedded && register >= 16 {
+		panic(fmt.Sprintf("registers: RV32E has no register x%d", register))
+	}
+}
+
 func (r *Registers) Read(register int) int32 {
+	r.exists(register)
 	return r.values[register]
 }
 
 func (r *Registers) Write(register int, val int32) {
+	r.exists(register)
+	if register != 0 {
+		r.values[register] = val
+	}
+}
+
+// Ref returns the storage behind a register so that a caller which has already
+// checked its operands can bind to it directly. Writes through the reference
+// bypass the x0 rule, so callers must never write through Ref(0).
+func (r *Registers) Ref(register int) *int32 {
+	r.exists(register)
+	return &r.values[register]
+}
+
+// File returns the storage behind the whole register file, for a caller that
+// indexes it by register number. The caveat about x0 in Ref applies, and on
+// RV32E the caller must keep to x0 to x15 itself.
+func (r *Registers) File() *[32]int32 {
+	return &r.values
+}
+
+// Registers64 is the integer register file in RV64 mode, where every
+// register is 64 bits wide. As in Registers, x0 ignores writes.
+type Registers64 struct {
+	values [32]int64
+}
+
+func NewRegisters64() *Registers64 {
+	return &Registers64{}
+}
+
+func (r *Registers64) Read(register int) int64 {
+	return r.values[register]
+}
+
+func (r *Registers64) Write(register int, val int64) {
 	if register != 0 {
 		r.values[register] = val
 	}
 }
+
+// Ref returns the storage behind a register, with the same caveat about x0
+// as Registers.Ref.
+func (r *Registers64) Ref(register int) *int64 {
+	return &r.values[register]
+}
+
+// FloatRegisters is the register file of the F and D extensions, f0 to f31,
+// each 64 bits wide. A single-precision value is NaN-boxed: it sits in the
+// low 32 bits with the upper 32 all ones, so a double read as a single, or a
+// single read as a double, is a NaN.
+type FloatRegisters struct {
+	values [32]uint64
+}
+
+func NewFloatRegisters() *FloatRegisters {
+	return &FloatRegisters{}
+}
+
+// Read returns the 64 bits of a register.
+func (r *FloatRegisters) Read(register int) uint64 {
+	return r.values[register]
+}
+
+func (r *FloatRegisters) Write(register int, bits uint64) {
+	r.values[register] = bits
+}
+
+// ReadSingle returns the single-precision value in a register.
+func (r *FloatRegisters) ReadSingle(register int) uint32 {
+	return UnboxSingle(r.values[register])
+}
+
+func (r *FloatRegisters) WriteSingle(register int, bits uint32) {
+	r.values[register] = BoxSingle(bits)
+}
+
+// Ref returns the storage behind a register, as Registers.Ref does. Unlike
+// x0, f0 is an ordinary register.
+func (r *FloatRegisters) Ref(register int) *uint64 {
+	return &r.values[register]
+}
+
+const (
+	boxed        = 0xFFFF_FFFF_0000_0000
+	canonicalNaN = 0x7FC0_0000
+)
+
+// BoxSingle NaN-boxes a single-precision value to fill a float register.
+func BoxSingle(bits uint32) uint64 {
+	return boxed | uint64(bits)
+}
+
+// UnboxSingle returns the single-precision value in a float register's
+// bits, or the canonical NaN if they are not properly NaN-boxed.
+func UnboxSingle(bits uint64) uint32 {
+	if bits&boxed != boxed {
+		return canonicalNaN
+	}
+	return uint32(bits)
+}
@@ -47,3 +47,55 @@ func TestReadIsNonDestructive(t *testing.T) {
 	assert.Equal(t, int32(42), firstRead, "value should persist after first read")
 	assert.Equal(t, int32(42), secondRead, "value should persist after second read")
 }
+
+func TestRefSharesStorageWithReadAndWrite(t *testing.T) {
+	r := NewRegisters()
+
+	ref := r.Ref(5)
+	*ref = 7
+	r.Write(6, 9)
+
+	assert.Equal(t, int32(7), r.Read(5), "writes through a reference should be visible to Read")
+	assert.Equal(t, int32(9), *r.Ref(6), "writes through Write should be visible through a reference")
+}
+
+func TestSinglesAreNaNBoxed(t *testing.T) {
+	r := NewFloatRegisters()
+
+	r.WriteSingle(3, 0x3FC00000)
+
+	assert.Equal(t, uint64(0xFFFF_FFFF_3FC0_0000), r.Read(3))
+	assert.Equal(t, uint32(0x3FC00000), r.ReadSingle(3))
+}
+
+func TestAnUnboxedSingleReadsAsTheCanonicalNaN(t *testing.T) {
+	r := NewFloatRegisters()
+
+	r.Write(0, 0x3FF8_0000_0000_0000)
+
+	assert.Equal(t, uint32(0x7FC00000), r.ReadSingle(0), "f0 is an ordinary register and 1.5 as a double is not a boxed single")
+}
+
+func TestRegisters64HoldSixtyFourBits(t *testing.T) {
+	r := NewRegisters64()
+
+	r.Write(0, 1)
+	r.Write(5, -1<<40)
+
+	assert.Equal(t, int64(0), r.Read(0), "x0 should ignore writes")
+	assert.Equal(t, int64(-1<<40), r.Read(5))
+}
+
+func TestRV32EHasSixteenRegisters(t *testing.T) {
+	assert.Equal(t, 32, NewRegisters().Count())
+	assert.Equal(t, 16, NewRegistersE().Count())
+}
+
+func TestRV32ERejectsRegistersAboveX15(t *testing.T) {
+	r := NewRegistersE()
+	r.Write(15, 7)
+	assert.Equal(t, int32(7), r.Read(15))
+	assert.Panics(t, func() { r.Read(16) })
+	assert.Panics(t, func() { r.Write(31, 1) })
+	assert.Panics(t, func() { r.Ref(16) })
+}
@@ -0,0 +1,346 @@
+// Package translator turns a stack-machine program into register bytecode
+// that runs unchanged on the register VM and code generator.
+//
+// The translation simulates the operand stack: it works out how deep the
+// stack is before every instruction and gives the value at depth d register
+// x(d+1), so the stack itself disappears. Constants are not loaded until an
+// instruction needs them in a register, which lets psh followed by add
+// become a single addi. Where control flow joins, every value is in its
+// register, so both paths agree on where the stack lives.
+package translator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// ErrStackDepth is wrapped by the error Translate returns when the stack
+// would underflow, when two paths reach an instruction with different
+// depths, or when the stack grows deeper than there are registers to hold
+// it.
+var ErrStackDepth = errors.New("stack depth error")
+
+// Registers is how deep the stack may grow: x1 to x15, the registers the
+// code generator maps onto x86-64.
+const Registers = 15
+
+// home is the register that holds the value at depth d.
+func home(d int) int {
+	return d + 1
+}
+
+// entry is one value on the simulated stack: a constant not yet loaded, or
+// whatever its home register holds.
+type entry struct {
+	constant bool
+	value    int32
+}
+
+var inRegister = entry{}
+
+func constant(value int32) entry {
+	return entry{constant: true, value: value}
+}
+
+type fixup struct {
+	at     int
+	target int
+}
+
+type translator struct {
+	input   []int
+	depths  map[int]int
+	targets map[int]bool
+	starts  map[int]int
+	fixups  []fixup
+	stack   []entry
+	out     []int
+}
+
+// Translate returns the register bytecode for a stack-machine program. The
+// value left on top of the stack ends up in x1, the register the VM's
+// callers and the compiled program exit with, and x1 is 0 if the stack ends
+// empty. Instructions no path reaches are left out.
+func Translate(byteCode []int) ([]int, error) {
+	if len(byteCode)%4 != 0 {
+		return nil, fmt.Errorf("bytecode of %d slots is not a whole number of instructions", len(byteCode))
+	}
+	t := &translator{
+		input:   byteCode,
+		depths:  map[int]int{0: 0},
+		targets: map[int]bool{},
+		starts:  map[int]int{},
+	}
+	if err := t.analyse(); err != nil {
+		return nil, err
+	}
+	t.emit()
+	for _, f := range t.fixups {
+		t.out[f.at+3] = t.starts[f.target] - f.at
+	}
+	return t.out, nil
+}
+
+// analyse walks every path through the program to find the depth of the
+// stack before each instruction it reaches.
+func (t *translator) analyse() error {
+	work := []int{0}
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		if ip == len(t.input) {
+			continue
+		}
+		op := opcodes.OpCode(t.input[ip])
+		info, ok := opcodes.StackSet.ByOpCode(op)
+		if !ok {
+			return fmt.Errorf("at ip %d: unknown opcode %d", ip, op)
+		}
+		depth := t.depths[ip]
+		if depth < info.Pops {
+			return fmt.Errorf("%w at ip %d: %s needs %d values and the stack holds %d",
+				ErrStackDepth, ip, info.Mnemonic, info.Pops, depth)
+		}
+		after := depth - info.Pops + info.Pushes
+		if after > Registers {
+			return fmt.Errorf("%w at ip %d: %s leaves %d values on the stack and there are %d registers to hold them",
+				ErrStackDepth, ip, info.Mnemonic, after, Registers)
+		}
+		var next []int
+		if op != opcodes.JMP {
+			next = append(next, ip+4)
+		}
+		if info.Is(opcodes.Branch) || info.Is(opcodes.Jump) {
+			target := ip + t.input[ip+3]
+			if target < 0 || target > len(t.input) || target%4 != 0 {
+				return fmt.Errorf("at ip %d: %s target %d is not an instruction of the program", ip, info.Mnemonic, target)
+			}
+			t.targets[target] = true
+			next = append(next, target)
+		}
+		for _, n := range next {
+			if d, seen := t.depths[n]; seen {
+				if d != after {
+					return fmt.Errorf("%w at ip %d: the stack holds %d values coming from ip %d and %d on another path",
+						ErrStackDepth, n, after, ip, d)
+				}
+				continue
+			}
+			t.depths[n] = after
+			work = append(work, n)
+		}
+	}
+	return nil
+}
+
+func (t *translator) emit() {
+	falls := true
+	for ip := 0; ip <= len(t.input); ip += 4 {
+		depth, reachable := t.depths[ip]
+		if !reachable {
+			falls = false
+			continue
+		}
+		if !falls {
+			t.stack = make([]entry, depth)
+		} else if t.targets[ip] {
+			t.flush()
+		}
+		t.starts[ip] = len(t.out)
+		if ip == len(t.input) {
+			t.finish()
+			return
+		}
+		falls = t.instruction(ip)
+	}
+}
+
+// instruction translates the instruction at ip and reports whether control
+// can fall through to the next one.
+func (t *translator) instruction(ip int) bool {
+	op := opcodes.OpCode(t.input[ip])
+	operand := t.input[ip+3]
+	switch op {
+	case opcodes.PSH:
+		t.push(constant(int32(operand)))
+	case opcodes.DUP:
+		d := len(t.stack)
+		top := t.stack[d-1]
+		if !top.constant {
+			t.append(opcodes.ADDI, home(d), home(d-1), 0)
+		}
+		t.push(top)
+	case opcodes.SWP:
+		t.swap()
+	case opcodes.DRP:
+		t.pop()
+	case opcodes.ADD, opcodes.SUB, opcodes.MUL, opcodes.DIV, opcodes.LTE, opcodes.GT:
+		t.arithmetic(op)
+	case opcodes.JMP:
+		t.flush()
+		t.jump(ip + operand)
+		return false
+	case opcodes.JZ, opcodes.JNZ:
+		cond := t.pop()
+		if cond.constant {
+			if (cond.value == 0) != (op == opcodes.JZ) {
+				return true
+			}
+			t.flush()
+			t.jump(ip + operand)
+			return false
+		}
+		t.flush()
+		branch := opcodes.BEQ
+		if op == opcodes.JNZ {
+			branch = opcodes.BNE
+		}
+		t.branch(branch, home(len(t.stack)), 0, ip+operand)
+	}
+	return true
+}
+
+// swap exchanges the top two values. A constant moves for free, and two
+// registers swap through three xors so no spare register is needed.
+func (t *translator) swap() {
+	d := len(t.stack)
+	below, top := t.stack[d-2], t.stack[d-1]
+	switch {
+	case below.constant && top.constant:
+	case below.constant:
+		t.append(opcodes.ADDI, home(d-2), home(d-1), 0)
+	case top.constant:
+		t.append(opcodes.ADDI, home(d-1), home(d-2), 0)
+	default:
+		a, b := home(d-2), home(d-1)
+		t.append(opcodes.XOR, a, a, b)
+		t.append(opcodes.XOR, b, a, b)
+		t.append(opcodes.XOR, a, a, b)
+	}
+	t.stack[d-2], t.stack[d-1] = top, below
+}
+
+// arithmetic replaces the top two values, a below b, with a op b. Two
+// constants fold into one, and a constant that fits the 12 bits of an addi
+// goes into one.
+func (t *translator) arithmetic(op opcodes.OpCode) {
+	b, a := t.pop(), t.pop()
+	if a.constant && b.constant {
+		t.push(constant(fold(op, a.value, b.value)))
+		return
+	}
+	d := len(t.stack)
+	rd := home(d)
+	switch {
+	case op == opcodes.ADD && b.constant && fitsImm12(int64(b.value)):
+		t.append(opcodes.ADDI, rd, home(d), int(b.value))
+	case op == opcodes.ADD && a.constant && fitsImm12(int64(a.value)):
+		t.append(opcodes.ADDI, rd, home(d+1), int(a.value))
+	case op == opcodes.SUB && b.constant && fitsImm12(-int64(b.value)):
+		t.append(opcodes.ADDI, rd, home(d), int(-b.value))
+	default:
+		rs1, rs2 := t.load(a, d), t.load(b, d+1)
+		switch op {
+		case opcodes.LTE:
+			t.append(opcodes.SLT, rd, rs2, rs1)
+			t.append(opcodes.XORI, rd, rd, 1)
+		case opcodes.GT:
+			t.append(opcodes.SLT, rd, rs2, rs1)
+		default:
+			t.append(op, rd, rs1, rs2)
+		}
+	}
+	t.push(inRegister)
+}
+
+// fold computes a op b for two constants the way the stack VM would.
+func fold(op opcodes.OpCode, a, b int32) int32 {
+	switch op {
+	case opcodes.ADD:
+		return a + b
+	case opcodes.SUB:
+		return a - b
+	case opcodes.MUL:
+		return a * b
+	case opcodes.DIV:
+		if b == 0 {
+			return -1
+		}
+		return a / b
+	case opcodes.LTE:
+		return boolToInt32(a <= b)
+	default:
+		return boolToInt32(a > b)
+	}
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func fitsImm12(n int64) bool {
+	return n >= -2048 && n <= 2047
+}
+
+// load puts the value at depth d in its home register and returns it.
+func (t *translator) load(e entry, d int) int {
+	if e.constant {
+		t.out = assembler.LoadImmediate(t.out, home(d), e.value)
+	}
+	return home(d)
+}
+
+// flush loads every pending constant, which is what control flow needs
+// before it can join another path.
+func (t *translator) flush() {
+	for d, e := range t.stack {
+		if e.constant {
+			t.load(e, d)
+			t.stack[d] = inRegister
+		}
+	}
+}
+
+// finish leaves the value on top of the stack in x1.
+func (t *translator) finish() {
+	d := len(t.stack)
+	switch {
+	case d == 0:
+		t.append(opcodes.ADDI, 1, 0, 0)
+	case t.stack[d-1].constant:
+		t.out = assembler.LoadImmediate(t.out, 1, t.stack[d-1].value)
+	case home(d-1) != 1:
+		t.append(opcodes.ADDI, 1, home(d-1), 0)
+	}
+}
+
+// jump branches unconditionally. It is a beq of x1 with itself rather than
+// a jal, which the code generator lowers as a call.
+func (t *translator) jump(target int) {
+	t.branch(opcodes.BEQ, 1, 1, target)
+}
+
+func (t *translator) branch(op opcodes.OpCode, rs1, rs2, target int) {
+	t.fixups = append(t.fixups, fixup{at: len(t.out), target: target})
+	t.append(op, rs1, rs2, 0)
+}
+
+func (t *translator) append(op opcodes.OpCode, a, b, c int) {
+	t.out = append(t.out, int(op), a, b, c)
+}
+
+func (t *translator) push(e entry) {
+	t.stack = append(t.stack, e)
+}
+
+func (t *translator) pop() entry {
+	e := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+	return e
+}
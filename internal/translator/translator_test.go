@@ -0,0 +1,166 @@
+package translator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/assembler"
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/phasecurve/zhuji/internal/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func assembleStack(t *testing.T, source string) []int {
+	t.Helper()
+	a := assembler.NewAssembler()
+	a.EnableStackMode()
+	byteCode, err := a.TryAssemble(source)
+	assert.NoError(t, err)
+	return byteCode
+}
+
+// runBoth runs the stack program on the stack VM and its translation on the
+// register VM, and returns the top of the stack and x1.
+func runBoth(t *testing.T, program []int) (stackTop, x1 int32) {
+	t.Helper()
+	s := vm.NewStackVM()
+	assert.NoError(t, s.Execute(program))
+	if stack := s.Stack(); len(stack) > 0 {
+		stackTop = stack[len(stack)-1]
+	}
+
+	translated, err := Translate(program)
+	assert.NoError(t, err)
+	rs := registers.NewRegisters()
+	assert.NoError(t, vm.NewVM(rs, memory.NewMemory(1024)).Execute(translated))
+	return stackTop, rs.Read(1)
+}
+
+func TestTranslationAgreesWithTheStackVM(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected int32
+	}{
+		{"constant", "psh 42", 42},
+		{"empty", "psh 1\ndrp", 0},
+		{"large constant", "psh 0x12345678", 0x12345678},
+		{"folded", "psh 6\npsh 7\nmul", 42},
+		{"add immediate", "psh 40\ndup\nadd\npsh 2\nadd", 82},
+		{"constant first", "psh 40\ndup\nadd\npsh 2\nswp\nsub", -78},
+		{"sub immediate", "psh 50\ndup\nadd\npsh 8\nsub", 92},
+		{"sub large", "psh 5\ndup\nadd\npsh -2048\nsub", 2058},
+		{"swap registers", "psh 3\ndup\nadd\npsh 4\ndup\nadd\nswp\nsub", 2},
+		{"swap constant under register", "psh 10\npsh 3\ndup\nadd\nswp\nsub", -4},
+		{"div by zero", "psh 7\ndup\nadd\npsh 0\ndiv", -1},
+		{"lte", "psh 2\ndup\nadd\npsh 4\nlte", 1},
+		{"gt", "psh 2\ndup\nadd\npsh 4\ngt", 0},
+		{"not top in x1", "psh 1\npsh 2\ndup\nadd", 4},
+		{"constant jz taken", "psh 5\npsh 0\njz end\ndrp\npsh 9\nend:", 5},
+		{"constant jnz not taken", "psh 5\npsh 0\njnz end\ndrp\npsh 9\nend:", 9},
+		{"doubling loop", `
+			psh 1
+			psh 5
+		loop:
+			swp
+			dup
+			add
+			swp
+			psh -1
+			add
+			dup
+			jnz loop
+			drp
+		`, 32},
+		{"jz out of a loop", `
+			psh 3
+			psh 4
+		loop:
+			dup
+			jz done
+			swp
+			dup
+			add
+			swp
+			psh 1
+			sub
+			jmp loop
+		done:
+			drp
+		`, 48},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stackTop, x1 := runBoth(t, assembleStack(t, tc.source))
+
+			assert.Equal(t, tc.expected, stackTop, "the stack VM should compute the expected value")
+			assert.Equal(t, stackTop, x1, "the translation should leave the top of the stack in x1")
+		})
+	}
+}
+
+func TestTranslationFoldsConstants(t *testing.T) {
+	translated, err := Translate(assembleStack(t, "psh 1\npsh 2\ndup\nadd\nadd"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{int(opcodes.ADDI), 1, 0, 5}, translated, "a program of constants should fold to one li")
+}
+
+func TestTranslationLoadsConstantsBeforeJoins(t *testing.T) {
+	translated, err := Translate(assembleStack(t, "psh 7\nloop:\npsh -1\nadd\ndup\njnz loop"))
+
+	expected := []int{
+		int(opcodes.ADDI), 1, 0, 7,
+		int(opcodes.ADDI), 1, 1, -1,
+		int(opcodes.ADDI), 2, 1, 0,
+		int(opcodes.BNE), 2, 0, -8,
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, expected, translated, "the counter should be in x1 when the loop starts and the copy jnz pops in x2")
+}
+
+func TestTranslationReportsDepthErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"underflow", "psh 1\nadd", "stack depth error at ip 4: add needs 2 values and the stack holds 1"},
+		{"underflow after a branch", "psh 0\njz skip\nskip:\ndrp", "stack depth error at ip 8: drp needs 1 values and the stack holds 0"},
+		{"paths disagree", "psh 1\npsh 1\njz skip\npsh 2\nskip:", "stack depth error at ip 16: the stack holds 2 values coming from ip 12 and 1 on another path"},
+		{"loop grows the stack", "loop:\npsh 1\njmp loop", "stack depth error at ip 0: the stack holds 1 values coming from ip 4 and 0 on another path"},
+		{"too deep", "psh 1\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup\ndup", "stack depth error at ip 60: dup leaves 16 values on the stack and there are 15 registers to hold them"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			translated, err := Translate(assembleStack(t, tc.source))
+
+			assert.Nil(t, translated)
+			assert.True(t, errors.Is(err, ErrStackDepth), "expected a depth error, got %v", err)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestTranslationRejectsBadBytecode(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    []int
+		expected string
+	}{
+		{"register instruction", []int{int(opcodes.ADDI), 1, 0, 1}, "at ip 0: unknown opcode 16"},
+		{"jump outside", []int{int(opcodes.JMP), 0, 0, 8}, "at ip 0: jmp target 8 is not an instruction of the program"},
+		{"partial instruction", []int{int(opcodes.PSH), 0}, "bytecode of 2 slots is not a whole number of instructions"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Translate(tc.input)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
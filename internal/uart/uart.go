@@ -0,0 +1,162 @@
+// Package uart is a serial port modelled on the 16550, with just enough of
+// one for a bare-metal program to write to and read from a console.
+package uart
+
+import (
+	"errors"
+	"io"
+)
+
+// Base is where the UART usually sits in the address space, clear of RAM and
+// of the CLINT. The registers are four bytes apart, as on the DesignWare
+// parts, so a program can reach every one of them with an aligned lw or sw.
+const (
+	Base = 0x1000_0000
+	Size = 8 << shift
+
+	shift = 2
+)
+
+// Register numbers. Several share a number and are told apart by direction
+// or by the divisor latch access bit in LCR.
+const (
+	rbr = 0 // receive buffer (read)
+	thr = 0 // transmit holding (write)
+	dll = 0 // divisor latch low (DLAB set)
+	ier = 1 // interrupt enable
+	dlm = 1 // divisor latch high (DLAB set)
+	iir = 2 // interrupt identification (read)
+	fcr = 2 // FIFO control (write)
+	lcr = 3 // line control
+	mcr = 4 // modem control
+	lsr = 5 // line status
+	msr = 6 // modem status
+	scr = 7 // scratch
+)
+
+const (
+	lcrDLAB = 1 << 7
+
+	lsrDataReady        = 1 << 0
+	lsrTHREmpty         = 1 << 5
+	lsrTransmitterEmpty = 1 << 6
+
+	iirNoInterrupt  = 1 << 0
+	iirFIFOsEnabled = 3 << 6
+
+	fcrEnable = 1 << 0
+)
+
+var errRegister = errors.New("uart registers are word aligned")
+
+// UART sends every byte written to THR straight to out and hands the bytes of
+// in to RBR one at a time. Transmission never has to wait, so THR always reads
+// as empty. There is no interrupt controller to raise interrupts with, so IER
+// only holds what was written to it and programs poll LSR instead.
+type UART struct {
+	out io.Writer
+	in  io.Reader
+
+	ier, fcr, lcr, mcr, scr byte
+	dll, dlm                byte
+
+	received byte
+	ready    bool
+	eof      bool
+}
+
+// New returns a UART writing to out and reading from in. Either may be nil,
+// for a port with nothing on the other end of that line.
+func New(out io.Writer, in io.Reader) *UART {
+	return &UART{out: out, in: in}
+}
+
+// poll pulls the next byte from in if RBR is empty. It blocks until a byte
+// arrives, the way a program polling LSR waits on a key press.
+func (u *UART) poll() {
+	if u.ready || u.eof || u.in == nil {
+		return
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(u.in, b[:]); err != nil {
+		u.eof = true
+		return
+	}
+	u.received, u.ready = b[0], true
+}
+
+func (u *UART) Load(offset, width int) (uint32, error) {
+	if offset&(1<<shift-1) != 0 {
+		return 0, errRegister
+	}
+	dlab := u.lcr&lcrDLAB != 0
+	switch offset >> shift {
+	case rbr:
+		if dlab {
+			return uint32(u.dll), nil
+		}
+		u.poll()
+		u.ready = false
+		return uint32(u.received), nil
+	case ier:
+		if dlab {
+			return uint32(u.dlm), nil
+		}
+		return uint32(u.ier), nil
+	case iir:
+		if u.fcr&fcrEnable != 0 {
+			return iirNoInterrupt | iirFIFOsEnabled, nil
+		}
+		return iirNoInterrupt, nil
+	case lcr:
+		return uint32(u.lcr), nil
+	case mcr:
+		return uint32(u.mcr), nil
+	case lsr:
+		u.poll()
+		status := uint32(lsrTHREmpty | lsrTransmitterEmpty)
+		if u.ready {
+			status |= lsrDataReady
+		}
+		return status, nil
+	case msr:
+		return 0, nil
+	default:
+		return uint32(u.scr), nil
+	}
+}
+
+func (u *UART) Store(offset, width int, value uint32) error {
+	if offset&(1<<shift-1) != 0 {
+		return errRegister
+	}
+	b := byte(value)
+	dlab := u.lcr&lcrDLAB != 0
+	switch offset >> shift {
+	case thr:
+		if dlab {
+			u.dll = b
+			return nil
+		}
+		if u.out == nil {
+			return nil
+		}
+		_, err := u.out.Write([]byte{b})
+		return err
+	case ier:
+		if dlab {
+			u.dlm = b
+		} else {
+			u.ier = b
+		}
+	case fcr:
+		u.fcr = b
+	case lcr:
+		u.lcr = b
+	case mcr:
+		u.mcr = b
+	case scr:
+		u.scr = b
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package uart
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritingTHRSendsTheLowByte(t *testing.T) {
+	var out bytes.Buffer
+	u := New(&out, nil)
+
+	u.Store(thr<<shift, 4, 0x1234_5668)
+	u.Store(thr<<shift, 1, 'i')
+
+	assert.Equal(t, "hi", out.String(), "each write to THR should transmit its low byte")
+}
+
+func TestLineStatusReportsReceivedData(t *testing.T) {
+	u := New(nil, strings.NewReader("ok"))
+
+	cases := []struct {
+		offset   int
+		expected uint32
+		message  string
+	}{
+		{lsr << shift, lsrDataReady | lsrTHREmpty | lsrTransmitterEmpty, "data should be ready before the first byte is read"},
+		{rbr << shift, 'o', "RBR should hold the first byte"},
+		{rbr << shift, 'k', "RBR should move on to the next byte"},
+		{lsr << shift, lsrTHREmpty | lsrTransmitterEmpty, "data ready should clear once the input runs out"},
+	}
+
+	for _, tc := range cases {
+		got, err := u.Load(tc.offset, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, got, tc.message)
+	}
+}
+
+func TestDivisorLatchSharesTHRAndIER(t *testing.T) {
+	var out bytes.Buffer
+	u := New(&out, nil)
+
+	u.Store(ier<<shift, 4, 0x01)
+	u.Store(lcr<<shift, 4, lcrDLAB|0x03)
+	u.Store(dll<<shift, 4, 0x0C)
+	u.Store(dlm<<shift, 4, 0x00)
+	u.Store(lcr<<shift, 4, 0x03)
+
+	low, _ := u.Load(ier<<shift, 4)
+	assert.Equal(t, uint32(0x01), low, "setting the divisor should leave IER alone")
+	assert.Empty(t, out.String(), "a write to the divisor latch should not transmit")
+	u.Store(lcr<<shift, 4, lcrDLAB)
+	divisor, _ := u.Load(dll<<shift, 4)
+	assert.Equal(t, uint32(0x0C), divisor, "the divisor latch should keep its value")
+}
+
+func TestMisalignedRegisterAccessFails(t *testing.T) {
+	u := New(nil, nil)
+
+	_, err := u.Load(1, 1)
+
+	assert.Error(t, err, "registers sit on word boundaries")
+}
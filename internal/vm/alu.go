@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"math/bits"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// The integer arithmetic and the branch conditions are written once here,
+// for both register widths, and reach everything that runs an instruction
+// through the tables below: the RV32 handlers, the basic blocks and the RV64
+// handlers all compute with the same functions.
+
+// xlen is a register of either width, and uxlen the same bits taken as
+// unsigned.
+type xlen interface{ int32 | int64 }
+type uxlen interface{ uint32 | uint64 }
+
+// shiftMask is the mask for a shift amount: the low five bits on RV32 and six
+// on RV64. Bit 31 is the sign bit only of a 32-bit register.
+func shiftMask[T xlen]() T {
+	if T(1)<<31 < 0 {
+		return 31
+	}
+	return 63
+}
+
+func add[T xlen](x, y T) T { return x + y }
+func sub[T xlen](x, y T) T { return x - y }
+func mul[T xlen](x, y T) T { return x * y }
+func and[T xlen](x, y T) T { return x & y }
+func or[T xlen](x, y T) T  { return x | y }
+func xor[T xlen](x, y T) T { return x ^ y }
+
+func sll[T xlen](x, y T) T { return x << (y & shiftMask[T]()) }
+func sra[T xlen](x, y T) T { return x >> (y & shiftMask[T]()) }
+func srl[T xlen, U uxlen](x, y T) T {
+	return T(U(x) >> (y & shiftMask[T]()))
+}
+
+// slt and sltu set 1 when x is below y. Registers are sign-extended, which
+// keeps the unsigned order of a word, so sltu may widen before comparing.
+func slt[T xlen](x, y T) T {
+	if x < y {
+		return 1
+	}
+	return 0
+}
+
+func sltu[T xlen, U uxlen](x, y T) T {
+	if U(x) < U(y) {
+		return 1
+	}
+	return 0
+}
+
+func divUnsigned[T xlen, U uxlen](x, y T) T { return T(divu(U(x), U(y))) }
+func remUnsigned[T xlen, U uxlen](x, y T) T { return T(remu(U(x), U(y))) }
+
+// word runs a 32-bit operation on the low words of RV64 registers and
+// sign-extends its result, which is what every W instruction does.
+func word(f func(x, y int32) int32) func(x, y int64) int64 {
+	return func(x, y int64) int64 { return int64(f(int32(x), int32(y))) }
+}
+
+// alu32 computes the result of each RV32 register-register instruction from
+// its two sources.
+var alu32 = map[opcodes.OpCode]func(x, y int32) int32{
+	opcodes.ADD: add[int32], opcodes.SUB: sub[int32], opcodes.MUL: mul[int32],
+	opcodes.AND: and[int32], opcodes.OR: or[int32], opcodes.XOR: xor[int32],
+	opcodes.SLL: sll[int32], opcodes.SRL: srl[int32, uint32], opcodes.SRA: sra[int32],
+	opcodes.SLT: slt[int32], opcodes.SLTU: sltu[int32, uint32],
+	opcodes.MULH:   func(x, y int32) int32 { return int32(int64(x) * int64(y) >> 32) },
+	opcodes.MULHU:  func(x, y int32) int32 { return int32(uint64(uint32(x)) * uint64(uint32(y)) >> 32) },
+	opcodes.MULHSU: func(x, y int32) int32 { return int32(int64(x) * int64(uint32(y)) >> 32) },
+	opcodes.DIV:    div[int32], opcodes.REM: rem[int32],
+	opcodes.DIVU: divUnsigned[int32, uint32], opcodes.REMU: remUnsigned[int32, uint32],
+}
+
+// alu64 is alu32 for RV64, with the W forms added.
+var alu64 = map[opcodes.OpCode]func(x, y int64) int64{
+	opcodes.ADD: add[int64], opcodes.SUB: sub[int64], opcodes.MUL: mul[int64],
+	opcodes.AND: and[int64], opcodes.OR: or[int64], opcodes.XOR: xor[int64],
+	opcodes.SLL: sll[int64], opcodes.SRL: srl[int64, uint64], opcodes.SRA: sra[int64],
+	opcodes.SLT: slt[int64], opcodes.SLTU: sltu[int64, uint64],
+	opcodes.MULH: func(x, y int64) int64 {
+		hi, _ := bits.Mul64(uint64(x), uint64(y))
+		return int64(hi) - x>>63&y - y>>63&x
+	},
+	opcodes.MULHU: func(x, y int64) int64 {
+		hi, _ := bits.Mul64(uint64(x), uint64(y))
+		return int64(hi)
+	},
+	opcodes.MULHSU: func(x, y int64) int64 {
+		hi, _ := bits.Mul64(uint64(x), uint64(y))
+		return int64(hi) - x>>63&y
+	},
+	opcodes.DIV: div[int64], opcodes.REM: rem[int64],
+	opcodes.DIVU: divUnsigned[int64, uint64], opcodes.REMU: remUnsigned[int64, uint64],
+
+	opcodes.ADDW: word(add[int32]), opcodes.SUBW: word(sub[int32]), opcodes.MULW: word(mul[int32]),
+	opcodes.SLLW: word(sll[int32]), opcodes.SRLW: word(srl[int32, uint32]), opcodes.SRAW: word(sra[int32]),
+	opcodes.DIVW: word(div[int32]), opcodes.REMW: word(rem[int32]),
+	opcodes.DIVUW: word(divUnsigned[int32, uint32]), opcodes.REMUW: word(remUnsigned[int32, uint32]),
+}
+
+// immediates maps each instruction that takes an immediate to the
+// register-register one that computes the same thing from it. SLTIU compares
+// with the sign-extended immediate, as SLTU would with it in a register.
+var immediates = map[opcodes.OpCode]opcodes.OpCode{
+	opcodes.ADDI: opcodes.ADD, opcodes.ANDI: opcodes.AND, opcodes.ORI: opcodes.OR,
+	opcodes.XORI: opcodes.XOR, opcodes.SLTI: opcodes.SLT, opcodes.SLTIU: opcodes.SLTU,
+	opcodes.SLLI: opcodes.SLL, opcodes.SRLI: opcodes.SRL, opcodes.SRAI: opcodes.SRA,
+	opcodes.ADDIW: opcodes.ADDW, opcodes.SLLIW: opcodes.SLLW,
+	opcodes.SRLIW: opcodes.SRLW, opcodes.SRAIW: opcodes.SRAW,
+}
+
+func beq[T xlen](x, y T) bool { return x == y }
+func bne[T xlen](x, y T) bool { return x != y }
+func blt[T xlen](x, y T) bool { return x < y }
+func bge[T xlen](x, y T) bool { return x >= y }
+
+func bltu[T xlen, U uxlen](x, y T) bool { return U(x) < U(y) }
+func bgeu[T xlen, U uxlen](x, y T) bool { return U(x) >= U(y) }
+
+// branches32 and branches64 are the condition each branch takes its target
+// on.
+var branches32 = map[opcodes.OpCode]func(x, y int32) bool{
+	opcodes.BEQ: beq[int32], opcodes.BNE: bne[int32], opcodes.BLT: blt[int32], opcodes.BGE: bge[int32],
+	opcodes.BLTU: bltu[int32, uint32], opcodes.BGEU: bgeu[int32, uint32],
+}
+
+var branches64 = map[opcodes.OpCode]func(x, y int64) bool{
+	opcodes.BEQ: beq[int64], opcodes.BNE: bne[int64], opcodes.BLT: blt[int64], opcodes.BGE: bge[int64],
+	opcodes.BLTU: bltu[int64, uint64], opcodes.BGEU: bgeu[int64, uint64],
+}
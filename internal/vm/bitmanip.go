@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"math/bits"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+)
+
+// bitUnary are the Zbb instructions that work on rs1 alone.
+var bitUnary = map[opcodes.OpCode]func(x uint32) uint32{
+	opcodes.CLZ:   func(x uint32) uint32 { return uint32(bits.LeadingZeros32(x)) },
+	opcodes.CTZ:   func(x uint32) uint32 { return uint32(bits.TrailingZeros32(x)) },
+	opcodes.CPOP:  func(x uint32) uint32 { return uint32(bits.OnesCount32(x)) },
+	opcodes.SEXTB: func(x uint32) uint32 { return uint32(int32(int8(x))) },
+	opcodes.SEXTH: func(x uint32) uint32 { return uint32(int32(int16(x))) },
+	opcodes.ZEXTH: func(x uint32) uint32 { return uint32(uint16(x)) },
+}
+
+// bitBinary are the Zba, Zbb and Zbs instructions that combine rs1 with rs2,
+// or with the shift amount in the immediate forms. Rotations and bit numbers
+// use the low five bits of y, as shifts do.
+var bitBinary = map[opcodes.OpCode]func(x, y uint32) uint32{
+	opcodes.MIN:    func(x, y uint32) uint32 { return uint32(min(int32(x), int32(y))) },
+	opcodes.MAX:    func(x, y uint32) uint32 { return uint32(max(int32(x), int32(y))) },
+	opcodes.MINU:   func(x, y uint32) uint32 { return min(x, y) },
+	opcodes.MAXU:   func(x, y uint32) uint32 { return max(x, y) },
+	opcodes.ROL:    func(x, y uint32) uint32 { return bits.RotateLeft32(x, int(y&31)) },
+	opcodes.ROR:    func(x, y uint32) uint32 { return bits.RotateLeft32(x, -int(y&31)) },
+	opcodes.RORI:   func(x, y uint32) uint32 { return bits.RotateLeft32(x, -int(y&31)) },
+	opcodes.ANDN:   func(x, y uint32) uint32 { return x &^ y },
+	opcodes.ORN:    func(x, y uint32) uint32 { return x | ^y },
+	opcodes.XNOR:   func(x, y uint32) uint32 { return ^(x ^ y) },
+	opcodes.SH1ADD: func(x, y uint32) uint32 { return x<<1 + y },
+	opcodes.SH2ADD: func(x, y uint32) uint32 { return x<<2 + y },
+	opcodes.SH3ADD: func(x, y uint32) uint32 { return x<<3 + y },
+	opcodes.BSET:   func(x, y uint32) uint32 { return x | 1<<(y&31) },
+	opcodes.BCLR:   func(x, y uint32) uint32 { return x &^ (1 << (y & 31)) },
+	opcodes.BINV:   func(x, y uint32) uint32 { return x ^ 1<<(y&31) },
+	opcodes.BEXT:   func(x, y uint32) uint32 { return x >> (y & 31) & 1 },
+	opcodes.BSETI:  func(x, y uint32) uint32 { return x | 1<<(y&31) },
+	opcodes.BCLRI:  func(x, y uint32) uint32 { return x &^ (1 << (y & 31)) },
+	opcodes.BINVI:  func(x, y uint32) uint32 { return x ^ 1<<(y&31) },
+	opcodes.BEXTI:  func(x, y uint32) uint32 { return x >> (y & 31) & 1 },
+}
+
+// decodeBitmanip binds a bit-manipulation instruction to the registers it
+// works on, or returns nil when the instruction is not one.
+func decodeBitmanip(regs *registers.Registers, inst [4]int) handler {
+	opCode, a, b, c := opcodes.OpCode(inst[0]), inst[1], inst[2], inst[3]
+	if f, ok := bitUnary[opCode]; ok {
+		if a == 0 {
+			return next
+		}
+		rd, rs := regs.Ref(a), regs.Ref(b)
+		return func(vm *vm, pc int) int {
+			*rd = int32(f(uint32(*rs)))
+			return pc + 1
+		}
+	}
+	f, ok := bitBinary[opCode]
+	if !ok {
+		return nil
+	}
+	if a == 0 {
+		return next
+	}
+	rd, rs1 := regs.Ref(a), regs.Ref(b)
+	if info, _ := opcodes.ByOpCode(opCode); info.Format == opcodes.ShiftType {
+		shamt := uint32(c)
+		return func(vm *vm, pc int) int {
+			*rd = int32(f(uint32(*rs1), shamt))
+			return pc + 1
+		}
+	}
+	rs2 := regs.Ref(c)
+	return func(vm *vm, pc int) int {
+		*rd = int32(f(uint32(*rs1), uint32(*rs2)))
+		return pc + 1
+	}
+}
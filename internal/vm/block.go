@@ -0,0 +1,248 @@
+package vm
+
+import (
+	endian "encoding/binary"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// uop is one instruction of a basic block, reduced to what running it inside
+// the block needs. Registers are numbers into the register file rather than
+// bound pointers, so a whole block runs as one loop over a switch instead of
+// a call per instruction. pc is the instruction's handler index. A branch
+// keeps the handler index of its target in imm.
+//
+// Arithmetic is one compute uop, whatever the instruction: fn, taken from
+// alu32 as the handlers take it, applied to rs1 and to rs2 plus imm. An
+// instruction with an immediate reads x0 as rs2, and one without has no imm.
+type uop struct {
+	op           opcodes.OpCode
+	rd, rs1, rs2 uint8
+	imm          int32
+	pc           int
+	fn           func(x, y int32) int32
+}
+
+// runHandler is the uop ending a block with an instruction that the block
+// cannot run itself, such as a jump, a CSR access or a float instruction. Its
+// own handler runs it. compute is the uop for any arithmetic instruction.
+const (
+	runHandler opcodes.OpCode = -2
+	compute    opcodes.OpCode = -3
+)
+
+// buildBlocks gives every instruction a block that runs from it to the end
+// of its basic block. A basic block is a run of integer arithmetic, loads and
+// stores ended by any other instruction, or by the end of the program.
+func (vm *vm) buildBlocks(insts []instruction, l *layout, end int) []block {
+	blocks := make([]block, len(insts))
+	for start := 0; start < len(insts); {
+		var ops []uop
+		term, ok := start, true
+		for ; term < len(insts); term++ {
+			if ops, ok = vm.appendUop(ops, insts[term], term, end); !ok {
+				break
+			}
+		}
+		last := exit{branch: uop{op: runHandler, pc: term}}
+		if term < len(insts) {
+			last = vm.terminator(insts[term], term, end, l)
+		}
+		// The arithmetic right before a branch is run with it, which takes a
+		// trip round the switch out of most loops. Entered at the branch
+		// itself, the block must leave it out.
+		fused := last
+		if n := len(ops); n > 0 && last.taken != nil && ops[n-1].pc == term-1 && ops[n-1].op == compute {
+			fused.step, fused.stepped = ops[n-1], true
+			ops = ops[:n-1]
+		}
+		for pc, first := start, 0; pc <= term && pc < len(insts); pc++ {
+			for first < len(ops) && ops[first].pc < pc {
+				first++
+			}
+			blocks[pc] = block{ops: ops[first:], last: fused, retired: uint64(min(term+1, len(insts)) - pc)}
+			if pc == term {
+				blocks[pc].last = last
+			}
+		}
+		start = term + 1
+	}
+	return blocks
+}
+
+// terminator builds the exit for the instruction ending a block. A
+// conditional branch is run by the block, with its condition from
+// branches32; anything else by its handler.
+func (vm *vm) terminator(in instruction, pc, end int, l *layout) exit {
+	op := opcodes.OpCode(in.slots[0])
+	info, _ := opcodes.ByOpCode(op)
+	taken, ok := branches32[op]
+	if in.next > end || !ok || !vm.hasRegisters(info, in.slots) {
+		return exit{branch: uop{op: runHandler, pc: pc}}
+	}
+	target := l.pc(in.ip + in.slots[3])
+	return exit{branch: uop{op: op, rs1: uint8(in.slots[1]), rs2: uint8(in.slots[2]), imm: int32(target), pc: pc}, taken: taken}
+}
+
+// block is the part of a basic block from one instruction to its end: the
+// uops to run, how it ends and how many instructions that retires.
+type block struct {
+	ops     []uop
+	last    exit
+	retired uint64
+}
+
+// exit is how a block ends: with a conditional branch the block takes
+// itself when taken holds, preceded by the compute uop step if stepped, or
+// with an instruction its handler runs.
+type exit struct {
+	branch  uop
+	taken   func(x, y int32) bool
+	step    uop
+	stepped bool
+}
+
+// run runs blocks from pc, following the branches that end them, until one
+// ends in an instruction that needs its own handler, and returns where
+// execution continues after that. Each block counts its instructions once, at
+// its end, which is safe because nothing inside one can read instret or the
+// timer, and nothing inside one can enable an interrupt either.
+func (vm *vm) run(prog *program, pc int) int {
+	r, ram := vm.registers.File(), vm.memory.Bytes()
+	for {
+		b := &prog.blocks[pc]
+	lap:
+		for i := range b.ops {
+			o := &b.ops[i]
+			switch o.op {
+			case compute:
+				r[o.rd&31] = o.fn(r[o.rs1&31], r[o.rs2&31]+o.imm)
+			case opcodes.LUI:
+				r[o.rd&31] = o.imm
+			case opcodes.LW:
+				addr := int(r[o.rs1&31]) + int(o.imm)
+				if addr < 0 || addr > len(ram)-4 {
+					return vm.leave(prog.insts, o.pc, pc)
+				}
+				r[o.rd&31] = int32(endian.LittleEndian.Uint32(ram[addr:]))
+			case opcodes.LH, opcodes.LHU:
+				addr := int(r[o.rs1&31]) + int(o.imm)
+				if addr < 0 || addr > len(ram)-2 {
+					return vm.leave(prog.insts, o.pc, pc)
+				}
+				if half := endian.LittleEndian.Uint16(ram[addr:]); o.op == opcodes.LH {
+					r[o.rd&31] = int32(int16(half))
+				} else {
+					r[o.rd&31] = int32(half)
+				}
+			case opcodes.LB, opcodes.LBU:
+				addr := int(r[o.rs1&31]) + int(o.imm)
+				if addr < 0 || addr >= len(ram) {
+					return vm.leave(prog.insts, o.pc, pc)
+				}
+				if o.op == opcodes.LB {
+					r[o.rd&31] = int32(int8(ram[addr]))
+				} else {
+					r[o.rd&31] = int32(ram[addr])
+				}
+			case opcodes.SW:
+				addr := int(r[o.rs1&31]) + int(o.imm)
+				if addr < 0 || addr > len(ram)-4 {
+					return vm.leave(prog.insts, o.pc, pc)
+				}
+				endian.LittleEndian.PutUint32(ram[addr:], uint32(r[o.rs2&31]))
+				vm.reservations.invalidate(addr)
+			case opcodes.SH:
+				addr := int(r[o.rs1&31]) + int(o.imm)
+				if addr < 0 || addr > len(ram)-2 {
+					return vm.leave(prog.insts, o.pc, pc)
+				}
+				endian.LittleEndian.PutUint16(ram[addr:], uint16(r[o.rs2&31]))
+				vm.reservations.invalidate(addr)
+			case opcodes.SB:
+				addr := int(r[o.rs1&31]) + int(o.imm)
+				if addr < 0 || addr >= len(ram) {
+					return vm.leave(prog.insts, o.pc, pc)
+				}
+				ram[addr] = byte(r[o.rs2&31])
+				vm.reservations.invalidate(addr)
+			}
+		}
+		branch := &b.last.branch
+		if branch.op == runHandler {
+			return vm.leave(prog.insts, branch.pc, pc)
+		}
+		if step := &b.last.step; b.last.stepped {
+			r[step.rd&31] = step.fn(r[step.rs1&31], r[step.rs2&31]+step.imm)
+		}
+		vm.instret += b.retired
+		if !b.last.taken(r[branch.rs1&31], r[branch.rs2&31]) {
+			pc = branch.pc + 1
+		} else if target := int(branch.imm); target != pc {
+			pc = target
+		} else {
+			goto lap
+		}
+		if uint(pc) >= uint(len(prog.blocks)) {
+			return pc
+		}
+	}
+}
+
+// leave ends a block at the instruction at at, which the block entered at pc
+// cannot run itself: its terminator, or an access outside RAM, which may be
+// to a device or fault. The instruction's own handler runs it.
+func (vm *vm) leave(insts []handler, at, pc int) int {
+	vm.instret += uint64(at - pc)
+	if at == len(insts) {
+		return at
+	}
+	next := insts[at](vm, at)
+	vm.instret++
+	return next
+}
+
+// appendUop adds the instruction to a block under construction, reporting
+// false if it has to end the block instead. Arithmetic writing x0 is left
+// out, as it does nothing.
+func (vm *vm) appendUop(ops []uop, in instruction, pc, end int) ([]uop, bool) {
+	op := opcodes.OpCode(in.slots[0])
+	info, _ := opcodes.ByOpCode(op)
+	if in.next > end || !vm.hasRegisters(info, in.slots) {
+		return ops, false
+	}
+	a, b, c := uint8(in.slots[1]), uint8(in.slots[2]), in.slots[3]
+	if rr, ok := immediates[op]; ok && alu32[rr] != nil {
+		if a == 0 {
+			return ops, true
+		}
+		return append(ops, uop{op: compute, rd: a, rs1: b, imm: int32(c), pc: pc, fn: alu32[rr]}), true
+	}
+	if f, ok := alu32[op]; ok {
+		if a == 0 {
+			return ops, true
+		}
+		return append(ops, uop{op: compute, rd: a, rs1: b, rs2: uint8(c), pc: pc, fn: f}), true
+	}
+	switch op {
+	case opcodes.LUI, opcodes.AUIPC:
+		// Both load a constant known when the program is decoded.
+		if a == 0 {
+			return ops, true
+		}
+		value := int32(uint32(c) << 12)
+		if op == opcodes.AUIPC {
+			value += int32(in.ip)
+		}
+		return append(ops, uop{op: opcodes.LUI, rd: a, imm: value, pc: pc}), true
+	case opcodes.LW, opcodes.LH, opcodes.LHU, opcodes.LB, opcodes.LBU:
+		// A load into x0 still has to read memory, so it keeps its handler.
+		if a == 0 {
+			return ops, false
+		}
+		return append(ops, uop{op: op, rd: a, rs1: uint8(c), imm: int32(in.slots[2]), pc: pc}), true
+	case opcodes.SW, opcodes.SH, opcodes.SB:
+		return append(ops, uop{op: op, rs2: a, rs1: uint8(c), imm: int32(in.slots[2]), pc: pc}), true
+	}
+	return ops, false
+}
@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"errors"
+	"math"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+)
+
+// The core-local interruptor is mapped at the same addresses as on the SiFive
+// boards: one 64-bit mtimecmp per hart and a single 64-bit mtime shared by
+// all of them.
+const (
+	clintBase     = 0x0200_0000
+	clintSize     = 0x1_0000
+	clintMtimecmp = 0x4000
+	clintMtime    = 0xBFF8
+)
+
+var errClintWidth = errors.New("the CLINT only supports word accesses")
+
+// clint is the machine timer. mtime advances by one for every instruction
+// any hart retires, which keeps timer interrupts deterministic, and a hart's
+// timer interrupt is pending while mtime >= its mtimecmp. Rather than ticking
+// on every instruction, mtime is worked out from the harts' instret counters
+// when it is read.
+type clint struct {
+	base     uint64
+	retired  []*uint64
+	mtimecmp []uint64
+}
+
+func newClint(harts int) *clint {
+	c := &clint{mtimecmp: make([]uint64, harts)}
+	for hart := range c.mtimecmp {
+		c.mtimecmp[hart] = math.MaxUint64
+	}
+	return c
+}
+
+// attach makes the instructions a hart retires advance mtime.
+func (c *clint) attach(instret *uint64) {
+	c.retired = append(c.retired, instret)
+}
+
+func (c *clint) mtime() uint64 {
+	mtime := c.base
+	for _, instret := range c.retired {
+		mtime += *instret
+	}
+	return mtime
+}
+
+func (c *clint) setMtime(mtime uint64) {
+	c.base += mtime - c.mtime()
+}
+
+func (c *clint) pending(hart int) bool {
+	return c.mtime() >= c.mtimecmp[hart]
+}
+
+// register finds the 64-bit register holding the word at offset, and whether
+// the word is its upper half.
+func (c *clint) register(offset int) (*uint64, bool) {
+	switch {
+	case offset&3 != 0:
+		return nil, false
+	case offset >= clintMtimecmp && offset < clintMtimecmp+8*len(c.mtimecmp):
+		return &c.mtimecmp[(offset-clintMtimecmp)/8], offset&4 != 0
+	}
+	return nil, false
+}
+
+// Load reads one half of a 64-bit timer register. The CLINT only answers
+// aligned word accesses.
+func (c *clint) Load(offset, width int) (uint32, error) {
+	value, high := uint64(0), offset&4 != 0
+	if width != 4 {
+		return 0, errClintWidth
+	} else if offset == clintMtime || offset == clintMtime+4 {
+		value = c.mtime()
+	} else if reg, _ := c.register(offset); reg != nil {
+		value = *reg
+	} else {
+		return 0, memory.ErrUnmapped
+	}
+	if high {
+		return uint32(value >> 32), nil
+	}
+	return uint32(value), nil
+}
+
+func (c *clint) Store(offset, width int, value uint32) error {
+	if width != 4 {
+		return errClintWidth
+	}
+	if offset == clintMtime || offset == clintMtime+4 {
+		mtime := c.mtime()
+		c.setMtime(replaceWord(mtime, offset&4 != 0, value))
+		return nil
+	}
+	reg, high := c.register(offset)
+	if reg == nil {
+		return memory.ErrUnmapped
+	}
+	*reg = replaceWord(*reg, high, value)
+	return nil
+}
+
+// replaceWord replaces the upper or lower half of a 64-bit register.
+func replaceWord(reg uint64, high bool, value uint32) uint64 {
+	if high {
+		return reg&0xFFFF_FFFF | uint64(value)<<32
+	}
+	return reg&^0xFFFF_FFFF | uint64(value)
+}
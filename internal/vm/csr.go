@@ -0,0 +1,150 @@
+package vm
+
+import "github.com/phasecurve/zhuji/internal/opcodes"
+
+// csrs holds a hart's writable machine-mode control and status registers and
+// fcsr, which fflags and frm are views of. The counters, mip and mhartid are
+// derived from the hart's state instead.
+type csrs struct {
+	fcsr     uint32
+	mstatus  uint32
+	mie      uint32
+	mtvec    uint32
+	mscratch uint32
+	mepc     uint32
+	mcause   uint32
+	mtval    uint32
+
+	// handled records that the program has written mtvec, which installs
+	// its trap handler. Until it does, a trap stops execution; after, the
+	// handler may be at any address, 0 included.
+	handled bool
+}
+
+// csrWriteMask lists the bits software can change in each writable CSR.
+// frm's mask is of its bits within fcsr.
+var csrWriteMask = map[opcodes.CSR]uint32{
+	opcodes.FFLAGS:   opcodes.FcsrFlags,
+	opcodes.FRM:      opcodes.FcsrRM,
+	opcodes.FCSR:     opcodes.FcsrFlags | opcodes.FcsrRM,
+	opcodes.MSTATUS:  opcodes.MstatusMIE | opcodes.MstatusMPIE | opcodes.MstatusMPP,
+	opcodes.MIE:      opcodes.MTIE,
+	opcodes.MTVEC:    0xFFFF_FFFD,
+	opcodes.MSCRATCH: 0xFFFF_FFFF,
+	opcodes.MEPC:     0xFFFF_FFFC,
+	opcodes.MCAUSE:   0xFFFF_FFFF,
+	opcodes.MTVAL:    0xFFFF_FFFF,
+	opcodes.MIP:      0,
+}
+
+func (vm *vm) readCSR(csr opcodes.CSR) (uint32, bool) {
+	switch csr {
+	case opcodes.FFLAGS:
+		return vm.csrs.fcsr & opcodes.FcsrFlags, true
+	case opcodes.FRM:
+		return vm.csrs.fcsr >> opcodes.FcsrRMShift, true
+	case opcodes.FCSR:
+		return vm.csrs.fcsr, true
+	case opcodes.MSTATUS:
+		return vm.csrs.mstatus, true
+	case opcodes.MIE:
+		return vm.csrs.mie, true
+	case opcodes.MTVEC:
+		return vm.csrs.mtvec, true
+	case opcodes.MSCRATCH:
+		return vm.csrs.mscratch, true
+	case opcodes.MEPC:
+		return vm.csrs.mepc, true
+	case opcodes.MCAUSE:
+		return vm.csrs.mcause, true
+	case opcodes.MTVAL:
+		return vm.csrs.mtval, true
+	case opcodes.MIP:
+		if vm.clint.pending(vm.hartID) {
+			return opcodes.MTIP, true
+		}
+		return 0, true
+	case opcodes.CYCLE, opcodes.INSTRET:
+		return uint32(vm.instret), true
+	case opcodes.CYCLEH, opcodes.INSTRETH:
+		return uint32(vm.instret >> 32), true
+	case opcodes.TIME:
+		return uint32(vm.clint.mtime()), true
+	case opcodes.TIMEH:
+		return uint32(vm.clint.mtime() >> 32), true
+	case opcodes.MHARTID:
+		return uint32(vm.hartID), true
+	}
+	return 0, false
+}
+
+func (vm *vm) writeCSR(csr opcodes.CSR, value uint32) bool {
+	mask, ok := csrWriteMask[csr]
+	if !ok || csr.ReadOnly() {
+		return false
+	}
+	var reg *uint32
+	switch csr {
+	case opcodes.FFLAGS, opcodes.FCSR:
+		reg = &vm.csrs.fcsr
+	case opcodes.FRM:
+		reg = &vm.csrs.fcsr
+		value <<= opcodes.FcsrRMShift
+	case opcodes.MSTATUS:
+		reg = &vm.csrs.mstatus
+	case opcodes.MIE:
+		reg = &vm.csrs.mie
+	case opcodes.MTVEC:
+		reg = &vm.csrs.mtvec
+		vm.csrs.handled = true
+	case opcodes.MSCRATCH:
+		reg = &vm.csrs.mscratch
+	case opcodes.MEPC:
+		reg = &vm.csrs.mepc
+	case opcodes.MCAUSE:
+		reg = &vm.csrs.mcause
+	case opcodes.MTVAL:
+		reg = &vm.csrs.mtval
+	default:
+		return true
+	}
+	*reg = *reg&^mask | value&mask
+	vm.rearm()
+	return true
+}
+
+// csrOp says how a CSR instruction combines its operand with the old value.
+type csrOp int
+
+const (
+	csrWrite csrOp = iota
+	csrSet
+	csrClear
+)
+
+// csrInstruction builds the handler for a CSR instruction. operand is rs1's
+// storage, or the zero-extended immediate for the ...I forms, and writes is
+// false for the set and clear forms whose operand is x0 or zero, which only
+// read the CSR and so may be used on read-only registers.
+func csrInstruction(rd *int32, csr opcodes.CSR, operand *int32, op csrOp, writes bool) handler {
+	return func(vm *vm, pc int) int {
+		old, ok := vm.readCSR(csr)
+		if !ok {
+			return vm.trap(CauseIllegalInstruction, uint32(csr), pc)
+		}
+		if writes {
+			value := uint32(*operand)
+			switch op {
+			case csrSet:
+				value = old | value
+			case csrClear:
+				value = old &^ value
+			}
+			if !vm.writeCSR(csr, value) {
+				return vm.trap(CauseIllegalInstruction, uint32(csr), pc)
+			}
+		}
+		*rd = int32(old)
+		return pc + 1
+	}
+}
@@ -0,0 +1,438 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/phasecurve/zhuji/internal/disassembler"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+)
+
+// handler is one pre-decoded instruction. Its operands and, for branches and
+// jumps, its target are bound when the program is decoded, so running it
+// needs no further look-ups. pc is the index of the handler in the program and
+// the return value is the index of the next handler to run.
+type handler func(vm *vm, pc int) int
+
+// program is a bytecode stream decoded into handlers, one per instruction,
+// and into blocks, one for every instruction too, each running from it to the
+// end of its basic block. A traced program has no blocks, as it has to report
+// every instruction.
+type program struct {
+	insts  []handler
+	blocks []block
+	layout *layout
+}
+
+// instruction is one instruction of the bytecode, a compressed one expanded to
+// the base instruction it stands for, with where it and the next one start.
+type instruction struct {
+	slots    [4]int
+	ip, next int
+}
+
+// layout maps between byte addresses and handler indices, which no longer
+// differ by a fixed factor once instructions can be two or four bytes long.
+// ips holds where each handler's instruction starts and, last, the end of
+// the program; pcs holds for every byte the handler whose instruction covers
+// it.
+type layout struct {
+	ips []int
+	pcs []int
+}
+
+// pc is the handler for the instruction at address ip. An address in the
+// middle of an instruction runs that instruction, an address past the end
+// ends the program and a negative one stops it.
+func (l *layout) pc(ip int) int {
+	switch {
+	case ip < 0:
+		return -1
+	case ip >= len(l.pcs):
+		return len(l.ips) - 1
+	}
+	return l.pcs[ip]
+}
+
+// ip is the address of the instruction run by handler pc.
+func (l *layout) ip(pc int) int {
+	return l.ips[pc]
+}
+
+// fetch splits the bytecode into instructions and lays them out. An
+// instruction cut short by the end of the bytecode still gets a handler, one
+// that raises an illegal instruction trap.
+func fetch(set *opcodes.Set, byteCode ByteCode) ([]instruction, *layout) {
+	var insts []instruction
+	l := &layout{pcs: make([]int, len(byteCode))}
+	for ip := 0; ip < len(byteCode); {
+		slots, size, _ := set.Fetch(byteCode, ip)
+		for i := ip; i < min(ip+size, len(byteCode)); i++ {
+			l.pcs[i] = len(insts)
+		}
+		insts = append(insts, instruction{slots: slots, ip: ip, next: ip + size})
+		l.ips = append(l.ips, ip)
+		ip += size
+	}
+	l.ips = append(l.ips, len(byteCode))
+	return insts, l
+}
+
+// decode turns the bytecode into a program. It walks the stream once,
+// resolving branch targets from byte offsets into handler indices.
+func (vm *vm) decode(byteCode ByteCode) *program {
+	insts, l := fetch(opcodes.RegisterSet, byteCode)
+	prog := &program{insts: make([]handler, 0, len(insts)), layout: l}
+	for _, in := range insts {
+		var h handler
+		info, _ := opcodes.ByOpCode(opcodes.OpCode(in.slots[0]))
+		switch {
+		case in.next > len(byteCode) || !vm.hasRegisters(info, in.slots):
+			h = illegalInstruction(opcodes.OpCode(byteCode[in.ip]))
+		case info.Is(opcodes.Float):
+			h = decodeFloat(vm.registers, vm.floats, &vm.discard, in.slots)
+		default:
+			h = decodeInstruction(vm.registers, &vm.discard, l, in)
+		}
+		if vm.traceEnabled {
+			h = traced(h, byteCode, in.ip, l)
+		}
+		prog.insts = append(prog.insts, h)
+	}
+	if !vm.traceEnabled && !vm.stepped {
+		prog.blocks = vm.buildBlocks(insts, l, len(byteCode))
+	}
+	return prog
+}
+
+// decoded is the program Execute decoded last and what it was decoded from,
+// so that running the same bytecode again skips decoding it.
+type decoded struct {
+	byteCode  ByteCode
+	traced    bool
+	registers *registers.Registers
+	prog      *program
+}
+
+// prepare returns the decoded program for the bytecode, reusing the last one
+// when the bytecode, the register file it was bound to and tracing are all
+// unchanged.
+func (vm *vm) prepare(byteCode ByteCode) *program {
+	c := &vm.decoded
+	if c.prog == nil || c.traced != vm.traceEnabled || c.registers != vm.registers || !slices.Equal(c.byteCode, byteCode) {
+		*c = decoded{
+			byteCode:  slices.Clone(byteCode),
+			traced:    vm.traceEnabled,
+			registers: vm.registers,
+			prog:      vm.decode(byteCode),
+		}
+	}
+	return c.prog
+}
+
+// hasRegisters reports whether the register file has every integer register
+// the instruction names. Only an RV32E file lacks any: naming x16 to x31 there
+// is an illegal instruction.
+func (vm *vm) hasRegisters(info opcodes.Info, slots [4]int) bool {
+	for _, r := range info.Registers(slots) {
+		if r >= vm.registers.Count() {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeInstruction binds the instruction to the register storage it
+// works on. Writes to x0 are dropped here, once, so the handlers themselves
+// never have to check for it.
+func decodeInstruction(regs *registers.Registers, discard *int32, l *layout, in instruction) handler {
+	opCode, ip := opcodes.OpCode(in.slots[0]), in.ip
+	a, b, c := in.slots[1], in.slots[2], in.slots[3]
+	ref := regs.Ref
+	// destination is where an instruction writes rd. Results written to x0 go
+	// to a scratch slot instead, for instructions that must still run for
+	// their side effects, such as a load.
+	destination := func(rd int) *int32 {
+		if rd == 0 {
+			return discard
+		}
+		return ref(rd)
+	}
+	if op, ok := immediates[opCode]; ok && alu32[op] != nil {
+		if a == 0 {
+			return next
+		}
+		f, rd, rs, imm := alu32[op], ref(a), ref(b), int32(c)
+		return func(vm *vm, pc int) int {
+			*rd = f(*rs, imm)
+			return pc + 1
+		}
+	}
+	if f, ok := alu32[opCode]; ok {
+		if a == 0 {
+			return next
+		}
+		rd, rs1, rs2 := ref(a), ref(b), ref(c)
+		return func(vm *vm, pc int) int {
+			*rd = f(*rs1, *rs2)
+			return pc + 1
+		}
+	}
+	if taken, ok := branches32[opCode]; ok {
+		rs1, rs2, target := ref(a), ref(b), l.pc(ip+c)
+		return func(vm *vm, pc int) int {
+			if taken(*rs1, *rs2) {
+				return target
+			}
+			return pc + 1
+		}
+	}
+	switch opCode {
+	case opcodes.LUI:
+		if a == 0 {
+			return next
+		}
+		rd, value := ref(a), int32(uint32(c)<<12)
+		return func(vm *vm, pc int) int {
+			*rd = value
+			return pc + 1
+		}
+	case opcodes.AUIPC:
+		if a == 0 {
+			return next
+		}
+		rd, value := ref(a), int32(ip)+int32(uint32(c)<<12)
+		return func(vm *vm, pc int) int {
+			*rd = value
+			return pc + 1
+		}
+	case opcodes.SW:
+		rs2, offset, rs1 := ref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs1) + offset
+			if !vm.storeWord(addr, *rs2) {
+				return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+			}
+			return pc + 1
+		}
+	case opcodes.LW:
+		rd, offset, rs := destination(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			val, ok := vm.loadWord(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*rd = val
+			return pc + 1
+		}
+	case opcodes.LB:
+		rd, offset, rs := destination(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			val, ok := vm.loadByte(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*rd = int32(int8(val))
+			return pc + 1
+		}
+	case opcodes.LBU:
+		rd, offset, rs := destination(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			val, ok := vm.loadByte(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*rd = int32(val)
+			return pc + 1
+		}
+	case opcodes.LH:
+		rd, offset, rs := destination(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			val, ok := vm.loadHalfword(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*rd = int32(int16(val))
+			return pc + 1
+		}
+	case opcodes.LHU:
+		rd, offset, rs := destination(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			val, ok := vm.loadHalfword(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*rd = int32(val)
+			return pc + 1
+		}
+	case opcodes.SB:
+		rs2, offset, rs1 := ref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs1) + offset
+			if !vm.storeByte(addr, byte(*rs2)) {
+				return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+			}
+			return pc + 1
+		}
+	case opcodes.SH:
+		rs2, offset, rs1 := ref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs1) + offset
+			if !vm.storeHalfword(addr, uint16(*rs2)) {
+				return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+			}
+			return pc + 1
+		}
+	case opcodes.JAL:
+		rd, link, target := destination(a), int32(in.next), l.pc(ip+c)
+		return func(vm *vm, pc int) int {
+			*rd = link
+			return target
+		}
+	case opcodes.JALR:
+		rd, rs, offset, link := destination(a), ref(b), c, int32(in.next)
+		return func(vm *vm, pc int) int {
+			target := int(*rs) + offset
+			*rd = link
+			return vm.layout.pc(target)
+		}
+	case opcodes.LRW:
+		rd, rs1 := destination(a), ref(b)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs1)
+			if addr&3 != 0 {
+				return vm.trap(CauseLoadAddressMisaligned, uint32(addr), pc)
+			}
+			val, ok := vm.loadWord(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*rd = val
+			vm.reservations.reserve(vm.hartID, addr)
+			return pc + 1
+		}
+	case opcodes.SCW:
+		rd, rs1, rs2 := destination(a), ref(b), ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs1)
+			if addr&3 != 0 {
+				return vm.trap(CauseStoreAddressMisaligned, uint32(addr), pc)
+			}
+			if !vm.reservations.claim(vm.hartID, addr) {
+				*rd = 1
+				return pc + 1
+			}
+			if !vm.storeWord(addr, *rs2) {
+				return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+			}
+			*rd = 0
+			return pc + 1
+		}
+	case opcodes.AMOSWAPW:
+		return amo(destination(a), ref(b), ref(c), func(_, v int32) int32 { return v })
+	case opcodes.AMOADDW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return m + v })
+	case opcodes.AMOXORW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return m ^ v })
+	case opcodes.AMOANDW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return m & v })
+	case opcodes.AMOORW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return m | v })
+	case opcodes.AMOMINW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return min(m, v) })
+	case opcodes.AMOMAXW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return max(m, v) })
+	case opcodes.AMOMINUW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return int32(min(uint32(m), uint32(v))) })
+	case opcodes.AMOMAXUW:
+		return amo(destination(a), ref(b), ref(c), func(m, v int32) int32 { return int32(max(uint32(m), uint32(v))) })
+	case opcodes.CSRRW:
+		return csrInstruction(destination(a), opcodes.CSR(b), ref(c), csrWrite, true)
+	case opcodes.CSRRS:
+		return csrInstruction(destination(a), opcodes.CSR(b), ref(c), csrSet, c != 0)
+	case opcodes.CSRRC:
+		return csrInstruction(destination(a), opcodes.CSR(b), ref(c), csrClear, c != 0)
+	case opcodes.CSRRWI:
+		uimm := int32(c & 31)
+		return csrInstruction(destination(a), opcodes.CSR(b), &uimm, csrWrite, true)
+	case opcodes.CSRRSI:
+		uimm := int32(c & 31)
+		return csrInstruction(destination(a), opcodes.CSR(b), &uimm, csrSet, uimm != 0)
+	case opcodes.CSRRCI:
+		uimm := int32(c & 31)
+		return csrInstruction(destination(a), opcodes.CSR(b), &uimm, csrClear, uimm != 0)
+	case opcodes.MRET:
+		return func(vm *vm, pc int) int {
+			return vm.mret()
+		}
+	}
+	if h := decodeBitmanip(regs, in.slots); h != nil {
+		return h
+	}
+	// Anything else is an illegal instruction, reported with the opcode.
+	return illegalInstruction(opCode)
+}
+
+// next is the handler for instructions that have no effect.
+func next(vm *vm, pc int) int {
+	return pc + 1
+}
+
+// amo builds the handler for an atomic memory operation: the word at the
+// address in rs1 is loaded into rd and replaced by op applied to it and rs2.
+// Harts take turns one whole instruction at a time, so nothing can come
+// between the load and the store.
+func amo(rd, rs1, rs2 *int32, op func(mem, val int32) int32) handler {
+	return func(vm *vm, pc int) int {
+		addr := int(*rs1)
+		if addr&3 != 0 {
+			return vm.trap(CauseStoreAddressMisaligned, uint32(addr), pc)
+		}
+		old, ok := vm.loadWord(addr)
+		if !ok || !vm.storeWord(addr, op(old, *rs2)) {
+			return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+		}
+		*rd = old
+		return pc + 1
+	}
+}
+
+// traced wraps a handler so that it reports the instruction it ran and where
+// execution continues.
+func traced(h handler, byteCode []int, ip int, l *layout) handler {
+	inst := disassembler.Instruction(byteCode, ip)
+	return func(vm *vm, pc int) int {
+		next := h(vm, pc)
+		fmt.Printf("[%d] %s → ip = %d\n", ip, inst, l.ip(max(next, 0)))
+		return next
+	}
+}
+
+// divu and remu divide the way RISC-V does: by zero, the quotient has every
+// bit set and the remainder is the dividend, rather than a trap.
+func divu[T uint32 | uint64](dividend, divisor T) T {
+	if divisor == 0 {
+		return ^T(0)
+	}
+	return dividend / divisor
+}
+
+func remu[T uint32 | uint64](dividend, divisor T) T {
+	if divisor == 0 {
+		return dividend
+	}
+	return dividend % divisor
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,265 @@
+package vm
+
+import (
+	"github.com/phasecurve/zhuji/internal/fpu"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+)
+
+// decodeFloat binds an F or D instruction to the integer and float register
+// storage it works on. The arithmetic itself is left to package fpu, which
+// returns the exception flags each result raised for the handler to
+// accumulate in fflags.
+func decodeFloat(regs *registers.Registers, floats *registers.FloatRegisters, discard *int32, inst [4]int) handler {
+	opCode, a, b, c := opcodes.OpCode(inst[0]), inst[1], inst[2], inst[3]
+	info, _ := opcodes.ByOpCode(opCode)
+	f := fpu.Single
+	if info.Is(opcodes.Double) {
+		f = fpu.Double
+	}
+	ref, fref := regs.Ref, floats.Ref
+	destination := func(rd int) *int32 {
+		if rd == 0 {
+			return discard
+		}
+		return ref(rd)
+	}
+	rm := fpu.RoundingMode(c)
+	switch info.Format {
+	case opcodes.FR2Type, opcodes.FToXType, opcodes.FFromXType:
+		if !rm.Valid() && rm != fpu.DYN {
+			return illegalInstruction(opCode)
+		}
+	}
+	switch opCode {
+	case opcodes.FLW:
+		fd, offset, rs := fref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			val, ok := vm.loadWord(addr)
+			if !ok {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*fd = registers.BoxSingle(uint32(val))
+			return pc + 1
+		}
+	case opcodes.FLD:
+		fd, offset, rs := fref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			lo, ok := vm.loadWord(addr)
+			hi, ok2 := vm.loadWord(addr + 4)
+			if !ok || !ok2 {
+				return vm.trap(CauseLoadAccessFault, uint32(addr), pc)
+			}
+			*fd = uint64(uint32(hi))<<32 | uint64(uint32(lo))
+			return pc + 1
+		}
+	case opcodes.FSW:
+		fs, offset, rs := fref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			if !vm.storeWord(addr, int32(uint32(*fs))) {
+				return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+			}
+			return pc + 1
+		}
+	case opcodes.FSD:
+		fs, offset, rs := fref(a), b, ref(c)
+		return func(vm *vm, pc int) int {
+			addr := int(*rs) + offset
+			if !vm.storeWord(addr, int32(uint32(*fs))) || !vm.storeWord(addr+4, int32(uint32(*fs>>32))) {
+				return vm.trap(CauseStoreAccessFault, uint32(addr), pc)
+			}
+			return pc + 1
+		}
+	case opcodes.FADDS, opcodes.FADDD:
+		return arithmetic(f, fref(a), fref(b), fref(c), fpu.Add)
+	case opcodes.FSUBS, opcodes.FSUBD:
+		return arithmetic(f, fref(a), fref(b), fref(c), fpu.Sub)
+	case opcodes.FMULS, opcodes.FMULD:
+		return arithmetic(f, fref(a), fref(b), fref(c), fpu.Mul)
+	case opcodes.FDIVS, opcodes.FDIVD:
+		return arithmetic(f, fref(a), fref(b), fref(c), fpu.Div)
+	case opcodes.FSQRTS, opcodes.FSQRTD:
+		fd, fs := fref(a), fref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.Sqrt(f, unbox(f, *fs), rm)
+			*fd = box(f, result)
+			vm.raise(flags)
+		})
+	case opcodes.FMINS, opcodes.FMIND:
+		return unrounded(f, fref(a), fref(b), fref(c), fpu.Min)
+	case opcodes.FMAXS, opcodes.FMAXD:
+		return unrounded(f, fref(a), fref(b), fref(c), fpu.Max)
+	case opcodes.FSGNJS, opcodes.FSGNJD:
+		return signInjection(f, fref(a), fref(b), fref(c), func(_, sign uint64) uint64 { return sign })
+	case opcodes.FSGNJNS, opcodes.FSGNJND:
+		return signInjection(f, fref(a), fref(b), fref(c), func(_, sign uint64) uint64 { return ^sign })
+	case opcodes.FSGNJXS, opcodes.FSGNJXD:
+		return signInjection(f, fref(a), fref(b), fref(c), func(value, sign uint64) uint64 { return value ^ sign })
+	case opcodes.FCVTWS, opcodes.FCVTWD:
+		rd, fs := destination(a), fref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.ToInt32(f, unbox(f, *fs), rm)
+			*rd = result
+			vm.raise(flags)
+		})
+	case opcodes.FCVTWUS, opcodes.FCVTWUD:
+		rd, fs := destination(a), fref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.ToUint32(f, unbox(f, *fs), rm)
+			*rd = int32(result)
+			vm.raise(flags)
+		})
+	case opcodes.FCVTSW, opcodes.FCVTDW:
+		fd, rs := fref(a), ref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.FromInt64(f, int64(*rs), rm)
+			*fd = box(f, result)
+			vm.raise(flags)
+		})
+	case opcodes.FCVTSWU, opcodes.FCVTDWU:
+		fd, rs := fref(a), ref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.FromInt64(f, int64(uint32(*rs)), rm)
+			*fd = box(f, result)
+			vm.raise(flags)
+		})
+	case opcodes.FCVTSD:
+		fd, fs := fref(a), fref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.Convert(fpu.Double, fpu.Single, *fs, rm)
+			*fd = box(fpu.Single, result)
+			vm.raise(flags)
+		})
+	case opcodes.FCVTDS:
+		fd, fs := fref(a), fref(b)
+		return rounded(rm, func(vm *vm, rm fpu.RoundingMode) {
+			result, flags := fpu.Convert(fpu.Single, fpu.Double, unbox(fpu.Single, *fs), rm)
+			*fd = result
+			vm.raise(flags)
+		})
+	case opcodes.FEQS, opcodes.FEQD:
+		return comparison(f, destination(a), fref(b), fref(c), fpu.Eq)
+	case opcodes.FLTS, opcodes.FLTD:
+		return comparison(f, destination(a), fref(b), fref(c), fpu.Lt)
+	case opcodes.FLES, opcodes.FLED:
+		return comparison(f, destination(a), fref(b), fref(c), fpu.Le)
+	case opcodes.FMVXW:
+		rd, fs := destination(a), fref(b)
+		return func(vm *vm, pc int) int {
+			*rd = int32(uint32(*fs))
+			return pc + 1
+		}
+	case opcodes.FMVWX:
+		fd, rs := fref(a), ref(b)
+		return func(vm *vm, pc int) int {
+			*fd = registers.BoxSingle(uint32(*rs))
+			return pc + 1
+		}
+	case opcodes.FCLASSS, opcodes.FCLASSD:
+		rd, fs := destination(a), fref(b)
+		return func(vm *vm, pc int) int {
+			*rd = int32(fpu.Classify(f, unbox(f, *fs)))
+			return pc + 1
+		}
+	}
+	return illegalInstruction(opCode)
+}
+
+// illegalInstruction is the handler for an instruction the VM cannot run,
+// which traps with its opcode.
+func illegalInstruction(opCode opcodes.OpCode) handler {
+	illegal := uint32(opCode)
+	return func(vm *vm, pc int) int {
+		return vm.trap(CauseIllegalInstruction, illegal, pc)
+	}
+}
+
+// unbox reads a float register as format f, and box turns a result back into
+// what the register holds.
+func unbox(f fpu.Format, bits uint64) uint64 {
+	if f == fpu.Single {
+		return uint64(registers.UnboxSingle(bits))
+	}
+	return bits
+}
+
+func box(f fpu.Format, bits uint64) uint64 {
+	if f == fpu.Single {
+		return registers.BoxSingle(uint32(bits))
+	}
+	return bits
+}
+
+// raise accrues exception flags in fflags.
+func (vm *vm) raise(flags fpu.Flags) {
+	vm.csrs.fcsr |= uint32(flags)
+}
+
+// rounded builds the handler for an instruction that rounds in mode rm, or
+// in frm when rm is dyn. A dynamic rounding mode frm holds no valid mode for
+// is an illegal instruction.
+func rounded(rm fpu.RoundingMode, run func(vm *vm, rm fpu.RoundingMode)) handler {
+	if rm != fpu.DYN {
+		return func(vm *vm, pc int) int {
+			run(vm, rm)
+			return pc + 1
+		}
+	}
+	return func(vm *vm, pc int) int {
+		frm := fpu.RoundingMode(vm.csrs.fcsr >> opcodes.FcsrRMShift)
+		if !frm.Valid() {
+			return vm.trap(CauseIllegalInstruction, uint32(opcodes.FRM), pc)
+		}
+		run(vm, frm)
+		return pc + 1
+	}
+}
+
+// arithmetic builds the handler for fd = fs1 op fs2, which has no rm operand
+// and so always rounds in frm.
+func arithmetic(f fpu.Format, fd, fs1, fs2 *uint64, op func(fpu.Format, uint64, uint64, fpu.RoundingMode) (uint64, fpu.Flags)) handler {
+	return rounded(fpu.DYN, func(vm *vm, rm fpu.RoundingMode) {
+		result, flags := op(f, unbox(f, *fs1), unbox(f, *fs2), rm)
+		*fd = box(f, result)
+		vm.raise(flags)
+	})
+}
+
+// unrounded builds the handler for fmin and fmax, whose results are always
+// one of their operands.
+func unrounded(f fpu.Format, fd, fs1, fs2 *uint64, op func(fpu.Format, uint64, uint64) (uint64, fpu.Flags)) handler {
+	return func(vm *vm, pc int) int {
+		result, flags := op(f, unbox(f, *fs1), unbox(f, *fs2))
+		*fd = box(f, result)
+		vm.raise(flags)
+		return pc + 1
+	}
+}
+
+// signInjection builds the handler for the fsgnj forms: fs1 with its sign
+// bit replaced by that of sign(fs1, fs2). They raise no flags, even for NaNs.
+func signInjection(f fpu.Format, fd, fs1, fs2 *uint64, sign func(value, sign uint64) uint64) handler {
+	bit := uint64(1) << 31
+	if f == fpu.Double {
+		bit = 1 << 63
+	}
+	return func(vm *vm, pc int) int {
+		value := unbox(f, *fs1)
+		*fd = box(f, value&^bit|sign(value, unbox(f, *fs2))&bit)
+		return pc + 1
+	}
+}
+
+// comparison builds the handler for feq, flt and fle, which write 1 or 0 to
+// an integer register.
+func comparison(f fpu.Format, rd *int32, fs1, fs2 *uint64, op func(fpu.Format, uint64, uint64) (bool, fpu.Flags)) handler {
+	return func(vm *vm, pc int) int {
+		result, flags := op(f, unbox(f, *fs1), unbox(f, *fs2))
+		*rd = boolToInt32(result)
+		vm.raise(flags)
+		return pc + 1
+	}
+}
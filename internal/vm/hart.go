@@ -0,0 +1,153 @@
+package vm
+
+import (
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/registers"
+)
+
+// Machine is a set of harts sharing one memory. Every hart has its own
+// registers and runs the same program, telling itself apart from the others
+// by reading mhartid. A round-robin scheduler interleaves the harts on one
+// goroutine, so a concurrent program behaves the same way on every run.
+//
+// The harts step one instruction at a time and never run basic blocks, as a
+// block runs to its end whatever the quantum, and the quantum is what decides
+// where one hart's turn gives way to the next.
+type Machine struct {
+	harts   []*vm
+	bus     *memory.Bus
+	quantum int
+}
+
+func NewMachine(mem *memory.Memory, harts int) *Machine {
+	held := newReservations(harts)
+	timer := newClint(harts)
+	m := &Machine{bus: memory.NewBus(mem), quantum: 1}
+	m.bus.Attach(clintBase, clintSize, timer)
+	for id := range harts {
+		hart := newHart(id, registers.NewRegisters(), mem, m.bus, timer, held)
+		hart.stepped = true
+		m.harts = append(m.harts, hart)
+	}
+	return m
+}
+
+// EnableRV32E gives every hart the 16-register file of RV32E. Call it before
+// reading any hart's Registers.
+func (m *Machine) EnableRV32E() {
+	for _, hart := range m.harts {
+		hart.registers = registers.NewRegistersE()
+	}
+}
+
+// Attach maps a device into the address space every hart shares.
+func (m *Machine) Attach(base, size int, device memory.Device) error {
+	return m.bus.Attach(base, size, device)
+}
+
+// Registers returns the register file of hart id.
+func (m *Machine) Registers(id int) *registers.Registers {
+	return m.harts[id].registers
+}
+
+// Floats returns the float register file of hart id.
+func (m *Machine) Floats(id int) *registers.FloatRegisters {
+	return m.harts[id].floats
+}
+
+// SetQuantum sets how many instructions a hart runs before the scheduler
+// moves on to the next one. The default of 1 interleaves the harts as finely
+// as possible, which is the best setting for flushing out races.
+func (m *Machine) SetQuantum(instructions int) {
+	m.quantum = max(instructions, 1)
+}
+
+func (m *Machine) EnableTrace() {
+	for _, hart := range m.harts {
+		hart.EnableTrace()
+	}
+}
+
+// Execute runs the program on every hart until all of them have run off its
+// end or stopped on a trap they had no handler for. It returns the first such
+// trap, in hart order.
+func (m *Machine) Execute(byteCode ByteCode) error {
+	progs := make([][]handler, len(m.harts))
+	pcs := make([]int, len(m.harts))
+	for id, hart := range m.harts {
+		hart.unhandled = nil
+		prog := hart.decode(byteCode)
+		progs[id], hart.layout = prog.insts, prog.layout
+	}
+	for running := len(m.harts); running > 0; {
+		running = 0
+		for id, hart := range m.harts {
+			prog, pc := progs[id], pcs[id]
+			for n := 0; n < m.quantum && uint(pc) < uint(len(prog)); n++ {
+				pc = hart.step(prog, pc)
+			}
+			pcs[id] = pc
+			if uint(pc) < uint(len(prog)) {
+				running++
+			}
+		}
+	}
+	for _, hart := range m.harts {
+		if hart.unhandled != nil {
+			return hart.unhandled
+		}
+	}
+	return nil
+}
+
+// noReservation marks a hart that holds no reservation.
+const noReservation = -1
+
+// reservations records the word each hart has reserved with LR.W. A
+// reservation is lost when any hart stores to the reserved word, which is
+// what makes a later SC.W by its holder fail.
+type reservations struct {
+	held  []int
+	count int
+}
+
+func newReservations(harts int) *reservations {
+	r := &reservations{held: make([]int, harts)}
+	for hart := range r.held {
+		r.held[hart] = noReservation
+	}
+	return r
+}
+
+func (r *reservations) reserve(hart, addr int) {
+	if r.held[hart] == noReservation {
+		r.count++
+	}
+	r.held[hart] = addr &^ 3
+}
+
+// claim consumes the hart's reservation and reports whether it still covered
+// addr, i.e. whether a store conditional to addr may go ahead.
+func (r *reservations) claim(hart, addr int) bool {
+	word := r.held[hart]
+	if word == noReservation {
+		return false
+	}
+	r.held[hart] = noReservation
+	r.count--
+	return word == addr&^3
+}
+
+// invalidate drops every reservation on the word holding addr.
+func (r *reservations) invalidate(addr int) {
+	if r.count == 0 {
+		return
+	}
+	word := addr &^ 3
+	for hart, held := range r.held {
+		if held == word {
+			r.held[hart] = noReservation
+			r.count--
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/disassembler"
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+)
+
+// handler64 is one pre-decoded instruction of an RV64 program, run the same
+// way as a handler of the RV32 machine.
+type handler64 func(v *RV64VM, pc int) int
+
+// RV64VM runs programs assembled in RV64 mode: the base integer instructions
+// and the M extension on 64-bit registers, with LD, SD, LWU and the W forms.
+// It has no CSRs, so every trap stops Execute, and the other extensions are
+// illegal instructions.
+type RV64VM struct {
+	registers    *registers.Registers64
+	bus          *memory.Bus
+	traceEnabled bool
+	unhandled    *Trap
+	layout       *layout
+}
+
+func NewRV64VM(regs *registers.Registers64, mem *memory.Memory) *RV64VM {
+	return &RV64VM{registers: regs, bus: memory.NewBus(mem)}
+}
+
+// Attach maps a device into the VM's address space at [base, base+size).
+func (v *RV64VM) Attach(base, size int, device memory.Device) error {
+	return v.bus.Attach(base, size, device)
+}
+
+func (v *RV64VM) EnableTrace() {
+	v.traceEnabled = true
+}
+
+// Execute decodes the bytecode into handlers and runs them, as the RV32
+// machine does. It returns a *Trap if the program raised a trap.
+func (v *RV64VM) Execute(byteCode ByteCode) error {
+	v.unhandled = nil
+	prog := v.decode(byteCode)
+	for pc := 0; uint(pc) < uint(len(prog)); {
+		pc = prog[pc](v, pc)
+	}
+	if v.unhandled != nil {
+		return v.unhandled
+	}
+	return nil
+}
+
+// trap records a trap raised by the instruction at pc and stops the program.
+func (v *RV64VM) trap(cause uint32, value uint64, pc int) int {
+	v.unhandled = &Trap{Cause: cause, Value: uint32(value), IP: v.layout.ip(pc)}
+	return -1
+}
+
+func (v *RV64VM) decode(byteCode ByteCode) []handler64 {
+	insts, l := fetch(opcodes.RV64Set, byteCode)
+	v.layout = l
+	prog := make([]handler64, 0, len(insts))
+	for _, in := range insts {
+		h := illegal64(opcodes.OpCode(byteCode[in.ip]))
+		if in.next <= len(byteCode) {
+			h = decode64(v.registers, l, in)
+		}
+		if v.traceEnabled {
+			h = traced64(h, byteCode, in.ip, l)
+		}
+		prog = append(prog, h)
+	}
+	return prog
+}
+
+// decode64 binds an RV64 instruction to the registers it works on. As in
+// decodeInstruction, writes to x0 are dropped here: an instruction that only
+// computes a value into x0 does nothing, and a load into x0 still loads.
+func decode64(regs *registers.Registers64, l *layout, in instruction) handler64 {
+	opCode, ip := opcodes.OpCode(in.slots[0]), in.ip
+	a, b, c := in.slots[1], in.slots[2], in.slots[3]
+	ref := regs.Ref
+	var discard int64
+	destination := func(rd int) *int64 {
+		if rd == 0 {
+			return &discard
+		}
+		return ref(rd)
+	}
+	if op, ok := immediates[opCode]; ok {
+		if a == 0 {
+			return next64
+		}
+		f, rd, rs, imm := alu64[op], ref(a), ref(b), int64(c)
+		return func(v *RV64VM, pc int) int {
+			*rd = f(*rs, imm)
+			return pc + 1
+		}
+	}
+	if f, ok := alu64[opCode]; ok {
+		if a == 0 {
+			return next64
+		}
+		rd, rs1, rs2 := ref(a), ref(b), ref(c)
+		return func(v *RV64VM, pc int) int {
+			*rd = f(*rs1, *rs2)
+			return pc + 1
+		}
+	}
+	if taken, ok := branches64[opCode]; ok {
+		rs1, rs2, target := ref(a), ref(b), l.pc(ip+c)
+		return func(v *RV64VM, pc int) int {
+			if taken(*rs1, *rs2) {
+				return target
+			}
+			return pc + 1
+		}
+	}
+	switch opCode {
+	case opcodes.LUI, opcodes.AUIPC:
+		if a == 0 {
+			return next64
+		}
+		rd, value := ref(a), int64(int32(uint32(c)<<12))
+		if opCode == opcodes.AUIPC {
+			value += int64(ip)
+		}
+		return func(v *RV64VM, pc int) int {
+			*rd = value
+			return pc + 1
+		}
+	case opcodes.LB, opcodes.LBU, opcodes.LH, opcodes.LHU, opcodes.LW, opcodes.LWU, opcodes.LD:
+		return load64(opCode, destination(a), b, ref(c))
+	case opcodes.SB, opcodes.SH, opcodes.SW, opcodes.SD:
+		return store64(opCode, ref(a), b, ref(c))
+	case opcodes.JAL:
+		rd, link, target := destination(a), int64(in.next), l.pc(ip+c)
+		return func(v *RV64VM, pc int) int {
+			*rd = link
+			return target
+		}
+	case opcodes.JALR:
+		rd, rs, offset, link := destination(a), ref(b), int64(c), int64(in.next)
+		return func(v *RV64VM, pc int) int {
+			target := *rs + offset
+			*rd = link
+			return v.layout.pc(int(target))
+		}
+	}
+	return illegal64(opCode)
+}
+
+// load64 builds the handler for a load. The bus moves at most a word at a
+// time, so LD reads two, low word first.
+func load64(op opcodes.OpCode, rd *int64, offset int, rs *int64) handler64 {
+	return func(v *RV64VM, pc int) int {
+		addr := *rs + int64(offset)
+		var val int64
+		var err error
+		switch op {
+		case opcodes.LB, opcodes.LBU:
+			var b byte
+			b, err = v.bus.LoadByte(int(addr))
+			val = int64(b)
+			if op == opcodes.LB {
+				val = int64(int8(b))
+			}
+		case opcodes.LH, opcodes.LHU:
+			var h uint16
+			h, err = v.bus.LoadHalfword(int(addr))
+			val = int64(h)
+			if op == opcodes.LH {
+				val = int64(int16(h))
+			}
+		case opcodes.LW, opcodes.LWU:
+			var w int32
+			w, err = v.bus.LoadWord(int(addr))
+			val = int64(w)
+			if op == opcodes.LWU {
+				val = int64(uint32(w))
+			}
+		case opcodes.LD:
+			var lo, hi int32
+			lo, err = v.bus.LoadWord(int(addr))
+			if err == nil {
+				hi, err = v.bus.LoadWord(int(addr) + 4)
+			}
+			val = int64(hi)<<32 | int64(uint32(lo))
+		}
+		if err != nil {
+			return v.trap(CauseLoadAccessFault, uint64(addr), pc)
+		}
+		*rd = val
+		return pc + 1
+	}
+}
+
+// store64 builds the handler for a store of the low bits of rs2.
+func store64(op opcodes.OpCode, rs2 *int64, offset int, rs *int64) handler64 {
+	return func(v *RV64VM, pc int) int {
+		addr, val := *rs+int64(offset), *rs2
+		var err error
+		switch op {
+		case opcodes.SB:
+			err = v.bus.StoreByte(int(addr), byte(val))
+		case opcodes.SH:
+			err = v.bus.StoreHalfword(int(addr), uint16(val))
+		case opcodes.SW:
+			err = v.bus.StoreWord(int(addr), int32(val))
+		case opcodes.SD:
+			err = v.bus.StoreWord(int(addr), int32(val))
+			if err == nil {
+				err = v.bus.StoreWord(int(addr)+4, int32(val>>32))
+			}
+		}
+		if err != nil {
+			return v.trap(CauseStoreAccessFault, uint64(addr), pc)
+		}
+		return pc + 1
+	}
+}
+
+// next64 is the handler for instructions that have no effect.
+func next64(v *RV64VM, pc int) int {
+	return pc + 1
+}
+
+func illegal64(opCode opcodes.OpCode) handler64 {
+	return func(v *RV64VM, pc int) int {
+		return v.trap(CauseIllegalInstruction, uint64(opCode), pc)
+	}
+}
+
+// traced64 wraps a handler so that it reports the instruction it ran and
+// where execution continues.
+func traced64(h handler64, byteCode []int, ip int, l *layout) handler64 {
+	inst := disassembler.RV64Instruction(byteCode, ip)
+	return func(v *RV64VM, pc int) int {
+		next := h(v, pc)
+		fmt.Printf("[%d] %s → ip = %d\n", ip, inst, l.ip(max(next, 0)))
+		return next
+	}
+}
@@ -0,0 +1,221 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/disassembler"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// ErrStackUnderflow is what StackVM.Execute returns when an instruction needs
+// more values than the operand stack holds.
+var ErrStackUnderflow = errors.New("stack underflow")
+
+// stackHandler is one pre-decoded stack-machine instruction, run the same way
+// as a handler of the register machine.
+type stackHandler func(s *StackVM, pc int) int
+
+// StackVM runs the stack-machine instruction set. Its only state is the
+// operand stack, which carries over from one Execute to the next.
+type StackVM struct {
+	stack        []int32
+	traceEnabled bool
+	err          error
+}
+
+func NewStackVM() *StackVM {
+	return &StackVM{}
+}
+
+func (s *StackVM) EnableTrace() {
+	s.traceEnabled = true
+}
+
+// Stack returns the operand stack, bottom first.
+func (s *StackVM) Stack() []int32 {
+	return append([]int32(nil), s.stack...)
+}
+
+// Execute decodes the bytecode into handlers and runs them until one runs
+// off the end of the program. It returns an error wrapping ErrStackUnderflow
+// if an instruction found too few values on the stack, or a *Trap for an
+// opcode that is not part of the stack machine. Bytecode that is not a whole
+// number of instructions, or that jumps anywhere but to the start of one of
+// its instructions or to its end, is rejected before anything runs.
+func (s *StackVM) Execute(byteCode ByteCode) error {
+	s.err = nil
+	prog, err := s.decode(byteCode)
+	if err != nil {
+		return err
+	}
+	for pc := 0; uint(pc) < uint(len(prog)); {
+		pc = prog[pc](s, pc)
+	}
+	return s.err
+}
+
+func (s *StackVM) decode(byteCode ByteCode) ([]stackHandler, error) {
+	if len(byteCode)%4 != 0 {
+		return nil, fmt.Errorf("bytecode of %d slots is not a whole number of instructions", len(byteCode))
+	}
+	prog := make([]stackHandler, 0, len(byteCode)/4)
+	for ip := 0; ip < len(byteCode); ip += 4 {
+		h, err := decodeStackInstruction(byteCode, ip)
+		if err != nil {
+			return nil, err
+		}
+		if s.traceEnabled {
+			h = tracedStack(h, byteCode, ip)
+		}
+		prog = append(prog, h)
+	}
+	return prog, nil
+}
+
+// decodeStackInstruction binds the operand of the instruction at ip. Every
+// handler checks the stack holds the values the opcode table says it pops. A
+// jump is bound to the handler index of its target, which it rejects unless
+// that is an instruction of the program or its end.
+func decodeStackInstruction(byteCode []int, ip int) (stackHandler, error) {
+	op := opcodes.OpCode(byteCode[ip])
+	info, ok := opcodes.StackSet.ByOpCode(op)
+	if !ok {
+		illegal := uint32(op)
+		return func(s *StackVM, pc int) int {
+			s.err = &Trap{Cause: CauseIllegalInstruction, Value: illegal, IP: pc * 4}
+			return -1
+		}, nil
+	}
+	operand := byteCode[ip+3]
+	if info.Is(opcodes.Branch) || info.Is(opcodes.Jump) {
+		target := ip + operand
+		if target < 0 || target > len(byteCode) || target%4 != 0 {
+			return nil, fmt.Errorf("at ip %d: %s target %d is not an instruction of the program", ip, info.Mnemonic, target)
+		}
+		operand = target / 4
+	}
+	h := stackOperation(op, operand)
+	pops := info.Pops
+	if pops == 0 {
+		return h, nil
+	}
+	return func(s *StackVM, pc int) int {
+		if len(s.stack) < pops {
+			s.err = fmt.Errorf("%w at ip %d: %s needs %d values and the stack holds %d",
+				ErrStackUnderflow, pc*4, info.Mnemonic, pops, len(s.stack))
+			return -1
+		}
+		return h(s, pc)
+	}, nil
+}
+
+// stackOperation builds the handler for op. A jump's operand is the handler
+// index of its target; any other operand is the instruction's immediate.
+func stackOperation(op opcodes.OpCode, operand int) stackHandler {
+	switch op {
+	case opcodes.PSH:
+		value := int32(operand)
+		return func(s *StackVM, pc int) int {
+			s.stack = append(s.stack, value)
+			return pc + 1
+		}
+	case opcodes.DUP:
+		return func(s *StackVM, pc int) int {
+			s.stack = append(s.stack, s.stack[len(s.stack)-1])
+			return pc + 1
+		}
+	case opcodes.SWP:
+		return func(s *StackVM, pc int) int {
+			n := len(s.stack)
+			s.stack[n-1], s.stack[n-2] = s.stack[n-2], s.stack[n-1]
+			return pc + 1
+		}
+	case opcodes.DRP:
+		return func(s *StackVM, pc int) int {
+			s.stack = s.stack[:len(s.stack)-1]
+			return pc + 1
+		}
+	case opcodes.ADD:
+		return binary(func(a, b int32) int32 { return a + b })
+	case opcodes.SUB:
+		return binary(func(a, b int32) int32 { return a - b })
+	case opcodes.MUL:
+		return binary(func(a, b int32) int32 { return a * b })
+	case opcodes.DIV:
+		return binary(div)
+	case opcodes.LTE:
+		return binary(func(a, b int32) int32 { return boolToInt32(a <= b) })
+	case opcodes.GT:
+		return binary(func(a, b int32) int32 { return boolToInt32(a > b) })
+	case opcodes.JMP:
+		target := operand
+		return func(s *StackVM, pc int) int {
+			return target
+		}
+	case opcodes.JZ:
+		target := operand
+		return func(s *StackVM, pc int) int {
+			if s.pop() == 0 {
+				return target
+			}
+			return pc + 1
+		}
+	case opcodes.JNZ:
+		target := operand
+		return func(s *StackVM, pc int) int {
+			if s.pop() != 0 {
+				return target
+			}
+			return pc + 1
+		}
+	}
+	panic(fmt.Sprintf("stack opcode %d has no handler", op))
+}
+
+// binary builds the handler for an instruction that replaces the top two
+// values, a below b, with op(a, b).
+func binary(op func(a, b int32) int32) stackHandler {
+	return func(s *StackVM, pc int) int {
+		n := len(s.stack)
+		s.stack[n-2] = op(s.stack[n-2], s.stack[n-1])
+		s.stack = s.stack[:n-1]
+		return pc + 1
+	}
+}
+
+func (s *StackVM) pop() int32 {
+	n := len(s.stack)
+	value := s.stack[n-1]
+	s.stack = s.stack[:n-1]
+	return value
+}
+
+// div and rem divide the way RISC-V does rather than faulting: by zero the
+// quotient has every bit set and the remainder is the dividend. Go already
+// wraps the one quotient that overflows, the most negative value over -1,
+// around to itself as RISC-V does, and makes its remainder 0.
+func div[T int32 | int64](dividend, divisor T) T {
+	if divisor == 0 {
+		return -1
+	}
+	return dividend / divisor
+}
+
+func rem[T int32 | int64](dividend, divisor T) T {
+	if divisor == 0 {
+		return dividend
+	}
+	return dividend % divisor
+}
+
+// tracedStack wraps a handler so that it reports the instruction it ran and
+// the stack it left behind.
+func tracedStack(h stackHandler, byteCode []int, ip int) stackHandler {
+	inst := disassembler.StackInstruction(byteCode, ip)
+	return func(s *StackVM, pc int) int {
+		next := h(s, pc)
+		fmt.Printf("[%d] %s → %v\n", ip, inst, s.stack)
+		return next
+	}
+}
@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/phasecurve/zhuji/internal/opcodes"
+)
+
+// Trap causes, as recorded in mcause. Interrupts have the top bit set.
+const (
+	CauseIllegalInstruction     uint32 = 2
+	CauseLoadAddressMisaligned  uint32 = 4
+	CauseLoadAccessFault        uint32 = 5
+	CauseStoreAddressMisaligned uint32 = 6
+	CauseStoreAccessFault       uint32 = 7
+	CauseMachineTimerInterrupt  uint32 = 1<<31 | 7
+
+	interruptBit uint32 = 1 << 31
+)
+
+// Trap is a trap the guest did not install a handler for, which stops
+// execution. A program handles traps itself by writing the address of a
+// handler to mtvec before anything can go wrong.
+type Trap struct {
+	Cause uint32
+	Value uint32
+	IP    int
+}
+
+func (t *Trap) Error() string {
+	return fmt.Sprintf("unhandled trap at ip %d: mcause %#x, mtval %#x", t.IP, t.Cause, t.Value)
+}
+
+// trap enters the handler at mtvec for a trap raised by the instruction at
+// pc, and returns where execution continues. Without a handler, which is
+// until the program first writes mtvec, the trap is recorded and execution
+// stops.
+func (vm *vm) trap(cause, value uint32, pc int) int {
+	if !vm.csrs.handled {
+		vm.unhandled = &Trap{Cause: cause, Value: value, IP: vm.layout.ip(pc)}
+		return -1
+	}
+	vm.csrs.mepc = uint32(vm.layout.ip(pc))
+	vm.csrs.mcause = cause
+	vm.csrs.mtval = value
+	previous := uint32(0)
+	if vm.csrs.mstatus&opcodes.MstatusMIE != 0 {
+		previous = opcodes.MstatusMPIE
+	}
+	vm.csrs.mstatus = vm.csrs.mstatus&^(opcodes.MstatusMIE|opcodes.MstatusMPIE) | previous | opcodes.MstatusMPP
+	vm.rearm()
+	base := int(vm.csrs.mtvec &^ 3)
+	if vm.csrs.mtvec&1 == 1 && cause&interruptBit != 0 {
+		base += 4 * int(cause&^interruptBit)
+	}
+	return vm.layout.pc(base)
+}
+
+// mret returns from a trap handler to mepc, restoring the interrupt enable
+// that was in force when the trap was taken.
+func (vm *vm) mret() int {
+	enabled := uint32(0)
+	if vm.csrs.mstatus&opcodes.MstatusMPIE != 0 {
+		enabled = opcodes.MstatusMIE
+	}
+	vm.csrs.mstatus = vm.csrs.mstatus&^opcodes.MstatusMIE | enabled | opcodes.MstatusMPIE
+	vm.rearm()
+	return vm.layout.pc(int(vm.csrs.mepc))
+}
+
+// rearm works out whether a timer interrupt can be taken at all, so that the
+// per-instruction check is a single flag test while interrupts are off.
+func (vm *vm) rearm() {
+	vm.armed = vm.csrs.mstatus&opcodes.MstatusMIE != 0 && vm.csrs.mie&opcodes.MTIE != 0
+}
+
+// step runs the handler at pc, counts it as retired and returns where
+// execution continues, taking a pending timer interrupt first.
+func (vm *vm) step(prog []handler, pc int) int {
+	pc = prog[pc](vm, pc)
+	vm.instret++
+	if vm.armed {
+		pc = vm.interrupt(pc)
+	}
+	return pc
+}
+
+// interrupt takes the timer interrupt if it is pending, before the
+// instruction at pc runs.
+func (vm *vm) interrupt(pc int) int {
+	if pc < 0 || !vm.clint.pending(vm.hartID) {
+		return pc
+	}
+	return vm.trap(CauseMachineTimerInterrupt, 0, pc)
+}
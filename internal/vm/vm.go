@@ -2,154 +2,127 @@
 package vm
 
 import (
-	"fmt"
-
 	"github.com/phasecurve/zhuji/internal/memory"
-	"github.com/phasecurve/zhuji/internal/opcodes"
 	"github.com/phasecurve/zhuji/internal/registers"
 )
 
-var opToAssemby = map[opcodes.OpCode]string{
-	opcodes.ADDI: "addi",
-	opcodes.ADD:  "add",
-	opcodes.SUB:  "sub",
-	opcodes.LW:   "lw",
-	opcodes.SW:   "sw",
-	opcodes.BNE:  "bne",
-	opcodes.BGE:  "bge",
-	opcodes.BEQ:  "beq",
-	opcodes.BLT:  "blt",
-}
-
 type ByteCode []int
 
 type vm struct {
 	registers    *registers.Registers
+	floats       *registers.FloatRegisters
 	memory       *memory.Memory
+	bus          *memory.Bus
 	traceEnabled bool
+	stepped      bool
+	discard      int32
+	hartID       int
+	reservations *reservations
+	clint        *clint
+	csrs         csrs
+	instret      uint64
+	armed        bool
+	unhandled    *Trap
+	layout       *layout
+	decoded      decoded
+}
+
+func NewVM(regs *registers.Registers, mem *memory.Memory) *vm {
+	timer := newClint(1)
+	bus := memory.NewBus(mem)
+	bus.Attach(clintBase, clintSize, timer)
+	return newHart(0, regs, mem, bus, timer, newReservations(1))
 }
 
-func NewVM(registers *registers.Registers, memory *memory.Memory) *vm {
+// newHart builds hart id on a bus, timer and reservations it may share with
+// other harts.
+func newHart(id int, regs *registers.Registers, mem *memory.Memory, bus *memory.Bus, timer *clint, held *reservations) *vm {
 	vm := &vm{
-		registers: registers,
-		memory:    memory,
+		registers:    regs,
+		floats:       registers.NewFloatRegisters(),
+		memory:       mem,
+		bus:          bus,
+		hartID:       id,
+		reservations: held,
+		clint:        timer,
 	}
+	timer.attach(&vm.instret)
 	return vm
 }
 
-func (vm *vm) execRegImmOp(opCode opcodes.OpCode, byteCode []int, ip int) int {
-	rd := byteCode[ip+1]
-	rs := byteCode[ip+2]
-	imm := byteCode[ip+3]
-	result := vm.registers.Read(rs) + int32(imm)
-	vm.registers.Write(rd, result)
-	if vm.traceEnabled {
-		fmt.Printf("[%d] %s x%d, x%d, %d → x%d = %d\n", ip, opToAssemby[opCode], rd, rs, imm, rd, result)
-	}
-	return 4
+// Floats returns the VM's float register file.
+func (vm *vm) Floats() *registers.FloatRegisters {
+	return vm.floats
+}
+
+// Attach maps a device into the VM's address space at [base, base+size).
+func (vm *vm) Attach(base, size int, device memory.Device) error {
+	return vm.bus.Attach(base, size, device)
 }
 
-func (vm *vm) execRegOp(opCode opcodes.OpCode, byteCode []int, ip int, op func(int32, int32) int32) int {
-	rd := byteCode[ip+1]
-	rs1 := byteCode[ip+2]
-	rs2 := byteCode[ip+3]
-	result := op(vm.registers.Read(rs1), vm.registers.Read(rs2))
-	vm.registers.Write(rd, result)
-	if vm.traceEnabled {
-		fmt.Printf("[%d] %s x%d, x%d, x%d → x%d = %d\n", ip, opToAssemby[opCode], rd, rs1, rs2, rd, result)
+// Execute decodes the bytecode once into a program of pre-bound handlers and
+// then runs it, each handler returning the index of the next one. Running the
+// same bytecode again reuses the decoded program. While no interrupt can be
+// taken it runs whole basic blocks; once one can, it steps an instruction at
+// a time so that the interrupt is taken between the right two. It returns a *Trap if the program raised a trap it had no handler for.
+func (vm *vm) Execute(byteCode ByteCode) error {
+	vm.unhandled = nil
+	prog := vm.prepare(byteCode)
+	vm.layout = prog.layout
+	for pc := 0; uint(pc) < uint(len(prog.insts)); {
+		if vm.armed || prog.blocks == nil {
+			pc = vm.step(prog.insts, pc)
+		} else {
+			pc = vm.run(prog, pc)
+		}
+	}
+	if vm.unhandled != nil {
+		return vm.unhandled
 	}
-	return 4
+	return nil
 }
-func (vm *vm) execBranch(opCode opcodes.OpCode, byteCode []int, ip int, cond func(int32, int32) bool) int {
-	rs1Val := vm.registers.Read(byteCode[ip+1])
-	rs2Val := vm.registers.Read(byteCode[ip+2])
-	target := byteCode[ip+3]
-	nextIP := ip + 4
-	if cond(rs1Val, rs2Val) {
-		nextIP = ip + target
+
+// loadWord reads the word at addr from memory or a device, reporting false
+// when nothing is mapped there or the device refused the access.
+func (vm *vm) loadWord(addr int) (int32, bool) {
+	val, err := vm.bus.LoadWord(addr)
+	return val, err == nil
+}
+
+// storeWord writes the word at addr to memory or a device, reporting false
+// when nothing is mapped there or the device refused the access.
+func (vm *vm) storeWord(addr int, value int32) bool {
+	if vm.bus.StoreWord(addr, value) != nil {
+		return false
 	}
-	if vm.traceEnabled {
-		fmt.Printf("[%d] %s x%d, x%d, %d → ip = %d\n", ip, opToAssemby[opCode], byteCode[ip+1], byteCode[ip+2], target,
-			nextIP)
+	vm.reservations.invalidate(addr)
+	return true
+}
+
+func (vm *vm) loadHalfword(addr int) (uint16, bool) {
+	val, err := vm.bus.LoadHalfword(addr)
+	return val, err == nil
+}
+
+func (vm *vm) storeHalfword(addr int, value uint16) bool {
+	if vm.bus.StoreHalfword(addr, value) != nil {
+		return false
 	}
-	return nextIP
+	vm.reservations.invalidate(addr)
+	return true
 }
 
-func (vm *vm) Execute(byteCode ByteCode) {
-	for ip := 0; ip < len(byteCode); {
-		opCode := opcodes.OpCode(byteCode[ip])
+func (vm *vm) loadByte(addr int) (byte, bool) {
+	val, err := vm.bus.LoadByte(addr)
+	return val, err == nil
+}
 
-		if vm.traceEnabled {
-			fmt.Printf("[Execute] \n\tbyteCode: %v\n\topCode: %v\n\tip: %d", byteCode, opCode, ip)
-		}
-		switch opCode {
-		case opcodes.ADDI:
-			ip += vm.execRegImmOp(opCode, byteCode, ip)
-		case opcodes.ADD:
-			ip += vm.execRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
-				return v1 + v2
-			})
-		case opcodes.SUB:
-			ip += vm.execRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
-				return v1 - v2
-			})
-		case opcodes.MUL:
-			ip += vm.execRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
-				return v1 * v2
-			})
-		case opcodes.DIV:
-			ip += vm.execRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
-				return v1 / v2
-			})
-		case opcodes.MOD:
-			ip += vm.execRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
-				return v1 % v2
-			})
-		case opcodes.SW:
-			rs2 := byteCode[ip+1]
-			offset := byteCode[ip+2]
-			rs1 := byteCode[ip+3]
-			val := vm.registers.Read(rs2)
-			addr := int(vm.registers.Read(rs1)) + offset
-			vm.memory.StoreWord(addr, val)
-			if vm.traceEnabled {
-				fmt.Printf("[%d] sw x%d, %d(x%d) → x%d = %d\n", ip, rs2, offset, rs1, addr, val)
-			}
-			ip += 4
-		case opcodes.LW:
-			rd := byteCode[ip+1]
-			offset := byteCode[ip+2]
-			rs := byteCode[ip+3]
-			addr := int(vm.registers.Read(rs)) + offset
-			val := vm.memory.LoadWord(addr)
-			vm.registers.Write(rd, val)
-			if vm.traceEnabled {
-				fmt.Printf("battle through the heavens 243[%d] lw x%d, %d(x%d) → x%d = %d\n", ip, rd, offset, rs, addr, val)
-			}
-			ip += 4
-		case opcodes.BLT:
-			ip = vm.execBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 < v2 })
-		case opcodes.BEQ:
-			ip = vm.execBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 == v2 })
-		case opcodes.BNE:
-			ip = vm.execBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 != v2 })
-		case opcodes.BGE:
-			ip = vm.execBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 >= v2 })
-		case opcodes.JAL:
-			rd := byteCode[ip+1]
-			offset := byteCode[ip+3]
-			vm.registers.Write(rd, int32(ip)+4)
-			ip = ip + offset
-		case opcodes.JALR:
-			rd := byteCode[ip+1]
-			rs := byteCode[ip+2]
-			offset := byteCode[ip+3]
-			if rd != 0 {
-				vm.registers.Write(rd, int32(ip+4))
-			}
-			ip = int(vm.registers.Read(rs)) + offset
-		}
+func (vm *vm) storeByte(addr int, value byte) bool {
+	if vm.bus.StoreByte(addr, value) != nil {
+		return false
 	}
+	vm.reservations.invalidate(addr)
+	return true
 }
 
 func (vm *vm) EnableTrace() {
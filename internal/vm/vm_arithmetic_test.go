@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"math"
 	"testing"
 
 	"github.com/phasecurve/zhuji/internal/memory"
@@ -166,6 +167,8 @@ func TestDiv(t *testing.T) {
 		{"by one", 42, 1, 42, "dividing by one should return same value"},
 		{"zero dividend", 0, 5, 0, "zero divided by anything should give zero"},
 		{"negatives", -20, 4, -5, "should handle negative dividend"},
+		{"by zero", 7, 0, -1, "the quotient of a division by zero has every bit set"},
+		{"overflow", math.MinInt32, -1, math.MinInt32, "the most negative word divided by -1 should wrap"},
 	}
 
 	for _, tc := range cases {
@@ -180,8 +183,9 @@ func TestDiv(t *testing.T) {
 				int(opcodes.DIV), 3, 1, 2,
 			}
 
-			vm.Execute(bytecode)
+			err := vm.Execute(bytecode)
 
+			assert.NoError(t, err)
 			assert.Equal(t, tc.expected, rs.Read(3), tc.message)
 		})
 	}
@@ -200,6 +204,8 @@ func TestMod(t *testing.T) {
 		{"zero dividend", 0, 5, 0, "zero mod anything should give zero"},
 		{"divisor larger", 3, 7, 3, "when divisor is larger, result is dividend"},
 		{"equal operands", 5, 5, 0, "equal values should give zero remainder"},
+		{"by zero", -7, 0, -7, "the remainder of a division by zero is the dividend"},
+		{"overflow", math.MinInt32, -1, 0, "the most negative word is a multiple of -1"},
 	}
 
 	for _, tc := range cases {
@@ -214,6 +220,94 @@ func TestMod(t *testing.T) {
 				int(opcodes.MOD), 3, 1, 2,
 			}
 
+			err := vm.Execute(bytecode)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rs.Read(3), tc.message)
+		})
+	}
+}
+
+func TestMExtensionHighMultiplyAndUnsignedDivide(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a        int
+		b        int
+		expected int32
+		message  string
+	}{
+		{"mulh positive", opcodes.MULH, 0x40000000, 8, 2, "mulh should return the upper word of the product"},
+		{"mulh negative", opcodes.MULH, -2, 3, -1, "mulh should sign-extend a negative product"},
+		{"mulhu", opcodes.MULHU, -1, -1, -2, "mulhu should treat both operands as unsigned"},
+		{"mulhsu", opcodes.MULHSU, -1, -1, -1, "mulhsu should treat only the first operand as signed"},
+		{"mulhsu positive", opcodes.MULHSU, 2, -1, 1, "mulhsu should treat the second operand as unsigned"},
+		{"divu", opcodes.DIVU, -2, 2, 0x7FFFFFFF, "divu should divide the unsigned values"},
+		{"divu by zero", opcodes.DIVU, 7, 0, -1, "divu by zero should set every bit"},
+		{"remu", opcodes.REMU, -1, 10, 5, "remu should take the unsigned remainder"},
+		{"remu by zero", opcodes.REMU, 7, 0, 7, "remu by zero should return the dividend"},
+		{"rem", opcodes.REM, -7, 3, -1, "rem should be the signed remainder"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+
+			bytecode := ByteCode{
+				int(opcodes.ADDI), 1, 0, tc.a,
+				int(opcodes.ADDI), 2, 0, tc.b,
+				int(tc.op), 3, 1, 2,
+			}
+
+			vm.Execute(bytecode)
+
+			assert.Equal(t, tc.expected, rs.Read(3), tc.message)
+		})
+	}
+}
+
+func TestLogicAndShifts(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a        int
+		b        int
+		expected int32
+		message  string
+	}{
+		{"and", opcodes.AND, 0b1100, 0b1010, 0b1000, "and should keep the bits set in both"},
+		{"or", opcodes.OR, 0b1100, 0b1010, 0b1110, "or should keep the bits set in either"},
+		{"xor", opcodes.XOR, 0b1100, 0b1010, 0b0110, "xor should keep the bits set in one"},
+		{"sll", opcodes.SLL, 3, 4, 48, "sll should shift left"},
+		{"sll masks amount", opcodes.SLL, 1, 33, 2, "sll should only use the low five bits of the amount"},
+		{"sll overflows", opcodes.SLL, 3, 31, -0x80000000, "sll should drop bits shifted past bit 31"},
+		{"srl", opcodes.SRL, -16, 28, 0xF, "srl should shift in zeros"},
+		{"sra", opcodes.SRA, -16, 2, -4, "sra should shift in copies of the sign bit"},
+		{"andi", opcodes.ANDI, 0xFF, -16, 0xF0, "andi should sign-extend its immediate"},
+		{"ori", opcodes.ORI, 0b0001, 0b0110, 0b0111, "ori should or in the immediate"},
+		{"xori not", opcodes.XORI, 5, -1, -6, "xori with -1 should invert every bit"},
+		{"slli", opcodes.SLLI, 1, 10, 1024, "slli should shift left"},
+		{"srli", opcodes.SRLI, -1, 31, 1, "srli should shift in zeros"},
+		{"srai", opcodes.SRAI, -1024, 4, -64, "srai should keep the sign"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+
+			bytecode := ByteCode{
+				int(opcodes.ADDI), 1, 0, tc.a,
+				int(opcodes.ADDI), 2, 0, tc.b,
+				int(tc.op), 3, 1, 2,
+			}
+			if tc.op >= opcodes.ANDI {
+				bytecode[11] = tc.b
+			}
+
 			vm.Execute(bytecode)
 
 			assert.Equal(t, tc.expected, rs.Read(3), tc.message)
@@ -221,6 +315,67 @@ func TestMod(t *testing.T) {
 	}
 }
 
+func TestSetLessThan(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a        int
+		b        int
+		expected int32
+		message  string
+	}{
+		{"slt true", opcodes.SLT, -1, 1, 1, "slt should compare signed"},
+		{"slt false", opcodes.SLT, 1, 1, 0, "slt should be false for equal values"},
+		{"sltu", opcodes.SLTU, -1, 1, 0, "sltu should treat -1 as the largest value"},
+		{"sltu true", opcodes.SLTU, 1, -1, 1, "sltu should compare unsigned"},
+		{"slti", opcodes.SLTI, -5, -4, 1, "slti should compare with the signed immediate"},
+		{"sltiu seqz", opcodes.SLTIU, 0, 1, 1, "sltiu with 1 should test for zero"},
+		{"sltiu sign-extends", opcodes.SLTIU, 5, -1, 1, "sltiu should sign-extend its immediate before comparing unsigned"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+
+			bytecode := ByteCode{
+				int(opcodes.ADDI), 1, 0, tc.a,
+				int(opcodes.ADDI), 2, 0, tc.b,
+				int(tc.op), 3, 1, 2,
+			}
+			if tc.op == opcodes.SLTI || tc.op == opcodes.SLTIU {
+				bytecode[11] = tc.b
+			}
+
+			vm.Execute(bytecode)
+
+			assert.Equal(t, tc.expected, rs.Read(3), tc.message)
+		})
+	}
+}
+
+func TestUpperImmediates(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.LUI), 1, 0, 0xDEADC,
+		int(opcodes.ADDI), 1, 1, -0x111,
+		int(opcodes.LUI), 2, 0, 0xFFFFF,
+		int(opcodes.AUIPC), 3, 0, 0,
+		int(opcodes.AUIPC), 4, 0, 1,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(-0x21524111), rs.Read(1), "lui and addi should build 0xDEADBEEF")
+	assert.Equal(t, int32(-0x1000), rs.Read(2), "lui should fill the upper 20 bits and clear the rest")
+	assert.Equal(t, int32(12), rs.Read(3), "auipc with zero should give its own address")
+	assert.Equal(t, int32(0x1000+16), rs.Read(4), "auipc should add its shifted immediate to its address")
+}
+
 func TestAddSubInversion(t *testing.T) {
 	rs := registers.NewRegisters()
 	mem := memory.NewMemory(1024)
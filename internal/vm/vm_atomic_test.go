@@ -0,0 +1,215 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadReservedThenStoreConditionalSucceeds(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+	mem.StoreWord(8, 5)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 4, 0, 8,
+		int(opcodes.LRW), 1, 4, 0,
+		int(opcodes.ADDI), 1, 1, 1,
+		int(opcodes.SCW), 2, 4, 1,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(0), rs.Read(2), "store conditional should report success with zero")
+	assert.Equal(t, int32(6), mem.LoadWord(8), "store conditional should write while the reservation holds")
+}
+
+func TestStoreConditionalWithoutReservationFails(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+	mem.StoreWord(8, 5)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 4, 0, 8,
+		int(opcodes.ADDI), 1, 0, 99,
+		int(opcodes.SCW), 2, 4, 1,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(1), rs.Read(2), "store conditional should report failure with non-zero")
+	assert.Equal(t, int32(5), mem.LoadWord(8), "failed store conditional should leave memory alone")
+}
+
+func TestStoreConditionalFailsAfterInterveningStore(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 4, 0, 8,
+		int(opcodes.LRW), 1, 4, 0,
+		int(opcodes.ADDI), 3, 0, 7,
+		int(opcodes.SW), 3, 0, 4,
+		int(opcodes.ADDI), 1, 0, 99,
+		int(opcodes.SCW), 2, 4, 1,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(1), rs.Read(2), "a store to the reserved word should break the reservation")
+	assert.Equal(t, int32(7), mem.LoadWord(8), "memory should keep the intervening store")
+}
+
+func TestStoreConditionalConsumesReservation(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 4, 0, 8,
+		int(opcodes.LRW), 1, 4, 0,
+		int(opcodes.SCW), 2, 4, 1,
+		int(opcodes.SCW), 3, 4, 1,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(0), rs.Read(2), "first store conditional should succeed")
+	assert.Equal(t, int32(1), rs.Read(3), "second store conditional should fail without a new reservation")
+}
+
+func TestAtomicMemoryOperations(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		mem      int32
+		val      int32
+		expected int32
+		message  string
+	}{
+		{"swap", opcodes.AMOSWAPW, 5, 9, 9, "amoswap should store the register value"},
+		{"add", opcodes.AMOADDW, 5, 9, 14, "amoadd should store the sum"},
+		{"xor", opcodes.AMOXORW, 0b1100, 0b1010, 0b0110, "amoxor should store the exclusive or"},
+		{"and", opcodes.AMOANDW, 0b1100, 0b1010, 0b1000, "amoand should store the and"},
+		{"or", opcodes.AMOORW, 0b1100, 0b1010, 0b1110, "amoor should store the or"},
+		{"min", opcodes.AMOMINW, -5, 3, -5, "amomin should compare signed"},
+		{"max", opcodes.AMOMAXW, -5, 3, 3, "amomax should compare signed"},
+		{"minu", opcodes.AMOMINUW, -5, 3, 3, "amominu should compare unsigned"},
+		{"maxu", opcodes.AMOMAXUW, -5, 3, -5, "amomaxu should compare unsigned"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+			mem.StoreWord(16, tc.mem)
+
+			bytecode := ByteCode{
+				int(opcodes.ADDI), 4, 0, 16,
+				int(opcodes.ADDI), 2, 0, int(tc.val),
+				int(tc.op), 1, 4, 2,
+			}
+
+			vm.Execute(bytecode)
+
+			assert.Equal(t, tc.mem, rs.Read(1), "destination should receive the original memory value")
+			assert.Equal(t, tc.expected, mem.LoadWord(16), tc.message)
+		})
+	}
+}
+
+func TestEachHartReadsItsOwnHartID(t *testing.T) {
+	mem := memory.NewMemory(1024)
+	machine := NewMachine(mem, 4)
+
+	bytecode := ByteCode{
+		int(opcodes.CSRRS), 10, int(opcodes.MHARTID), 0,
+	}
+
+	machine.Execute(bytecode)
+
+	for id := range 4 {
+		assert.Equal(t, int32(id), machine.Registers(id).Read(10), "hart %d should read its own mhartid", id)
+	}
+}
+
+func TestHartsShareOneBusTimerAndReservations(t *testing.T) {
+	machine := NewMachine(memory.NewMemory(1024), 3)
+
+	first := machine.harts[0]
+	for _, hart := range machine.harts {
+		assert.Same(t, machine.bus, hart.bus)
+		assert.Same(t, first.clint, hart.clint)
+		assert.Same(t, first.reservations, hart.reservations)
+	}
+	assert.Len(t, first.clint.retired, 3, "mtime should count the instructions of every hart, once each")
+	assert.Nil(t, first.decode(ByteCode{int(opcodes.ADDI), 1, 0, 1}).blocks, "a hart that steps needs no blocks")
+}
+
+func TestPlainIncrementsFromTwoHartsLoseUpdates(t *testing.T) {
+	mem := memory.NewMemory(1024)
+	machine := NewMachine(mem, 2)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 100,
+		int(opcodes.LW), 3, 0, 0,
+		int(opcodes.ADDI), 3, 3, 1,
+		int(opcodes.SW), 3, 0, 0,
+		int(opcodes.ADDI), 1, 1, -1,
+		int(opcodes.BNE), 1, 0, -16,
+	}
+
+	machine.Execute(bytecode)
+
+	assert.Less(t, mem.LoadWord(0), int32(200), "interleaved load/add/store should lose increments")
+}
+
+func TestAtomicAddFromTwoHartsKeepsEveryUpdate(t *testing.T) {
+	mem := memory.NewMemory(1024)
+	machine := NewMachine(mem, 2)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 100,
+		int(opcodes.ADDI), 2, 0, 1,
+		int(opcodes.AMOADDW), 0, 0, 2,
+		int(opcodes.ADDI), 1, 1, -1,
+		int(opcodes.BNE), 1, 0, -8,
+	}
+
+	machine.Execute(bytecode)
+
+	assert.Equal(t, int32(200), mem.LoadWord(0), "atomic add should not lose any increment")
+}
+
+func TestSpinLockBuiltFromLoadReservedAndStoreConditional(t *testing.T) {
+	mem := memory.NewMemory(1024)
+	machine := NewMachine(mem, 3)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 50, // IP=0: iterations
+		int(opcodes.ADDI), 4, 0, 4, // IP=4: lock address
+		int(opcodes.ADDI), 5, 0, 1, // IP=8: locked value
+		int(opcodes.LRW), 6, 4, 0, // IP=12: acquire: read the lock
+		int(opcodes.BNE), 6, 0, -4, // IP=16: held by another hart, retry
+		int(opcodes.SCW), 6, 4, 5, // IP=20: try to take it
+		int(opcodes.BNE), 6, 0, -12, // IP=24: lost the race, retry
+		int(opcodes.LW), 3, 0, 0, // IP=28: critical section: counter++
+		int(opcodes.ADDI), 3, 3, 1,
+		int(opcodes.SW), 3, 0, 0,
+		int(opcodes.SW), 0, 0, 4, // IP=40: release
+		int(opcodes.ADDI), 1, 1, -1,
+		int(opcodes.BNE), 1, 0, -36, // IP=48: next iteration
+	}
+
+	machine.Execute(bytecode)
+
+	assert.Equal(t, int32(150), mem.LoadWord(0), "the lock should serialise every critical section")
+	assert.Equal(t, int32(0), mem.LoadWord(4), "the lock should be released at the end")
+}
@@ -0,0 +1,274 @@
+package vm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+)
+
+// The functions below are the interpreter Execute replaced, kept as the
+// baseline for the benchmarks: it re-dispatches every instruction through a
+// switch and passes a fresh closure to each arithmetic and branch helper.
+// They are renamed with a switch prefix to sit beside the new code, and their
+// trace lines take mnemonics from the opcode table and drop the old debug
+// output; the dispatch and arithmetic, which is what gets measured, are as
+// they were.
+
+func mnemonic(op opcodes.OpCode) string {
+	info, _ := opcodes.ByOpCode(op)
+	return info.Mnemonic
+}
+
+func (vm *vm) switchRegImmOp(opCode opcodes.OpCode, byteCode []int, ip int) int {
+	rd := byteCode[ip+1]
+	rs := byteCode[ip+2]
+	imm := byteCode[ip+3]
+	result := vm.registers.Read(rs) + int32(imm)
+	vm.registers.Write(rd, result)
+	if vm.traceEnabled {
+		fmt.Printf("[%d] %s x%d, x%d, %d → x%d = %d\n", ip, mnemonic(opCode), rd, rs, imm, rd, result)
+	}
+	return 4
+}
+
+func (vm *vm) switchRegOp(opCode opcodes.OpCode, byteCode []int, ip int, op func(int32, int32) int32) int {
+	rd := byteCode[ip+1]
+	rs1 := byteCode[ip+2]
+	rs2 := byteCode[ip+3]
+	result := op(vm.registers.Read(rs1), vm.registers.Read(rs2))
+	vm.registers.Write(rd, result)
+	if vm.traceEnabled {
+		fmt.Printf("[%d] %s x%d, x%d, x%d → x%d = %d\n", ip, mnemonic(opCode), rd, rs1, rs2, rd, result)
+	}
+	return 4
+}
+func (vm *vm) switchBranch(opCode opcodes.OpCode, byteCode []int, ip int, cond func(int32, int32) bool) int {
+	rs1Val := vm.registers.Read(byteCode[ip+1])
+	rs2Val := vm.registers.Read(byteCode[ip+2])
+	target := byteCode[ip+3]
+	nextIP := ip + 4
+	if cond(rs1Val, rs2Val) {
+		nextIP = ip + target
+	}
+	if vm.traceEnabled {
+		fmt.Printf("[%d] %s x%d, x%d, %d → ip = %d\n", ip, mnemonic(opCode), byteCode[ip+1], byteCode[ip+2], target,
+			nextIP)
+	}
+	return nextIP
+}
+
+func (vm *vm) switchExecute(byteCode ByteCode) {
+	for ip := 0; ip < len(byteCode); {
+		opCode := opcodes.OpCode(byteCode[ip])
+
+		if vm.traceEnabled {
+			fmt.Printf("[Execute] \n\tbyteCode: %v\n\topCode: %v\n\tip: %d", byteCode, opCode, ip)
+		}
+		switch opCode {
+		case opcodes.ADDI:
+			ip += vm.switchRegImmOp(opCode, byteCode, ip)
+		case opcodes.ADD:
+			ip += vm.switchRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
+				return v1 + v2
+			})
+		case opcodes.SUB:
+			ip += vm.switchRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
+				return v1 - v2
+			})
+		case opcodes.MUL:
+			ip += vm.switchRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
+				return v1 * v2
+			})
+		case opcodes.DIV:
+			ip += vm.switchRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
+				return v1 / v2
+			})
+		case opcodes.MOD:
+			ip += vm.switchRegOp(opCode, byteCode, ip, func(v1, v2 int32) int32 {
+				return v1 % v2
+			})
+		case opcodes.SW:
+			rs2 := byteCode[ip+1]
+			offset := byteCode[ip+2]
+			rs1 := byteCode[ip+3]
+			val := vm.registers.Read(rs2)
+			addr := int(vm.registers.Read(rs1)) + offset
+			vm.memory.StoreWord(addr, val)
+			if vm.traceEnabled {
+				fmt.Printf("[%d] sw x%d, %d(x%d) → x%d = %d\n", ip, rs2, offset, rs1, addr, val)
+			}
+			ip += 4
+		case opcodes.LW:
+			rd := byteCode[ip+1]
+			offset := byteCode[ip+2]
+			rs := byteCode[ip+3]
+			addr := int(vm.registers.Read(rs)) + offset
+			val := vm.memory.LoadWord(addr)
+			vm.registers.Write(rd, val)
+			if vm.traceEnabled {
+				fmt.Printf("[%d] lw x%d, %d(x%d) → x%d = %d\n", ip, rd, offset, rs, addr, val)
+			}
+			ip += 4
+		case opcodes.BLT:
+			ip = vm.switchBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 < v2 })
+		case opcodes.BEQ:
+			ip = vm.switchBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 == v2 })
+		case opcodes.BNE:
+			ip = vm.switchBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 != v2 })
+		case opcodes.BGE:
+			ip = vm.switchBranch(opCode, byteCode, ip, func(v1 int32, v2 int32) bool { return v1 >= v2 })
+		case opcodes.JAL:
+			rd := byteCode[ip+1]
+			offset := byteCode[ip+3]
+			vm.registers.Write(rd, int32(ip)+4)
+			ip = ip + offset
+		case opcodes.JALR:
+			rd := byteCode[ip+1]
+			rs := byteCode[ip+2]
+			offset := byteCode[ip+3]
+			if rd != 0 {
+				vm.registers.Write(rd, int32(ip+4))
+			}
+			ip = int(vm.registers.Read(rs)) + offset
+		}
+	}
+}
+
+// countdownLoop sums 1..n into x1.
+func countdownLoop(n int) ByteCode {
+	return ByteCode{
+		int(opcodes.ADDI), 1, 0, 0,
+		int(opcodes.ADDI), 2, 0, n,
+		int(opcodes.ADD), 1, 1, 2,
+		int(opcodes.ADDI), 2, 2, -1,
+		int(opcodes.BNE), 2, 0, -8,
+	}
+}
+
+// arrayLoop fills n words of memory with i*i and sums them back up into x5.
+func arrayLoop(n int) ByteCode {
+	return ByteCode{
+		int(opcodes.ADDI), 1, 0, 0,
+		int(opcodes.ADDI), 2, 0, n,
+		int(opcodes.ADDI), 3, 0, 0,
+		int(opcodes.MUL), 4, 1, 1,
+		int(opcodes.SW), 4, 0, 3,
+		int(opcodes.ADDI), 3, 3, 4,
+		int(opcodes.ADDI), 1, 1, 1,
+		int(opcodes.BLT), 1, 2, -16,
+		int(opcodes.ADDI), 5, 0, 0,
+		int(opcodes.LW), 4, -4, 3,
+		int(opcodes.ADD), 5, 5, 4,
+		int(opcodes.ADDI), 3, 3, -4,
+		int(opcodes.BNE), 3, 0, -12,
+	}
+}
+
+// gcdLoop runs Euclid's algorithm over pairs of numbers n times.
+func gcdLoop(n int) ByteCode {
+	return ByteCode{
+		int(opcodes.ADDI), 10, 0, n,
+		int(opcodes.ADDI), 1, 10, 1071,
+		int(opcodes.ADDI), 2, 0, 462,
+		int(opcodes.MOD), 3, 1, 2,
+		int(opcodes.ADD), 1, 2, 0,
+		int(opcodes.ADD), 2, 3, 0,
+		int(opcodes.BNE), 2, 0, -12,
+		int(opcodes.ADDI), 10, 10, -1,
+		int(opcodes.BNE), 10, 0, -28,
+	}
+}
+
+var benchmarkPrograms = []struct {
+	name     string
+	bytecode ByteCode
+}{
+	{"countdown", countdownLoop(10_000)},
+	{"array", arrayLoop(200)},
+	{"gcd", gcdLoop(1_000)},
+}
+
+func TestSwitchAndDecodedExecutionAgree(t *testing.T) {
+	for _, p := range benchmarkPrograms {
+		t.Run(p.name, func(t *testing.T) {
+			switchRegs := registers.NewRegisters()
+			decodedRegs := registers.NewRegisters()
+			NewVM(switchRegs, memory.NewMemory(1024)).switchExecute(p.bytecode)
+			NewVM(decodedRegs, memory.NewMemory(1024)).Execute(p.bytecode)
+			for r := range 32 {
+				if switchRegs.Read(r) != decodedRegs.Read(r) {
+					t.Errorf("x%d: switch interpreter has %d, decoded has %d", r, switchRegs.Read(r), decodedRegs.Read(r))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExecute(b *testing.B) {
+	for _, p := range benchmarkPrograms {
+		b.Run(p.name, func(b *testing.B) {
+			vm := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+			for b.Loop() {
+				vm.Execute(p.bytecode)
+			}
+		})
+	}
+}
+
+// BenchmarkStackAndRegisterExecute sums the same range on both machines, so
+// the cost of keeping values on the stack shows up next to keeping them in
+// registers.
+func BenchmarkStackAndRegisterExecute(b *testing.B) {
+	b.Run("register", func(b *testing.B) {
+		vm := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+		program := countdownLoop(10_000)
+		for b.Loop() {
+			vm.Execute(program)
+		}
+	})
+	b.Run("stack", func(b *testing.B) {
+		s := NewStackVM()
+		program := stackCountdown(10_000)
+		for b.Loop() {
+			s.stack = s.stack[:0]
+			s.Execute(program)
+		}
+	})
+}
+
+func BenchmarkSwitchExecute(b *testing.B) {
+	for _, p := range benchmarkPrograms {
+		b.Run(p.name, func(b *testing.B) {
+			vm := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+			for b.Loop() {
+				vm.switchExecute(p.bytecode)
+			}
+		})
+	}
+}
+
+// BenchmarkSpeedup runs each program on Execute and on the switch interpreter
+// in turn and reports how many times faster Execute was, so that the ratio
+// holds up on a machine whose speed drifts between one benchmark and the next.
+func BenchmarkSpeedup(b *testing.B) {
+	for _, p := range benchmarkPrograms {
+		b.Run(p.name, func(b *testing.B) {
+			decoded := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+			switched := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+			var inDecoded, inSwitch time.Duration
+			for b.Loop() {
+				start := time.Now()
+				decoded.Execute(p.bytecode)
+				inDecoded += time.Since(start)
+				start = time.Now()
+				switched.switchExecute(p.bytecode)
+				inSwitch += time.Since(start)
+			}
+			b.ReportMetric(float64(inSwitch)/float64(inDecoded), "x")
+		})
+	}
+}
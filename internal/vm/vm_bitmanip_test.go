@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitManipulation(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a        int32
+		b        int
+		expected int32
+		message  string
+	}{
+		{"clz", opcodes.CLZ, 0x00F0_0000, 0, 8, "should count the zeros above the top set bit"},
+		{"clz of zero", opcodes.CLZ, 0, 0, 32, "every bit of zero is a leading zero"},
+		{"ctz", opcodes.CTZ, 0x50, 0, 4, "should count the zeros below the lowest set bit"},
+		{"ctz of zero", opcodes.CTZ, 0, 0, 32, "every bit of zero is a trailing zero"},
+		{"cpop", opcodes.CPOP, -1, 0, 32, "every bit of -1 is set"},
+		{"sext.b", opcodes.SEXTB, 0x1F0, 0, -16, "should sign-extend the low byte"},
+		{"sext.h", opcodes.SEXTH, 0x18000, 0, -32768, "should sign-extend the low halfword"},
+		{"zext.h", opcodes.ZEXTH, -1, 0, 0xFFFF, "should zero-extend the low halfword"},
+		{"min", opcodes.MIN, -3, 2, -3, "should compare signed"},
+		{"max", opcodes.MAX, -3, 2, 2, "should compare signed"},
+		{"minu", opcodes.MINU, -3, 2, 2, "-3 is a large unsigned number"},
+		{"maxu", opcodes.MAXU, -3, 2, -3, "-3 is a large unsigned number"},
+		{"rol", opcodes.ROL, -0x8000_0000, 33, 1, "should rotate by the low five bits of rs2"},
+		{"ror", opcodes.ROR, 1, 1, -0x8000_0000, "the low bit should wrap round to the top"},
+		{"andn", opcodes.ANDN, 0xFF, 0x0F, 0xF0, "should clear the bits set in rs2"},
+		{"orn", opcodes.ORN, 0, -2, 1, "should set the bits clear in rs2"},
+		{"xnor", opcodes.XNOR, 0x0F, 0x0F, -1, "equal bits should give ones"},
+		{"sh1add", opcodes.SH1ADD, 5, 1, 11, "should add rs1 shifted by one"},
+		{"sh2add", opcodes.SH2ADD, 5, 1, 21, "should add rs1 shifted by two"},
+		{"sh3add", opcodes.SH3ADD, 5, 1, 41, "should add rs1 shifted by three"},
+		{"bset", opcodes.BSET, 0, 31, -0x8000_0000, "should set the bit rs2 numbers"},
+		{"bclr", opcodes.BCLR, -1, 32, -2, "bit numbers should wrap at 32"},
+		{"binv", opcodes.BINV, 0x10, 4, 0, "should flip the bit rs2 numbers"},
+		{"bext", opcodes.BEXT, 0x10, 4, 1, "should move the bit rs2 numbers down to bit 0"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			vm := NewVM(rs, memory.NewMemory(1024))
+			rs.Write(2, tc.a)
+			rs.Write(3, int32(tc.b))
+
+			err := vm.Execute(ByteCode{int(tc.op), 1, 2, 3})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rs.Read(1), tc.message)
+		})
+	}
+}
+
+func TestBitManipulationImmediates(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		shamt    int
+		expected int32
+	}{
+		{"rori", opcodes.RORI, 4, 7},
+		{"bseti", opcodes.BSETI, 0, 0x71},
+		{"bclri", opcodes.BCLRI, 4, 0x60},
+		{"binvi", opcodes.BINVI, 7, 0xF0},
+		{"bexti", opcodes.BEXTI, 5, 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			vm := NewVM(rs, memory.NewMemory(1024))
+			rs.Write(2, 0x70)
+
+			err := vm.Execute(ByteCode{
+				int(tc.op), 1, 2, tc.shamt,
+				int(tc.op), 0, 2, tc.shamt,
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rs.Read(1))
+			assert.Equal(t, int32(0), rs.Read(0), "x0 should stay zero")
+		})
+	}
+}
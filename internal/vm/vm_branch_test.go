@@ -260,3 +260,88 @@ func TestJALRJumpsToOffestPlusAddrAndSavesNextAddrToX6(t *testing.T) {
 
 	assert.Equal(t, expectedVal, actualVal, "x6 should have jump ip=24 after JALR executes")
 }
+
+func TestJumpStraightToBranchAfterCounter(t *testing.T) {
+	/*	sampleAsm:
+		addi x1, x0, 3  # IP=0
+		jal x0, 8       # IP=4: jump past the counter straight to the branch
+		addi x2, x2, 1  # IP=8: counter, runs together with the branch after it
+		bne x1, x2, -4  # IP=12: loop back to the counter until x2 reaches x1
+	*/
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 3,
+		int(opcodes.JAL), 0, 0, 8,
+		int(opcodes.ADDI), 2, 2, 1,
+		int(opcodes.BNE), 1, 2, -4,
+	}
+
+	for _, trace := range []bool{false, true} {
+		rs := registers.NewRegisters()
+		mem := memory.NewMemory(1024)
+		vm := NewVM(rs, mem)
+		if trace {
+			vm.EnableTrace()
+		}
+		vm.Execute(bytecode)
+
+		assert.Equal(t, int32(3), rs.Read(2), "branch should run on its own when jumped to directly (trace %v)", trace)
+	}
+}
+
+func TestUnsignedBranches(t *testing.T) {
+	cases := []struct {
+		name    string
+		op      opcodes.OpCode
+		a, b    int
+		taken   bool
+		message string
+	}{
+		{"bltu taken", opcodes.BLTU, 1, 2, true, "bltu should branch when rs1 is below rs2"},
+		{"bltu negative is large", opcodes.BLTU, 1, -1, true, "bltu should treat -1 as the largest value"},
+		{"bltu not taken", opcodes.BLTU, -1, 1, false, "bltu should not branch when rs1 is above rs2 unsigned"},
+		{"bltu equal", opcodes.BLTU, 7, 7, false, "bltu should not branch on equal values"},
+		{"bgeu taken", opcodes.BGEU, -2048, 5, true, "bgeu should compare unsigned"},
+		{"bgeu equal", opcodes.BGEU, 7, 7, true, "bgeu should branch on equal values"},
+		{"bgeu not taken", opcodes.BGEU, 0, -1, false, "bgeu should not branch when rs1 is below rs2 unsigned"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+
+			bytecode := ByteCode{
+				int(opcodes.ADDI), 1, 0, tc.a,
+				int(opcodes.ADDI), 2, 0, tc.b,
+				int(tc.op), 1, 2, 8,
+				int(opcodes.ADDI), 3, 0, 1,
+			}
+
+			vm.Execute(bytecode)
+
+			assert.Equal(t, tc.taken, rs.Read(3) == 0, tc.message)
+		})
+	}
+}
+
+func TestUnsignedBranchAfterCounter(t *testing.T) {
+	/*	sampleAsm:
+		addi x1, x0, 5   # IP=0
+		addi x2, x2, 1   # IP=4: counter, fused with the branch after it
+		bltu x2, x1, -4  # IP=8: loop until x2 reaches x1
+	*/
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 5,
+		int(opcodes.ADDI), 2, 2, 1,
+		int(opcodes.BLTU), 2, 1, -4,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(5), rs.Read(2), "a fused counter and bltu should loop until the counter reaches the bound")
+}
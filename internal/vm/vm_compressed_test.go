@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+// compressed is the two slots of a compressed instruction standing for the
+// base instruction with operands inst.
+func compressed(op opcodes.OpCode, inst ...int) []int {
+	info, _ := opcodes.ByOpCode(op)
+	return []int{int(op), info.Pack([4]int(append([]int{int(info.Base)}, inst...)))}
+}
+
+// mixed joins instructions of both sizes into one program.
+func mixed(parts ...[]int) ByteCode {
+	var byteCode ByteCode
+	for _, part := range parts {
+		byteCode = append(byteCode, part...)
+	}
+	return byteCode
+}
+
+func TestCompressedInstructionsRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		byteCode ByteCode
+		reg      int
+		expected int32
+	}{
+		{"c.li", mixed(compressed(opcodes.CLI, 8, 0, -5)), 8, -5},
+		{"c.lui", mixed(compressed(opcodes.CLUI, 8, 0, 0xFFFFF)), 8, -4096},
+		{"c.addi16sp", mixed(compressed(opcodes.CADDI16SP, 2, 2, -32)), 2, -32},
+		{"c.srai", mixed(compressed(opcodes.CLI, 8, 0, -8), compressed(opcodes.CSRAI, 8, 8, 2)), 8, -2},
+		{"c.mv", mixed(compressed(opcodes.CLI, 9, 0, 7), compressed(opcodes.CMV, 8, 0, 9)), 8, 7},
+		{"c.sw and c.lw", mixed(
+			compressed(opcodes.CLI, 8, 0, 9),
+			compressed(opcodes.CLI, 9, 0, 16),
+			compressed(opcodes.CSW, 8, 4, 9),
+			compressed(opcodes.CLW, 10, 4, 9),
+		), 10, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			vm := NewVM(rs, memory.NewMemory(1024))
+
+			err := vm.Execute(tt.byteCode)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, rs.Read(tt.reg))
+		})
+	}
+}
+
+func TestCompressedBranchesCountInBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		byteCode ByteCode
+	}{
+		{"compressed loop", mixed(
+			compressed(opcodes.CLI, 8, 0, 5),
+			compressed(opcodes.CADD, 9, 9, 8),
+			compressed(opcodes.CADDI, 8, 8, -1),
+			compressed(opcodes.CBNEZ, 8, 0, -4),
+		)},
+		{"full counter, compressed branch", mixed(
+			[]int{int(opcodes.ADDI), 8, 0, 5},
+			compressed(opcodes.CADD, 9, 9, 8),
+			[]int{int(opcodes.ADDI), 8, 8, -1},
+			compressed(opcodes.CBNEZ, 8, 0, -6),
+		)},
+		{"compressed counter, full branch", mixed(
+			compressed(opcodes.CLI, 8, 0, 5),
+			[]int{int(opcodes.ADD), 9, 9, 8},
+			compressed(opcodes.CADDI, 8, 8, -1),
+			[]int{int(opcodes.BNE), 8, 0, -6},
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			vm := NewVM(rs, memory.NewMemory(1024))
+
+			err := vm.Execute(tt.byteCode)
+
+			assert.NoError(t, err)
+			assert.Equal(t, int32(15), rs.Read(9), "the loop should sum 5 down to 1")
+		})
+	}
+}
+
+func TestCompressedJumpsLinkTwoBytesOn(t *testing.T) {
+	rs := registers.NewRegisters()
+	vm := NewVM(rs, memory.NewMemory(1024))
+
+	err := vm.Execute(mixed(
+		compressed(opcodes.CJAL, 1, 0, 4),
+		compressed(opcodes.CLI, 10, 0, 1),
+		[]int{int(opcodes.ADDI), 5, 0, 12},
+		compressed(opcodes.CJR, 0, 5, 0),
+		compressed(opcodes.CLI, 11, 0, 1),
+		compressed(opcodes.CLI, 12, 0, 1),
+	))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), rs.Read(1), "c.jal should link the address of the next instruction")
+	assert.Equal(t, int32(0), rs.Read(10), "c.jal should skip the instruction after it")
+	assert.Equal(t, int32(0), rs.Read(11), "c.jr should skip to the address in its register")
+	assert.Equal(t, int32(1), rs.Read(12), "c.jr should land on a two-byte boundary")
+}
+
+func TestTrapsReportByteAddressesInMixedCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		byteCode ByteCode
+		ip       int
+	}{
+		{"after a compressed instruction", mixed(compressed(opcodes.CNOP, 0, 0, 0), []int{999, 0, 0, 0}), 2},
+		{"cut short", mixed(compressed(opcodes.CNOP, 0, 0, 0), []int{int(opcodes.ADDI), 1}), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+
+			err := vm.Execute(tt.byteCode)
+
+			var trap *Trap
+			assert.ErrorAs(t, err, &trap)
+			assert.Equal(t, uint32(CauseIllegalInstruction), trap.Cause)
+			assert.Equal(t, tt.ip, trap.IP)
+		})
+	}
+}
+
+func TestMretReturnsToTheCompressedInstructionAfterTheTrap(t *testing.T) {
+	rs := registers.NewRegisters()
+	vm := NewVM(rs, memory.NewMemory(1024))
+
+	// The handler at 16 steps mepc over the illegal instruction at 8 and
+	// returns to the c.li at 12.
+	err := vm.Execute(mixed(
+		[]int{int(opcodes.ADDI), 5, 0, 16},
+		[]int{int(opcodes.CSRRW), 0, int(opcodes.MTVEC), 5},
+		[]int{999, 0, 0, 0},
+		compressed(opcodes.CLI, 10, 0, 1),
+		compressed(opcodes.CJ, 0, 0, 16),
+		[]int{int(opcodes.CSRRS), 6, int(opcodes.MEPC), 0},
+		compressed(opcodes.CADDI, 6, 6, 4),
+		[]int{int(opcodes.CSRRW), 0, int(opcodes.MEPC), 6},
+		[]int{int(opcodes.MRET), 0, 0, 0},
+	))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(12), rs.Read(6), "mepc should have been 8, the byte address of the illegal instruction")
+	assert.Equal(t, int32(1), rs.Read(10), "mret should resume at the compressed instruction after it")
+}
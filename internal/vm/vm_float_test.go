@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/fpu"
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFloatVM() (*vm, *registers.Registers, *registers.FloatRegisters) {
+	rs := registers.NewRegisters()
+	vm := NewVM(rs, memory.NewMemory(1024))
+	return vm, rs, vm.Floats()
+}
+
+func single(x float32) uint32 {
+	return math.Float32bits(x)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       opcodes.OpCode
+		a, b     float32
+		expected float32
+	}{
+		{"fadd.s", opcodes.FADDS, 1.5, 2.25, 3.75},
+		{"fsub.s", opcodes.FSUBS, 1.5, 2.25, -0.75},
+		{"fmul.s", opcodes.FMULS, 1.5, -4, -6},
+		{"fdiv.s", opcodes.FDIVS, 1, 4, 0.25},
+		{"fmin.s", opcodes.FMINS, 1, -4, -4},
+		{"fmax.s", opcodes.FMAXS, 1, -4, 1},
+		{"fsgnj.s", opcodes.FSGNJS, 1.5, -4, -1.5},
+		{"fsgnjn.s", opcodes.FSGNJNS, 1.5, -4, 1.5},
+		{"fsgnjx.s", opcodes.FSGNJXS, -1.5, -4, 1.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, _, fs := newFloatVM()
+			fs.WriteSingle(1, single(tt.a))
+			fs.WriteSingle(2, single(tt.b))
+
+			err := vm.Execute(ByteCode{int(tt.op), 3, 1, 2})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, math.Float32frombits(fs.ReadSingle(3)))
+			assert.Equal(t, uint64(0xFFFF_FFFF), fs.Read(3)>>32, "a single result should be NaN-boxed")
+		})
+	}
+}
+
+func TestDoubleArithmetic(t *testing.T) {
+	vm, rs, fs := newFloatVM()
+	fs.Write(1, math.Float64bits(2))
+	fs.Write(2, math.Float64bits(0.1))
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.FSQRTD), 3, 1, int(fpu.DYN),
+		int(opcodes.FMULD), 4, 2, 3,
+		int(opcodes.FLTD), 5, 2, 3,
+		int(opcodes.FCVTSD), 6, 3, int(fpu.DYN),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, math.Sqrt2, math.Float64frombits(fs.Read(3)))
+	tenth, root := 0.1, math.Sqrt2
+	assert.Equal(t, tenth*root, math.Float64frombits(fs.Read(4)))
+	assert.Equal(t, int32(1), rs.Read(5))
+	assert.Equal(t, float32(math.Sqrt2), math.Float32frombits(fs.ReadSingle(6)))
+}
+
+func TestFloatLoadsAndStores(t *testing.T) {
+	vm, rs, fs := newFloatVM()
+	fs.Write(1, math.Float64bits(-2.5))
+	fs.WriteSingle(2, single(0.5))
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.FSD), 1, 16, 0,
+		int(opcodes.FSW), 2, 24, 0,
+		int(opcodes.FLD), 3, 16, 0,
+		int(opcodes.FLW), 4, 24, 0,
+		int(opcodes.LW), 5, 24, 0,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, -2.5, math.Float64frombits(fs.Read(3)))
+	assert.Equal(t, float32(0.5), math.Float32frombits(fs.ReadSingle(4)))
+	assert.Equal(t, int32(single(0.5)), rs.Read(5), "fsw should store the single's bits")
+}
+
+func TestFloatConversionsAndMoves(t *testing.T) {
+	vm, rs, fs := newFloatVM()
+	fs.WriteSingle(1, single(-2.5))
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.FCVTWS), 2, 1, int(fpu.RTZ),
+		int(opcodes.FCVTWS), 3, 1, int(fpu.RDN),
+		int(opcodes.FCVTWUS), 4, 1, int(fpu.RTZ),
+		int(opcodes.ADDI), 5, 0, -7,
+		int(opcodes.FCVTSWU), 2, 5, int(fpu.DYN),
+		int(opcodes.FCVTSW), 3, 5, int(fpu.DYN),
+		int(opcodes.FMVXW), 6, 1, 0,
+		int(opcodes.FMVWX), 4, 6, 0,
+		int(opcodes.FCLASSS), 7, 4, 0,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(-2), rs.Read(2))
+	assert.Equal(t, int32(-3), rs.Read(3))
+	assert.Equal(t, int32(0), rs.Read(4), "a negative value converts to 0 unsigned")
+	assert.Equal(t, float32(4294967289), math.Float32frombits(fs.ReadSingle(2)))
+	assert.Equal(t, float32(-7), math.Float32frombits(fs.ReadSingle(3)))
+	assert.Equal(t, int32(single(-2.5)), rs.Read(6))
+	assert.Equal(t, single(-2.5), fs.ReadSingle(4))
+	assert.Equal(t, int32(1<<1), rs.Read(7), "-2.5 is a negative normal")
+}
+
+func TestFloatFlagsAccrueInFflags(t *testing.T) {
+	vm, rs, fs := newFloatVM()
+	fs.WriteSingle(1, single(1))
+	fs.WriteSingle(2, 0)
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.FDIVS), 3, 1, 2,
+		int(opcodes.FLTS), 4, 3, 3,
+		int(opcodes.CSRRS), 5, int(opcodes.FFLAGS), 0,
+		int(opcodes.FDIVS), 3, 2, 2,
+		int(opcodes.CSRRS), 6, int(opcodes.FFLAGS), 0,
+		int(opcodes.CSRRW), 0, int(opcodes.FFLAGS), 0,
+		int(opcodes.CSRRS), 7, int(opcodes.FFLAGS), 0,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(fpu.DivideByZero), rs.Read(5), "1/0 divides by zero and inf < inf is false but valid")
+	assert.Equal(t, int32(fpu.DivideByZero|fpu.Invalid), rs.Read(6), "0/0 is invalid and flags accrue")
+	assert.Equal(t, int32(0), rs.Read(7), "writing fflags clears them")
+	assert.Equal(t, uint32(0x7FC00000), fs.ReadSingle(3), "0/0 gives the canonical NaN")
+}
+
+func TestFrmSetsTheDynamicRoundingMode(t *testing.T) {
+	vm, rs, fs := newFloatVM()
+	fs.WriteSingle(1, single(1))
+	fs.WriteSingle(2, single(3))
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.FDIVS), 3, 1, 2,
+		int(opcodes.ADDI), 1, 0, int(fpu.RUP),
+		int(opcodes.CSRRW), 0, int(opcodes.FRM), 1,
+		int(opcodes.FDIVS), 4, 1, 2,
+		int(opcodes.CSRRS), 5, int(opcodes.FCSR), 0,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x3EAAAAAB), fs.ReadSingle(3), "a third rounds up to nearest")
+	assert.Equal(t, uint32(0x3EAAAAAB), fs.ReadSingle(4))
+	fs.WriteSingle(1, single(2))
+	assert.NoError(t, vm.Execute(ByteCode{int(opcodes.FDIVS), 4, 1, 2}))
+	assert.Equal(t, uint32(0x3F2AAAAB), fs.ReadSingle(4), "two thirds round up only in rup")
+	assert.Equal(t, int32(int(fpu.RUP)<<5|int(fpu.Inexact)), rs.Read(5), "fcsr holds frm above fflags")
+}
+
+func TestInvalidRoundingModesAreIllegal(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytecode ByteCode
+		expected Trap
+	}{
+		{
+			"reserved static mode",
+			ByteCode{int(opcodes.FSQRTS), 1, 1, 5},
+			Trap{Cause: CauseIllegalInstruction, Value: uint32(opcodes.FSQRTS), IP: 0},
+		},
+		{
+			"reserved mode in frm",
+			ByteCode{
+				int(opcodes.CSRRWI), 0, int(opcodes.FRM), 6,
+				int(opcodes.FADDS), 1, 1, 1,
+			},
+			Trap{Cause: CauseIllegalInstruction, Value: uint32(opcodes.FRM), IP: 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, _, _ := newFloatVM()
+
+			err := vm.Execute(tt.bytecode)
+
+			assert.Equal(t, &tt.expected, err)
+		})
+	}
+}
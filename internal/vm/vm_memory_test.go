@@ -77,3 +77,70 @@ func TestLoadStoreOverwrite(t *testing.T) {
 
 	assert.Equal(t, int32(99), rs.Read(2), "second store should overwrite first value")
 }
+
+func TestSubWordLoadsExtend(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		offset   int
+		expected int32
+		message  string
+	}{
+		{"lb", opcodes.LB, 0, -2, "lb should sign-extend the byte"},
+		{"lbu", opcodes.LBU, 0, 0xFE, "lbu should zero-extend the byte"},
+		{"lb positive", opcodes.LB, 1, 0x7F, "lb should leave a positive byte alone"},
+		{"lh", opcodes.LH, 2, -0x7EDC, "lh should sign-extend the halfword"},
+		{"lhu", opcodes.LHU, 2, 0x8124, "lhu should zero-extend the halfword"},
+		{"lh misaligned", opcodes.LH, 1, 0x247F, "lh should read any two consecutive bytes"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+			mem.StoreWord(16, -0x7EDB8002)
+
+			bytecode := ByteCode{
+				int(opcodes.ADDI), 2, 0, 16,
+				int(tc.op), 1, tc.offset, 2,
+			}
+
+			vm.Execute(bytecode)
+
+			assert.Equal(t, tc.expected, rs.Read(1), tc.message)
+		})
+	}
+}
+
+func TestSubWordStoresWriteOnlyTheirBytes(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+	mem.StoreWord(0, -1)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 0x234,
+		int(opcodes.SB), 1, 0, 0,
+		int(opcodes.SH), 1, 2, 0,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(0x0234FF34), mem.LoadWord(0), "sb and sh should replace only the low byte and halfword of rs2")
+}
+
+func TestSubWordAccessOutsideMemoryFaults(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 2, 0, 1023,
+		int(opcodes.LH), 1, 0, 2,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.Equal(t, &Trap{Cause: CauseLoadAccessFault, Value: 1023, IP: 4}, err, "a halfword straddling the end of memory should fault")
+}
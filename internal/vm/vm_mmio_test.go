@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/phasecurve/zhuji/internal/uart"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgramPrintsThroughUART(t *testing.T) {
+	var out bytes.Buffer
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+	assert.NoError(t, vm.Attach(uart.Base, uart.Size, uart.New(&out, nil)))
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, uart.Base,
+		int(opcodes.ADDI), 2, 0, 'h',
+		int(opcodes.SW), 2, 0, 1,
+		int(opcodes.ADDI), 2, 0, 'i',
+		int(opcodes.SW), 2, 0, 1,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", out.String(), "stores to THR should reach the host writer")
+}
+
+func TestProgramEchoesUARTInput(t *testing.T) {
+	var out bytes.Buffer
+	mem := memory.NewMemory(1024)
+	vm := NewVM(registers.NewRegisters(), mem)
+	vm.Attach(uart.Base, uart.Size, uart.New(&out, strings.NewReader("echo")))
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, uart.Base,
+		int(opcodes.ADDI), 4, 0, 0x61, // IP=4: LSR with data ready and THR empty
+		int(opcodes.LW), 3, 5 << 2, 1, // IP=8: read LSR
+		int(opcodes.BNE), 3, 4, 16, // IP=12: stop once no data is ready
+		int(opcodes.LW), 2, 0, 1, // IP=16: read RBR
+		int(opcodes.SW), 2, 0, 1, // IP=20: write THR
+		int(opcodes.JAL), 0, 0, -16,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "echo", out.String(), "every byte received should be sent back")
+}
+
+func TestStoreToUnmappedDeviceAddressFaults(t *testing.T) {
+	mem := memory.NewMemory(1024)
+	vm := NewVM(registers.NewRegisters(), mem)
+	vm.Attach(uart.Base, uart.Size, uart.New(nil, nil))
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, uart.Base + uart.Size,
+		int(opcodes.SW), 0, 0, 1,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.Equal(t, &Trap{Cause: CauseStoreAccessFault, Value: uart.Base + uart.Size, IP: 4}, err,
+		"a store just past the UART should fault")
+}
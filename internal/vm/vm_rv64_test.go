@@ -0,0 +1,165 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRV64Arithmetic(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       opcodes.OpCode
+		a, b     int64
+		expected int64
+		message  string
+	}{
+		{"add", opcodes.ADD, math.MaxInt32, 1, math.MaxInt32 + 1, "RV64 should not wrap at 32 bits"},
+		{"addw", opcodes.ADDW, math.MaxInt32, 1, math.MinInt32, "addw should wrap at 32 bits and sign-extend"},
+		{"subw", opcodes.SUBW, 1 << 32, 1, -1, "subw should ignore the upper words"},
+		{"sll", opcodes.SLL, 1, 63, math.MinInt64, "RV64 shifts should take six bits"},
+		{"sllw", opcodes.SLLW, 1, 31, math.MinInt32, "sllw should sign-extend bit 31"},
+		{"srl", opcodes.SRL, -1, 60, 15, "srl should shift zeros in at bit 63"},
+		{"srlw", opcodes.SRLW, -1, 28, 15, "srlw should shift zeros in at bit 31"},
+		{"sraw", opcodes.SRAW, 0x8000_0000, 4, -0x0800_0000, "sraw should shift copies of bit 31 in"},
+		{"sltu", opcodes.SLTU, 1, -1, 1, "-1 is the largest unsigned doubleword"},
+		{"mul", opcodes.MUL, 1 << 32, 1 << 20, 1 << 52, "mul should keep 64 bits"},
+		{"mulw", opcodes.MULW, 1 << 16, 1 << 15, math.MinInt32, "mulw should keep 32 bits, sign-extended"},
+		{"mulh", opcodes.MULH, -1, -1, 0, "-1 × -1 is 1, whose upper doubleword is 0"},
+		{"mulhu", opcodes.MULHU, -1, -1, -2, "(2^64-1)^2 = 2^128 - 2^65 + 1"},
+		{"mulhsu", opcodes.MULHSU, -1, -1, -1, "-1 × (2^64-1) is negative"},
+		{"div", opcodes.DIV, math.MinInt64, -1, math.MinInt64, "the overflowing quotient should wrap"},
+		{"div by zero", opcodes.DIV, 7, 0, -1, "the quotient of a division by zero has every bit set"},
+		{"divuw", opcodes.DIVUW, 1<<32 | 10, 3, 3, "divuw should divide the low words"},
+		{"remw", opcodes.REMW, -7, 1<<32 | 2, -1, "remw should take the sign of the dividend"},
+		{"remu by zero", opcodes.REMU, -7, 0, -7, "the remainder of a division by zero is the dividend"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters64()
+			vm := NewRV64VM(rs, memory.NewMemory(1024))
+			rs.Write(2, tc.a)
+			rs.Write(3, tc.b)
+
+			err := vm.Execute(ByteCode{int(tc.op), 1, 2, 3})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rs.Read(1), tc.message)
+		})
+	}
+}
+
+func TestRV64Immediates(t *testing.T) {
+	rs := registers.NewRegisters64()
+	vm := NewRV64VM(rs, memory.NewMemory(1024))
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.ADDI), 1, 0, -1,
+		int(opcodes.SRLI), 2, 1, 32,
+		int(opcodes.ADDIW), 3, 2, 1,
+		int(opcodes.SLLIW), 4, 1, 31,
+		int(opcodes.LUI), 5, 0, 0x80000,
+		int(opcodes.SLTIU), 6, 2, -1,
+		int(opcodes.ADDI), 0, 1, 5,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0xFFFF_FFFF), rs.Read(2), "srli should shift the whole doubleword")
+	assert.Equal(t, int64(0), rs.Read(3), "addiw should wrap 0xFFFFFFFF + 1 to 0")
+	assert.Equal(t, int64(math.MinInt32), rs.Read(4), "slliw should sign-extend its result")
+	assert.Equal(t, int64(math.MinInt32), rs.Read(5), "lui should sign-extend to 64 bits")
+	assert.Equal(t, int64(1), rs.Read(6), "sltiu should compare with the sign-extended immediate")
+	assert.Equal(t, int64(0), rs.Read(0), "x0 should stay zero")
+}
+
+func TestRV64LoadsAndStores(t *testing.T) {
+	rs := registers.NewRegisters64()
+	vm := NewRV64VM(rs, memory.NewMemory(1024))
+	rs.Write(1, -0x0123_4567_89AB_CDEF)
+	rs.Write(2, 16)
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.SD), 1, 8, 2,
+		int(opcodes.LD), 3, 8, 2,
+		int(opcodes.LW), 4, 8, 2,
+		int(opcodes.LWU), 5, 8, 2,
+		int(opcodes.LW), 6, 12, 2,
+		int(opcodes.SW), 1, 0, 2,
+		int(opcodes.LD), 7, 0, 2,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-0x0123_4567_89AB_CDEF), rs.Read(3), "ld should load what sd stored")
+	assert.Equal(t, int64(0x7654_3211), rs.Read(4), "lw should sign-extend the low word")
+	assert.Equal(t, int64(0x7654_3211), rs.Read(5), "lwu should zero-extend the low word")
+	assert.Equal(t, int64(-0x0123_4568), rs.Read(6), "the upper word should be stored above the lower one")
+	assert.Equal(t, int64(0x7654_3211), rs.Read(7), "sw should store only the low word")
+}
+
+func TestRV64LwuZeroExtends(t *testing.T) {
+	rs := registers.NewRegisters64()
+	vm := NewRV64VM(rs, memory.NewMemory(1024))
+	rs.Write(1, -2)
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.SW), 1, 0, 0,
+		int(opcodes.LW), 2, 0, 0,
+		int(opcodes.LWU), 3, 0, 0,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-2), rs.Read(2))
+	assert.Equal(t, int64(0xFFFF_FFFE), rs.Read(3))
+}
+
+func TestRV64BranchesCompareDoublewords(t *testing.T) {
+	rs := registers.NewRegisters64()
+	vm := NewRV64VM(rs, memory.NewMemory(1024))
+	rs.Write(1, 1<<32)
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.BEQ), 1, 0, 8,
+		int(opcodes.ADDI), 2, 0, 1,
+		int(opcodes.BLT), 0, 1, 8,
+		int(opcodes.ADDI), 3, 0, 1,
+		int(opcodes.JAL), 4, 0, 8,
+		int(opcodes.ADDI), 5, 0, 1,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), rs.Read(2), "2^32 is not zero, though its low word is")
+	assert.Equal(t, int64(0), rs.Read(3), "2^32 is greater than zero")
+	assert.Equal(t, int64(20), rs.Read(4), "jal should link the next address")
+	assert.Equal(t, int64(0), rs.Read(5), "jal should skip to its target")
+}
+
+func TestRV64TrapsOnOtherExtensions(t *testing.T) {
+	vm := NewRV64VM(registers.NewRegisters64(), memory.NewMemory(1024))
+
+	err := vm.Execute(ByteCode{
+		int(opcodes.ADDI), 1, 0, 1,
+		int(opcodes.FADDS), 1, 2, 3,
+	})
+
+	var trap *Trap
+	assert.ErrorAs(t, err, &trap)
+	assert.Equal(t, CauseIllegalInstruction, trap.Cause)
+	assert.Equal(t, 4, trap.IP)
+}
+
+func TestRV64LoadOutsideMemoryTraps(t *testing.T) {
+	rs := registers.NewRegisters64()
+	vm := NewRV64VM(rs, memory.NewMemory(1024))
+	rs.Write(1, 1<<40)
+
+	err := vm.Execute(ByteCode{int(opcodes.LD), 2, 0, 1})
+
+	var trap *Trap
+	assert.ErrorAs(t, err, &trap)
+	assert.Equal(t, CauseLoadAccessFault, trap.Cause)
+}
@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStackOperations(t *testing.T) {
+	psh := func(v int) []int { return []int{int(opcodes.PSH), 0, 0, v} }
+	op := func(o opcodes.OpCode) []int { return []int{int(o), 0, 0, 0} }
+	program := func(parts ...[]int) ByteCode {
+		var bc ByteCode
+		for _, p := range parts {
+			bc = append(bc, p...)
+		}
+		return bc
+	}
+
+	tests := []struct {
+		name     string
+		bytecode ByteCode
+		expected []int32
+	}{
+		{"psh", program(psh(1), psh(-2)), []int32{1, -2}},
+		{"dup", program(psh(7), op(opcodes.DUP)), []int32{7, 7}},
+		{"swp", program(psh(1), psh(2), op(opcodes.SWP)), []int32{2, 1}},
+		{"drp", program(psh(1), psh(2), op(opcodes.DRP)), []int32{1}},
+		{"add", program(psh(40), psh(2), op(opcodes.ADD)), []int32{42}},
+		{"sub", program(psh(40), psh(2), op(opcodes.SUB)), []int32{38}},
+		{"mul", program(psh(6), psh(7), op(opcodes.MUL)), []int32{42}},
+		{"div", program(psh(-7), psh(2), op(opcodes.DIV)), []int32{-3}},
+		{"div by zero", program(psh(7), psh(0), op(opcodes.DIV)), []int32{-1}},
+		{"div overflow", program(psh(math.MinInt32), psh(-1), op(opcodes.DIV)), []int32{math.MinInt32}},
+		{"lte true", program(psh(2), psh(2), op(opcodes.LTE)), []int32{1}},
+		{"lte false", program(psh(3), psh(2), op(opcodes.LTE)), []int32{0}},
+		{"gt true", program(psh(3), psh(2), op(opcodes.GT)), []int32{1}},
+		{"gt false", program(psh(-3), psh(2), op(opcodes.GT)), []int32{0}},
+		{"add wraps", program(psh(math.MaxInt32), psh(1), op(opcodes.ADD)), []int32{math.MinInt32}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStackVM()
+
+			err := s.Execute(tt.bytecode)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, s.Stack())
+		})
+	}
+}
+
+func TestStackJumps(t *testing.T) {
+	s := NewStackVM()
+
+	err := s.Execute(stackCountdown(5))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{15}, s.Stack(), "the loops should leave only the sum of 1..5")
+}
+
+func TestStackUnderflow(t *testing.T) {
+	bytecode := ByteCode{
+		int(opcodes.PSH), 0, 0, 1,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.PSH), 0, 0, 2,
+	}
+	s := NewStackVM()
+
+	err := s.Execute(bytecode)
+
+	assert.True(t, errors.Is(err, ErrStackUnderflow), "add with one value on the stack should underflow, got %v", err)
+	assert.EqualError(t, err, "stack underflow at ip 4: add needs 2 values and the stack holds 1")
+	assert.Equal(t, []int32{1}, s.Stack(), "execution should stop at the failing instruction")
+}
+
+func TestStackRejectsMalformedBytecode(t *testing.T) {
+	cases := []struct {
+		name     string
+		bytecode ByteCode
+		expected string
+	}{
+		{"partial instruction", ByteCode{int(opcodes.PSH), 0, 0, 1, int(opcodes.DUP), 0}, "bytecode of 6 slots is not a whole number of instructions"},
+		{"misaligned jump", ByteCode{int(opcodes.PSH), 0, 0, 1, int(opcodes.JNZ), 0, 0, -2}, "at ip 4: jnz target 2 is not an instruction of the program"},
+		{"jump past the end", ByteCode{int(opcodes.JMP), 0, 0, 8}, "at ip 0: jmp target 8 is not an instruction of the program"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewStackVM()
+
+			err := s.Execute(tc.bytecode)
+
+			assert.EqualError(t, err, tc.expected)
+			assert.Empty(t, s.Stack(), "nothing should run")
+		})
+	}
+}
+
+func TestStackRejectsRegisterInstructions(t *testing.T) {
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 5,
+	}
+	s := NewStackVM()
+
+	err := s.Execute(bytecode)
+
+	var trap *Trap
+	assert.True(t, errors.As(err, &trap), "expected a trap, got %v", err)
+	assert.Equal(t, CauseIllegalInstruction, trap.Cause)
+	assert.Equal(t, uint32(opcodes.ADDI), trap.Value)
+}
+
+func TestStackCarriesOverBetweenExecutions(t *testing.T) {
+	s := NewStackVM()
+
+	s.Execute(ByteCode{int(opcodes.PSH), 0, 0, 20})
+	err := s.Execute(ByteCode{int(opcodes.PSH), 0, 0, 22, int(opcodes.ADD), 0, 0, 0})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{42}, s.Stack())
+}
+
+// stackCountdown sums 1..n the way countdownLoop does, but on the stack: the
+// first loop pushes n down to 0 above a 0 that marks the bottom, and the
+// second adds the values up until it swaps that marker to the top.
+func stackCountdown(n int) ByteCode {
+	return ByteCode{
+		int(opcodes.PSH), 0, 0, 0,
+		int(opcodes.PSH), 0, 0, n,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.PSH), 0, 0, -1,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.JNZ), 0, 0, -16,
+		int(opcodes.DRP), 0, 0, 0,
+		int(opcodes.SWP), 0, 0, 0,
+		int(opcodes.DUP), 0, 0, 0,
+		int(opcodes.JZ), 0, 0, 12,
+		int(opcodes.ADD), 0, 0, 0,
+		int(opcodes.JMP), 0, 0, -16,
+		int(opcodes.DRP), 0, 0, 0,
+	}
+}
+
+func TestStackAndRegisterCountdownsAgree(t *testing.T) {
+	rs := registers.NewRegisters()
+	NewVM(rs, memory.NewMemory(1024)).Execute(countdownLoop(10_000))
+	s := NewStackVM()
+
+	err := s.Execute(stackCountdown(10_000))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{rs.Read(1)}, s.Stack())
+}
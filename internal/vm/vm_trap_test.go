@@ -0,0 +1,298 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/opcodes"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRReadWriteSetClear(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 0b1100,
+		int(opcodes.CSRRW), 0, int(opcodes.MSCRATCH), 1,
+		int(opcodes.ADDI), 2, 0, 0b0011,
+		int(opcodes.CSRRS), 3, int(opcodes.MSCRATCH), 2,
+		int(opcodes.CSRRC), 4, int(opcodes.MSCRATCH), 1,
+		int(opcodes.CSRRWI), 5, int(opcodes.MSCRATCH), 31,
+		int(opcodes.CSRRSI), 6, int(opcodes.MSCRATCH), 0,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0b1100), rs.Read(3), "csrrs should return the value csrrw wrote")
+	assert.Equal(t, int32(0b1111), rs.Read(4), "csrrc should return the value with csrrs's bits set")
+	assert.Equal(t, int32(0b0011), rs.Read(5), "csrrwi should return the value with csrrc's bits cleared")
+	assert.Equal(t, int32(31), rs.Read(6), "csrrsi should return the immediate csrrwi wrote")
+}
+
+func TestCountersAdvanceWithRetiredInstructions(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 3,
+		int(opcodes.ADDI), 1, 1, -1,
+		int(opcodes.BNE), 1, 0, -4,
+		int(opcodes.CSRRS), 2, int(opcodes.INSTRET), 0,
+		int(opcodes.CSRRS), 3, int(opcodes.CYCLE), 0,
+		int(opcodes.CSRRS), 4, int(opcodes.TIME), 0,
+	}
+
+	vm.Execute(bytecode)
+
+	assert.Equal(t, int32(7), rs.Read(2), "instret should count every instruction retired before it")
+	assert.Equal(t, int32(8), rs.Read(3), "cycle should advance once per instruction")
+	assert.Equal(t, int32(9), rs.Read(4), "time should advance once per instruction")
+}
+
+func TestUnhandledTrapStopsExecution(t *testing.T) {
+	cases := []struct {
+		name     string
+		bytecode ByteCode
+		expected Trap
+		message  string
+	}{
+		{
+			"illegal opcode",
+			ByteCode{
+				int(opcodes.ADDI), 1, 0, 1,
+				999, 0, 0, 0,
+				int(opcodes.ADDI), 1, 0, 2,
+			},
+			Trap{Cause: CauseIllegalInstruction, Value: 999, IP: 4},
+			"an unknown opcode should raise an illegal instruction trap",
+		},
+		{
+			"write to read-only CSR",
+			ByteCode{
+				int(opcodes.ADDI), 1, 0, 1,
+				int(opcodes.CSRRW), 0, int(opcodes.MHARTID), 1,
+				int(opcodes.ADDI), 1, 0, 2,
+			},
+			Trap{Cause: CauseIllegalInstruction, Value: uint32(opcodes.MHARTID), IP: 4},
+			"writing a read-only CSR should raise an illegal instruction trap",
+		},
+		{
+			"load outside memory",
+			ByteCode{
+				int(opcodes.ADDI), 1, 0, 1,
+				int(opcodes.LW), 3, 2048, 0,
+				int(opcodes.ADDI), 1, 0, 2,
+			},
+			Trap{Cause: CauseLoadAccessFault, Value: 2048, IP: 4},
+			"loading from an unmapped address should raise a load access fault",
+		},
+		{
+			"store outside memory",
+			ByteCode{
+				int(opcodes.ADDI), 1, 0, 1,
+				int(opcodes.ADDI), 2, 0, -8,
+				int(opcodes.SW), 1, 0, 2,
+				int(opcodes.ADDI), 1, 0, 2,
+			},
+			Trap{Cause: CauseStoreAccessFault, Value: 0xFFFFFFF8, IP: 8},
+			"storing to an unmapped address should raise a store access fault",
+		},
+		{
+			"misaligned atomic",
+			ByteCode{
+				int(opcodes.ADDI), 1, 0, 1,
+				int(opcodes.ADDI), 2, 0, 2,
+				int(opcodes.AMOADDW), 3, 2, 0,
+				int(opcodes.ADDI), 1, 0, 2,
+			},
+			Trap{Cause: CauseStoreAddressMisaligned, Value: 2, IP: 8},
+			"a misaligned atomic should raise an address misaligned trap",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegisters()
+			mem := memory.NewMemory(1024)
+			vm := NewVM(rs, mem)
+
+			err := vm.Execute(tc.bytecode)
+
+			assert.Equal(t, &tc.expected, err, tc.message)
+			assert.Equal(t, int32(1), rs.Read(1), "nothing after the trapping instruction should run")
+		})
+	}
+}
+
+func TestIllegalInstructionHandledByGuest(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 20, // IP=0: handler address
+		int(opcodes.CSRRW), 0, int(opcodes.MTVEC), 1,
+		999, 0, 0, 0, // IP=8: illegal
+		int(opcodes.ADDI), 3, 0, 7, // IP=12: resumed here
+		int(opcodes.JAL), 0, 0, 28, // IP=16: jump past the handler to the end
+		int(opcodes.CSRRS), 5, int(opcodes.MCAUSE), 0, // IP=20: handler
+		int(opcodes.CSRRS), 6, int(opcodes.MEPC), 0,
+		int(opcodes.CSRRS), 7, int(opcodes.MTVAL), 0,
+		int(opcodes.ADDI), 6, 6, 4,
+		int(opcodes.CSRRW), 0, int(opcodes.MEPC), 6,
+		int(opcodes.MRET), 0, 0, 0,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.NoError(t, err, "a handled trap should not stop execution")
+	assert.Equal(t, int32(CauseIllegalInstruction), rs.Read(5), "mcause should record an illegal instruction")
+	assert.Equal(t, int32(12), rs.Read(6), "mepc should point at the illegal instruction before the handler moves it on")
+	assert.Equal(t, int32(999), rs.Read(7), "mtval should record the offending opcode")
+	assert.Equal(t, int32(7), rs.Read(3), "mret should resume at the updated mepc")
+}
+
+func TestHandlerAtAddressZero(t *testing.T) {
+	rs := registers.NewRegisters()
+	vm := NewVM(rs, memory.NewMemory(1024))
+
+	bytecode := ByteCode{
+		int(opcodes.CSRRS), 5, int(opcodes.MCAUSE), 0, // IP=0: handler, and where the program starts
+		int(opcodes.BNE), 5, 0, 16, // IP=4: leave once trapped
+		int(opcodes.CSRRW), 0, int(opcodes.MTVEC), 0, // IP=8: install the handler at 0
+		999, 0, 0, 0, // IP=12: illegal
+		int(opcodes.ADDI), 3, 0, 1,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.NoError(t, err, "writing 0 to mtvec should install a handler at address 0")
+	assert.Equal(t, int32(CauseIllegalInstruction), rs.Read(5))
+	assert.Equal(t, int32(0), rs.Read(3), "the illegal instruction should not fall through")
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	rs := registers.NewRegisters()
+	mem := memory.NewMemory(1024)
+	vm := NewVM(rs, mem)
+
+	bytecode := ByteCode{
+		int(opcodes.ADDI), 1, 0, 48, // IP=0: handler address
+		int(opcodes.CSRRW), 0, int(opcodes.MTVEC), 1,
+		int(opcodes.ADDI), 2, 0, clintBase + clintMtimecmp,
+		int(opcodes.ADDI), 3, 0, 30,
+		int(opcodes.SW), 3, 0, 2, // IP=16: mtimecmp = 30
+		int(opcodes.SW), 0, 4, 2,
+		int(opcodes.ADDI), 4, 0, opcodes.MTIE,
+		int(opcodes.CSRRS), 0, int(opcodes.MIE), 4,
+		int(opcodes.CSRRSI), 0, int(opcodes.MSTATUS), opcodes.MstatusMIE,
+		int(opcodes.ADDI), 5, 5, 1, // IP=36: spin until the timer fires
+		int(opcodes.BEQ), 0, 0, -4,
+		int(opcodes.ADDI), 9, 0, 1, // IP=44: never reached
+		int(opcodes.CSRRS), 6, int(opcodes.MCAUSE), 0, // IP=48: handler
+		int(opcodes.CSRRS), 7, int(opcodes.MSTATUS), 0,
+		int(opcodes.CSRRS), 8, int(opcodes.MIP), 0,
+		int(opcodes.LW), 10, clintMtime - clintMtimecmp, 2,
+	}
+
+	err := vm.Execute(bytecode)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(-0x80000000|7), rs.Read(6), "mcause should record a machine timer interrupt")
+	assert.Equal(t, int32(0), rs.Read(7)&opcodes.MstatusMIE, "interrupts should be disabled inside the handler")
+	assert.Equal(t, int32(opcodes.MstatusMPIE), rs.Read(7)&opcodes.MstatusMPIE, "the previous interrupt enable should be saved in MPIE")
+	assert.Equal(t, int32(opcodes.MTIP), rs.Read(8), "the timer interrupt should be pending")
+	assert.GreaterOrEqual(t, rs.Read(10), int32(30), "mtime should have reached mtimecmp")
+	assert.Equal(t, int32(0), rs.Read(9), "the instruction after the spin loop should not run")
+	assert.Greater(t, rs.Read(5), int32(0), "the spin loop should run until the interrupt")
+}
+
+func TestRV32ERegistersAboveX15AreIllegal(t *testing.T) {
+	cases := []struct {
+		name     string
+		bytecode ByteCode
+		ip       int
+	}{
+		{"destination", ByteCode{int(opcodes.ADDI), 1, 0, 1, int(opcodes.ADDI), 16, 0, 2}, 4},
+		{"store base", ByteCode{int(opcodes.ADDI), 1, 0, 1, int(opcodes.SW), 1, 0, 20}, 4},
+		{"fused branch", ByteCode{int(opcodes.ADDI), 1, 0, 1, int(opcodes.BNE), 1, 31, 8}, 4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := registers.NewRegistersE()
+			vm := NewVM(rs, memory.NewMemory(1024))
+
+			err := vm.Execute(tc.bytecode)
+
+			var trap *Trap
+			assert.ErrorAs(t, err, &trap)
+			assert.Equal(t, uint32(CauseIllegalInstruction), trap.Cause)
+			assert.Equal(t, tc.ip, trap.IP)
+			assert.Equal(t, int32(1), rs.Read(1), "the instruction before should have run")
+		})
+	}
+}
+
+func TestRV32EMachineGivesEveryHartSixteenRegisters(t *testing.T) {
+	m := NewMachine(memory.NewMemory(1024), 2)
+	m.EnableRV32E()
+
+	err := m.Execute(ByteCode{int(opcodes.ADDI), 16, 0, 1})
+
+	assert.Error(t, err)
+	assert.Equal(t, 16, m.Registers(1).Count())
+}
+
+// operands fills the slots of an instruction in the given format with
+// operands that are valid for it: x1 or f1 for registers, x0 for addresses,
+// so that memory accesses go to 0, mscratch for a CSR, the end of a
+// one-instruction program for a target, and 1 for a shift.
+func operands(info opcodes.Info) [4]int {
+	slots := [4]int{int(info.Op)}
+	for _, f := range info.Format.Fields() {
+		switch f.Kind {
+		case opcodes.RegOperand, opcodes.FRegOperand, opcodes.ShamtOperand:
+			slots[f.Slot] = 1
+		case opcodes.CSROperand:
+			slots[f.Slot] = int(opcodes.MSCRATCH)
+		case opcodes.TargetOperand:
+			slots[f.Slot] = 4
+		}
+	}
+	return slots
+}
+
+// TestEveryOpcodeInTheTableDecodes runs every instruction of opcodes.Table
+// once, checking that the decoder has a case for it rather than falling
+// through to an illegal instruction trap.
+func TestEveryOpcodeInTheTableDecodes(t *testing.T) {
+	for _, info := range opcodes.Table {
+		if info.Is(opcodes.Pseudo) || info.Is(opcodes.Compressed) {
+			continue
+		}
+		slots := operands(info)
+		byteCode := ByteCode(slots[:])
+		if info.Is(opcodes.RV64) {
+			v := NewRV64VM(registers.NewRegisters64(), memory.NewMemory(1024))
+			prog := v.decode(byteCode)
+			prog[0](v, 0)
+			if v.unhandled != nil {
+				assert.NotEqual(t, CauseIllegalInstruction, v.unhandled.Cause, "%s decodes as illegal on RV64", info.Mnemonic)
+			}
+			continue
+		}
+		vm := NewVM(registers.NewRegisters(), memory.NewMemory(1024))
+		prog := vm.decode(byteCode)
+		vm.layout = prog.layout
+		prog.insts[0](vm, 0)
+		if vm.unhandled != nil {
+			assert.NotEqual(t, CauseIllegalInstruction, vm.unhandled.Cause, "%s decodes as illegal", info.Mnemonic)
+		}
+	}
+}
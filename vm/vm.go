@@ -0,0 +1,367 @@
+// Package vm runs zhuji bytecode in an interpreter.
+//
+//	machine, err := vm.New(vm.WithMemory(64<<10), vm.WithUART(os.Stdout, os.Stdin))
+//	if err != nil { ... }
+//	err = machine.Run(program)
+//	result := machine.Register(1)
+//
+// See package asm for the stability of this API.
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/phasecurve/zhuji/internal/memory"
+	"github.com/phasecurve/zhuji/internal/registers"
+	"github.com/phasecurve/zhuji/internal/uart"
+	ivm "github.com/phasecurve/zhuji/internal/vm"
+)
+
+// DefaultMemory is the RAM a VM gets without WithMemory. It matches the data
+// area the native code generator reserves, so a program sees the same memory
+// whether it is interpreted or compiled.
+const DefaultMemory = 1024
+
+// UARTBase is where WithUART maps the serial port. Its transmit and receive
+// register is at UARTBase and its line status register at UARTBase+20.
+const UARTBase = uart.Base
+
+// Device is a peripheral mapped into the address space with WithDevice.
+// Offsets are relative to the start of its range and width is the size of
+// the access in bytes.
+type Device = memory.Device
+
+// ErrUnmapped is what a Device returns for an offset it has nothing at.
+var ErrUnmapped = memory.ErrUnmapped
+
+// ErrStackUnderflow is wrapped by the error Run returns when a stack-machine
+// instruction needs more values than the operand stack holds.
+var ErrStackUnderflow = ivm.ErrStackUnderflow
+
+// ErrNoMemory is what LoadWord and StoreWord return on a stack machine,
+// which has no memory.
+var ErrNoMemory = errors.New("vm: a stack machine has no memory")
+
+// Trap is the error Run returns when the program raises a trap without a
+// handler installed in mtvec.
+type Trap = ivm.Trap
+
+// Trap causes, as found in Trap.Cause and in mcause.
+const (
+	CauseIllegalInstruction     = ivm.CauseIllegalInstruction
+	CauseLoadAddressMisaligned  = ivm.CauseLoadAddressMisaligned
+	CauseLoadAccessFault        = ivm.CauseLoadAccessFault
+	CauseStoreAddressMisaligned = ivm.CauseStoreAddressMisaligned
+	CauseStoreAccessFault       = ivm.CauseStoreAccessFault
+	CauseMachineTimerInterrupt  = ivm.CauseMachineTimerInterrupt
+)
+
+type mapping struct {
+	base, size int
+	device     Device
+}
+
+type config struct {
+	memory  int
+	sized   bool
+	harts   int
+	quantum int
+	trace   bool
+	stack   bool
+	rv64    bool
+	rv32e   bool
+	devices []mapping
+}
+
+// Option configures New.
+type Option func(*config)
+
+// WithMemory sets the size of RAM in bytes. RAM starts at address zero.
+func WithMemory(bytes int) Option {
+	return func(c *config) {
+		c.memory, c.sized = bytes, true
+	}
+}
+
+// WithHarts runs the program on n harts sharing one memory. Each hart has its
+// own registers and can tell itself apart from the others by reading
+// mhartid.
+func WithHarts(n int) Option {
+	return func(c *config) {
+		c.harts = n
+	}
+}
+
+// WithQuantum sets how many instructions a hart runs before the next one gets
+// a turn. Harts are interleaved deterministically, so a program behaves the
+// same on every run. The default of 1 interleaves them as finely as possible.
+func WithQuantum(instructions int) Option {
+	return func(c *config) {
+		c.quantum = instructions
+	}
+}
+
+// WithTrace prints every instruction as it executes to standard output.
+func WithTrace() Option {
+	return func(c *config) {
+		c.trace = true
+	}
+}
+
+// WithStackMode runs programs assembled with asm.WithStackMode on an operand
+// stack instead of registers. A stack machine has one hart and no registers,
+// memory or devices, so it cannot be combined with WithHarts, WithMemory or
+// WithDevice. Read what a program leaves behind with Stack.
+func WithStackMode() Option {
+	return func(c *config) {
+		c.stack = true
+	}
+}
+
+// WithRV64 runs programs assembled with asm.WithRV64 on 64-bit registers.
+// An RV64 machine has one hart and no CSRs, F, D or B extensions, so it
+// cannot be combined with WithHarts, and a trap always stops Run. Read its
+// registers whole with Register64.
+func WithRV64() Option {
+	return func(c *config) {
+		c.rv64 = true
+	}
+}
+
+// WithRV32E gives every hart the 16 registers of RV32E, x0 to x15. An
+// instruction naming any of the others raises an illegal instruction trap.
+// It cannot be combined with WithRV64 or WithStackMode.
+func WithRV32E() Option {
+	return func(c *config) {
+		c.rv32e = true
+	}
+}
+
+// WithDevice maps device at [base, base+size). The range must lie above RAM
+// and must not overlap another device.
+func WithDevice(base, size int, device Device) Option {
+	return func(c *config) {
+		c.devices = append(c.devices, mapping{base: base, size: size, device: device})
+	}
+}
+
+// WithUART maps a 16550-style serial port at UARTBase that sends what the
+// program transmits to out and feeds it what arrives on in. Either may be
+// nil.
+func WithUART(out io.Writer, in io.Reader) Option {
+	return WithDevice(uart.Base, uart.Size, uart.New(out, in))
+}
+
+// VM is a machine with its RAM, devices and one or more harts. Registers and
+// memory carry over from one Run to the next.
+//
+// A register the machine does not have reads as 0 and ignores writes, the
+// way x0 does: any register of a hart past the last, x16 to x31 on RV32E,
+// every register of a stack machine and the float registers of an RV64 one.
+type VM struct {
+	ram     *memory.Bus
+	harts   []*registers.Registers
+	floats  []*registers.FloatRegisters
+	stack   *ivm.StackVM
+	wide    *registers.Registers64
+	execute func(ivm.ByteCode) error
+}
+
+// New builds a VM. It fails if the options describe a machine that cannot be
+// built, such as one with overlapping devices.
+func New(opts ...Option) (*VM, error) {
+	c := config{memory: DefaultMemory, harts: 1, quantum: 1}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.memory < 0 {
+		return nil, fmt.Errorf("vm: memory size %d is negative", c.memory)
+	}
+	if c.harts < 1 {
+		return nil, fmt.Errorf("vm: a machine needs at least one hart, not %d", c.harts)
+	}
+
+	if c.rv32e && (c.rv64 || c.stack) {
+		return nil, fmt.Errorf("vm: RV32E is a register machine with 32-bit registers")
+	}
+
+	if c.stack {
+		if c.harts != 1 || len(c.devices) > 0 || c.sized {
+			return nil, fmt.Errorf("vm: a stack machine runs on one hart without memory or devices")
+		}
+		v := &VM{stack: ivm.NewStackVM()}
+		if c.trace {
+			v.stack.EnableTrace()
+		}
+		v.execute = v.stack.Execute
+		return v, nil
+	}
+	mem := memory.NewMemory(c.memory)
+	v := &VM{ram: memory.NewBus(mem)}
+	var attach func(base, size int, device memory.Device) error
+	if c.rv64 {
+		if c.harts != 1 {
+			return nil, fmt.Errorf("vm: an RV64 machine runs on one hart")
+		}
+		v.wide = registers.NewRegisters64()
+		hart := ivm.NewRV64VM(v.wide, mem)
+		if c.trace {
+			hart.EnableTrace()
+		}
+		v.execute, attach = hart.Execute, hart.Attach
+	} else if c.harts == 1 {
+		regs := registers.NewRegisters()
+		if c.rv32e {
+			regs = registers.NewRegistersE()
+		}
+		hart := ivm.NewVM(regs, mem)
+		if c.trace {
+			hart.EnableTrace()
+		}
+		v.harts = append(v.harts, regs)
+		v.floats = append(v.floats, hart.Floats())
+		v.execute, attach = hart.Execute, hart.Attach
+	} else {
+		m := ivm.NewMachine(mem, c.harts)
+		m.SetQuantum(c.quantum)
+		if c.rv32e {
+			m.EnableRV32E()
+		}
+		if c.trace {
+			m.EnableTrace()
+		}
+		for id := range c.harts {
+			v.harts = append(v.harts, m.Registers(id))
+			v.floats = append(v.floats, m.Floats(id))
+		}
+		v.execute, attach = m.Execute, m.Attach
+	}
+	for _, d := range c.devices {
+		if err := attach(d.base, d.size, d.device); err != nil {
+			return nil, fmt.Errorf("vm: %w", err)
+		}
+	}
+	return v, nil
+}
+
+// Run executes program on every hart until all of them have run off its end.
+// It returns a *Trap if a hart raised a trap it had no handler for, and on a
+// stack machine an error wrapping ErrStackUnderflow if the program popped
+// more than it pushed.
+func (v *VM) Run(program []int) error {
+	return v.execute(program)
+}
+
+// Stack returns the operand stack of a VM built WithStackMode, bottom first.
+// It is empty for a register machine.
+func (v *VM) Stack() []int32 {
+	if v.stack == nil {
+		return nil
+	}
+	return v.stack.Stack()
+}
+
+// Harts is the number of harts the VM runs.
+func (v *VM) Harts() int {
+	return max(len(v.harts), 1)
+}
+
+// Register reads register x<r> of hart 0. On an RV64 machine it is the low
+// 32 bits of the register.
+func (v *VM) Register(r int) int32 {
+	return v.HartRegister(0, r)
+}
+
+// register is the storage behind register x<r> of the given hart on an RV32
+// machine, or nil if it has no such register.
+func (v *VM) register(hart, r int) *int32 {
+	if hart < 0 || hart >= len(v.harts) || r < 0 || r >= v.harts[hart].Count() {
+		return nil
+	}
+	return v.harts[hart].Ref(r)
+}
+
+// SetRegister writes register x<r> of hart 0, for instance to pass arguments
+// in before Run. Writes to x0 are ignored. On an RV64 machine the value is
+// sign-extended to 64 bits.
+func (v *VM) SetRegister(r int, value int32) {
+	v.SetRegister64(r, int64(value))
+}
+
+// Register64 reads register x<r> of hart 0 as 64 bits. On an RV32 machine it
+// is the register sign-extended.
+func (v *VM) Register64(r int) int64 {
+	if v.wide != nil {
+		if r < 0 || r >= 32 {
+			return 0
+		}
+		return v.wide.Read(r)
+	}
+	return int64(v.HartRegister(0, r))
+}
+
+// SetRegister64 writes register x<r> of hart 0. On an RV32 machine only the
+// low 32 bits are kept.
+func (v *VM) SetRegister64(r int, value int64) {
+	if v.wide != nil {
+		if r >= 0 && r < 32 {
+			v.wide.Write(r, value)
+		}
+		return
+	}
+	if reg := v.register(0, r); reg != nil && r != 0 {
+		*reg = int32(value)
+	}
+}
+
+// HartRegister reads register x<r> of the given hart. An RV64 machine has
+// only hart 0.
+func (v *VM) HartRegister(hart, r int) int32 {
+	if v.wide != nil {
+		if hart != 0 {
+			return 0
+		}
+		return int32(v.Register64(r))
+	}
+	if reg := v.register(hart, r); reg != nil {
+		return *reg
+	}
+	return 0
+}
+
+// FloatRegister reads the 64 bits of float register f<r> of hart 0. A
+// single-precision value is in the low 32 bits, with the upper 32 all ones.
+func (v *VM) FloatRegister(r int) uint64 {
+	if len(v.floats) == 0 || r < 0 || r >= 32 {
+		return 0
+	}
+	return v.floats[0].Read(r)
+}
+
+// SetFloatRegister writes the 64 bits of float register f<r> of hart 0. Use
+// 0xFFFFFFFF<<32 | bits to pass in a single-precision value.
+func (v *VM) SetFloatRegister(r int, bits uint64) {
+	if len(v.floats) > 0 && r >= 0 && r < 32 {
+		v.floats[0].Write(r, bits)
+	}
+}
+
+// LoadWord reads the little-endian word at addr in RAM. On a stack machine
+// it returns ErrNoMemory.
+func (v *VM) LoadWord(addr int) (int32, error) {
+	if v.ram == nil {
+		return 0, ErrNoMemory
+	}
+	return v.ram.LoadWord(addr)
+}
+
+// StoreWord writes the little-endian word at addr in RAM. On a stack machine
+// it returns ErrNoMemory.
+func (v *VM) StoreWord(addr int, value int32) error {
+	if v.ram == nil {
+		return ErrNoMemory
+	}
+	return v.ram.StoreWord(addr, value)
+}
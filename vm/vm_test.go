@@ -0,0 +1,201 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/phasecurve/zhuji/asm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunLeavesResultsInRegistersAndMemory(t *testing.T) {
+	program, _ := asm.Assemble(`
+		addi x1, x0, 6
+		addi x2, x0, 7
+		mul x3, x1, x2
+		sw x3, 8(x0)
+	`)
+	machine, err := New()
+	assert.NoError(t, err)
+
+	err = machine.Run(program)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(42), machine.Register(3))
+	word, err := machine.LoadWord(8)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(42), word)
+}
+
+func TestSetRegisterPassesArgumentsIn(t *testing.T) {
+	program, _ := asm.Assemble("add x1, x10, x11")
+	machine, _ := New()
+	machine.SetRegister(10, 40)
+	machine.SetRegister(11, 2)
+
+	machine.Run(program)
+
+	assert.Equal(t, int32(42), machine.Register(1))
+}
+
+func TestFloatRegistersPassValuesInAndOut(t *testing.T) {
+	program, err := asm.Assemble(`
+		fmul.d f2, f1, f1
+		fcvt.s.d f3, f2
+		fcvt.w.d x1, f2, rtz
+	`)
+	assert.NoError(t, err)
+	machine, _ := New()
+	machine.SetFloatRegister(1, math.Float64bits(1.5))
+
+	machine.Run(program)
+
+	assert.Equal(t, 2.25, math.Float64frombits(machine.FloatRegister(2)))
+	assert.Equal(t, uint64(0xFFFFFFFF)<<32|uint64(math.Float32bits(2.25)), machine.FloatRegister(3))
+	assert.Equal(t, int32(2), machine.Register(1))
+}
+
+func TestWithUARTPrintsProgramOutput(t *testing.T) {
+	var out bytes.Buffer
+	program, _ := asm.Assemble(`
+		li x1, 0x10000000
+		addi x2, x0, 111
+		sw x2, 0(x1)
+		addi x2, x0, 107
+		sw x2, 0(x1)
+	`)
+	machine, err := New(WithUART(&out, nil))
+	assert.NoError(t, err)
+
+	machine.Run(program)
+
+	assert.Equal(t, "ok", out.String())
+}
+
+func TestWithHartsGivesEachHartItsOwnRegisters(t *testing.T) {
+	program, _ := asm.Assemble("csrr x10, mhartid")
+	machine, err := New(WithHarts(3), WithQuantum(2))
+	assert.NoError(t, err)
+
+	machine.Run(program)
+
+	assert.Equal(t, 3, machine.Harts())
+	for hart := range 3 {
+		assert.Equal(t, int32(hart), machine.HartRegister(hart, 10), "hart %d should read its own id", hart)
+	}
+}
+
+func TestRunReturnsUnhandledTraps(t *testing.T) {
+	program, _ := asm.Assemble("li x2, 4096\nlw x1, 0(x2)")
+	machine, _ := New()
+
+	err := machine.Run(program)
+
+	var trap *Trap
+	assert.ErrorAs(t, err, &trap)
+	assert.Equal(t, CauseLoadAccessFault, trap.Cause)
+}
+
+func TestWithStackModeRunsStackPrograms(t *testing.T) {
+	program, _ := asm.Assemble("psh 6\npsh 7\nmul", asm.WithStackMode())
+	machine, err := New(WithStackMode())
+	assert.NoError(t, err)
+
+	err = machine.Run(program)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{42}, machine.Stack())
+}
+
+func TestWithStackModeReportsUnderflow(t *testing.T) {
+	program, _ := asm.Assemble("psh 1\nswp", asm.WithStackMode())
+	machine, _ := New(WithStackMode())
+
+	err := machine.Run(program)
+
+	assert.ErrorIs(t, err, ErrStackUnderflow)
+}
+
+func TestWithRV64RunsOnSixtyFourBitRegisters(t *testing.T) {
+	program, _ := asm.Assemble("slli x1, x2, 32\naddiw x3, x1, -1", asm.WithRV64())
+	machine, err := New(WithRV64())
+	assert.NoError(t, err)
+	machine.SetRegister(2, 3)
+
+	err = machine.Run(program)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3)<<32, machine.Register64(1))
+	assert.Equal(t, int32(0), machine.Register(1), "Register should read the low word")
+	assert.Equal(t, int64(-1), machine.Register64(3))
+}
+
+func TestWithRV32ETrapsOnTheUpperRegisters(t *testing.T) {
+	program, _ := asm.Assemble("addi x15, x0, 1\naddi x16, x0, 2")
+	machine, err := New(WithRV32E())
+	assert.NoError(t, err)
+
+	err = machine.Run(program)
+
+	var trap *Trap
+	assert.ErrorAs(t, err, &trap)
+	assert.Equal(t, uint32(CauseIllegalInstruction), trap.Cause)
+	assert.Equal(t, int32(1), machine.Register(15))
+}
+
+func TestRegistersAMachineLacksReadAsZero(t *testing.T) {
+	program, _ := asm.Assemble("addi x1, x0, 7")
+	wide, _ := New(WithRV64())
+	wide.Run(program)
+	embedded, _ := New(WithRV32E())
+	embedded.SetRegister(16, 5)
+	harts, _ := New(WithHarts(2))
+	stack, _ := New(WithStackMode())
+	stack.SetRegister(1, 5)
+	stack.SetFloatRegister(1, 5)
+
+	assert.Equal(t, int32(7), wide.HartRegister(0, 1))
+	assert.Equal(t, int32(0), wide.HartRegister(1, 1), "an RV64 machine has only hart 0")
+	assert.Equal(t, uint64(0), wide.FloatRegister(1), "an RV64 machine has no float registers")
+	assert.Equal(t, int32(0), embedded.Register(16), "RV32E stops at x15")
+	assert.Equal(t, int32(0), harts.HartRegister(2, 1), "there is no third hart")
+	assert.Equal(t, int32(0), harts.HartRegister(-1, 1))
+	assert.Equal(t, int32(0), stack.Register(1), "a stack machine has no registers")
+	assert.Equal(t, uint64(0), stack.FloatRegister(1))
+	assert.Equal(t, 1, stack.Harts())
+}
+
+func TestStackMachineHasNoMemory(t *testing.T) {
+	machine, _ := New(WithStackMode())
+
+	_, err := machine.LoadWord(0)
+	assert.ErrorIs(t, err, ErrNoMemory)
+	assert.ErrorIs(t, machine.StoreWord(0, 1), ErrNoMemory)
+}
+
+func TestNewRejectsImpossibleMachines(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []Option
+	}{
+		{"no harts", []Option{WithHarts(0)}},
+		{"negative memory", []Option{WithMemory(-1)}},
+		{"device over RAM", []Option{WithMemory(1 << 20), WithDevice(0x1000, 16, nil)}},
+		{"overlapping devices", []Option{WithUART(nil, nil), WithDevice(UARTBase, 4, nil)}},
+		{"stack machine harts", []Option{WithStackMode(), WithHarts(2)}},
+		{"stack machine devices", []Option{WithStackMode(), WithUART(nil, nil)}},
+		{"stack machine memory", []Option{WithStackMode(), WithMemory(4096)}},
+		{"RV64 machine harts", []Option{WithRV64(), WithHarts(2)}},
+		{"RV32E with RV64", []Option{WithRV32E(), WithRV64()}},
+		{"RV32E stack machine", []Option{WithRV32E(), WithStackMode()}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine, err := New(tc.opts...)
+			assert.Error(t, err)
+			assert.Nil(t, machine)
+		})
+	}
+}